@@ -3,11 +3,11 @@
 use crate::action::{Action, ActionSignal, Props, StatefulAction, DEFAULT, INFINITE};
 use crate::comm::{QWriter, Signal, SignalId};
 use crate::resource::{
-    AudioSink, IoManager, ResourceAddr, ResourceManager, ResourceValue, TimePrecision, Trigger,
-    Volume,
+    AudioSink, IoManager, LogEntry, LoggerSignal, OptionalString, PlaybackMarks, ResourceAddr,
+    ResourceManager, ResourceValue, TimePrecision, Trigger, Volume,
 };
 use crate::server::{AsyncSignal, Config, State, SyncSignal};
-use crate::util::spin_sleeper;
+use crate::util::{instant_to_local, is_default, spin_sleeper};
 use eyre::{eyre, Context, Result};
 use serde::{Deserialize, Serialize};
 use serde_cbor::Value;
@@ -30,15 +30,38 @@ pub struct Audio {
     #[serde(default)]
     trigger: Trigger,
     #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    device: Option<String>,
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    trigger_device: Option<String>,
+    #[serde(default)]
     in_volume: SignalId,
+    #[serde(default)]
+    #[serde(skip_serializing_if = "OptionalString::is_none")]
+    group: OptionalString,
+    #[serde(default)]
+    #[serde(skip_serializing_if = "is_default")]
+    out_onset: SignalId,
+    #[serde(default)]
+    #[serde(skip_serializing_if = "is_default")]
+    out_offset: SignalId,
 }
 
 stateful_arc!(Audio {
+    src: String,
     duration: Duration,
     looping: bool,
+    interlaced: bool,
     sink: Arc<Mutex<Option<AudioSink>>>,
+    trigger_sink: Arc<Mutex<Option<AudioSink>>>,
+    marks: PlaybackMarks,
     link: Option<(Sender<()>, Receiver<()>)>,
+    halt: Option<Sender<()>>,
     in_volume: SignalId,
+    group: Option<String>,
+    out_onset: SignalId,
+    out_offset: SignalId,
 });
 
 impl Action for Audio {
@@ -47,6 +70,11 @@ impl Action for Audio {
         BTreeSet::from([self.in_volume])
     }
 
+    #[inline(always)]
+    fn out_signals(&self) -> BTreeSet<SignalId> {
+        BTreeSet::from([self.out_onset, self.out_offset])
+    }
+
     #[inline(always)]
     fn resources(&self, _config: &Config) -> Vec<ResourceAddr> {
         if let Trigger::Ext(trig) = &self.trigger {
@@ -59,6 +87,50 @@ impl Action for Audio {
         }
     }
 
+    fn log_entries(&self) -> Vec<LogEntry> {
+        if let OptionalString::Some(group) = &self.group {
+            vec![
+                LogEntry::new(
+                    group,
+                    "onset",
+                    "text",
+                    "",
+                    "Audio file, timestamped when its first sample was pulled by the device",
+                ),
+                LogEntry::new(
+                    group,
+                    "latency",
+                    "float",
+                    "s",
+                    "Delay between the playback request and the onset",
+                ),
+                LogEntry::new(
+                    group,
+                    "trigger",
+                    "bool",
+                    "",
+                    "Whether a trigger was played along with the audio",
+                ),
+                LogEntry::new(
+                    group,
+                    "offset",
+                    "text",
+                    "",
+                    "Audio file, timestamped when its last sample was pulled by the device",
+                ),
+                LogEntry::new(
+                    group,
+                    "stop",
+                    "text",
+                    "",
+                    "Audio file, logged if playback was stopped before its offset",
+                ),
+            ]
+        } else {
+            vec![]
+        }
+    }
+
     fn stateful(
         &self,
         io: &IoManager,
@@ -74,8 +146,16 @@ impl Action for Audio {
             return Err(eyre!("Resource value and address types don't match."));
         };
 
-        let src = match (&self.trigger, config.use_trigger().value()) {
-            (Trigger::Ext(trig), true) => {
+        let use_trigger = config.use_trigger().value();
+        let interlaced = matches!(
+            (&self.trigger, use_trigger),
+            (Trigger::Ext(_), true) | (Trigger::Int, true)
+        );
+
+        // With a separate trigger device, the trigger is played on its own sink instead of being
+        // carried by the last channel of the audio
+        let (src, trig) = match (&self.trigger, use_trigger, &self.trigger_device) {
+            (Trigger::Ext(trig), true, routed) => {
                 let trig = ResourceAddr::Audio(trig.clone());
                 let trig = if let ResourceValue::Audio(trig) = res.fetch(&trig)? {
                     trig
@@ -83,15 +163,25 @@ impl Action for Audio {
                     return Err(eyre!("Resource value and address types don't match."));
                 };
 
-                src.interlace(trig)?
+                if routed.is_some() {
+                    (src, Some(trig))
+                } else {
+                    (src.interlace(trig)?, None)
+                }
             }
-            (Trigger::Int, false) => src.drop_last()?,
-            _ => src,
+            (Trigger::Int, true, Some(_)) => {
+                let (src, trig) = src.split_last()?;
+                (src, Some(trig))
+            }
+            (Trigger::Int, false, _) => (src.drop_last()?, None),
+            _ => (src, None),
         };
 
         let duration = src.duration();
         let volume = self.volume.or(&config.volume());
-        let mut sink = io.audio()?;
+        let mut sink = io
+            .audio_on(self.device.as_deref())
+            .wrap_err("Failed to create audio sink.")?;
 
         sink.set_volume(volume.value())?;
         if self.looping {
@@ -100,14 +190,31 @@ impl Action for Audio {
             sink.queue(src)?;
         }
 
+        let trigger_sink = if let Some(trig) = trig {
+            let mut trigger_sink = io
+                .audio_on(self.trigger_device.as_deref())
+                .wrap_err("Failed to create trigger sink.")?;
+            if self.looping {
+                trigger_sink.repeat(trig)?;
+            } else {
+                trigger_sink.queue(trig)?;
+            }
+            Some(trigger_sink)
+        } else {
+            None
+        };
+
+        let marks = sink.marks();
         let done = Arc::new(Mutex::new(sink.empty()));
         let sink = Arc::new(Mutex::new(Some(sink)));
+        let trigger_sink = Arc::new(Mutex::new(trigger_sink));
         let (tx_start, rx_start) = mpsc::channel();
         let (tx_stop, rx_stop) = mpsc::channel();
 
         {
             let done = done.clone();
             let sink = sink.clone();
+            let trigger_sink = trigger_sink.clone();
             let time_precision = config.time_precision();
             let looping = self.looping;
             let sleeper = spin_sleeper();
@@ -118,6 +225,9 @@ impl Action for Audio {
                 }
 
                 if let Some(sink) = sink.lock().unwrap().as_mut() {
+                    if let Some(trigger_sink) = trigger_sink.lock().unwrap().as_mut() {
+                        let _ = trigger_sink.play();
+                    }
                     let _ = sink.play();
                 } else {
                     let _ = tx_stop.send(());
@@ -145,6 +255,9 @@ impl Action for Audio {
                             ));
                         }
                         TimePrecision::RespectIntervals => {
+                            if let Some(trigger_sink) = trigger_sink.lock().unwrap().take() {
+                                let _ = trigger_sink.detach();
+                            }
                             if let Some(sink) = sink.lock().unwrap().take() {
                                 if let Err(e) = sink.detach() {
                                     *done.lock().unwrap() = Err(e);
@@ -184,13 +297,26 @@ impl Action for Audio {
             });
         }
 
+        let group = match &self.group {
+            OptionalString::Some(s) => Some(s.clone()),
+            OptionalString::None => None,
+        };
+
         Ok(Box::new(StatefulAudio {
             done,
+            src: self.src.to_string_lossy().to_string(),
             duration,
             looping: self.looping,
+            interlaced,
             sink,
+            trigger_sink,
+            marks,
             link: Some((tx_start, rx_stop)),
+            halt: None,
             in_volume: self.in_volume,
+            group,
+            out_onset: self.out_onset,
+            out_offset: self.out_offset,
         }))
     }
 }
@@ -206,7 +332,7 @@ impl StatefulAction for StatefulAudio {
     fn start(
         &mut self,
         sync_writer: &mut QWriter<SyncSignal>,
-        _async_writer: &mut QWriter<AsyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
         _state: &State,
     ) -> Result<Signal> {
         let link = self
@@ -218,6 +344,12 @@ impl StatefulAction for StatefulAudio {
             .send(())
             .wrap_err("Failed to send start signal to concurrent audio thread.")?;
 
+        if self.group.is_some() || self.out_onset > 0 || self.out_offset > 0 {
+            let (tx_halt, rx_halt) = mpsc::channel();
+            self.halt = Some(tx_halt);
+            self.report_marks(rx_halt, sync_writer.clone(), async_writer.clone());
+        }
+
         if let Ok(true) = *self.done.lock().unwrap() {
             sync_writer.push(SyncSignal::UpdateGraph);
         } else {
@@ -261,12 +393,26 @@ impl StatefulAction for StatefulAudio {
     fn stop(
         &mut self,
         _sync_writer: &mut QWriter<SyncSignal>,
-        _async_writer: &mut QWriter<AsyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
         _state: &State,
     ) -> Result<Signal> {
         if let Some(mut sink) = self.sink.lock().unwrap().take() {
             sink.stop().wrap_err("Failed to stop audio sink.")?;
         }
+        if let Some(mut sink) = self.trigger_sink.lock().unwrap().take() {
+            sink.stop().wrap_err("Failed to stop trigger sink.")?;
+        }
+
+        self.halt.take();
+        if let Some(group) = self.group.as_ref() {
+            if self.marks.onset().is_some() && self.marks.offset().is_none() {
+                async_writer.push(LoggerSignal::Append(
+                    group.clone(),
+                    ("stop".to_owned(), Value::Text(self.src.clone())),
+                ));
+            }
+        }
+
         Ok(Signal::none())
     }
 
@@ -278,10 +424,139 @@ impl StatefulAction for StatefulAudio {
     }
 }
 
+impl StatefulAudio {
+    /// Waits (in a separate thread) for the sink to actually pull the first and last samples of
+    /// the audio, then emits and logs those times along with the latency of the onset relative to
+    /// when playback was requested.
+    fn report_marks(
+        &self,
+        halt: Receiver<()>,
+        mut sync_writer: QWriter<SyncSignal>,
+        mut async_writer: QWriter<AsyncSignal>,
+    ) {
+        let requested = Instant::now();
+        let marks = self.marks.clone();
+        let src = self.src.clone();
+        let duration = self.duration;
+        let looping = self.looping;
+        let interlaced = self.interlaced;
+        let group = self.group.clone();
+        let out_onset = self.out_onset;
+        let out_offset = self.out_offset;
+
+        thread::spawn(move || {
+            let onset = match wait_for_mark(|| marks.onset(), &halt, requested) {
+                Some(t) => t,
+                None => return,
+            };
+            let onset_time = instant_to_local(onset);
+
+            if out_onset > 0 {
+                sync_writer.push(SyncSignal::Emit(
+                    onset,
+                    vec![(out_onset, Value::Text(onset_time.to_string()))].into(),
+                ));
+            }
+            if let Some(group) = group.as_ref() {
+                let latency = onset.saturating_duration_since(requested);
+                async_writer.push(AsyncSignal::Logger(
+                    onset,
+                    LoggerSignal::Extend(
+                        group.clone(),
+                        vec![
+                            ("onset".to_owned(), Value::Text(src.clone())),
+                            ("latency".to_owned(), Value::Float(latency.as_secs_f64())),
+                            ("trigger".to_owned(), Value::Bool(interlaced)),
+                        ],
+                    ),
+                ));
+            }
+
+            if looping {
+                return;
+            }
+
+            let offset = match wait_for_mark(|| marks.offset(), &halt, onset + duration) {
+                Some(t) => t,
+                None => return,
+            };
+            let offset_time = instant_to_local(offset);
+
+            if out_offset > 0 {
+                sync_writer.push(SyncSignal::Emit(
+                    offset,
+                    vec![(out_offset, Value::Text(offset_time.to_string()))].into(),
+                ));
+            }
+            if let Some(group) = group.as_ref() {
+                async_writer.push(AsyncSignal::Logger(
+                    offset,
+                    LoggerSignal::Append(group.clone(), ("offset".to_owned(), Value::Text(src))),
+                ));
+            }
+        });
+    }
+}
+
+/// Polls `mark` until it is set or `halt` is disconnected. Polling is coarse until `expected`, and
+/// fine-grained afterwards.
+fn wait_for_mark(
+    mark: impl Fn() -> Option<Instant>,
+    halt: &Receiver<()>,
+    expected: Instant,
+) -> Option<Instant> {
+    let sleeper = spin_sleeper();
+    loop {
+        if let Some(t) = mark() {
+            return Some(t);
+        }
+        if let Err(TryRecvError::Disconnected) = halt.try_recv() {
+            return None;
+        }
+
+        let now = Instant::now();
+        if now < expected {
+            thread::sleep((expected - now).min(Duration::from_millis(20)));
+        } else {
+            sleeper.sleep(Duration::from_micros(100));
+        }
+    }
+}
+
 impl Drop for StatefulAudio {
     fn drop(&mut self) {
         if let Some(mut sink) = self.sink.lock().unwrap().take() {
             let _ = sink.stop();
         }
+        if let Some(mut sink) = self.trigger_sink.lock().unwrap().take() {
+            let _ = sink.stop();
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn marks_are_awaited_until_halted() {
+        let marks = PlaybackMarks::default();
+        let (tx_halt, rx_halt) = mpsc::channel::<()>();
+
+        let pulled = Instant::now();
+        let setter = {
+            let marks = marks.clone();
+            thread::spawn(move || {
+                thread::sleep(Duration::from_millis(30));
+                marks.mark_onset(pulled);
+            })
+        };
+        let onset = wait_for_mark(|| marks.onset(), &rx_halt, Instant::now());
+        setter.join().unwrap();
+        assert_eq!(onset, Some(pulled));
+
+        drop(tx_halt);
+        let offset = wait_for_mark(|| marks.offset(), &rx_halt, Instant::now());
+        assert_eq!(offset, None);
     }
 }
@@ -30,6 +30,11 @@ stateful!(Branch {
 });
 
 impl Action for Branch {
+    #[inline]
+    fn children(&self) -> Vec<&dyn Action> {
+        self.children.iter().map(|c| c.as_ref()).collect()
+    }
+
     #[inline]
     fn in_signals(&self) -> BTreeSet<SignalId> {
         let mut signals = BTreeSet::new();
@@ -80,7 +85,7 @@ impl Action for Branch {
     ) -> Result<Box<dyn StatefulAction>> {
         let mut children = vec![];
         for c in self.children.iter() {
-            children.push(c.stateful(io, res, config, sync_writer, async_writer)?);
+            children.push(c.routed(io, res, config, sync_writer, async_writer)?);
         }
 
         Ok(Box::new(StatefulBranch {
@@ -22,6 +22,11 @@ stateful!(Delayed {
 });
 
 impl Action for Delayed {
+    #[inline]
+    fn children(&self) -> Vec<&dyn Action> {
+        vec![self.1.as_ref()]
+    }
+
     #[inline]
     fn in_signals(&self) -> BTreeSet<SignalId> {
         self.1.in_signals()
@@ -45,9 +50,7 @@ impl Action for Delayed {
         sync_writer: &QWriter<SyncSignal>,
         async_writer: &QWriter<AsyncSignal>,
     ) -> Result<Box<dyn StatefulAction>> {
-        let inner = self
-            .1
-            .stateful(io, res, config, sync_writer, async_writer)?;
+        let inner = self.1.routed(io, res, config, sync_writer, async_writer)?;
 
         Ok(Box::new(StatefulDelayed {
             done: inner.is_over()?,
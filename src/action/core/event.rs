@@ -1,6 +1,6 @@
 use crate::action::{Action, Props, StatefulAction, INFINITE};
 use crate::comm::{QWriter, Signal};
-use crate::resource::{IoManager, LoggerSignal, ResourceManager};
+use crate::resource::{IoManager, LogEntry, LoggerSignal, ResourceManager};
 use crate::server::{AsyncSignal, Config, State, SyncSignal};
 use eyre::Result;
 use serde::{Deserialize, Serialize};
@@ -12,6 +12,17 @@ pub struct Event(String);
 stateful!(Event { name: String });
 
 impl Action for Event {
+    #[inline]
+    fn log_entries(&self) -> Vec<LogEntry> {
+        vec![LogEntry::new(
+            "event",
+            &self.0,
+            "text",
+            "",
+            "Marks the `start` and `stop` of the event",
+        )]
+    }
+
     #[inline(always)]
     fn stateful(
         &self,
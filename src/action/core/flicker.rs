@@ -0,0 +1,599 @@
+use crate::action::{Action, ActionSignal, Props, StatefulAction, INFINITE, VISUAL};
+use crate::comm::{QWriter, Signal, SignalId};
+use crate::resource::{
+    Color, IoManager, LogEntry, LoggerSignal, OptionalString, ResourceAddr, ResourceManager,
+};
+use crate::server::{measured_refresh_rate, AsyncSignal, Config, State, SyncSignal};
+use eframe::egui;
+use eframe::egui::{Color32, CursorIcon, Rect, Vec2};
+use eyre::{eyre, Result};
+use itertools::Itertools;
+use serde::{Deserialize, Serialize};
+use serde_cbor::Value;
+use std::collections::BTreeSet;
+use std::f64::consts::PI;
+use std::time::Instant;
+
+/// Gray that `contrast` targets are faded towards.
+const MID_GRAY: u8 = 128;
+
+#[derive(Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Flicker {
+    targets: Vec<Target>,
+    #[serde(default = "defaults::tolerance")]
+    tolerance: f64,
+    #[serde(default)]
+    uneven_duty: bool,
+    #[serde(default)]
+    background: Color,
+    #[serde(default = "defaults::group")]
+    group: OptionalString,
+}
+
+/// A region (`x`, `y`, `width`, `height` as fractions of the area of the action) that is filled
+/// with `color`, or that shows the `inner` visual action, modulated at `frequency`.
+#[derive(Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Target {
+    frequency: f64,
+    #[serde(default)]
+    waveform: Waveform,
+    #[serde(default)]
+    mode: Mode,
+    #[serde(default = "defaults::depth")]
+    depth: f64,
+    #[serde(default)]
+    phase: f64,
+    #[serde(default = "defaults::region")]
+    region: (f32, f32, f32, f32),
+    #[serde(default = "defaults::color")]
+    color: Color,
+    #[serde(default)]
+    inner: Option<Box<dyn Action>>,
+}
+
+/// Shape of the modulation: on for the first half of every cycle (which should span a whole
+/// number of frames), or a sinusoid sampled at every frame.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Waveform {
+    Square,
+    Sine,
+}
+
+/// What is modulated: the luminance of the target (faded towards black), or its contrast (faded
+/// towards mid-gray).
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Mode {
+    Luminance,
+    Contrast,
+}
+
+impl Default for Waveform {
+    #[inline(always)]
+    fn default() -> Self {
+        Waveform::Square
+    }
+}
+
+impl Default for Mode {
+    #[inline(always)]
+    fn default() -> Self {
+        Mode::Luminance
+    }
+}
+
+struct StatefulTarget {
+    waveform: Waveform,
+    mode: Mode,
+    depth: f64,
+    phase: f64,
+    cycle: f64,
+    region: (f32, f32, f32, f32),
+    color: Color32,
+    inner: Option<Box<dyn StatefulAction>>,
+}
+
+stateful!(Flicker {
+    targets: Vec<StatefulTarget>,
+    rate: f64,
+    background: Color32,
+    group: Option<String>,
+    frame: u64,
+    last_frame: Option<Instant>,
+    missed: u64,
+});
+
+mod defaults {
+    use crate::resource::{Color, OptionalString};
+
+    #[inline(always)]
+    pub fn tolerance() -> f64 {
+        0.01
+    }
+
+    #[inline(always)]
+    pub fn depth() -> f64 {
+        1.0
+    }
+
+    #[inline(always)]
+    pub fn region() -> (f32, f32, f32, f32) {
+        (0.0, 0.0, 1.0, 1.0)
+    }
+
+    #[inline(always)]
+    pub fn color() -> Color {
+        Color::White
+    }
+
+    #[inline(always)]
+    pub fn group() -> OptionalString {
+        OptionalString::Some("flicker".to_owned())
+    }
+}
+
+impl Action for Flicker {
+    #[inline]
+    fn children(&self) -> Vec<&dyn Action> {
+        self.inners().collect()
+    }
+
+    #[inline]
+    fn in_signals(&self) -> BTreeSet<SignalId> {
+        self.inners().flat_map(|c| c.in_signals()).collect()
+    }
+
+    #[inline]
+    fn out_signals(&self) -> BTreeSet<SignalId> {
+        self.inners().flat_map(|c| c.out_signals()).collect()
+    }
+
+    #[inline]
+    fn resources(&self, config: &Config) -> Vec<ResourceAddr> {
+        self.inners()
+            .flat_map(|c| c.resources(config))
+            .unique()
+            .collect()
+    }
+
+    fn init(self) -> Result<Box<dyn Action>>
+    where
+        Self: 'static + Sized,
+    {
+        if self.targets.is_empty() {
+            return Err(eyre!("Flicker should have at least one target."));
+        }
+        if self.tolerance < 0.0 {
+            return Err(eyre!("Flicker `tolerance` cannot be negative."));
+        }
+
+        for t in self.targets.iter() {
+            let (x, y, w, h) = t.region;
+            if t.frequency <= 0.0 {
+                return Err(eyre!("Flicker target `frequency` should be positive."));
+            } else if !(0.0..=1.0).contains(&t.depth) {
+                return Err(eyre!("Flicker target `depth` should be between 0 and 1."));
+            } else if x < 0.0 || y < 0.0 || w <= 0.0 || h <= 0.0 || x + w > 1.0 || y + h > 1.0 {
+                return Err(eyre!(
+                    "Flicker target `region` should lie within the area of the action: {:?}",
+                    t.region
+                ));
+            }
+        }
+
+        Ok(Box::new(self))
+    }
+
+    fn log_entries(&self) -> Vec<LogEntry> {
+        if let OptionalString::Some(group) = &self.group {
+            vec![
+                LogEntry::new(
+                    group,
+                    "event",
+                    "text",
+                    "",
+                    "Marks the `start` and `stop` of the action",
+                ),
+                LogEntry::new(
+                    group,
+                    "rate",
+                    "float",
+                    "Hz",
+                    "Measured refresh rate that the modulation is computed from",
+                ),
+                LogEntry::new(
+                    group,
+                    "frequency",
+                    "[float]",
+                    "Hz",
+                    "Frequency of each target as presented, which can differ from the requested \
+                    one by up to `tolerance` for square waves",
+                ),
+                LogEntry::new(
+                    group,
+                    "frame",
+                    "[integer, float...]",
+                    "",
+                    "Frame index since the start, followed by the luminance (or contrast) of \
+                    each target in that frame",
+                ),
+                LogEntry::new(
+                    group,
+                    "missed",
+                    "integer",
+                    "",
+                    "Number of frames that were missed right before the current frame",
+                ),
+                LogEntry::new(
+                    group,
+                    "missed_total",
+                    "integer",
+                    "",
+                    "Number of frames missed while the action ran, logged when it stops",
+                ),
+            ]
+        } else {
+            vec![]
+        }
+    }
+
+    fn stateful(
+        &self,
+        io: &IoManager,
+        res: &ResourceManager,
+        config: &Config,
+        sync_writer: &QWriter<SyncSignal>,
+        async_writer: &QWriter<AsyncSignal>,
+    ) -> Result<Box<dyn StatefulAction>> {
+        if !config.vsync() {
+            return Err(eyre!("Flicker requires `vsync` to be enabled."));
+        }
+        let rate = measured_refresh_rate(config.vsync()).ok_or_else(|| {
+            eyre!(
+                "Flicker requires a refresh rate measured on the current display with vsync. Add \
+                a `refresh_rate` requirement to the block or task so that it is measured before \
+                the block starts."
+            )
+        })?;
+
+        let mut targets = vec![];
+        for t in self.targets.iter() {
+            let cycle = t.cycle(rate, self.tolerance, self.uneven_duty)?;
+
+            let inner = match &t.inner {
+                Some(inner) => Some(inner.routed(io, res, config, sync_writer, async_writer)?),
+                None => None,
+            };
+
+            targets.push(StatefulTarget {
+                waveform: t.waveform,
+                mode: t.mode,
+                depth: t.depth,
+                phase: t.phase,
+                cycle,
+                region: t.region,
+                color: t.color.into(),
+                inner,
+            });
+        }
+
+        let group = match &self.group {
+            OptionalString::Some(s) => Some(s.clone()),
+            OptionalString::None => None,
+        };
+
+        Ok(Box::new(StatefulFlicker {
+            done: false,
+            targets,
+            rate,
+            background: self.background.into(),
+            group,
+            frame: 0,
+            last_frame: None,
+            missed: 0,
+        }))
+    }
+}
+
+impl Flicker {
+    fn inners(&self) -> impl Iterator<Item = &dyn Action> {
+        self.targets.iter().filter_map(|t| t.inner.as_deref())
+    }
+}
+
+impl StatefulAction for StatefulFlicker {
+    impl_stateful!();
+
+    #[inline(always)]
+    fn props(&self) -> Props {
+        (INFINITE | VISUAL).into()
+    }
+
+    fn start(
+        &mut self,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        state: &State,
+    ) -> Result<Signal> {
+        let mut news = vec![];
+        for inner in self.targets.iter_mut().filter_map(|t| t.inner.as_mut()) {
+            news.extend(inner.start(sync_writer, async_writer, state)?);
+        }
+
+        if let Some(group) = &self.group {
+            async_writer.push(LoggerSignal::Extend(
+                group.clone(),
+                vec![
+                    ("event".to_owned(), Value::Text("start".to_owned())),
+                    ("rate".to_owned(), Value::Float(self.rate)),
+                    (
+                        "frequency".to_owned(),
+                        Value::Array(
+                            self.targets
+                                .iter()
+                                .map(|t| Value::Float(self.rate / t.cycle))
+                                .collect(),
+                        ),
+                    ),
+                ],
+            ));
+        }
+
+        sync_writer.push(SyncSignal::Repaint);
+        Ok(news.into())
+    }
+
+    fn update(
+        &mut self,
+        signal: &ActionSignal,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        state: &State,
+    ) -> Result<Signal> {
+        let mut news = vec![];
+        for inner in self.targets.iter_mut().filter_map(|t| t.inner.as_mut()) {
+            news.extend(inner.update(signal, sync_writer, async_writer, state)?);
+        }
+        Ok(news.into())
+    }
+
+    fn show(
+        &mut self,
+        ui: &mut egui::Ui,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        state: &State,
+    ) -> Result<()> {
+        ui.output().cursor_icon = CursorIcon::None;
+        ui.ctx().request_repaint();
+
+        // Frames are counted in refresh periods since the previous one, so that the modulation
+        // stays locked to the display when frames are missed.
+        let now = Instant::now();
+        let mut missed = 0;
+        if let Some(last) = self.last_frame {
+            let periods = ((now - last).as_secs_f64() * self.rate).round() as u64;
+            missed = periods.saturating_sub(1);
+            self.frame += periods.max(1);
+        }
+        self.last_frame = Some(now);
+        self.missed += missed;
+
+        let area = ui.max_rect();
+        ui.painter().rect_filled(area, 0.0, self.background);
+
+        let mut values = vec![Value::Integer(self.frame as i128)];
+        for t in self.targets.iter_mut() {
+            let level = t.level(self.frame);
+            values.push(Value::Float(level));
+
+            let (x, y, w, h) = t.region;
+            let rect = Rect::from_min_size(
+                area.min + Vec2::new(x * area.width(), y * area.height()),
+                Vec2::new(w * area.width(), h * area.height()),
+            );
+
+            match t.inner.as_mut() {
+                Some(inner) => {
+                    let mut result = Ok(());
+                    ui.allocate_ui_at_rect(rect, |ui| {
+                        result = inner.show(ui, sync_writer, async_writer, state);
+                    });
+                    result?;
+                }
+                None => {
+                    ui.painter().rect_filled(rect, 0.0, t.color);
+                }
+            }
+
+            let alpha = ((1.0 - level) * 255.0).round() as u8;
+            let veil = match t.mode {
+                Mode::Luminance => Color32::from_black_alpha(alpha),
+                Mode::Contrast => {
+                    Color32::from_rgba_unmultiplied(MID_GRAY, MID_GRAY, MID_GRAY, alpha)
+                }
+            };
+            ui.painter().rect_filled(rect, 0.0, veil);
+        }
+
+        if let Some(group) = &self.group {
+            let mut entries = vec![("frame".to_owned(), Value::Array(values))];
+            if missed > 0 {
+                entries.push(("missed".to_owned(), Value::Integer(missed as i128)));
+            }
+            async_writer.push(AsyncSignal::Logger(
+                now,
+                LoggerSignal::Extend(group.clone(), entries),
+            ));
+        }
+
+        Ok(())
+    }
+
+    fn stop(
+        &mut self,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        state: &State,
+    ) -> Result<Signal> {
+        let mut news = vec![];
+        for inner in self.targets.iter_mut().filter_map(|t| t.inner.as_mut()) {
+            news.extend(inner.stop(sync_writer, async_writer, state)?);
+        }
+
+        if let Some(group) = &self.group {
+            async_writer.push(LoggerSignal::Extend(
+                group.clone(),
+                vec![
+                    (
+                        "missed_total".to_owned(),
+                        Value::Integer(self.missed as i128),
+                    ),
+                    ("event".to_owned(), Value::Text("stop".to_owned())),
+                ],
+            ));
+        }
+
+        sync_writer.push(SyncSignal::Repaint);
+        Ok(news.into())
+    }
+
+    fn debug(&self) -> Vec<(&str, String)> {
+        <dyn StatefulAction>::debug(self)
+            .into_iter()
+            .chain([
+                ("rate", format!("{:?}", self.rate)),
+                ("frame", format!("{:?}", self.frame)),
+                ("missed", format!("{:?}", self.missed)),
+            ])
+            .collect()
+    }
+}
+
+impl Target {
+    /// Number of frames (at refresh rate `rate`) that a cycle of the modulation spans, which is a
+    /// whole number for square waves.
+    fn cycle(&self, rate: f64, tolerance: f64, uneven_duty: bool) -> Result<f64> {
+        match self.waveform {
+            Waveform::Square => {
+                let frames = (rate / self.frequency).round();
+                let actual = rate / frames;
+                if frames < 2.0 || (actual - self.frequency).abs() > tolerance * self.frequency {
+                    Err(eyre!(
+                        "Flicker frequency of {} Hz is not achievable with a square wave at \
+                        {rate:.2} Hz (closest is {actual:.3} Hz).",
+                        self.frequency
+                    ))
+                } else if frames as u64 % 2 == 1 && !uneven_duty {
+                    Err(eyre!(
+                        "Flicker frequency of {} Hz spans an odd number of frames ({frames}) \
+                        at {rate:.2} Hz, so a square wave cannot be on for exactly half of \
+                        each cycle. Set `uneven_duty: true` to accept the longer on phase.",
+                        self.frequency
+                    ))
+                } else {
+                    Ok(frames)
+                }
+            }
+            Waveform::Sine => {
+                if self.frequency * 2.0 > rate {
+                    Err(eyre!(
+                        "Flicker frequency of {} Hz is above the Nyquist limit at {rate:.2} \
+                        Hz.",
+                        self.frequency
+                    ))
+                } else {
+                    Ok(rate / self.frequency)
+                }
+            }
+        }
+    }
+}
+
+impl StatefulTarget {
+    /// Luminance (or contrast) of the target in the given frame, between `1 - depth` and 1.
+    fn level(&self, frame: u64) -> f64 {
+        let position = (frame as f64 / self.cycle + self.phase).rem_euclid(1.0);
+        let on = match self.waveform {
+            Waveform::Square => {
+                // Whole frames into the cycle, so rounding errors cannot shift the edges
+                let k = (position * self.cycle + 1e-6).floor();
+                if k < self.cycle / 2.0 {
+                    1.0
+                } else {
+                    0.0
+                }
+            }
+            Waveform::Sine => 0.5 * (1.0 + (2.0 * PI * position).sin()),
+        };
+        1.0 - self.depth * (1.0 - on)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn target(frequency: f64, waveform: Waveform) -> Target {
+        Target {
+            frequency,
+            waveform,
+            mode: Mode::default(),
+            depth: 1.0,
+            phase: 0.0,
+            region: defaults::region(),
+            color: defaults::color(),
+            inner: None,
+        }
+    }
+
+    fn stateful(cycle: f64, waveform: Waveform) -> StatefulTarget {
+        StatefulTarget {
+            waveform,
+            mode: Mode::default(),
+            depth: 1.0,
+            phase: 0.0,
+            cycle,
+            region: defaults::region(),
+            color: Color32::WHITE,
+            inner: None,
+        }
+    }
+
+    #[test]
+    fn square_waves_need_whole_even_cycles() {
+        let square = |f: f64| target(f, Waveform::Square);
+        assert_eq!(square(15.0).cycle(60.0, 0.01, false).unwrap(), 4.0);
+        assert!(square(12.0).cycle(60.0, 0.01, false).is_err());
+        assert_eq!(square(12.0).cycle(60.0, 0.01, true).unwrap(), 5.0);
+        assert!(square(13.0).cycle(60.0, 0.01, true).is_err());
+        assert!(square(45.0).cycle(60.0, 0.5, true).is_err());
+    }
+
+    #[test]
+    fn sine_waves_respect_nyquist() {
+        assert_eq!(
+            target(12.0, Waveform::Sine)
+                .cycle(60.0, 0.0, false)
+                .unwrap(),
+            5.0
+        );
+        assert!(target(31.0, Waveform::Sine)
+            .cycle(60.0, 0.0, false)
+            .is_err());
+    }
+
+    #[test]
+    fn square_wave_is_on_for_first_half() {
+        let t = stateful(4.0, Waveform::Square);
+        let levels: Vec<_> = (0..8).map(|f| t.level(f)).collect();
+        assert_eq!(levels, [1.0, 1.0, 0.0, 0.0, 1.0, 1.0, 0.0, 0.0]);
+
+        let t = stateful(5.0, Waveform::Square);
+        let on = (0..5).filter(|f| t.level(*f) == 1.0).count();
+        assert_eq!(on, 3);
+    }
+}
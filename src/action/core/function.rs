@@ -1,8 +1,8 @@
 use crate::action::{Action, ActionSignal, Props, StatefulAction, DEFAULT, INFINITE};
 use crate::comm::{QWriter, Signal, SignalId};
 use crate::resource::{
-    Evaluator, Interpreter, IoManager, LoggerSignal, OptionalPath, OptionalString, ResourceAddr,
-    ResourceManager, ResourceValue,
+    Evaluator, Interpreter, IoManager, LogEntry, LoggerSignal, OptionalPath, OptionalString,
+    ResourceAddr, ResourceManager, ResourceValue,
 };
 use crate::server::{AsyncSignal, Config, State, SyncSignal};
 use eyre::{eyre, Context, Error, Result};
@@ -133,6 +133,21 @@ impl Action for Function {
         resources
     }
 
+    #[inline]
+    fn log_entries(&self) -> Vec<LogEntry> {
+        if self.name.is_empty() {
+            vec![]
+        } else {
+            vec![LogEntry::new(
+                "function",
+                &self.name,
+                "any",
+                "",
+                "Result of evaluating the function",
+            )]
+        }
+    }
+
     fn stateful(
         &self,
         _io: &IoManager,
@@ -1,13 +1,14 @@
 use crate::action::{Action, ActionSignal, Props, StatefulAction, INFINITE};
 use crate::comm::{QWriter, Signal, SignalId};
-use crate::resource::{IoManager, LoggerSignal, OptionalString, ResourceManager};
-use crate::server::{AsyncSignal, Config, State, SyncSignal};
-use chrono::Local;
+use crate::resource::{
+    IoManager, KeyboardLayout, LogEntry, LoggerSignal, OptionalString, ResourceManager,
+};
+use crate::server::{AsyncSignal, Config, State, SyncSignal, KEYBOARD_LAYOUT_ENV};
+use crate::util::is_default;
 use eyre::{eyre, Result};
 use serde::{Deserialize, Serialize};
 use serde_cbor::Value;
 use std::collections::BTreeSet;
-use std::time::Instant;
 
 #[derive(Debug, Deserialize, Serialize)]
 #[serde(deny_unknown_fields)]
@@ -16,11 +17,16 @@ pub struct KeyLogger {
     group: OptionalString,
     #[serde(default)]
     out_key: SignalId,
+    #[serde(default)]
+    #[serde(skip_serializing_if = "is_default")]
+    out_code: SignalId,
 }
 
 stateful!(KeyLogger {
     group: Option<String>,
+    layout: Option<KeyboardLayout>,
     out_key: SignalId,
+    out_code: SignalId,
 });
 
 mod defaults {
@@ -34,20 +40,71 @@ mod defaults {
 
 impl Action for KeyLogger {
     fn out_signals(&self) -> BTreeSet<SignalId> {
-        BTreeSet::from([self.out_key])
+        BTreeSet::from([self.out_key, self.out_code])
+    }
+
+    #[inline(always)]
+    fn in_keys(&self) -> bool {
+        true
+    }
+
+    fn log_entries(&self) -> Vec<LogEntry> {
+        if let OptionalString::Some(group) = &self.group {
+            vec![
+                LogEntry::new(
+                    group,
+                    "event",
+                    "text",
+                    "",
+                    "Marks the `start` and `stop` of logging",
+                ),
+                LogEntry::new(
+                    group,
+                    "layout",
+                    "text",
+                    "",
+                    "Configured keyboard layout from which key positions are derived (if set)",
+                ),
+                LogEntry::new(
+                    group,
+                    "key",
+                    "array<text>",
+                    "",
+                    "Keys pressed in a single frame",
+                ),
+                LogEntry::new(
+                    group,
+                    "code",
+                    "array<text>",
+                    "",
+                    "Positions of the keys pressed in a single frame (e.g., `KeyZ`), derived from \
+                    the configured keyboard layout rather than read from the keyboard (only \
+                    logged if a layout is set)",
+                ),
+            ]
+        } else {
+            vec![]
+        }
     }
 
     fn stateful(
         &self,
         _io: &IoManager,
         _res: &ResourceManager,
-        _config: &Config,
+        config: &Config,
         _sync_writer: &QWriter<SyncSignal>,
         _async_writer: &QWriter<AsyncSignal>,
     ) -> Result<Box<dyn StatefulAction>> {
-        if self.group.is_none() && self.out_key == 0 {
+        if self.group.is_none() && self.out_key == 0 && self.out_code == 0 {
+            return Err(eyre!(
+                "`group`, `out_key`, and `out_code` for KeyLogger cannot be empty simultaneously."
+            ));
+        }
+
+        if self.out_code > 0 && config.keyboard_layout().is_none() {
             return Err(eyre!(
-                "Both `group` and `out_key` for KeyLogger cannot be empty simultaneously."
+                "KeyLogger `out_code` requires the `keyboard_layout` of the machine to be set \
+                (in the task config or with `{KEYBOARD_LAYOUT_ENV}`)."
             ));
         }
 
@@ -59,7 +116,9 @@ impl Action for KeyLogger {
         Ok(Box::new(StatefulKeyLogger {
             done: false,
             group,
+            layout: config.keyboard_layout(),
             out_key: self.out_key,
+            out_code: self.out_code,
         }))
     }
 }
@@ -79,10 +138,14 @@ impl StatefulAction for StatefulKeyLogger {
         _state: &State,
     ) -> Result<Signal> {
         if let Some(group) = self.group.as_ref() {
-            async_writer.push(LoggerSignal::Append(
-                group.clone(),
-                ("event".to_owned(), Value::Text("start".to_owned())),
-            ));
+            let mut entries = vec![("event".to_owned(), Value::Text("start".to_owned()))];
+            if let Some(layout) = self.layout {
+                entries.push((
+                    "layout".to_owned(),
+                    Value::Text(format!("{layout:?}").to_lowercase()),
+                ));
+            }
+            async_writer.push(LoggerSignal::Extend(group.clone(), entries));
         }
 
         Ok(Signal::none())
@@ -95,27 +158,49 @@ impl StatefulAction for StatefulKeyLogger {
         async_writer: &mut QWriter<AsyncSignal>,
         _state: &State,
     ) -> Result<Signal> {
-        if let ActionSignal::KeyPress(_, keys) = signal {
-            let entry = (
+        if let ActionSignal::KeyPress(time, keys) = signal {
+            let codes: Vec<_> = match self.layout {
+                Some(layout) => keys.iter().map(|k| layout.code(*k)).collect(),
+                None => vec![],
+            };
+            let mut entries = vec![(
                 "key".to_string(),
                 Value::Array(keys.iter().map(|k| Value::Text(format!("{k:?}"))).collect()),
-            );
-
-            if self.out_key > 0 {
-                sync_writer.push(SyncSignal::Emit(
-                    Instant::now(),
-                    Signal::from(
-                        keys.iter()
-                            .map(|k| (self.out_key, Value::Text(format!("{k:?}"))))
-                            .collect::<Vec<_>>(),
+            )];
+            if self.layout.is_some() {
+                entries.push((
+                    "code".to_string(),
+                    Value::Array(
+                        codes
+                            .iter()
+                            .map(|c| Value::Text(format!("{c:?}")))
+                            .collect(),
                     ),
                 ));
             }
 
+            let mut news = vec![];
+            if self.out_key > 0 {
+                news.extend(
+                    keys.iter()
+                        .map(|k| (self.out_key, Value::Text(format!("{k:?}")))),
+                );
+            }
+            if self.out_code > 0 {
+                news.extend(
+                    codes
+                        .iter()
+                        .map(|c| (self.out_code, Value::Text(format!("{c:?}")))),
+                );
+            }
+            if !news.is_empty() {
+                sync_writer.push(SyncSignal::Emit(*time, Signal::from(news)));
+            }
+
             if let Some(group) = self.group.as_ref() {
                 async_writer.push(AsyncSignal::Logger(
-                    Local::now(),
-                    LoggerSignal::Append(group.clone(), entry),
+                    *time,
+                    LoggerSignal::Extend(group.clone(), entries),
                 ));
             }
         }
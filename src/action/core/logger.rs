@@ -1,6 +1,6 @@
 use crate::action::{Action, ActionSignal, Props, StatefulAction, INFINITE};
 use crate::comm::{QWriter, Signal, SignalId};
-use crate::resource::{IoManager, LoggerSignal, ResourceManager};
+use crate::resource::{IoManager, LogEntry, LoggerSignal, ResourceManager};
 use crate::server::{AsyncSignal, Config, State, SyncSignal};
 use eyre::{eyre, Result};
 use serde::{Deserialize, Serialize};
@@ -36,6 +36,21 @@ impl Action for Logger {
         }
     }
 
+    fn log_entries(&self) -> Vec<LogEntry> {
+        self.in_mapping
+            .iter()
+            .map(|(id, name)| {
+                LogEntry::new(
+                    &self.group,
+                    name,
+                    "any",
+                    "",
+                    &format!("Value of signal {id}"),
+                )
+            })
+            .collect()
+    }
+
     fn stateful(
         &self,
         _io: &IoManager,
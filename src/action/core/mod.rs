@@ -9,6 +9,7 @@ pub mod counter;
 pub mod delayed;
 pub mod event;
 pub mod fixation;
+pub mod flicker;
 pub mod function;
 pub mod horizontal;
 pub mod image;
@@ -28,8 +29,10 @@ pub mod stack;
 pub mod stream;
 pub mod switch;
 pub mod template;
+pub mod time_reproduction;
 pub mod timeout;
 pub mod timer;
+pub mod tracking;
 pub mod until;
 pub mod vertical;
 #[cfg(feature = "stream")]
@@ -45,6 +45,15 @@ impl Par {
 }
 
 impl Action for Par {
+    #[inline]
+    fn children(&self) -> Vec<&dyn Action> {
+        self.0
+            .iter()
+            .chain(self.1.iter())
+            .map(|c| c.as_ref())
+            .collect()
+    }
+
     #[inline]
     fn in_signals(&self) -> BTreeSet<SignalId> {
         let mut signals = BTreeSet::new();
@@ -89,12 +98,12 @@ impl Action for Par {
     ) -> Result<Box<dyn StatefulAction>> {
         let mut primary = vec![];
         for c in self.0.iter() {
-            primary.push(c.stateful(io, res, config, sync_writer, async_writer)?);
+            primary.push(c.routed(io, res, config, sync_writer, async_writer)?);
         }
 
         let mut secondary = vec![];
         for c in self.1.iter() {
-            secondary.push(c.stateful(io, res, config, sync_writer, async_writer)?);
+            secondary.push(c.routed(io, res, config, sync_writer, async_writer)?);
         }
 
         Ok(Box::new(StatefulPar {
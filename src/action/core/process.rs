@@ -1,6 +1,8 @@
 use crate::action::{Action, ActionSignal, Props, StatefulAction, DEFAULT, INFINITE};
 use crate::comm::{QWriter, Signal, SignalId};
-use crate::resource::{IoManager, LoggerSignal, ResourceAddr, ResourceManager, ResourceValue};
+use crate::resource::{
+    IoManager, LogEntry, LoggerSignal, ResourceAddr, ResourceManager, ResourceValue,
+};
 use crate::server::{AsyncSignal, Config, State, SyncSignal};
 use eyre::{eyre, Context, Error, Result};
 use serde::{Deserialize, Serialize};
@@ -142,6 +144,21 @@ impl Action for Process {
         vec![ResourceAddr::Ref(self.src.clone())]
     }
 
+    #[inline]
+    fn log_entries(&self) -> Vec<LogEntry> {
+        if self.name.is_empty() {
+            vec![]
+        } else {
+            vec![LogEntry::new(
+                "process",
+                &self.name,
+                "any",
+                "",
+                "Result returned by the process",
+            )]
+        }
+    }
+
     fn stateful(
         &self,
         _io: &IoManager,
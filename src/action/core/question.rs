@@ -1,12 +1,13 @@
 use crate::action::{Action, Props, StatefulAction, VISUAL};
-use crate::comm::QWriter;
+use crate::comm::{QWriter, Signal};
 use crate::gui::{
     center_x, header_body_controls, style_ui, text::body, text::button1, text::inactive, Style,
     TEXT_SIZE_BODY,
 };
-use crate::resource::{parse_text, IoManager, LoggerSignal, ResourceManager};
+use crate::resource::{parse_text, IoManager, LogEntry, LoggerSignal, ResourceManager};
 use crate::server::{AsyncSignal, Config, State, SyncSignal};
 use crate::util::{f32_with_precision, f64_with_precision};
+use chrono::Local;
 use eframe::egui;
 use eframe::egui::{
     Checkbox, Color32, RadioButton, ScrollArea, Slider, Stroke, TextEdit, Vec2, Widget,
@@ -15,7 +16,9 @@ use egui_extras::StripBuilder;
 use eyre::{eyre, Result};
 use serde::{Deserialize, Serialize};
 use serde_cbor::Value;
+use std::collections::BTreeMap;
 use std::ops::RangeInclusive;
+use std::time::{Duration, Instant};
 
 #[derive(Debug, Deserialize, Serialize)]
 #[serde(deny_unknown_fields)]
@@ -23,11 +26,17 @@ pub struct Question {
     #[serde(default = "defaults::group")]
     group: String,
     list: Vec<QItem>,
+    #[serde(default = "defaults::autosave")]
+    #[serde(skip_serializing_if = "defaults::is_autosave")]
+    autosave: f32,
 }
 
 stateful!(Question {
     group: String,
     list: Vec<StatefulQItem>,
+    autosave: Duration,
+    answers: Vec<(String, Value)>,
+    changed: Option<Instant>,
 });
 
 mod defaults {
@@ -36,6 +45,16 @@ mod defaults {
         "questions".to_owned()
     }
 
+    #[inline(always)]
+    pub fn autosave() -> f32 {
+        1.0
+    }
+
+    #[inline(always)]
+    pub fn is_autosave(autosave: &f32) -> bool {
+        *autosave == 1.0
+    }
+
     #[inline(always)]
     pub fn lines() -> usize {
         3
@@ -53,6 +72,23 @@ mod defaults {
 }
 
 impl Action for Question {
+    fn log_entries(&self) -> Vec<LogEntry> {
+        self.list
+            .iter()
+            .map(|q| {
+                let (id, prompt, dtype) = match q {
+                    QItem::SingleLine { id, prompt } | QItem::MultiLine { id, prompt, .. } => {
+                        (id, prompt, "text")
+                    }
+                    QItem::SingleChoice { id, prompt, .. } => (id, prompt, "text|null"),
+                    QItem::MultiChoice { id, prompt, .. } => (id, prompt, "array<text>"),
+                    QItem::Slider { id, prompt, .. } => (id, prompt, "float"),
+                };
+                LogEntry::new(&self.group, id, dtype, "", prompt)
+            })
+            .collect()
+    }
+
     fn stateful(
         &self,
         _io: &IoManager,
@@ -64,12 +100,25 @@ impl Action for Question {
         if self.group.is_empty() {
             return Err(eyre!("Question `group` cannot be an empty string"));
         }
+        if self.autosave < 0.0 {
+            return Err(eyre!("Question `autosave` cannot be negative"));
+        }
+
+        Ok(Box::new(self.state()))
+    }
+}
 
-        Ok(Box::new(StatefulQuestion {
+impl Question {
+    fn state(&self) -> StatefulQuestion {
+        let list: Vec<_> = self.list.iter().map(|q| q.stateful()).collect();
+        StatefulQuestion {
             done: false,
             group: self.group.clone(),
-            list: self.list.iter().map(|q| q.stateful()).collect(),
-        }))
+            answers: list.iter().map(|q| q.to_string()).collect(),
+            list,
+            autosave: Duration::from_secs_f32(self.autosave),
+            changed: None,
+        }
     }
 }
 
@@ -100,8 +149,26 @@ impl StatefulAction for StatefulQuestion {
             strip.strip(|builder| self.show_controls(builder, sync_writer, async_writer));
         });
 
+        if !self.done && self.autosave(Instant::now(), async_writer) {
+            ui.ctx().request_repaint();
+        }
+
         Ok(())
     }
+
+    fn stop(
+        &mut self,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        _state: &State,
+    ) -> Result<Signal> {
+        if !self.done {
+            self.save_draft(async_writer, "incomplete");
+        }
+
+        sync_writer.push(SyncSignal::Repaint);
+        Ok(Signal::none())
+    }
 }
 
 impl StatefulQuestion {
@@ -164,9 +231,58 @@ impl StatefulQuestion {
                     self.group.clone(),
                     self.list.iter().map(|q| q.to_string()).collect(),
                 ));
+                self.save_draft(async_writer, "submitted");
+            }
+        }
+    }
+
+    /// Saves a draft of the answers once they have not changed for `autosave` seconds. Returns
+    /// whether a draft is still due, i.e., the form needs to be shown again.
+    fn autosave(&mut self, now: Instant, async_writer: &mut QWriter<AsyncSignal>) -> bool {
+        let answers: Vec<_> = self.list.iter().map(|q| q.to_string()).collect();
+        if answers != self.answers {
+            self.answers = answers;
+            self.changed = Some(now);
+        }
+
+        match self.changed {
+            Some(changed) if now.duration_since(changed) >= self.autosave => {
+                self.save_draft(async_writer, "draft");
+                self.changed = None;
+                false
             }
+            Some(_) => true,
+            None => false,
         }
     }
+
+    /// Overwrites the draft log of the form (`<group>_draft`) with the current answers, labeled
+    /// with `status` and the time of saving.
+    fn save_draft(&self, async_writer: &mut QWriter<AsyncSignal>, status: &str) {
+        let answers = self
+            .list
+            .iter()
+            .map(|q| {
+                let (name, value) = q.to_string();
+                (Value::Text(name), value)
+            })
+            .collect();
+
+        async_writer.push(LoggerSignal::Write(
+            format!("{}_draft", self.group),
+            Value::Map(BTreeMap::from([
+                (
+                    Value::Text("status".to_owned()),
+                    Value::Text(status.to_owned()),
+                ),
+                (
+                    Value::Text("time".to_owned()),
+                    Value::Text(Local::now().to_string()),
+                ),
+                (Value::Text("answers".to_owned()), Value::Map(answers)),
+            ])),
+        ));
+    }
 }
 
 #[derive(Debug, Deserialize, Serialize)]
@@ -511,3 +627,91 @@ impl StatefulQItem {
         (name, value)
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::comm::QReader;
+
+    fn question() -> StatefulQuestion {
+        let question: Question =
+            ron::from_str("(list: [single_line(id: \"name\", prompt: \"Name\")])").unwrap();
+        question.state()
+    }
+
+    fn answer(question: &mut StatefulQuestion, text: &str) {
+        if let StatefulQItem::SingleLine { input, .. } = &mut question.list[0] {
+            *input = text.to_owned();
+        }
+    }
+
+    /// Status and answer of every draft written to the queue since the last call.
+    fn drafts(reader: &mut QReader<AsyncSignal>) -> Vec<(String, Value)> {
+        let mut drafts = vec![];
+        while let Some(signal) = reader.try_pop() {
+            if let AsyncSignal::Logger(_, LoggerSignal::Write(name, Value::Map(draft))) = signal {
+                assert_eq!(name, "questions_draft");
+                let status = match &draft[&Value::Text("status".to_owned())] {
+                    Value::Text(status) => status.clone(),
+                    v => panic!("unexpected status: {v:?}"),
+                };
+                let answer = match &draft[&Value::Text("answers".to_owned())] {
+                    Value::Map(answers) => answers[&Value::Text("name".to_owned())].clone(),
+                    v => panic!("unexpected answers: {v:?}"),
+                };
+                drafts.push((status, answer));
+            }
+        }
+        drafts
+    }
+
+    #[test]
+    fn drafts_are_saved_once_answers_settle() {
+        let mut reader = QReader::new();
+        let mut async_writer = reader.writer();
+        let mut question = question();
+        let start = Instant::now();
+        let at = |secs: f32| start + Duration::from_secs_f32(secs);
+
+        assert!(!question.autosave(at(0.0), &mut async_writer));
+        answer(&mut question, "A");
+        assert!(question.autosave(at(0.0), &mut async_writer));
+        answer(&mut question, "Ada");
+        assert!(question.autosave(at(0.5), &mut async_writer));
+        // Only 0.7 s since the last change
+        assert!(question.autosave(at(1.2), &mut async_writer));
+        assert!(drafts(&mut reader).is_empty());
+
+        assert!(!question.autosave(at(1.5), &mut async_writer));
+        assert_eq!(
+            drafts(&mut reader),
+            vec![("draft".to_owned(), Value::Text("Ada".to_owned()))]
+        );
+        assert!(!question.autosave(at(3.0), &mut async_writer));
+        assert!(drafts(&mut reader).is_empty());
+    }
+
+    #[test]
+    fn unsubmitted_answers_are_saved_on_stop() {
+        let mut reader = QReader::new();
+        let mut sync_writer = QReader::new().writer();
+        let mut async_writer = reader.writer();
+        let state = State::new();
+
+        let mut question = question();
+        answer(&mut question, "Ada");
+        question
+            .stop(&mut sync_writer, &mut async_writer, &state)
+            .unwrap();
+        assert_eq!(
+            drafts(&mut reader),
+            vec![("incomplete".to_owned(), Value::Text("Ada".to_owned()))]
+        );
+
+        question.done = true;
+        question
+            .stop(&mut sync_writer, &mut async_writer, &state)
+            .unwrap();
+        assert!(drafts(&mut reader).is_empty());
+    }
+}
@@ -1,7 +1,10 @@
 use crate::action::{Action, ActionSignal, Props, StatefulAction, INFINITE};
 use crate::comm::{QWriter, Signal, SignalId};
-use crate::resource::{IoManager, Key, LoggerSignal, ResourceManager};
-use crate::server::{AsyncSignal, Config, State, SyncSignal};
+use crate::resource::{
+    IoManager, Key, KeyCode, KeyboardLayout, LogEntry, LoggerSignal, ResourceManager,
+};
+use crate::server::{AsyncSignal, Config, State, SyncSignal, KEYBOARD_LAYOUT_ENV};
+use crate::util::is_default;
 use eyre::{eyre, Error, Result};
 use serde::{Deserialize, Serialize};
 use serde_cbor::Value;
@@ -16,6 +19,12 @@ pub struct Reaction {
     group: String,
     #[serde(default = "defaults::keys")]
     keys: BTreeSet<Key>,
+    #[serde(default)]
+    #[serde(skip_serializing_if = "BTreeSet::is_empty")]
+    codes: BTreeSet<KeyCode>,
+    #[serde(default)]
+    #[serde(skip_serializing_if = "BTreeSet::is_empty")]
+    correct_keys: BTreeSet<Key>,
     #[serde(default = "defaults::tol")]
     tol: f32,
     #[serde(default)]
@@ -26,11 +35,20 @@ pub struct Reaction {
     out_mean_rt: SignalId,
     #[serde(default)]
     out_recall: SignalId,
+    #[serde(default)]
+    #[serde(skip_serializing_if = "is_default")]
+    out_success: SignalId,
+    #[serde(default)]
+    #[serde(skip_serializing_if = "is_default")]
+    out_key: SignalId,
 }
 
 stateful!(Reaction {
     group: String,
     keys: BTreeSet<Key>,
+    codes: BTreeSet<KeyCode>,
+    correct_keys: BTreeSet<Key>,
+    layout: Option<KeyboardLayout>,
     times: Vec<Duration>,
     tol: Duration,
     since: Instant,
@@ -42,6 +60,8 @@ stateful!(Reaction {
     out_accuracy: SignalId,
     out_mean_rt: SignalId,
     out_recall: SignalId,
+    out_success: SignalId,
+    out_key: SignalId,
 });
 
 mod defaults {
@@ -65,6 +85,11 @@ mod defaults {
 }
 
 impl Action for Reaction {
+    #[inline(always)]
+    fn in_keys(&self) -> bool {
+        true
+    }
+
     #[inline]
     fn out_signals(&self) -> BTreeSet<SignalId> {
         BTreeSet::from([
@@ -72,6 +97,8 @@ impl Action for Reaction {
             self.out_accuracy,
             self.out_mean_rt,
             self.out_recall,
+            self.out_success,
+            self.out_key,
         ])
     }
 
@@ -88,18 +115,106 @@ impl Action for Reaction {
         Ok(Box::new(self))
     }
 
+    fn log_entries(&self) -> Vec<LogEntry> {
+        let group = &self.group;
+        vec![
+            LogEntry::new(
+                group,
+                "event",
+                "text",
+                "",
+                "Marks the `start` and `stop` of the action",
+            ),
+            LogEntry::new(
+                group,
+                "layout",
+                "text",
+                "",
+                "Configured keyboard layout from which key positions are derived (if set)",
+            ),
+            LogEntry::new(
+                group,
+                "key",
+                "array<text>",
+                "",
+                "Keys of a response, logged before its outcome",
+            ),
+            LogEntry::new(
+                group,
+                "code",
+                "array<text>",
+                "",
+                "Positions of the keys of a response (e.g., `KeyZ`), derived from the configured \
+                keyboard layout (only logged if a layout is set)",
+            ),
+            LogEntry::new(
+                group,
+                "correct",
+                "array<float>",
+                "s",
+                "Time of a correct response since start, followed by its reaction time",
+            ),
+            LogEntry::new(
+                group,
+                "incorrect",
+                "array<float>",
+                "s",
+                "Time of an incorrect response since start",
+            ),
+            LogEntry::new(
+                group,
+                "accuracy",
+                "float",
+                "",
+                "Fraction of responses that were correct",
+            ),
+            LogEntry::new(
+                group,
+                "mean_rt",
+                "float",
+                "s",
+                "Mean reaction time of correct responses",
+            ),
+            LogEntry::new(
+                group,
+                "recall",
+                "float",
+                "",
+                "Fraction of targets that were responded to",
+            ),
+            LogEntry::new(
+                group,
+                "success",
+                "bool",
+                "",
+                "Whether every target was responded to, without any incorrect response",
+            ),
+        ]
+    }
+
     fn stateful(
         &self,
         _io: &IoManager,
         _res: &ResourceManager,
-        _config: &Config,
+        config: &Config,
         _sync_writer: &QWriter<SyncSignal>,
         _async_writer: &QWriter<AsyncSignal>,
     ) -> Result<Box<dyn StatefulAction>> {
+        let layout = config.keyboard_layout();
+        if layout.is_none() && !self.codes.is_empty() {
+            return Err(eyre!(
+                "Reaction `codes` require the `keyboard_layout` of the machine to be set (in the \
+                task config or with `{KEYBOARD_LAYOUT_ENV}`)."
+            ));
+        }
+
         Ok(Box::new(StatefulReaction {
             done: false,
             group: self.group.clone(),
             keys: self.keys.clone(),
+            codes: self.codes.clone(),
+            correct_keys: self.correct_keys.clone(),
+            layout,
             times: self
                 .times
                 .iter()
@@ -107,7 +222,7 @@ impl Action for Reaction {
                 .collect(),
             tol: Duration::from_secs_f32(self.tol),
             since: Instant::now(),
-            next: Some(0),
+            next: (!self.times.is_empty()).then_some(0),
             reaction_correct: vec![],
             reaction_times: vec![],
             reaction_rts: vec![],
@@ -115,6 +230,8 @@ impl Action for Reaction {
             out_accuracy: self.out_accuracy,
             out_recall: self.out_recall,
             out_mean_rt: self.out_mean_rt,
+            out_success: self.out_success,
+            out_key: self.out_key,
         }))
     }
 }
@@ -134,10 +251,14 @@ impl StatefulAction for StatefulReaction {
         _state: &State,
     ) -> Result<Signal> {
         self.since = Instant::now();
-        async_writer.push(LoggerSignal::Append(
-            self.group.clone(),
-            ("event".to_owned(), Value::Text("start".to_owned())),
-        ));
+        let mut entries = vec![("event".to_owned(), Value::Text("start".to_owned()))];
+        if let Some(layout) = self.layout {
+            entries.push((
+                "layout".to_owned(),
+                Value::Text(format!("{layout:?}").to_lowercase()),
+            ));
+        }
+        async_writer.push(LoggerSignal::Extend(self.group.clone(), entries));
         Ok(Signal::none())
     }
 
@@ -148,19 +269,29 @@ impl StatefulAction for StatefulReaction {
         async_writer: &mut QWriter<AsyncSignal>,
         _state: &State,
     ) -> Result<Signal> {
-        let (time, keys) = match signal {
-            ActionSignal::KeyPress(t, k) => (t.duration_since(self.since), k),
+        let (pressed, keys) = match signal {
+            ActionSignal::KeyPress(t, k) => (*t, k),
             _ => return Ok(Signal::none()),
         };
+        let time = pressed.duration_since(self.since);
 
-        if !self.keys.is_empty() && keys.is_disjoint(&self.keys) {
+        if !self.responds_to(keys) {
             return Ok(Signal::none());
         }
 
         self.reaction_times.push(time.as_secs_f32());
+        if self.out_key > 0 {
+            sync_writer.push(SyncSignal::Emit(
+                Instant::now(),
+                keys.iter()
+                    .map(|k| (self.out_key, Value::Text(format!("{k:?}"))))
+                    .collect::<Vec<_>>()
+                    .into(),
+            ));
+        }
 
         let mut correct = false;
-        if self.next.is_none() {
+        if !self.is_correct_key(keys) || self.next.is_none() {
             self.reaction_correct.push(false);
         } else {
             while let Some(i) = self.next {
@@ -195,7 +326,22 @@ impl StatefulAction for StatefulReaction {
             }
         }
 
-        let entry = if correct {
+        let mut entries = vec![(
+            "key".to_owned(),
+            Value::Array(keys.iter().map(|k| Value::Text(format!("{k:?}"))).collect()),
+        )];
+        if let Some(layout) = self.layout {
+            entries.push((
+                "code".to_owned(),
+                Value::Array(
+                    keys.iter()
+                        .map(|k| Value::Text(format!("{:?}", layout.code(*k))))
+                        .collect(),
+                ),
+            ));
+        }
+
+        entries.push(if correct {
             (
                 "correct".to_string(),
                 Value::Array(vec![
@@ -210,8 +356,11 @@ impl StatefulAction for StatefulReaction {
                     self.reaction_times[self.reaction_times.len() - 1] as f64,
                 )]),
             )
-        };
-        async_writer.push(LoggerSignal::Append(self.group.clone(), entry));
+        });
+        async_writer.push(AsyncSignal::Logger(
+            pressed,
+            LoggerSignal::Extend(self.group.clone(), entries),
+        ));
 
         Ok(Signal::none())
     }
@@ -226,6 +375,7 @@ impl StatefulAction for StatefulReaction {
         let accuracy = self.accuracy();
         let mean_rt = self.mean_rt();
         let recall = self.recall();
+        let success = self.success();
 
         async_writer.push(LoggerSignal::Extend(
             self.group.clone(),
@@ -234,6 +384,7 @@ impl StatefulAction for StatefulReaction {
                 ("accuracy".to_owned(), Value::Float(accuracy)),
                 ("mean_rt".to_owned(), Value::Float(mean_rt)),
                 ("recall".to_owned(), Value::Float(recall)),
+                ("success".to_owned(), Value::Bool(success)),
             ],
         ));
 
@@ -247,6 +398,9 @@ impl StatefulAction for StatefulReaction {
         if self.out_recall > 0 {
             news.push((self.out_recall, Value::Float(recall)))
         }
+        if self.out_success > 0 {
+            news.push((self.out_success, Value::Bool(success)))
+        }
         Ok(news.into())
     }
 
@@ -259,6 +413,32 @@ impl StatefulAction for StatefulReaction {
 }
 
 impl StatefulReaction {
+    /// Whether any of the pressed keys is a response key, either by its label (`keys`) or by its
+    /// physical position (`codes`). If neither is set, every key counts as a response.
+    fn responds_to(&self, keys: &BTreeSet<Key>) -> bool {
+        if self.keys.is_empty() && self.codes.is_empty() {
+            return true;
+        }
+
+        keys.iter().any(|k| {
+            self.keys.contains(k)
+                || matches!(self.layout, Some(layout) if self.codes.contains(&layout.code(*k)))
+        })
+    }
+
+    /// Whether a response was made with one of the `correct_keys`. If none are set, every response
+    /// key is correct.
+    fn is_correct_key(&self, keys: &BTreeSet<Key>) -> bool {
+        self.correct_keys.is_empty() || keys.iter().any(|k| self.correct_keys.contains(k))
+    }
+
+    /// Whether every target was responded to in time, and no response was incorrect. Without any
+    /// targets, this is whether the participant refrained from responding.
+    #[inline(always)]
+    fn success(&self) -> bool {
+        self.reaction_rts.len() == self.times.len() && self.reaction_correct.iter().all(|c| *c)
+    }
+
     #[inline(always)]
     fn accuracy(&self) -> f64 {
         self.reaction_rts.len() as f64 / self.reaction_correct.len() as f64
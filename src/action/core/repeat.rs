@@ -1,4 +1,4 @@
-use crate::action::{Action, ActionSignal, Props, StatefulAction, INFINITE};
+use crate::action::{Action, ActionSignal, Props, Scope, StatefulAction, INFINITE};
 use crate::comm::{QWriter, Signal, SignalId};
 use crate::resource::{IoManager, ResourceAddr, ResourceManager};
 use crate::server::{AsyncSignal, Config, State, SyncSignal};
@@ -29,6 +29,11 @@ mod defaults {
 }
 
 impl Action for Repeat {
+    #[inline]
+    fn children(&self) -> Vec<&dyn Action> {
+        vec![self.0.as_ref()]
+    }
+
     fn in_signals(&self) -> BTreeSet<SignalId> {
         self.0.in_signals()
     }
@@ -51,12 +56,13 @@ impl Action for Repeat {
     ) -> Result<Box<dyn StatefulAction>> {
         let (tx, rx) = mpsc::channel();
 
+        // Every repetition shares the same path in the trace
+        let path = Scope::current().unwrap_or_default();
+
         let mut queue = VecDeque::new();
         for _ in 0..self.1 {
-            queue.push_back(
-                self.0
-                    .stateful(io, res, config, sync_writer, async_writer)?,
-            );
+            let _scope = Scope::within(&path);
+            queue.push_back(self.0.routed(io, res, config, sync_writer, async_writer)?);
         }
 
         let queue = Arc::new(Mutex::new(queue));
@@ -66,6 +72,8 @@ impl Action for Repeat {
             let blueprint =
                 serde_cbor::to_vec(&self.0).wrap_err("Failed to serialize action blueprint.")?;
 
+            let path = path.clone();
+            let routes = Scope::routes();
             let res = res.clone();
             let config = config.clone();
             let mut sync_writer = sync_writer.clone();
@@ -92,12 +100,15 @@ impl Action for Repeat {
                     }
                 };
 
+                // Prefetched repetitions register with the routing index of the tree
+                let _routing = routes.as_ref().map(Scope::routing);
                 loop {
                     if let Err(RecvError) = rx.recv() {
                         break;
                     } else {
+                        let _scope = Scope::within(&path);
                         match blueprint
-                            .stateful(&io, &res, &config, &sync_writer, &async_writer)
+                            .routed(&io, &res, &config, &sync_writer, &async_writer)
                             .wrap_err("Failed to prefetch inner stateful action for Repeat.")
                         {
                             Ok(inner) => {
@@ -113,11 +124,10 @@ impl Action for Repeat {
             });
         }
 
+        let _scope = Scope::within(&path);
         Ok(Box::new(StatefulRepeat {
             done: false,
-            inner: self
-                .0
-                .stateful(io, res, config, sync_writer, async_writer)?,
+            inner: self.0.routed(io, res, config, sync_writer, async_writer)?,
             queue,
             link: tx,
         }))
@@ -22,6 +22,11 @@ impl Seq {
 }
 
 impl Action for Seq {
+    #[inline]
+    fn children(&self) -> Vec<&dyn Action> {
+        self.0.iter().map(|c| c.as_ref()).collect()
+    }
+
     #[inline]
     fn in_signals(&self) -> BTreeSet<SignalId> {
         let mut signals = BTreeSet::new();
@@ -59,7 +64,7 @@ impl Action for Seq {
     ) -> Result<Box<dyn StatefulAction>> {
         let mut children: VecDeque<_> = VecDeque::with_capacity(self.0.len());
         for c in self.0.iter() {
-            children.push_back(c.stateful(io, res, config, sync_writer, async_writer)?);
+            children.push_back(c.routed(io, res, config, sync_writer, async_writer)?);
         }
 
         for c in children.iter().take(children.len() - 1) {
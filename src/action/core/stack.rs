@@ -61,6 +61,11 @@ impl Action for Stack {
         Ok(Box::new(self))
     }
 
+    #[inline]
+    fn children(&self) -> Vec<&dyn Action> {
+        self.0.iter().map(|c| c.as_ref()).collect()
+    }
+
     #[inline]
     fn in_signals(&self) -> BTreeSet<SignalId> {
         let mut signals = BTreeSet::new();
@@ -98,7 +103,7 @@ impl Action for Stack {
     ) -> Result<Box<dyn StatefulAction>> {
         let mut children = vec![];
         for c in self.0.iter() {
-            children.push(c.stateful(io, res, config, sync_writer, async_writer)?);
+            children.push(c.routed(io, res, config, sync_writer, async_writer)?);
         }
 
         let active = (0..children.len() as usize).map(|_| true).collect();
@@ -3,7 +3,8 @@
 use crate::action::{Action, Props, StatefulAction, DEFAULT, INFINITE, VISUAL};
 use crate::comm::{QWriter, Signal};
 use crate::resource::{
-    Color, IoManager, ResourceAddr, ResourceManager, ResourceValue, StreamMode, Trigger, Volume,
+    Color, IoManager, LogEntry, LoggerSignal, OutputDevice, ResourceAddr, ResourceManager,
+    ResourceValue, StreamMode, Trigger, Volume,
 };
 use crate::server::{AsyncSignal, Config, State, SyncSignal};
 use crate::util::spin_sleeper;
@@ -11,6 +12,7 @@ use eframe::egui;
 use eframe::egui::{CentralPanel, Color32, CursorIcon, Frame, TextureId, Vec2};
 use eyre::{eyre, Context, Result};
 use serde::{Deserialize, Serialize};
+use serde_cbor::Value;
 use std::path::PathBuf;
 use std::sync::mpsc::{Receiver, Sender, TryRecvError};
 use std::sync::{mpsc, Arc, Mutex};
@@ -21,8 +23,12 @@ use std::time::Duration;
 #[derive(Debug, Deserialize, Serialize)]
 #[serde(deny_unknown_fields)]
 pub struct Stream {
+    #[serde(default)]
     src: PathBuf,
     #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pipeline: Option<String>,
+    #[serde(default)]
     width: Option<u16>,
     #[serde(default)]
     volume: Volume,
@@ -31,7 +37,25 @@ pub struct Stream {
     #[serde(default)]
     trigger: Trigger,
     #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    device: Option<String>,
+    #[serde(default)]
     background: Color,
+    #[serde(default = "defaults::group")]
+    #[serde(skip_serializing_if = "defaults::is_group")]
+    group: String,
+}
+
+mod defaults {
+    #[inline(always)]
+    pub fn group() -> String {
+        "stream".to_owned()
+    }
+
+    #[inline(always)]
+    pub fn is_group(group: &String) -> bool {
+        group == "stream"
+    }
 }
 
 stateful_arc!(Stream {
@@ -43,23 +67,47 @@ stateful_arc!(Stream {
     link_stop: Option<Receiver<()>>,
     join_handle: Option<JoinHandle<Result<()>>>,
     background: Color32,
+    pipeline: Option<String>,
+    group: String,
 });
 
 impl Action for Stream {
     #[inline(always)]
     fn resources(&self, _config: &Config) -> Vec<ResourceAddr> {
         if let Trigger::Ext(trig) = &self.trigger {
-            vec![
-                ResourceAddr::Stream(self.src.clone()),
-                ResourceAddr::Ref(trig.clone()),
-            ]
+            vec![self.source(), ResourceAddr::Ref(trig.clone())]
+        } else {
+            vec![self.source()]
+        }
+    }
+
+    fn log_entries(&self) -> Vec<LogEntry> {
+        if self.pipeline.is_some() {
+            vec![LogEntry::new(
+                &self.group,
+                "pipeline",
+                "text",
+                "",
+                "Description of the custom GStreamer pipeline, timestamped when the stream starts",
+            )]
         } else {
-            vec![ResourceAddr::Stream(self.src.clone())]
+            vec![]
         }
     }
 
     #[inline]
     fn init(self) -> Result<Box<dyn Action>> {
+        match (self.src.as_os_str().is_empty(), &self.pipeline) {
+            (true, None) => return Err(eyre!("Stream requires either `src` or `pipeline`.")),
+            (false, Some(_)) => {
+                return Err(eyre!(
+                    "Stream cannot have both `src` and `pipeline` (use `{{resource}}` in the \
+                    pipeline to refer to files in the resource directory)."
+                ))
+            }
+            _ => {}
+        }
+
         if let Volume::Value(vol) = self.volume {
             if !(0.0..=1.0).contains(&vol) {
                 return Err(eyre!(
@@ -79,8 +127,7 @@ impl Action for Stream {
         _sync_writer: &QWriter<SyncSignal>,
         _async_writer: &QWriter<AsyncSignal>,
     ) -> Result<Box<dyn StatefulAction>> {
-        let src = ResourceAddr::Stream(self.src.clone());
-        let stream = if let ResourceValue::Stream(stream) = res.fetch(&src)? {
+        let stream = if let ResourceValue::Stream(stream) = res.fetch(&self.source())? {
             stream
         } else {
             return Err(eyre!("Resource value and address types don't match."));
@@ -103,7 +150,14 @@ impl Action for Stream {
 
         let frame = Arc::new(Mutex::new(None));
         let volume = self.volume.or(&config.volume()).value();
-        let mut stream = stream.cloned(frame.clone(), media_mode, volume)?;
+        let output = self.output(config)?;
+        let mut stream = match stream.cloned(frame.clone(), media_mode.clone(), volume, &output) {
+            Err(e) if config.audio_fallback() && output != OutputDevice::Default => {
+                eprintln!("Stream audio device is unavailable, falling back to default: {e:#}");
+                stream.cloned(frame.clone(), media_mode, volume, &OutputDevice::Default)?
+            }
+            result => result?,
+        };
 
         if !stream.has_video() && self.width.is_some() {
             return Err(eyre!(
@@ -165,10 +219,42 @@ impl Action for Stream {
             link_stop: Some(rx_stop),
             join_handle: Some(join_handle),
             background: self.background.into(),
+            pipeline: self.pipeline.clone(),
+            group: self.group.clone(),
         }))
     }
 }
 
+impl Stream {
+    /// Address of the stream resource, either a media file or a custom pipeline description.
+    fn source(&self) -> ResourceAddr {
+        match &self.pipeline {
+            Some(pipeline) => ResourceAddr::Pipeline(pipeline.clone()),
+            None => ResourceAddr::Stream(self.src.clone()),
+        }
+    }
+
+    /// Output that the audio of the stream is played on, from the `audio_devices` of the config.
+    /// Unknown devices are replaced by the default one if `audio_fallback` is set.
+    fn output(&self, config: &Config) -> Result<OutputDevice> {
+        let default = || {
+            config
+                .audio_devices()
+                .get("default")
+                .cloned()
+                .unwrap_or_default()
+        };
+        match self.device.as_deref() {
+            None | Some("default") => Ok(default()),
+            Some(name) => match config.audio_devices().get(name) {
+                Some(output) => Ok(output.clone()),
+                None if config.audio_fallback() => Ok(default()),
+                None => Err(eyre!("Unknown audio device: `{name}`")),
+            },
+        }
+    }
+}
+
 impl StatefulAction for StatefulStream {
     impl_stateful!();
 
@@ -186,9 +272,16 @@ impl StatefulAction for StatefulStream {
     fn start(
         &mut self,
         sync_writer: &mut QWriter<SyncSignal>,
-        _async_writer: &mut QWriter<AsyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
         _state: &State,
     ) -> Result<Signal> {
+        if let Some(pipeline) = self.pipeline.as_ref() {
+            async_writer.push(LoggerSignal::Append(
+                self.group.clone(),
+                ("pipeline".to_owned(), Value::Text(pipeline.clone())),
+            ));
+        }
+
         self.link_start
             .send(())
             .wrap_err("Failed to send start signal to concurrent stream thread.")?;
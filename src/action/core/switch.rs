@@ -34,6 +34,11 @@ stateful!(Switch {
 });
 
 impl Action for Switch {
+    #[inline]
+    fn children(&self) -> Vec<&dyn Action> {
+        vec![self.if_true.as_ref(), self.if_false.as_ref()]
+    }
+
     #[inline]
     fn in_signals(&self) -> BTreeSet<SignalId> {
         let mut signals = BTreeSet::from([self.in_control]);
@@ -71,10 +76,10 @@ impl Action for Switch {
             done: false,
             if_true: self
                 .if_true
-                .stateful(io, res, config, sync_writer, async_writer)?,
+                .routed(io, res, config, sync_writer, async_writer)?,
             if_false: self
                 .if_false
-                .stateful(io, res, config, sync_writer, async_writer)?,
+                .routed(io, res, config, sync_writer, async_writer)?,
             in_control: self.in_control,
             decision: Decision::Temporary(self.default),
         }))
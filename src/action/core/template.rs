@@ -4,10 +4,15 @@ use crate::resource::{IoManager, ResourceManager};
 use crate::server::{AsyncSignal, Config, SyncSignal, ROOT_DIR};
 use eyre::{eyre, Context, Result};
 use serde::{Deserialize, Serialize};
+use std::cell::RefCell;
 use std::collections::BTreeMap;
 use std::fs;
 use std::path::PathBuf;
 
+thread_local! {
+    static FILLING: RefCell<Option<BTreeMap<String, String>>> = RefCell::new(None);
+}
+
 #[derive(Debug, Deserialize, Serialize)]
 #[serde(deny_unknown_fields)]
 pub struct Template {
@@ -16,18 +21,65 @@ pub struct Template {
     params: BTreeMap<String, String>,
 }
 
+impl Template {
+    /// Expands templates deserialized on this thread until the guard is dropped, filling the
+    /// placeholders that their own `params` leave open with `values` (e.g., the block params).
+    /// Outside of it, templates with open placeholders are kept as they are, so they can be
+    /// expanded once the values are known.
+    pub fn filling(values: BTreeMap<String, String>) -> Filling {
+        Filling(FILLING.with(|f| f.borrow_mut().replace(values)))
+    }
+}
+
+/// Guard returned by [`Template::filling`], which restores the previous values when dropped.
+pub struct Filling(Option<BTreeMap<String, String>>);
+
+impl Drop for Filling {
+    fn drop(&mut self) {
+        FILLING.with(|f| *f.borrow_mut() = self.0.take());
+    }
+}
+
+fn fill(text: &str, values: &BTreeMap<String, String>) -> String {
+    let mut text = text.to_owned();
+    for (k, v) in values.iter() {
+        let re = regex::Regex::new(&format!(r"\$\{{{}\}}", regex::escape(k))).unwrap();
+        text = re.replace_all(&text, regex::NoExpand(v)).to_string();
+    }
+    text
+}
+
+fn placeholders(text: &str) -> Vec<&str> {
+    let re = regex::Regex::new(r"\$\{(\w+)\}").unwrap();
+    re.find_iter(text).map(|m| m.as_str()).collect()
+}
+
 impl Action for Template {
     fn init(self) -> Result<Box<dyn Action>> {
         let path = ROOT_DIR.get().unwrap().join(&self.src);
-        let mut inner = fs::read_to_string(&path)
+        let inner = fs::read_to_string(&path)
             .wrap_err_with(|| format!("Failed to read `Template` source: {path:?}"))?;
+        let mut inner = fill(&inner, &self.params);
 
-        for (k, v) in self.params.iter() {
-            let re = regex::Regex::new(&format!(r"\$\{{{k}\}}")).unwrap();
-            inner = re.replace_all(&inner, v).to_string();
+        if !placeholders(&inner).is_empty() {
+            match FILLING.with(|f| f.borrow().clone()) {
+                Some(values) => inner = fill(&inner, &values),
+                None => return Ok(Box::new(self)),
+            }
         }
 
-        ron::from_str::<Box<dyn Action>>(&inner).wrap_err("Failed to deserialize `Template`.")
+        ron::from_str::<Box<dyn Action>>(&inner).wrap_err_with(|| {
+            let unfilled = placeholders(&inner);
+            if unfilled.is_empty() {
+                "Failed to deserialize `Template`.".to_owned()
+            } else {
+                format!(
+                    "Failed to deserialize `Template` with placeholders that have no value in \
+                    its `params` or the block params: {}",
+                    unfilled.join(", ")
+                )
+            }
+        })
     }
 
     #[inline]
@@ -39,6 +91,8 @@ impl Action for Template {
         _sync_writer: &QWriter<SyncSignal>,
         _async_writer: &QWriter<AsyncSignal>,
     ) -> Result<Box<dyn StatefulAction>> {
-        Err(eyre!("Template can not be stateful."))
+        Err(eyre!(
+            "Template can not be stateful (it has not been expanded with the block params)."
+        ))
     }
 }
@@ -0,0 +1,728 @@
+use crate::action::{Action, ActionSignal, Props, StatefulAction, VISUAL};
+use crate::comm::{QWriter, Signal, SignalId};
+use crate::gui::{center_x, header_body_controls, style_ui, text::body, text::button1, Style};
+use crate::resource::{
+    audio_from_samples, AudioSink, Color, IoManager, Key, LogEntry, LoggerSignal, OptionalString,
+    ResourceManager,
+};
+use crate::server::{AsyncSignal, Config, State, SyncSignal};
+use crate::util::spin_sleeper;
+use eframe::egui;
+use eframe::egui::{Color32, CursorIcon, TextEdit};
+use eyre::{eyre, Result};
+use serde::{Deserialize, Serialize};
+use serde_cbor::Value;
+use std::collections::BTreeSet;
+use std::f64::consts::PI;
+use std::thread;
+use std::time::{Duration, Instant};
+
+/// Duration of each of the two markers that bound an `empty` interval.
+const MARKER_DURATION: f64 = 0.05;
+
+/// Duration of the onset/offset ramps of a `tone` interval.
+const RAMP_DURATION: f64 = 0.005;
+
+const SAMPLE_RATE: u32 = 44100;
+
+#[derive(Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct TimeReproduction {
+    #[serde(default)]
+    durations: Vec<f32>,
+    #[serde(default)]
+    in_duration: SignalId,
+    #[serde(default)]
+    variant: Variant,
+    #[serde(default)]
+    response: Response,
+    #[serde(default)]
+    stimulus: Stimulus,
+    #[serde(default = "defaults::key")]
+    key: Key,
+    #[serde(default = "defaults::gap")]
+    gap: f32,
+    #[serde(default = "defaults::frequency")]
+    frequency: f64,
+    #[serde(default)]
+    device: Option<String>,
+    #[serde(default = "defaults::color")]
+    color: Color,
+    #[serde(default = "defaults::group")]
+    group: OptionalString,
+    #[serde(default)]
+    out_produced: SignalId,
+    #[serde(default)]
+    out_ratio: SignalId,
+}
+
+/// What the participant does with the standard interval: reproduce it after it is presented,
+/// produce it from its value alone (nothing is presented), or verbally estimate its length.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Variant {
+    Reproduction,
+    Production,
+    Estimation,
+}
+
+/// How an interval is produced: by holding the response key down, or by pressing it once to
+/// start and once more to stop.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Response {
+    Hold,
+    Press,
+}
+
+/// How the standard interval is presented: a filled tone, a filled visual disc, or an empty
+/// interval bounded by two brief flashes of the disc.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Stimulus {
+    Tone,
+    Visual,
+    Empty,
+}
+
+impl Default for Variant {
+    #[inline(always)]
+    fn default() -> Self {
+        Variant::Reproduction
+    }
+}
+
+impl Default for Response {
+    #[inline(always)]
+    fn default() -> Self {
+        Response::Hold
+    }
+}
+
+impl Default for Stimulus {
+    #[inline(always)]
+    fn default() -> Self {
+        Stimulus::Visual
+    }
+}
+
+#[derive(Debug, Clone, Copy)]
+enum Phase {
+    Standard(Instant, Instant),
+    Gap(Instant),
+    Respond,
+    Timing(Instant),
+}
+
+stateful!(TimeReproduction {
+    standards: Vec<Duration>,
+    in_duration: SignalId,
+    variant: Variant,
+    response: Response,
+    stimulus: Stimulus,
+    key: Key,
+    gap: Duration,
+    frequency: f64,
+    volume: f32,
+    color: Color32,
+    config: Config,
+    sink: Option<AudioSink>,
+    group: Option<String>,
+    out_produced: SignalId,
+    out_ratio: SignalId,
+    trial: usize,
+    standard: Duration,
+    phase: Phase,
+    key_down: bool,
+    estimate: String,
+});
+
+mod defaults {
+    use crate::resource::{Color, Key, OptionalString};
+
+    #[inline(always)]
+    pub fn key() -> Key {
+        Key::Space
+    }
+
+    #[inline(always)]
+    pub fn gap() -> f32 {
+        0.5
+    }
+
+    #[inline(always)]
+    pub fn frequency() -> f64 {
+        1000.0
+    }
+
+    #[inline(always)]
+    pub fn color() -> Color {
+        Color::White
+    }
+
+    #[inline(always)]
+    pub fn group() -> OptionalString {
+        OptionalString::Some("time_reproduction".to_owned())
+    }
+}
+
+impl Action for TimeReproduction {
+    #[inline(always)]
+    fn in_signals(&self) -> BTreeSet<SignalId> {
+        BTreeSet::from([self.in_duration])
+    }
+
+    #[inline(always)]
+    fn out_signals(&self) -> BTreeSet<SignalId> {
+        BTreeSet::from([self.out_produced, self.out_ratio])
+    }
+
+    #[inline(always)]
+    fn in_keys(&self) -> bool {
+        true
+    }
+
+    fn init(self) -> Result<Box<dyn Action>>
+    where
+        Self: 'static + Sized,
+    {
+        match (self.durations.is_empty(), self.in_duration) {
+            (true, 0) => Err(eyre!(
+                "TimeReproduction requires either a list of `durations` or an `in_duration`."
+            )),
+            (false, id) if id > 0 => Err(eyre!(
+                "Only one of `durations` and `in_duration` should be set for TimeReproduction."
+            )),
+            _ if self.durations.iter().any(|d| *d <= 0.0) => {
+                Err(eyre!("TimeReproduction `durations` should be positive."))
+            }
+            _ if self.gap < 0.0 => Err(eyre!("TimeReproduction `gap` cannot be negative.")),
+            _ => Ok(Box::new(self)),
+        }
+    }
+
+    fn log_entries(&self) -> Vec<LogEntry> {
+        if let OptionalString::Some(group) = &self.group {
+            vec![
+                LogEntry::new(
+                    group,
+                    "event",
+                    "text",
+                    "",
+                    "Marks the `start` and `stop` of the action",
+                ),
+                LogEntry::new(
+                    group,
+                    "standard",
+                    "float",
+                    "s",
+                    "Standard interval of a trial, timestamped when its presentation starts",
+                ),
+                LogEntry::new(
+                    group,
+                    "standard_end",
+                    "float",
+                    "s",
+                    "Standard interval of a trial, timestamped when its presentation ends",
+                ),
+                LogEntry::new(
+                    group,
+                    "press",
+                    "integer",
+                    "",
+                    "Trial index, timestamped when the response key was pressed",
+                ),
+                LogEntry::new(
+                    group,
+                    "release",
+                    "integer",
+                    "",
+                    "Trial index, timestamped when the response key was released",
+                ),
+                LogEntry::new(
+                    group,
+                    "produced",
+                    "float",
+                    "s",
+                    "Reproduced, produced, or verbally estimated duration",
+                ),
+                LogEntry::new(
+                    group,
+                    "ratio",
+                    "float",
+                    "",
+                    "Ratio of the produced duration to the standard",
+                ),
+            ]
+        } else {
+            vec![]
+        }
+    }
+
+    fn stateful(
+        &self,
+        io: &IoManager,
+        _res: &ResourceManager,
+        config: &Config,
+        _sync_writer: &QWriter<SyncSignal>,
+        _async_writer: &QWriter<AsyncSignal>,
+    ) -> Result<Box<dyn StatefulAction>> {
+        let sink = if self.stimulus == Stimulus::Tone && self.variant != Variant::Production {
+            Some(io.audio_on(self.device.as_deref())?)
+        } else {
+            None
+        };
+
+        let group = match &self.group {
+            OptionalString::Some(s) => Some(s.clone()),
+            OptionalString::None => None,
+        };
+
+        Ok(Box::new(StatefulTimeReproduction {
+            done: false,
+            standards: self
+                .durations
+                .iter()
+                .map(|d| Duration::from_secs_f32(*d))
+                .collect(),
+            in_duration: self.in_duration,
+            variant: self.variant,
+            response: self.response,
+            stimulus: self.stimulus,
+            key: self.key,
+            gap: Duration::from_secs_f32(self.gap),
+            frequency: self.frequency,
+            volume: config.volume().value(),
+            color: self.color.into(),
+            config: config.clone(),
+            sink,
+            group,
+            out_produced: self.out_produced,
+            out_ratio: self.out_ratio,
+            trial: 0,
+            standard: Duration::default(),
+            phase: Phase::Respond,
+            key_down: false,
+            estimate: String::new(),
+        }))
+    }
+}
+
+impl StatefulAction for StatefulTimeReproduction {
+    impl_stateful!();
+
+    #[inline(always)]
+    fn props(&self) -> Props {
+        VISUAL.into()
+    }
+
+    fn start(
+        &mut self,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        state: &State,
+    ) -> Result<Signal> {
+        if self.standards.is_empty() {
+            let duration = match state.get(&self.in_duration) {
+                Some(Value::Float(v)) => *v,
+                Some(Value::Integer(v)) => *v as f64,
+                v => {
+                    return Err(eyre!(
+                        "Invalid standard duration for TimeReproduction: {v:?}"
+                    ))
+                }
+            };
+            if duration <= 0.0 {
+                return Err(eyre!(
+                    "Standard duration for TimeReproduction should be positive: {duration}"
+                ));
+            }
+            self.standards.push(Duration::from_secs_f64(duration));
+        }
+
+        if let Some(group) = &self.group {
+            async_writer.push(LoggerSignal::Append(
+                group.clone(),
+                ("event".to_owned(), Value::Text("start".to_owned())),
+            ));
+        }
+
+        self.begin_trial(sync_writer, async_writer)?;
+        Ok(Signal::none())
+    }
+
+    fn update(
+        &mut self,
+        signal: &ActionSignal,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        _state: &State,
+    ) -> Result<Signal> {
+        let (phase, response) = (self.phase, self.response);
+        let repeated = is_repeat(&mut self.key_down, self.key, signal);
+        match (signal, phase) {
+            (ActionSignal::UpdateGraph, _) => {
+                self.advance(sync_writer, async_writer);
+                Ok(Signal::none())
+            }
+            _ if self.variant == Variant::Estimation => Ok(Signal::none()),
+            _ if repeated => Ok(Signal::none()),
+            (ActionSignal::KeyPress(t, keys), Phase::Respond) if keys.contains(&self.key) => {
+                self.log_key(async_writer, *t, "press");
+                self.phase = Phase::Timing(*t);
+                Ok(Signal::none())
+            }
+            (ActionSignal::KeyPress(t, keys), Phase::Timing(since))
+                if response == Response::Press && keys.contains(&self.key) =>
+            {
+                self.log_key(async_writer, *t, "press");
+                self.finish_trial(
+                    t.duration_since(since).as_secs_f64(),
+                    sync_writer,
+                    async_writer,
+                )
+            }
+            (ActionSignal::KeyRelease(t, keys), Phase::Timing(since))
+                if response == Response::Hold && keys.contains(&self.key) =>
+            {
+                self.log_key(async_writer, *t, "release");
+                self.finish_trial(
+                    t.duration_since(since).as_secs_f64(),
+                    sync_writer,
+                    async_writer,
+                )
+            }
+            _ => Ok(Signal::none()),
+        }
+    }
+
+    fn show(
+        &mut self,
+        ui: &mut egui::Ui,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        _state: &State,
+    ) -> Result<()> {
+        ui.output().cursor_icon = CursorIcon::None;
+
+        match self.phase {
+            Phase::Standard(onset, end) => {
+                let now = Instant::now();
+                let marker = Duration::from_secs_f64(MARKER_DURATION);
+                let visible = match self.stimulus {
+                    Stimulus::Tone => false,
+                    Stimulus::Visual => true,
+                    Stimulus::Empty => now < onset + marker || now + marker >= end,
+                };
+                if visible {
+                    let center = ui.max_rect().center();
+                    ui.painter().circle_filled(center, 60.0, self.color);
+                }
+            }
+            Phase::Gap(_) => {}
+            Phase::Respond | Phase::Timing(_) => match self.variant {
+                Variant::Estimation => {
+                    ui.output().cursor_icon = CursorIcon::Default;
+                    self.show_estimation(ui, sync_writer, async_writer)?;
+                }
+                Variant::Production => {
+                    ui.centered_and_justified(|ui| {
+                        ui.heading(format!(
+                            "Produce {:.2} seconds",
+                            self.standard.as_secs_f64()
+                        ))
+                    });
+                }
+                Variant::Reproduction => {
+                    ui.centered_and_justified(|ui| ui.heading("Reproduce the interval"));
+                }
+            },
+        }
+
+        Ok(())
+    }
+
+    fn stop(
+        &mut self,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        _state: &State,
+    ) -> Result<Signal> {
+        if let Some(sink) = self.sink.as_mut() {
+            sink.stop()?;
+        }
+
+        if let Some(group) = &self.group {
+            async_writer.push(LoggerSignal::Append(
+                group.clone(),
+                ("event".to_owned(), Value::Text("stop".to_owned())),
+            ));
+        }
+
+        sync_writer.push(SyncSignal::Repaint);
+        Ok(Signal::none())
+    }
+
+    fn debug(&self) -> Vec<(&str, String)> {
+        <dyn StatefulAction>::debug(self)
+            .into_iter()
+            .chain([
+                ("variant", format!("{:?}", self.variant)),
+                ("trial", format!("{:?}", self.trial)),
+                ("phase", format!("{:?}", self.phase)),
+            ])
+            .collect()
+    }
+}
+
+impl StatefulTimeReproduction {
+    fn begin_trial(
+        &mut self,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+    ) -> Result<()> {
+        self.standard = self.standards[self.trial];
+        self.estimate.clear();
+        self.log(
+            async_writer,
+            Instant::now(),
+            "standard",
+            self.standard_value(),
+        );
+
+        if self.variant == Variant::Production {
+            self.phase = Phase::Respond;
+            sync_writer.push(SyncSignal::Repaint);
+            return Ok(());
+        }
+
+        if let Some(sink) = self.sink.as_mut() {
+            let len = (self.standard.as_secs_f64() * SAMPLE_RATE as f64) as usize;
+            let ramp = (RAMP_DURATION * SAMPLE_RATE as f64) as usize;
+            let samples = (0..len)
+                .map(|i| {
+                    let t = i as f64 / SAMPLE_RATE as f64;
+                    let envelope = (i.min(len - i) as f64 / ramp as f64).min(1.0);
+                    let value = envelope * (2.0 * PI * self.frequency * t).sin();
+                    (value * i16::MAX as f64) as i16
+                })
+                .collect();
+            let buffer = audio_from_samples(1, SAMPLE_RATE, samples, &self.config)?;
+            sink.set_volume(self.volume)?;
+            sink.queue(buffer)?;
+            sink.play()?;
+        }
+
+        let onset = Instant::now();
+        let end = onset + self.standard;
+        self.phase = Phase::Standard(onset, end);
+
+        let mut wakeups = vec![end];
+        if self.stimulus == Stimulus::Empty {
+            let marker = Duration::from_secs_f64(MARKER_DURATION).min(self.standard / 2);
+            wakeups.insert(0, onset + marker);
+            wakeups.insert(1, end - marker);
+        }
+        schedule(sync_writer, wakeups);
+        sync_writer.push(SyncSignal::Repaint);
+        Ok(())
+    }
+
+    /// Moves past the presentation of the standard and the gap that follows it, once they are over.
+    fn advance(
+        &mut self,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+    ) {
+        let now = Instant::now();
+        if let Phase::Standard(_, end) = self.phase {
+            if now < end {
+                return;
+            }
+            self.log(async_writer, end, "standard_end", self.standard_value());
+            self.phase = Phase::Gap(end + self.gap);
+            schedule(sync_writer, vec![end + self.gap]);
+        }
+
+        if let Phase::Gap(end) = self.phase {
+            if now >= end {
+                self.phase = Phase::Respond;
+                sync_writer.push(SyncSignal::Repaint);
+            }
+        }
+    }
+
+    fn finish_trial(
+        &mut self,
+        produced: f64,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+    ) -> Result<Signal> {
+        let ratio = produced / self.standard.as_secs_f64();
+        if let Some(group) = &self.group {
+            async_writer.push(LoggerSignal::Extend(
+                group.clone(),
+                vec![
+                    ("produced".to_owned(), Value::Float(produced)),
+                    ("ratio".to_owned(), Value::Float(ratio)),
+                ],
+            ));
+        }
+
+        let mut news = vec![];
+        if self.out_produced > 0 {
+            news.push((self.out_produced, Value::Float(produced)));
+        }
+        if self.out_ratio > 0 {
+            news.push((self.out_ratio, Value::Float(ratio)));
+        }
+
+        self.trial += 1;
+        if self.trial < self.standards.len() {
+            self.begin_trial(sync_writer, async_writer)?;
+        } else {
+            self.done = true;
+            sync_writer.push(SyncSignal::UpdateGraph);
+        }
+        Ok(news.into())
+    }
+
+    fn show_estimation(
+        &mut self,
+        ui: &mut egui::Ui,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+    ) -> Result<()> {
+        enum Interaction {
+            None,
+            Submit(f64),
+        }
+
+        let mut interaction = Interaction::None;
+        let estimate = self
+            .estimate
+            .trim()
+            .parse::<f64>()
+            .ok()
+            .filter(|v| *v > 0.0);
+
+        header_body_controls(ui, |strip| {
+            strip.cell(|ui| {
+                ui.centered_and_justified(|ui| ui.heading("How long was the interval?"));
+            });
+            strip.empty();
+            strip.strip(|builder| {
+                center_x(builder, 300.0, |ui| {
+                    ui.horizontal_centered(|ui| {
+                        let response = ui.add(
+                            TextEdit::singleline(&mut self.estimate)
+                                .hint_text("Seconds")
+                                .desired_width(200.0),
+                        );
+                        response.request_focus();
+                        ui.label(body("s"));
+                        if let (Some(v), true) =
+                            (estimate, ui.input().key_pressed(egui::Key::Enter))
+                        {
+                            interaction = Interaction::Submit(v);
+                        }
+                    });
+                });
+            });
+            strip.empty();
+            strip.strip(|builder| {
+                center_x(builder, 200.0, |ui| {
+                    ui.horizontal_centered(|ui| {
+                        style_ui(ui, Style::SubmitButton);
+                        if ui
+                            .add_enabled(estimate.is_some(), egui::Button::new(button1("Submit")))
+                            .clicked()
+                        {
+                            interaction = Interaction::Submit(estimate.unwrap());
+                        }
+                    });
+                });
+            });
+        });
+
+        match interaction {
+            Interaction::None => {}
+            Interaction::Submit(v) => {
+                let news = self.finish_trial(v, sync_writer, async_writer)?;
+                if !news.is_empty() {
+                    sync_writer.push(SyncSignal::Emit(Instant::now(), news));
+                }
+            }
+        }
+        Ok(())
+    }
+
+    #[inline(always)]
+    fn standard_value(&self) -> Value {
+        Value::Float(self.standard.as_secs_f64())
+    }
+
+    fn log_key(&self, async_writer: &mut QWriter<AsyncSignal>, time: Instant, name: &str) {
+        self.log(async_writer, time, name, Value::Integer(self.trial as i128));
+    }
+
+    fn log(
+        &self,
+        async_writer: &mut QWriter<AsyncSignal>,
+        time: Instant,
+        name: &str,
+        value: Value,
+    ) {
+        if let Some(group) = &self.group {
+            async_writer.push(AsyncSignal::Logger(
+                time,
+                LoggerSignal::Append(group.clone(), (name.to_owned(), value)),
+            ));
+        }
+    }
+}
+
+/// Wakes the action up (through `UpdateGraph`) and repaints at each of the given times.
+fn schedule(sync_writer: &QWriter<SyncSignal>, times: Vec<Instant>) {
+    let mut sync_writer = sync_writer.clone();
+    thread::spawn(move || {
+        for time in times {
+            spin_sleeper().sleep(time.saturating_duration_since(Instant::now()));
+            sync_writer.push(SyncSignal::UpdateGraph);
+            sync_writer.push(SyncSignal::Repaint);
+        }
+    });
+}
+
+/// Tracks whether the response key is held down, and returns whether `signal` is a press of the
+/// key that is only repeated by the OS while it is held (i.e., no release came in between).
+fn is_repeat(key_down: &mut bool, key: Key, signal: &ActionSignal) -> bool {
+    match signal {
+        ActionSignal::KeyPress(_, keys) if keys.contains(&key) => std::mem::replace(key_down, true),
+        ActionSignal::KeyRelease(_, keys) if keys.contains(&key) => {
+            *key_down = false;
+            false
+        }
+        _ => false,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn held_key_presses_are_repeats() {
+        let (now, mut down) = (Instant::now(), false);
+        let press = ActionSignal::KeyPress(now, BTreeSet::from([Key::Space]));
+        let release = ActionSignal::KeyRelease(now, BTreeSet::from([Key::Space]));
+        let other = ActionSignal::KeyPress(now, BTreeSet::from([Key::Enter]));
+
+        assert!(!is_repeat(&mut down, Key::Space, &press));
+        assert!(is_repeat(&mut down, Key::Space, &press));
+        assert!(!is_repeat(&mut down, Key::Space, &other));
+        assert!(is_repeat(&mut down, Key::Space, &press));
+        assert!(!is_repeat(&mut down, Key::Space, &release));
+        assert!(!is_repeat(&mut down, Key::Space, &press));
+    }
+}
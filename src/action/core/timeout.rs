@@ -21,6 +21,11 @@ stateful!(Timeout {
 });
 
 impl Action for Timeout {
+    #[inline]
+    fn children(&self) -> Vec<&dyn Action> {
+        vec![self.1.as_ref()]
+    }
+
     #[inline]
     fn in_signals(&self) -> BTreeSet<SignalId> {
         self.1.in_signals()
@@ -44,9 +49,7 @@ impl Action for Timeout {
         sync_writer: &QWriter<SyncSignal>,
         async_writer: &QWriter<AsyncSignal>,
     ) -> Result<Box<dyn StatefulAction>> {
-        let inner = self
-            .1
-            .stateful(io, res, config, sync_writer, async_writer)?;
+        let inner = self.1.routed(io, res, config, sync_writer, async_writer)?;
 
         Ok(Box::new(StatefulTimeout {
             done: inner.is_over()?,
@@ -1,6 +1,6 @@
 use crate::action::{Action, Props, StatefulAction, INFINITE};
 use crate::comm::{QWriter, Signal, SignalId};
-use crate::resource::{IoManager, LoggerSignal, ResourceManager};
+use crate::resource::{IoManager, LogEntry, LoggerSignal, ResourceManager};
 use crate::server::{AsyncSignal, Config, State, SyncSignal};
 use eyre::{eyre, Error, Result};
 use serde::{Deserialize, Serialize};
@@ -41,6 +41,21 @@ impl Action for Timer {
         }
     }
 
+    #[inline]
+    fn log_entries(&self) -> Vec<LogEntry> {
+        if self.name.is_empty() {
+            vec![]
+        } else {
+            vec![LogEntry::new(
+                "timer",
+                &self.name,
+                "text",
+                "",
+                "Time elapsed between the start and stop of the timer (formatted duration)",
+            )]
+        }
+    }
+
     #[inline(always)]
     fn stateful(
         &self,
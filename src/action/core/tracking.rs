@@ -0,0 +1,1030 @@
+use crate::action::{Action, ActionSignal, Props, StatefulAction, VISUAL};
+use crate::comm::{QWriter, Signal, SignalId};
+use crate::launcher::template::Rng;
+use crate::resource::{
+    Color, IoManager, Key, LogEntry, LoggerSignal, OptionalString, ResourceAddr, ResourceManager,
+    ResourceValue,
+};
+use crate::server::{AsyncSignal, Config, State, SyncSignal};
+use eframe::egui;
+use eframe::egui::{Color32, CursorIcon, Pos2, Rect, Sense, Stroke, TextureId, Vec2};
+use eyre::{eyre, Result};
+use serde::{Deserialize, Serialize};
+use serde_cbor::Value;
+use std::collections::BTreeSet;
+use std::f32::consts::PI;
+use std::path::PathBuf;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+/// Attempts at placing an object away from the others before it is placed anywhere.
+const MAX_PLACEMENTS: usize = 1000;
+
+/// Width of the ring that marks targets, probes, and selected objects, relative to their radius.
+const RING_WIDTH: f32 = 0.2;
+
+#[derive(Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Tracking {
+    objects: usize,
+    targets: usize,
+    #[serde(default)]
+    motion: Motion,
+    #[serde(default = "defaults::speed")]
+    speed: f32,
+    #[serde(default = "defaults::size")]
+    size: f32,
+    #[serde(default = "defaults::region")]
+    region: (f32, f32, f32, f32),
+    #[serde(default = "defaults::collisions")]
+    collisions: bool,
+    #[serde(default = "defaults::cue")]
+    cue: f32,
+    #[serde(default = "defaults::duration")]
+    duration: f32,
+    #[serde(default)]
+    response: Response,
+    #[serde(default = "defaults::yes_key")]
+    yes_key: Key,
+    #[serde(default = "defaults::no_key")]
+    no_key: Key,
+    #[serde(default)]
+    src: Option<PathBuf>,
+    #[serde(default = "defaults::color")]
+    color: Color,
+    #[serde(default = "defaults::highlight")]
+    highlight: Color,
+    #[serde(default)]
+    background: Color,
+    #[serde(default)]
+    seed: Option<u64>,
+    #[serde(default = "defaults::group")]
+    group: OptionalString,
+    #[serde(default)]
+    out_accuracy: SignalId,
+    #[serde(default)]
+    out_error: SignalId,
+}
+
+/// How objects move during tracking: in straight lines at constant speed, bouncing off the edges
+/// of the region (and each other, with `collisions`), additionally turning at random by up to the
+/// given rate (radians per second), or along fixed paths of waypoints (one per object, as
+/// fractions of the region) that they follow at constant speed and stop at the end of.
+#[derive(Debug, Clone, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Motion {
+    Bounce,
+    Wander(f32),
+    Paths(Vec<Vec<(f32, f32)>>),
+}
+
+/// How tracking is probed once the objects stop: by clicking on the objects that were marked as
+/// targets, by answering whether a single highlighted object was one of them (`yes_key` or
+/// `no_key`), or (with a single target) by clicking where the target is after all objects
+/// disappear while they keep moving, as in motion extrapolation.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Response {
+    Select,
+    Probe,
+    Locate,
+}
+
+impl Default for Motion {
+    #[inline(always)]
+    fn default() -> Self {
+        Motion::Bounce
+    }
+}
+
+impl Default for Response {
+    #[inline(always)]
+    fn default() -> Self {
+        Response::Select
+    }
+}
+
+#[derive(Debug, Clone, Copy)]
+enum Phase {
+    Cue(Instant),
+    Track(Instant),
+    Respond(Instant),
+}
+
+#[derive(Debug, Clone, Copy)]
+struct Object {
+    pos: Vec2,
+    vel: Vec2,
+    waypoint: usize,
+}
+
+stateful!(Tracking {
+    count: usize,
+    targets: BTreeSet<usize>,
+    n_targets: usize,
+    motion: Motion,
+    speed: f32,
+    size: f32,
+    region: (f32, f32, f32, f32),
+    collisions: bool,
+    cue: Duration,
+    duration: Duration,
+    response: Response,
+    yes_key: Key,
+    no_key: Key,
+    texture: Option<TextureId>,
+    color: Color32,
+    highlight: Color32,
+    background: Color32,
+    seed: u64,
+    rng: Rng,
+    group: Option<String>,
+    out_accuracy: SignalId,
+    out_error: SignalId,
+    objects: Vec<Object>,
+    area: Vec2,
+    phase: Phase,
+    last_frame: Option<Instant>,
+    selected: BTreeSet<usize>,
+    probe: Option<usize>,
+});
+
+mod defaults {
+    use crate::resource::{Color, Key, OptionalString};
+
+    #[inline(always)]
+    pub fn speed() -> f32 {
+        0.3
+    }
+
+    #[inline(always)]
+    pub fn size() -> f32 {
+        0.06
+    }
+
+    #[inline(always)]
+    pub fn region() -> (f32, f32, f32, f32) {
+        (0.0, 0.0, 1.0, 1.0)
+    }
+
+    #[inline(always)]
+    pub fn collisions() -> bool {
+        true
+    }
+
+    #[inline(always)]
+    pub fn cue() -> f32 {
+        2.0
+    }
+
+    #[inline(always)]
+    pub fn duration() -> f32 {
+        6.0
+    }
+
+    #[inline(always)]
+    pub fn yes_key() -> Key {
+        Key::J
+    }
+
+    #[inline(always)]
+    pub fn no_key() -> Key {
+        Key::F
+    }
+
+    #[inline(always)]
+    pub fn color() -> Color {
+        Color::Black
+    }
+
+    #[inline(always)]
+    pub fn highlight() -> Color {
+        Color::Red
+    }
+
+    #[inline(always)]
+    pub fn group() -> OptionalString {
+        OptionalString::Some("tracking".to_owned())
+    }
+}
+
+impl Action for Tracking {
+    #[inline(always)]
+    fn out_signals(&self) -> BTreeSet<SignalId> {
+        BTreeSet::from([self.out_accuracy, self.out_error])
+    }
+
+    #[inline(always)]
+    fn in_keys(&self) -> bool {
+        self.response == Response::Probe
+    }
+
+    #[inline]
+    fn resources(&self, _config: &Config) -> Vec<ResourceAddr> {
+        match &self.src {
+            Some(src) => vec![ResourceAddr::Image(src.clone())],
+            None => vec![],
+        }
+    }
+
+    fn init(self) -> Result<Box<dyn Action>>
+    where
+        Self: 'static + Sized,
+    {
+        let (x, y, w, h) = self.region;
+        if self.objects == 0 || self.targets == 0 || self.targets > self.objects {
+            Err(eyre!(
+                "Tracking requires at least one object and between 1 and `objects` targets."
+            ))
+        } else if self.response == Response::Locate && self.targets != 1 {
+            Err(eyre!(
+                "Tracking with `response: locate` requires a single target."
+            ))
+        } else if self.response == Response::Probe && self.targets == self.objects {
+            Err(eyre!(
+                "Tracking with `response: probe` requires some non-target objects."
+            ))
+        } else if self.speed < 0.0 || self.size <= 0.0 || self.cue < 0.0 || self.duration < 0.0 {
+            Err(eyre!(
+                "Tracking `size` should be positive, and `speed`, `cue`, and `duration` cannot be \
+                negative."
+            ))
+        } else if x < 0.0 || y < 0.0 || w <= 0.0 || h <= 0.0 || x + w > 1.0 || y + h > 1.0 {
+            Err(eyre!(
+                "Tracking `region` should lie within the area of the action: {:?}",
+                self.region
+            ))
+        } else if matches!(&self.motion, Motion::Paths(p) if p.len() != self.objects) {
+            Err(eyre!("Tracking requires one path per object."))
+        } else if matches!(&self.motion, Motion::Paths(p) if p.iter().any(|p| p.is_empty())) {
+            Err(eyre!("Tracking paths should have at least one waypoint."))
+        } else {
+            Ok(Box::new(self))
+        }
+    }
+
+    fn log_entries(&self) -> Vec<LogEntry> {
+        if let OptionalString::Some(group) = &self.group {
+            vec![
+                LogEntry::new(
+                    group,
+                    "event",
+                    "text",
+                    "",
+                    "Marks the `start` and `stop` of the action",
+                ),
+                LogEntry::new(group, "seed", "integer", "", "Seed of the random placement"),
+                LogEntry::new(group, "targets", "[integer]", "", "Indices of the targets"),
+                LogEntry::new(
+                    group,
+                    "phase",
+                    "text",
+                    "",
+                    "Start of the `cue`, `track`, or `respond` phase",
+                ),
+                LogEntry::new(
+                    group,
+                    "positions",
+                    "[[float, float]]",
+                    "",
+                    "Position of each object (as fractions of the region) in the current frame",
+                ),
+                LogEntry::new(group, "selected", "integer", "", "Object clicked on"),
+                LogEntry::new(
+                    group,
+                    "probe",
+                    "[integer, bool]",
+                    "",
+                    "Probed object and whether it is a target",
+                ),
+                LogEntry::new(
+                    group,
+                    "response",
+                    "bool",
+                    "",
+                    "Answer to the probe (yes/no)",
+                ),
+                LogEntry::new(
+                    group,
+                    "located",
+                    "[float, float]",
+                    "",
+                    "Clicked location (as fractions of the region)",
+                ),
+                LogEntry::new(
+                    group,
+                    "error",
+                    "float",
+                    "",
+                    "Distance of the clicked location from the target (in region heights)",
+                ),
+                LogEntry::new(
+                    group,
+                    "accuracy",
+                    "float",
+                    "",
+                    "Fraction of targets selected, or correctness of the probe answer",
+                ),
+                LogEntry::new(
+                    group,
+                    "rt",
+                    "float",
+                    "s",
+                    "Time from the start of the response phase to the end of the response",
+                ),
+            ]
+        } else {
+            vec![]
+        }
+    }
+
+    fn stateful(
+        &self,
+        _io: &IoManager,
+        res: &ResourceManager,
+        _config: &Config,
+        _sync_writer: &QWriter<SyncSignal>,
+        _async_writer: &QWriter<AsyncSignal>,
+    ) -> Result<Box<dyn StatefulAction>> {
+        let texture = match &self.src {
+            Some(src) => match res.fetch(&ResourceAddr::Image(src.clone()))? {
+                ResourceValue::Image(texture, _) => Some(texture),
+                _ => return Err(eyre!("Resource value and address types don't match.")),
+            },
+            None => None,
+        };
+
+        Ok(Box::new(self.state(texture)))
+    }
+}
+
+impl Tracking {
+    fn state(&self, texture: Option<TextureId>) -> StatefulTracking {
+        let seed = self.seed.unwrap_or_else(|| {
+            SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .map_or(1, |t| t.as_nanos() as u64)
+        });
+
+        let group = match &self.group {
+            OptionalString::Some(s) => Some(s.clone()),
+            OptionalString::None => None,
+        };
+
+        StatefulTracking {
+            done: false,
+            count: self.objects,
+            targets: BTreeSet::new(),
+            n_targets: self.targets,
+            motion: self.motion.clone(),
+            speed: self.speed,
+            size: self.size,
+            region: self.region,
+            collisions: self.collisions,
+            cue: Duration::from_secs_f32(self.cue),
+            duration: Duration::from_secs_f32(self.duration),
+            response: self.response,
+            yes_key: self.yes_key,
+            no_key: self.no_key,
+            texture,
+            color: self.color.into(),
+            highlight: self.highlight.into(),
+            background: self.background.into(),
+            seed,
+            rng: Rng::new(seed),
+            group,
+            out_accuracy: self.out_accuracy,
+            out_error: self.out_error,
+            objects: vec![],
+            area: Vec2::ZERO,
+            phase: Phase::Cue(Instant::now()),
+            last_frame: None,
+            selected: BTreeSet::new(),
+            probe: None,
+        }
+    }
+}
+
+impl StatefulAction for StatefulTracking {
+    impl_stateful!();
+
+    #[inline(always)]
+    fn props(&self) -> Props {
+        VISUAL.into()
+    }
+
+    fn start(
+        &mut self,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        _state: &State,
+    ) -> Result<Signal> {
+        let mut order: Vec<_> = (0..self.count).collect();
+        self.rng.shuffle(&mut order);
+        self.targets = order.into_iter().take(self.n_targets).collect();
+
+        let now = Instant::now();
+        self.phase = Phase::Cue(now + self.cue);
+        if let Some(group) = &self.group {
+            async_writer.push(LoggerSignal::Extend(
+                group.clone(),
+                vec![
+                    ("event".to_owned(), Value::Text("start".to_owned())),
+                    ("seed".to_owned(), Value::Integer(self.seed as i128)),
+                    (
+                        "targets".to_owned(),
+                        Value::Array(
+                            self.targets
+                                .iter()
+                                .map(|i| Value::Integer(*i as i128))
+                                .collect(),
+                        ),
+                    ),
+                ],
+            ));
+        }
+        self.log(async_writer, now, "phase", Value::Text("cue".to_owned()));
+
+        sync_writer.push(SyncSignal::Repaint);
+        Ok(Signal::none())
+    }
+
+    fn update(
+        &mut self,
+        signal: &ActionSignal,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        _state: &State,
+    ) -> Result<Signal> {
+        let (time, keys) = match (signal, self.phase, self.probe) {
+            (ActionSignal::KeyPress(t, keys), Phase::Respond(_), Some(_)) if !self.done => {
+                (*t, keys)
+            }
+            _ => return Ok(Signal::none()),
+        };
+
+        let answer = if keys.contains(&self.yes_key) {
+            true
+        } else if keys.contains(&self.no_key) {
+            false
+        } else {
+            return Ok(Signal::none());
+        };
+
+        let probe = self.probe.unwrap();
+        self.log(async_writer, time, "response", Value::Bool(answer));
+        let correct = answer == self.targets.contains(&probe);
+        Ok(self.finish(
+            time,
+            if correct { 1.0 } else { 0.0 },
+            None,
+            sync_writer,
+            async_writer,
+        ))
+    }
+
+    fn show(
+        &mut self,
+        ui: &mut egui::Ui,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        _state: &State,
+    ) -> Result<()> {
+        ui.ctx().request_repaint();
+
+        let max_rect = ui.max_rect();
+        ui.painter().rect_filled(max_rect, 0.0, self.background);
+        let (x, y, w, h) = self.region;
+        let rect = Rect::from_min_size(
+            max_rect.min + Vec2::new(x * max_rect.width(), y * max_rect.height()),
+            Vec2::new(w * max_rect.width(), h * max_rect.height()),
+        );
+        if self.objects.is_empty() {
+            self.place(rect.size());
+        }
+
+        let now = Instant::now();
+        let dt = self
+            .last_frame
+            .map_or(0.0, |t| now.duration_since(t).as_secs_f32());
+        self.last_frame = Some(now);
+        self.advance(now, async_writer);
+        if !matches!(self.phase, Phase::Cue(_)) && !self.done {
+            self.step(dt);
+        }
+
+        let positions = self
+            .objects
+            .iter()
+            .map(|o| {
+                Value::Array(vec![
+                    Value::Float((o.pos.x / self.area.x) as f64),
+                    Value::Float((o.pos.y / self.area.y) as f64),
+                ])
+            })
+            .collect();
+        self.log(async_writer, now, "positions", Value::Array(positions));
+
+        let respond = matches!(self.phase, Phase::Respond(_)) && !self.done;
+        ui.output().cursor_icon = if respond && self.response != Response::Probe {
+            CursorIcon::Default
+        } else {
+            CursorIcon::None
+        };
+
+        if !(respond && self.response == Response::Locate) {
+            self.draw(ui, rect);
+        }
+
+        if respond && self.response != Response::Probe {
+            let response = ui.interact(rect, ui.id().with("tracking"), Sense::click());
+            if let Some(pos) = response
+                .clicked()
+                .then(|| response.interact_pointer_pos())
+                .flatten()
+            {
+                let pos = (pos - rect.min) * self.scale(rect);
+                let news = self.click(now, pos, sync_writer, async_writer);
+                if !news.is_empty() {
+                    sync_writer.push(SyncSignal::Emit(now, news));
+                }
+            }
+        }
+
+        Ok(())
+    }
+
+    fn stop(
+        &mut self,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        _state: &State,
+    ) -> Result<Signal> {
+        if let Some(group) = &self.group {
+            async_writer.push(LoggerSignal::Append(
+                group.clone(),
+                ("event".to_owned(), Value::Text("stop".to_owned())),
+            ));
+        }
+
+        sync_writer.push(SyncSignal::Repaint);
+        Ok(Signal::none())
+    }
+
+    fn debug(&self) -> Vec<(&str, String)> {
+        <dyn StatefulAction>::debug(self)
+            .into_iter()
+            .chain([
+                ("phase", format!("{:?}", self.phase)),
+                ("targets", format!("{:?}", self.targets)),
+                ("selected", format!("{:?}", self.selected)),
+            ])
+            .collect()
+    }
+}
+
+impl StatefulTracking {
+    #[inline(always)]
+    fn radius(&self) -> f32 {
+        self.size * self.area.y / 2.0
+    }
+
+    /// Factor from the current size of the region on screen to the one the objects were placed in.
+    #[inline(always)]
+    fn scale(&self, rect: Rect) -> Vec2 {
+        self.area / rect.size()
+    }
+
+    #[inline(always)]
+    fn uniform(&mut self) -> f32 {
+        (self.rng.next_u64() as f64 / u64::MAX as f64) as f32
+    }
+
+    /// Places the objects in a region of the given size (in points) at random positions that are
+    /// apart from each other (or at the start of their paths), moving in random directions.
+    fn place(&mut self, area: Vec2) {
+        self.area = area;
+        let r = self.radius();
+        let speed = self.speed * area.y;
+
+        if let Motion::Paths(paths) = &self.motion {
+            self.objects = paths
+                .iter()
+                .map(|p| Object {
+                    pos: Vec2::new(p[0].0 * area.x, p[0].1 * area.y),
+                    vel: Vec2::ZERO,
+                    waypoint: 1,
+                })
+                .collect();
+            return;
+        }
+
+        for _ in 0..self.count {
+            let mut pos = Vec2::ZERO;
+            for _ in 0..MAX_PLACEMENTS {
+                pos = Vec2::new(
+                    r + self.uniform() * (area.x - 2.0 * r).max(0.0),
+                    r + self.uniform() * (area.y - 2.0 * r).max(0.0),
+                );
+                if self
+                    .objects
+                    .iter()
+                    .all(|o| (o.pos - pos).length() >= 3.0 * r)
+                {
+                    break;
+                }
+            }
+
+            let angle = self.uniform() * 2.0 * PI;
+            self.objects.push(Object {
+                pos,
+                vel: Vec2::angled(angle) * speed,
+                waypoint: 0,
+            });
+        }
+    }
+
+    /// Moves on to the next phase once the current one is over.
+    fn advance(&mut self, now: Instant, async_writer: &mut QWriter<AsyncSignal>) {
+        if let Phase::Cue(end) = self.phase {
+            if now >= end {
+                self.phase = Phase::Track(end + self.duration);
+                self.log(async_writer, end, "phase", Value::Text("track".to_owned()));
+            }
+        }
+
+        if let Phase::Track(end) = self.phase {
+            if now >= end {
+                self.phase = Phase::Respond(end);
+                self.log(
+                    async_writer,
+                    end,
+                    "phase",
+                    Value::Text("respond".to_owned()),
+                );
+
+                if self.response == Response::Probe {
+                    let (targets, others): (Vec<_>, Vec<_>) =
+                        (0..self.count).partition(|i| self.targets.contains(i));
+                    let pool = if self.rng.below(2) == 0 {
+                        targets
+                    } else {
+                        others
+                    };
+                    let probe = pool[self.rng.below(pool.len())];
+                    self.probe = Some(probe);
+                    self.log(
+                        async_writer,
+                        end,
+                        "probe",
+                        Value::Array(vec![
+                            Value::Integer(probe as i128),
+                            Value::Bool(self.targets.contains(&probe)),
+                        ]),
+                    );
+                }
+            }
+        }
+    }
+
+    /// Advances the objects by `dt` seconds. Objects only keep moving during the response phase
+    /// when they are hidden (`locate`).
+    fn step(&mut self, dt: f32) {
+        if matches!(self.phase, Phase::Respond(_)) && self.response != Response::Locate {
+            return;
+        }
+
+        let speed = self.speed * self.area.y;
+        let r = self.radius();
+
+        if let Motion::Paths(paths) = &self.motion {
+            for (o, path) in self.objects.iter_mut().zip(paths.iter()) {
+                let mut travel = speed * dt;
+                while travel > 0.0 && o.waypoint < path.len() {
+                    let (x, y) = path[o.waypoint];
+                    let target = Vec2::new(x * self.area.x, y * self.area.y);
+                    let distance = (target - o.pos).length();
+                    if distance <= travel {
+                        o.pos = target;
+                        o.waypoint += 1;
+                        travel -= distance;
+                    } else {
+                        o.vel = (target - o.pos) / distance * speed;
+                        o.pos += o.vel / speed * travel;
+                        travel = 0.0;
+                    }
+                }
+            }
+            return;
+        }
+
+        if let Motion::Wander(rate) = self.motion {
+            for i in 0..self.objects.len() {
+                let turn = (self.uniform() * 2.0 - 1.0) * rate * dt;
+                let o = &mut self.objects[i];
+                o.vel = Vec2::angled(o.vel.angle() + turn) * speed;
+            }
+        }
+
+        // Objects that overshoot an edge (e.g., after a long frame) are put back on it, so they
+        // cannot get stuck outside of the region
+        let (max_x, max_y) = ((self.area.x - r).max(r), (self.area.y - r).max(r));
+        for o in self.objects.iter_mut() {
+            o.pos += o.vel * dt;
+            if (o.pos.x < r && o.vel.x < 0.0) || (o.pos.x > max_x && o.vel.x > 0.0) {
+                o.vel.x = -o.vel.x;
+            }
+            if (o.pos.y < r && o.vel.y < 0.0) || (o.pos.y > max_y && o.vel.y > 0.0) {
+                o.vel.y = -o.vel.y;
+            }
+            o.pos.x = o.pos.x.clamp(r, max_x);
+            o.pos.y = o.pos.y.clamp(r, max_y);
+        }
+
+        if self.collisions {
+            // Elastic collisions between equal masses exchange the velocity components along the
+            // line between the centers, after which speeds are restored to keep them constant.
+            for i in 0..self.objects.len() {
+                for j in i + 1..self.objects.len() {
+                    let (a, b) = (self.objects[i], self.objects[j]);
+                    let delta = b.pos - a.pos;
+                    let distance = delta.length();
+                    if distance >= 2.0 * r || distance == 0.0 {
+                        continue;
+                    }
+                    let normal = delta / distance;
+                    let approach = (a.vel - b.vel).dot(normal);
+                    if approach <= 0.0 {
+                        continue;
+                    }
+                    self.objects[i].vel = (a.vel - normal * approach).normalized() * speed;
+                    self.objects[j].vel = (b.vel + normal * approach).normalized() * speed;
+                }
+            }
+        }
+    }
+
+    fn draw(&self, ui: &mut egui::Ui, rect: Rect) {
+        let scale = rect.size() / self.area;
+        let r = self.radius() * scale.y;
+        let painter = ui.painter_at(rect);
+        for (i, o) in self.objects.iter().enumerate() {
+            let center = rect.min + o.pos * scale;
+            if let Some(texture) = self.texture {
+                painter.image(
+                    texture,
+                    Rect::from_center_size(center, Vec2::splat(2.0 * r)),
+                    Rect::from_min_max(Pos2::ZERO, Pos2::new(1.0, 1.0)),
+                    Color32::WHITE,
+                );
+            } else {
+                painter.circle_filled(center, r, self.color);
+            }
+
+            let marked = match self.phase {
+                Phase::Cue(_) => self.targets.contains(&i),
+                Phase::Track(_) => false,
+                Phase::Respond(_) => self.selected.contains(&i) || self.probe == Some(i),
+            };
+            if marked {
+                painter.circle_stroke(
+                    center,
+                    r * (1.0 + RING_WIDTH),
+                    Stroke::new(r * RING_WIDTH, self.highlight),
+                );
+            }
+        }
+    }
+
+    /// Handles a click at the given position (in the coordinates of the objects) during the
+    /// response phase.
+    fn click(
+        &mut self,
+        time: Instant,
+        pos: Vec2,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+    ) -> Signal {
+        match self.response {
+            Response::Select => {
+                let r = self.radius();
+                let hit = self
+                    .objects
+                    .iter()
+                    .enumerate()
+                    .filter(|(i, o)| !self.selected.contains(i) && (o.pos - pos).length() <= r)
+                    .min_by(|(_, a), (_, b)| {
+                        (a.pos - pos).length().total_cmp(&(b.pos - pos).length())
+                    })
+                    .map(|(i, _)| i);
+
+                if let Some(i) = hit {
+                    self.selected.insert(i);
+                    self.log(async_writer, time, "selected", Value::Integer(i as i128));
+                    if self.selected.len() == self.n_targets {
+                        let hits = self.selected.intersection(&self.targets).count();
+                        let accuracy = hits as f64 / self.n_targets as f64;
+                        return self.finish(time, accuracy, None, sync_writer, async_writer);
+                    }
+                }
+                Signal::none()
+            }
+            Response::Locate => {
+                let target = *self.targets.iter().next().unwrap();
+                let error = (self.objects[target].pos - pos).length() / self.area.y;
+                self.log(
+                    async_writer,
+                    time,
+                    "located",
+                    Value::Array(vec![
+                        Value::Float((pos.x / self.area.x) as f64),
+                        Value::Float((pos.y / self.area.y) as f64),
+                    ]),
+                );
+                self.finish(time, 1.0, Some(error as f64), sync_writer, async_writer)
+            }
+            Response::Probe => Signal::none(),
+        }
+    }
+
+    fn finish(
+        &mut self,
+        time: Instant,
+        accuracy: f64,
+        error: Option<f64>,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+    ) -> Signal {
+        let rt = match self.phase {
+            Phase::Respond(since) => time.saturating_duration_since(since).as_secs_f64(),
+            _ => 0.0,
+        };
+
+        let mut entries = vec![];
+        let mut news = vec![];
+        if let Some(error) = error {
+            entries.push(("error".to_owned(), Value::Float(error)));
+            if self.out_error > 0 {
+                news.push((self.out_error, Value::Float(error)));
+            }
+        } else {
+            entries.push(("accuracy".to_owned(), Value::Float(accuracy)));
+            if self.out_accuracy > 0 {
+                news.push((self.out_accuracy, Value::Float(accuracy)));
+            }
+        }
+        entries.push(("rt".to_owned(), Value::Float(rt)));
+
+        if let Some(group) = &self.group {
+            async_writer.push(AsyncSignal::Logger(
+                time,
+                LoggerSignal::Extend(group.clone(), entries),
+            ));
+        }
+
+        self.done = true;
+        sync_writer.push(SyncSignal::UpdateGraph);
+        news.into()
+    }
+
+    fn log(
+        &self,
+        async_writer: &mut QWriter<AsyncSignal>,
+        time: Instant,
+        name: &str,
+        value: Value,
+    ) {
+        if let Some(group) = &self.group {
+            async_writer.push(AsyncSignal::Logger(
+                time,
+                LoggerSignal::Append(group.clone(), (name.to_owned(), value)),
+            ));
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::comm::QReader;
+
+    fn tracking(attributes: &str) -> StatefulTracking {
+        let tracking: Tracking =
+            ron::from_str(&format!("(objects: 4, seed: Some(1), {attributes})")).unwrap();
+        let mut state = tracking.state(None);
+        state.place(Vec2::new(400.0, 300.0));
+        state.phase = Phase::Track(Instant::now() + Duration::from_secs(60));
+        state
+    }
+
+    fn object(x: f32, y: f32, vx: f32, vy: f32) -> Object {
+        Object {
+            pos: Vec2::new(x, y),
+            vel: Vec2::new(vx, vy),
+            waypoint: 0,
+        }
+    }
+
+    #[test]
+    fn objects_stay_in_the_region() {
+        let mut state = tracking("targets: 1, motion: wander(2.0)");
+        let r = state.radius();
+        let speed = state.speed * state.area.y;
+        // Includes frames that are long enough to overshoot the edges
+        for dt in [0.01, 0.5, 2.0].into_iter().cycle().take(300) {
+            state.step(dt);
+            for o in state.objects.iter() {
+                assert!((r..=400.0 - r).contains(&o.pos.x), "{o:?}");
+                assert!((r..=300.0 - r).contains(&o.pos.y), "{o:?}");
+                assert!((o.vel.length() - speed).abs() < 1e-3 * speed, "{o:?}");
+            }
+        }
+    }
+
+    #[test]
+    fn collisions_keep_speed() {
+        let mut state = tracking("targets: 1");
+        let r = state.radius();
+        let speed = state.speed * state.area.y;
+        state.objects = vec![
+            object(100.0, 150.0, speed, 0.0),
+            object(100.0 + 1.5 * r, 150.0 + 0.5 * r, -speed, 0.0),
+        ];
+        state.step(0.0);
+
+        let (a, b) = (state.objects[0], state.objects[1]);
+        assert!((a.vel.length() - speed).abs() < 1e-3 * speed);
+        assert!((b.vel.length() - speed).abs() < 1e-3 * speed);
+        assert!(a.vel.x < 0.0 && b.vel.x > 0.0);
+
+        // Objects that already move apart are left alone
+        state.objects = vec![
+            object(100.0, 150.0, -speed, 0.0),
+            object(100.0 + 1.5 * r, 150.0, speed, 0.0),
+        ];
+        state.step(0.0);
+        assert_eq!(state.objects[0].vel, Vec2::new(-speed, 0.0));
+        assert_eq!(state.objects[1].vel, Vec2::new(speed, 0.0));
+    }
+
+    #[test]
+    fn accuracy_is_the_fraction_of_selected_targets() {
+        let mut state = tracking("targets: 2, out_accuracy: 1");
+        state.targets = BTreeSet::from([0, 1]);
+        state.phase = Phase::Respond(Instant::now());
+        state.objects = vec![
+            object(50.0, 50.0, 0.0, 0.0),
+            object(150.0, 50.0, 0.0, 0.0),
+            object(250.0, 50.0, 0.0, 0.0),
+            object(350.0, 50.0, 0.0, 0.0),
+        ];
+
+        let mut sync_writer = QReader::new().writer();
+        let mut async_writer = QReader::new().writer();
+        let now = Instant::now();
+        let news = state.click(
+            now,
+            Vec2::new(52.0, 48.0),
+            &mut sync_writer,
+            &mut async_writer,
+        );
+        assert!(news.is_empty());
+        // Clicking the same object again does not count twice
+        let news = state.click(
+            now,
+            Vec2::new(50.0, 50.0),
+            &mut sync_writer,
+            &mut async_writer,
+        );
+        assert!(news.is_empty());
+        let news = state.click(
+            now,
+            Vec2::new(250.0, 50.0),
+            &mut sync_writer,
+            &mut async_writer,
+        );
+        assert_eq!(news.get(1), Some(&Value::Float(0.5)));
+        assert!(state.done);
+    }
+
+    #[test]
+    fn localization_error_is_relative_to_the_region_height() {
+        let mut state = tracking("targets: 1, response: locate, out_error: 2");
+        state.targets = BTreeSet::from([0]);
+        state.phase = Phase::Respond(Instant::now());
+        state.objects[0] = object(100.0, 100.0, 0.0, 0.0);
+
+        let mut sync_writer = QReader::new().writer();
+        let mut async_writer = QReader::new().writer();
+        let news = state.click(
+            Instant::now(),
+            Vec2::new(130.0, 140.0),
+            &mut sync_writer,
+            &mut async_writer,
+        );
+        match news.get(2) {
+            Some(Value::Float(error)) => assert!((error - 50.0 / 300.0).abs() < 1e-6),
+            v => panic!("unexpected error value: {v:?}"),
+        }
+        assert!(state.done);
+    }
+}
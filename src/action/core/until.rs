@@ -37,8 +37,14 @@ impl Action for Until {
         }
     }
 
+    #[inline]
+    fn children(&self) -> Vec<&dyn Action> {
+        vec![self.inner.as_ref()]
+    }
+
     fn in_signals(&self) -> BTreeSet<SignalId> {
         let mut signals = BTreeSet::from([self.in_event, self.in_condition]);
+        signals.extend(self.inner.in_signals());
         signals.extend(self.inner.out_signals());
         signals
     }
@@ -63,7 +69,7 @@ impl Action for Until {
             done: false,
             inner: self
                 .inner
-                .stateful(io, res, config, sync_writer, async_writer)?,
+                .routed(io, res, config, sync_writer, async_writer)?,
             in_condition: self.in_condition,
             in_event: self.in_event,
         }))
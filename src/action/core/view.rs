@@ -25,6 +25,11 @@ stateful!(View {
 });
 
 impl Action for View {
+    #[inline]
+    fn children(&self) -> Vec<&dyn Action> {
+        self.children.iter().map(|c| c.as_ref()).collect()
+    }
+
     #[inline]
     fn in_signals(&self) -> BTreeSet<SignalId> {
         let mut signals = BTreeSet::from([self.in_control]);
@@ -62,7 +67,7 @@ impl Action for View {
     ) -> Result<Box<dyn StatefulAction>> {
         let mut children = vec![];
         for c in self.children.iter() {
-            children.push(c.stateful(io, res, config, sync_writer, async_writer)?);
+            children.push(c.routed(io, res, config, sync_writer, async_writer)?);
         }
 
         Ok(Box::new(StatefulView {
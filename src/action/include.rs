@@ -9,6 +9,7 @@ include_actions!(
     core::delayed@(),
     core::event@(),
     core::fixation@(),
+    core::flicker@(),
     core::function@(),
     core::horizontal@(),
     core::image@(),
@@ -27,8 +28,10 @@ include_actions!(
     core::stream@("stream"),
     core::switch@(),
     core::template@(),
+    core::time_reproduction@(),
     core::timeout@(),
     core::timer@(),
+    core::tracking@(),
     core::until@(),
     core::vertical@(),
     core::video@("stream"),
@@ -43,6 +46,7 @@ include_stateful_actions!(
     core::counter@(),
     core::delayed@(),
     core::event@(),
+    core::flicker@(),
     core::function@(),
     core::image@(),
     core::instruction@(),
@@ -59,8 +63,10 @@ include_stateful_actions!(
     core::stack@(),
     core::stream@("stream"),
     core::switch@(),
+    core::time_reproduction@(),
     core::timeout@(),
     core::timer@(),
+    core::tracking@(),
     core::until@(),
     core::video@("stream"),
     core::view@(),
@@ -57,6 +57,17 @@ macro_rules! include_actions {
                 )*
             }
 
+            impl ActionEnumAsRef<'_> {
+                pub fn name(&self) -> &'static str {
+                    match self {
+                        $(
+                            #[cfg(all($(feature = $feature,)*))]
+                            Self::[<$name:camel>](_) => stringify!($name),
+                        )*
+                    }
+                }
+            }
+
             impl<'a> From<&'a dyn Action> for ActionEnumAsRef<'a> {
                 fn from(f: &dyn Action) -> ActionEnumAsRef {
                     match f.type_id() {
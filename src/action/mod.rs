@@ -5,15 +5,18 @@ pub mod de;
 pub mod extra;
 pub mod include;
 pub mod props;
+pub mod route;
 
 pub use include::*;
 pub use props::*;
+pub use route::{Routed, Routes, Routing, Scope, SharedRoutes};
 
 use crate::comm::{QWriter, Signal, SignalId};
-use crate::resource::{IoManager, Key, ResourceAddr, ResourceManager};
+use crate::resource::{IoManager, Key, LogEntry, ResourceAddr, ResourceManager};
 use crate::server::{AsyncSignal, Config, State, SyncSignal};
 use eframe::egui;
 use eyre::Result;
+use heck::ToSnakeCase;
 use itertools::Itertools;
 use std::any::Any;
 use std::collections::BTreeSet;
@@ -39,12 +42,28 @@ pub trait Action: Debug + Any {
         BTreeSet::new()
     }
 
+    /// Whether this action (or any of its descendants) consumes key presses.
+    #[inline(always)]
+    fn in_keys(&self) -> bool {
+        self.children().iter().any(|c| c.in_keys())
+    }
+
     #[inline(always)]
     #[allow(unused_variables)]
     fn resources(&self, config: &Config) -> Vec<ResourceAddr> {
         vec![]
     }
 
+    #[inline(always)]
+    fn children(&self) -> Vec<&dyn Action> {
+        vec![]
+    }
+
+    #[inline(always)]
+    fn log_entries(&self) -> Vec<LogEntry> {
+        vec![]
+    }
+
     fn stateful(
         &self,
         io: &IoManager,
@@ -53,6 +72,34 @@ pub trait Action: Debug + Any {
         sync_writer: &QWriter<SyncSignal>,
         async_writer: &QWriter<AsyncSignal>,
     ) -> Result<Box<dyn StatefulAction>>;
+
+    /// Same as `stateful`, but the result only receives the key presses and state changes that
+    /// this action subscribes to, and logs its start/stop under its tree path if tracing is enabled.
+    /// Containers use this for their children.
+    fn routed(
+        &self,
+        io: &IoManager,
+        res: &ResourceManager,
+        config: &Config,
+        sync_writer: &QWriter<SyncSignal>,
+        async_writer: &QWriter<AsyncSignal>,
+    ) -> Result<Box<dyn StatefulAction>> {
+        let name = std::any::type_name::<Self>()
+            .rsplit("::")
+            .next()
+            .unwrap_or_default()
+            .to_snake_case();
+        let scope = Scope::enter(&name);
+        let inner = self.stateful(io, res, config, sync_writer, async_writer)?;
+        Ok(Box::new(Routed::new(
+            inner,
+            Scope::routes().unwrap_or_default(),
+            self.in_signals(),
+            self.in_keys(),
+            scope.path().to_owned(),
+            config.trace(),
+        )))
+    }
 }
 
 pub trait StatefulAction: Send {
@@ -141,5 +188,6 @@ pub trait ImplStatefulAction: StatefulAction {}
 pub enum ActionSignal {
     UpdateGraph,
     KeyPress(Instant, BTreeSet<Key>),
+    KeyRelease(Instant, BTreeSet<Key>),
     StateChanged(Instant, BTreeSet<SignalId>),
 }
@@ -0,0 +1,378 @@
+use crate::action::{ActionSignal, Props, StatefulAction};
+use crate::comm::{QWriter, Signal, SignalId};
+use crate::resource::LoggerSignal;
+use crate::server::{AsyncSignal, State, SyncSignal};
+use eframe::egui;
+use eyre::Result;
+use serde_cbor::Value;
+use std::cell::RefCell;
+use std::collections::{BTreeSet, HashMap};
+use std::sync::{Arc, RwLock};
+
+thread_local! {
+    static SCOPE: RefCell<Vec<(String, usize)>> = RefCell::new(vec![]);
+    static ROUTES: RefCell<Option<SharedRoutes>> = RefCell::new(None);
+}
+
+pub type SharedRoutes = Arc<RwLock<Routes>>;
+
+/// Tree path of the action currently being made stateful on this thread. Paths have the same
+/// format as in the codebook, e.g. `seq[0]/par[1]/audio`.
+pub struct Scope(String);
+
+impl Scope {
+    /// Enters the scope of the next child (named `name`) of the current action.
+    pub fn enter(name: &str) -> Self {
+        SCOPE.with(|scope| {
+            let mut scope = scope.borrow_mut();
+            let path = match scope.last_mut() {
+                Some((parent, i)) => {
+                    *i += 1;
+                    format!("{parent}[{}]/{name}", *i - 1)
+                }
+                None => name.to_owned(),
+            };
+            scope.push((path.clone(), 0));
+            Self(path)
+        })
+    }
+
+    /// Re-enters the scope of an existing path, e.g. to make more copies of the same children
+    /// from a different thread.
+    pub fn within(path: &str) -> Self {
+        SCOPE.with(|scope| scope.borrow_mut().push((path.to_owned(), 0)));
+        Self(path.to_owned())
+    }
+
+    /// Path of the innermost scope on this thread.
+    pub fn current() -> Option<String> {
+        SCOPE.with(|scope| scope.borrow().last().map(|(path, _)| path.clone()))
+    }
+
+    /// Makes `routes` the index that actions made stateful on this thread register with, until
+    /// the returned guard is dropped.
+    pub fn routing(routes: &SharedRoutes) -> Routing {
+        Routing(ROUTES.with(|r| r.borrow_mut().replace(routes.clone())))
+    }
+
+    /// Index that actions made stateful on this thread register with, if any.
+    pub fn routes() -> Option<SharedRoutes> {
+        ROUTES.with(|r| r.borrow().clone())
+    }
+
+    #[inline(always)]
+    pub fn path(&self) -> &str {
+        &self.0
+    }
+}
+
+impl Drop for Scope {
+    fn drop(&mut self) {
+        SCOPE.with(|scope| scope.borrow_mut().pop());
+    }
+}
+
+/// Guard returned by [`Scope::routing`], which restores the previous index when dropped.
+pub struct Routing(Option<SharedRoutes>);
+
+impl Drop for Routing {
+    fn drop(&mut self) {
+        ROUTES.with(|r| *r.borrow_mut() = self.0.take());
+    }
+}
+
+/// Index from signals (and key presses) to the routed actions that subscribe to them, built while
+/// the action tree is made stateful. Actions are identified by their tree path, so all
+/// repetitions of an action share their entry.
+#[derive(Debug, Default)]
+pub struct Routes {
+    paths: Vec<String>,
+    ids: HashMap<String, usize>,
+    signals: HashMap<SignalId, BTreeSet<usize>>,
+    keys: BTreeSet<usize>,
+}
+
+impl Routes {
+    /// Adds the subscriptions of the action at `path` to the index, and returns its id.
+    pub fn register(
+        &mut self,
+        path: &str,
+        in_signals: &BTreeSet<SignalId>,
+        in_keys: bool,
+    ) -> usize {
+        let id = match self.ids.get(path) {
+            Some(id) => *id,
+            None => {
+                self.paths.push(path.to_owned());
+                self.ids.insert(path.to_owned(), self.paths.len() - 1);
+                self.paths.len() - 1
+            }
+        };
+
+        for signal in in_signals {
+            self.signals.entry(*signal).or_default().insert(id);
+        }
+        if in_keys {
+            self.keys.insert(id);
+        }
+        id
+    }
+
+    /// Whether the action with the given id subscribes to the signal. `UpdateGraph` is always
+    /// delivered, since any action may finish in the background.
+    pub fn routes(&self, id: usize, signal: &ActionSignal) -> bool {
+        match signal {
+            ActionSignal::UpdateGraph => true,
+            ActionSignal::KeyPress(_, _) | ActionSignal::KeyRelease(_, _) => {
+                self.keys.contains(&id)
+            }
+            ActionSignal::StateChanged(_, changed) => changed
+                .iter()
+                .filter_map(|s| self.signals.get(s))
+                .any(|ids| ids.contains(&id)),
+        }
+    }
+
+    /// Tree paths of the actions that subscribe to a signal.
+    pub fn subscribers(&self, signal: SignalId) -> Vec<&str> {
+        self.signals.get(&signal).map_or(vec![], |ids| {
+            ids.iter().map(|id| self.paths[*id].as_str()).collect()
+        })
+    }
+}
+
+/// Wraps a stateful action so that it only receives the signals it subscribed to when it was made
+/// stateful, as registered in the routing index of its tree. With `trace` enabled in the config,
+/// start and stop times are logged to the `trace` group along with the action's tree path.
+pub struct Routed {
+    inner: Box<dyn StatefulAction>,
+    routes: SharedRoutes,
+    id: usize,
+    path: String,
+    trace: bool,
+    running: bool,
+}
+
+impl Routed {
+    pub fn new(
+        inner: Box<dyn StatefulAction>,
+        routes: SharedRoutes,
+        in_signals: BTreeSet<SignalId>,
+        in_keys: bool,
+        path: String,
+        trace: bool,
+    ) -> Self {
+        let id = routes
+            .write()
+            .unwrap()
+            .register(&path, &in_signals, in_keys);
+        Self {
+            inner,
+            routes,
+            id,
+            path,
+            trace,
+            running: false,
+        }
+    }
+
+    #[inline(always)]
+    pub fn path(&self) -> &str {
+        &self.path
+    }
+
+    #[inline]
+    pub fn subscribes(&self, signal: &ActionSignal) -> bool {
+        self.routes.read().unwrap().routes(self.id, signal)
+    }
+}
+
+impl StatefulAction for Routed {
+    #[inline(always)]
+    fn is_over(&self) -> Result<bool> {
+        self.inner.is_over()
+    }
+
+    #[inline(always)]
+    fn type_str(&self) -> String {
+        self.inner.type_str()
+    }
+
+    #[inline(always)]
+    fn props(&self) -> Props {
+        self.inner.props()
+    }
+
+    #[inline(always)]
+    fn start(
+        &mut self,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        state: &State,
+    ) -> Result<Signal> {
+        self.running = true;
+        if self.trace {
+            async_writer.push(LoggerSignal::Append(
+                "trace".to_owned(),
+                ("start".to_owned(), Value::Text(self.path.clone())),
+            ));
+        }
+        self.inner.start(sync_writer, async_writer, state)
+    }
+
+    #[inline]
+    fn update(
+        &mut self,
+        signal: &ActionSignal,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        state: &State,
+    ) -> Result<Signal> {
+        if self.subscribes(signal) {
+            self.inner.update(signal, sync_writer, async_writer, state)
+        } else {
+            Ok(Signal::none())
+        }
+    }
+
+    #[inline(always)]
+    fn show(
+        &mut self,
+        ui: &mut egui::Ui,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        state: &State,
+    ) -> Result<()> {
+        self.inner.show(ui, sync_writer, async_writer, state)
+    }
+
+    #[inline(always)]
+    fn stop(
+        &mut self,
+        sync_writer: &mut QWriter<SyncSignal>,
+        async_writer: &mut QWriter<AsyncSignal>,
+        state: &State,
+    ) -> Result<Signal> {
+        if self.running && self.trace {
+            async_writer.push(LoggerSignal::Append(
+                "trace".to_owned(),
+                ("stop".to_owned(), Value::Text(self.path.clone())),
+            ));
+        }
+        self.running = false;
+        self.inner.stop(sync_writer, async_writer, state)
+    }
+
+    #[inline(always)]
+    fn debug(&self) -> Vec<(&str, String)> {
+        self.inner.debug()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::comm::QReader;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::time::Instant;
+
+    /// Counts the signals it receives.
+    struct Probe(Arc<AtomicUsize>);
+
+    impl StatefulAction for Probe {
+        fn is_over(&self) -> Result<bool> {
+            Ok(false)
+        }
+
+        fn type_str(&self) -> String {
+            "probe".to_owned()
+        }
+
+        fn update(
+            &mut self,
+            _signal: &ActionSignal,
+            _sync_writer: &mut QWriter<SyncSignal>,
+            _async_writer: &mut QWriter<AsyncSignal>,
+            _state: &State,
+        ) -> Result<Signal> {
+            self.0.fetch_add(1, Ordering::Relaxed);
+            Ok(Signal::none())
+        }
+    }
+
+    fn changed(signals: &[SignalId]) -> ActionSignal {
+        ActionSignal::StateChanged(Instant::now(), signals.iter().copied().collect())
+    }
+
+    #[test]
+    fn index_maps_signals_to_subscribers() {
+        let mut routes = Routes::default();
+        let seq = routes.register("seq", &BTreeSet::from([1, 2]), true);
+        let timer = routes.register("seq[0]/timer", &BTreeSet::from([1]), false);
+        let reaction = routes.register("seq[1]/reaction", &BTreeSet::from([2]), true);
+
+        // Repetitions of an action share its entry
+        assert_eq!(
+            routes.register("seq[0]/timer", &BTreeSet::new(), false),
+            timer
+        );
+
+        assert_eq!(routes.subscribers(1), vec!["seq", "seq[0]/timer"]);
+        assert_eq!(routes.subscribers(2), vec!["seq", "seq[1]/reaction"]);
+        assert!(routes.subscribers(3).is_empty());
+
+        assert!(routes.routes(timer, &changed(&[1, 3])));
+        assert!(!routes.routes(timer, &changed(&[2, 3])));
+        assert!(!routes.routes(seq, &changed(&[3])));
+        assert!(routes.routes(timer, &ActionSignal::UpdateGraph));
+
+        let press = ActionSignal::KeyPress(Instant::now(), BTreeSet::new());
+        assert!(routes.routes(seq, &press));
+        assert!(routes.routes(reaction, &press));
+        assert!(!routes.routes(timer, &press));
+    }
+
+    #[test]
+    fn routed_actions_only_receive_subscribed_signals() {
+        let routes = SharedRoutes::default();
+        let count = Arc::new(AtomicUsize::new(0));
+        let mut routed = Routed::new(
+            Box::new(Probe(count.clone())),
+            routes.clone(),
+            BTreeSet::from([1]),
+            false,
+            "probe".to_owned(),
+            false,
+        );
+
+        let mut sync_writer = QReader::new().writer();
+        let mut async_writer = QReader::new().writer();
+        let state = State::new();
+        for signal in [
+            changed(&[1]),
+            changed(&[2]),
+            ActionSignal::KeyPress(Instant::now(), BTreeSet::new()),
+            ActionSignal::UpdateGraph,
+        ] {
+            routed
+                .update(&signal, &mut sync_writer, &mut async_writer, &state)
+                .unwrap();
+        }
+        assert_eq!(count.load(Ordering::Relaxed), 2);
+        assert_eq!(routes.read().unwrap().subscribers(1), vec!["probe"]);
+    }
+
+    #[test]
+    fn routing_index_is_set_per_thread() {
+        let routes = SharedRoutes::default();
+        assert!(Scope::routes().is_none());
+        {
+            let _routing = Scope::routing(&routes);
+            assert!(Arc::ptr_eq(&Scope::routes().unwrap(), &routes));
+            std::thread::spawn(|| assert!(Scope::routes().is_none()))
+                .join()
+                .unwrap();
+        }
+        assert!(Scope::routes().is_none());
+    }
+}
@@ -6,6 +6,16 @@ pub const VERSION: &str = env!("CARGO_PKG_VERSION");
 pub const IMAGE_FIXATION: &[u8] = include_bytes!("images/fixation.svg");
 pub const IMAGE_RUSTACEAN: &[u8] = include_bytes!("images/rustacean.svg");
 
+pub const TEMPLATE_TRIAL: &str = include_str!("templates/trial.ron");
+pub const TEMPLATE_POSNER_TRIAL: &str = include_str!("templates/posner_trial.ron");
+pub const TEMPLATE_STROOP: &str = include_str!("templates/stroop.ron");
+pub const TEMPLATE_FLANKER: &str = include_str!("templates/flanker.ron");
+pub const TEMPLATE_POSNER: &str = include_str!("templates/posner.ron");
+pub const TEMPLATE_NBACK: &str = include_str!("templates/nback.ron");
+pub const TEMPLATE_GO_NO_GO: &str = include_str!("templates/go_no_go.ron");
+pub const TEMPLATE_ODDBALL: &str = include_str!("templates/oddball.ron");
+pub const TEMPLATE_QUESTIONNAIRE: &str = include_str!("templates/questionnaire.ron");
+
 pub const FONT_ICONS_BRANDS: &[u8] = include_bytes!("fonts/fa-6-brands-regular-400.otf");
 pub const FONT_ICONS_REGULAR: &[u8] = include_bytes!("fonts/fa-6-free-regular-400.otf");
 pub const FONT_ICONS_SOLID: &[u8] = include_bytes!("fonts/fa-6-free-solid-900.otf");
@@ -18,6 +28,7 @@ pub enum Icon {
     Folder,
     FolderTree,
     MagnifyingGlass,
+    Plus,
 }
 impl Icon {
     pub fn size(self, size: f32) -> RichText {
@@ -34,6 +45,7 @@ impl From<Icon> for RichText {
             Icon::Folder => "\u{f07b}",
             Icon::FolderTree => "\u{f802}",
             Icon::MagnifyingGlass => "\u{f002}",
+            Icon::Plus => "\u{f067}",
         })
         .font(FontId::new(
             TEXT_SIZE_ICON,
@@ -0,0 +1,26 @@
+use cog_task::assets::VERSION;
+use cog_task::monitor::MonitorWindow;
+use eyre::Result;
+
+const USAGE: &str = "Correct usage:
+./monitor [address] [token]";
+
+fn main() -> Result<()> {
+    let args: Vec<_> = std::env::args().skip(1).collect();
+    let (address, token) = match args.as_slice() {
+        [flag] if flag == "--version" => {
+            println!("Monitor-v{VERSION}");
+            return Ok(());
+        }
+        [] => ("127.0.0.1:7878", None),
+        [address] => (address.as_str(), None),
+        [address, token] => (address.as_str(), Some(token.as_str())),
+        _ => {
+            println!("Invalid arguments. {USAGE}");
+            std::process::exit(1);
+        }
+    };
+
+    MonitorWindow::new(address, token)?.run();
+    Ok(())
+}
@@ -0,0 +1,286 @@
+use cog_task::assets::VERSION;
+use cog_task::design::Design;
+use cog_task::server::{verify_audit, Codebook, Task, CHECKSUM_HEADER};
+use cog_task::timeline::Timeline;
+use cog_task::util::Hash;
+use eyre::{eyre, Context, Result};
+use std::io::{BufRead, BufReader, Read, Write};
+use std::net::{TcpListener, TcpStream};
+use std::path::{Component, Path, PathBuf};
+
+const USAGE: &str = "Correct usage:
+./tool codebook path_to_task_dir [md|csv]
+./tool timeline path_to_run_dir
+./tool hash path_to_task_dir
+./tool receive path_to_storage_dir [address] [token]
+./tool audit path_to_subject_output_dir
+./tool design path_to_design_file [seed]";
+
+fn main() -> Result<()> {
+    let args: Vec<_> = std::env::args().skip(1).collect();
+    match args.first().map(|s| s.as_str()) {
+        Some("codebook") => codebook(&args[1..]),
+        Some("timeline") => timeline(&args[1..]),
+        Some("hash") => hash(&args[1..]),
+        Some("receive") => receive(&args[1..]),
+        Some("audit") => audit(&args[1..]),
+        Some("design") => design(&args[1..]),
+        Some("--version") => {
+            println!("Tool-v{VERSION}");
+            Ok(())
+        }
+        _ => {
+            println!("Invalid arguments. {USAGE}");
+            std::process::exit(1);
+        }
+    }
+}
+
+fn codebook(args: &[String]) -> Result<()> {
+    let (path, format) = match args {
+        [path] => (path, "md"),
+        [path, format] => (path, format.as_str()),
+        _ => {
+            println!("Invalid number of arguments. {USAGE}");
+            std::process::exit(1);
+        }
+    };
+
+    let task = Task::new(&PathBuf::from(path))?;
+    let codebook = Codebook::new(&task);
+    match format {
+        "md" => println!("{}", codebook.to_markdown()),
+        "csv" => print!("{}", codebook.to_csv()),
+        _ => {
+            return Err(eyre!(
+                "Unknown codebook format ({format}), expected `md` or `csv`."
+            ))
+        }
+    }
+
+    Ok(())
+}
+
+fn timeline(args: &[String]) -> Result<()> {
+    let path = match args {
+        [path] => path,
+        _ => {
+            println!("Invalid number of arguments. {USAGE}");
+            std::process::exit(1);
+        }
+    };
+
+    Timeline::new(&PathBuf::from(path))?.run();
+    Ok(())
+}
+
+fn audit(args: &[String]) -> Result<()> {
+    let path = match args {
+        [path] => path,
+        _ => {
+            println!("Invalid number of arguments. {USAGE}");
+            std::process::exit(1);
+        }
+    };
+
+    let (head, problems) = verify_audit(&PathBuf::from(path))?;
+    println!("Last entry: {head}");
+    if problems.is_empty() {
+        println!("Audit trail and sealed files are intact.");
+        Ok(())
+    } else {
+        for problem in problems.iter() {
+            println!("- {problem}");
+        }
+        Err(eyre!(
+            "Audit verification found {} problem(s).",
+            problems.len()
+        ))
+    }
+}
+
+fn design(args: &[String]) -> Result<()> {
+    let (path, seed) = match args {
+        [path] => (path, None),
+        [path, seed] => (
+            path,
+            Some(
+                seed.parse()
+                    .wrap_err("Seed should be a non-negative integer.")?,
+            ),
+        ),
+        _ => {
+            println!("Invalid number of arguments. {USAGE}");
+            std::process::exit(1);
+        }
+    };
+
+    let path = PathBuf::from(path);
+    let schedule = Design::new(&path)?.optimize(seed)?;
+    print!("{}", schedule.report());
+    for file in schedule.save(&path)? {
+        println!("Wrote {file:?}");
+    }
+
+    Ok(())
+}
+
+fn hash(args: &[String]) -> Result<()> {
+    let path = match args {
+        [path] => path,
+        _ => {
+            println!("Invalid number of arguments. {USAGE}");
+            std::process::exit(1);
+        }
+    };
+
+    let task = Task::new(&PathBuf::from(path))?;
+    println!("task: {} {}", task.hash(), task.canonical_hash()?);
+    for block in task.blocks() {
+        println!(
+            "block '{}': {} {}",
+            block.label(),
+            block.hash(),
+            block.canonical_hash()?
+        );
+    }
+
+    Ok(())
+}
+
+/// Minimal stand-in for a data repository endpoint, which accepts runs uploaded by the server
+/// (`PUT /<subject>/<date>/<block>/<time>.zip`), verifies their checksum, and stores them under
+/// the given directory.
+fn receive(args: &[String]) -> Result<()> {
+    let (dir, addr, token) = match args {
+        [dir] => (dir, "127.0.0.1:8080", None),
+        [dir, addr] => (dir, addr.as_str(), None),
+        [dir, addr, token] => (dir, addr.as_str(), Some(token.as_str())),
+        _ => {
+            println!("Invalid number of arguments. {USAGE}");
+            std::process::exit(1);
+        }
+    };
+
+    let dir = PathBuf::from(dir);
+    let listener =
+        TcpListener::bind(addr).wrap_err_with(|| format!("Failed to bind to {addr}."))?;
+    println!("Receiving runs at http://{addr}/ into {dir:?}");
+
+    for stream in listener.incoming() {
+        let mut stream = match stream {
+            Ok(stream) => stream,
+            Err(e) => {
+                println!("Connection failed: {e}");
+                continue;
+            }
+        };
+
+        let (status, checksum) = match receive_one(&mut stream, &dir, token) {
+            Ok(checksum) => ("201 Created", Some(checksum)),
+            Err((status, e)) => {
+                println!("Rejected upload: {e:#}");
+                (status, None)
+            }
+        };
+
+        let mut response =
+            format!("HTTP/1.1 {status}\r\nContent-Length: 0\r\nConnection: close\r\n");
+        if let Some(checksum) = checksum {
+            response.push_str(&format!("{CHECKSUM_HEADER}: {checksum}\r\n"));
+        }
+        response.push_str("\r\n");
+        let _ = stream.write_all(response.as_bytes());
+    }
+
+    Ok(())
+}
+
+fn receive_one(
+    stream: &mut TcpStream,
+    dir: &Path,
+    token: Option<&str>,
+) -> Result<String, (&'static str, eyre::Error)> {
+    use sha2::{Digest, Sha256};
+
+    let bad_request = |e| ("400 Bad Request", e);
+    let mut reader = BufReader::new(stream);
+
+    let mut line = String::new();
+    reader
+        .read_line(&mut line)
+        .map_err(|e| bad_request(eyre!("Failed to read request ({e}).")))?;
+    let (method, target) = match line.split_whitespace().collect::<Vec<_>>()[..] {
+        [method, target, _] => (method.to_owned(), target.to_owned()),
+        _ => return Err(bad_request(eyre!("Malformed request line: {line:?}"))),
+    };
+    if method != "PUT" {
+        return Err((
+            "405 Method Not Allowed",
+            eyre!("Unsupported method: {method}"),
+        ));
+    }
+
+    let mut length = None;
+    let mut checksum = None;
+    let mut authorization = None;
+    loop {
+        let mut line = String::new();
+        reader
+            .read_line(&mut line)
+            .map_err(|e| bad_request(eyre!("Failed to read headers ({e}).")))?;
+        let line = line.trim_end();
+        if line.is_empty() {
+            break;
+        }
+        if let Some((name, value)) = line.split_once(':') {
+            let value = value.trim().to_owned();
+            match name.trim().to_lowercase().as_str() {
+                "content-length" => length = value.parse::<usize>().ok(),
+                "authorization" => authorization = Some(value),
+                n if n == CHECKSUM_HEADER.to_lowercase() => checksum = Some(value.to_lowercase()),
+                _ => {}
+            }
+        }
+    }
+
+    if let Some(token) = token {
+        if authorization.as_deref() != Some(&format!("Bearer {token}")) {
+            return Err(("401 Unauthorized", eyre!("Missing or invalid token.")));
+        }
+    }
+
+    let path = Path::new(target.trim_start_matches('/'));
+    if !path.components().all(|c| matches!(c, Component::Normal(_))) {
+        return Err(bad_request(eyre!("Invalid upload path: {target}")));
+    }
+
+    let length = length.ok_or_else(|| ("411 Length Required", eyre!("Missing Content-Length.")))?;
+    let mut data = vec![0; length];
+    reader
+        .read_exact(&mut data)
+        .map_err(|e| bad_request(eyre!("Failed to read body ({e}).")))?;
+
+    let mut hasher = Sha256::default();
+    hasher.update(&data);
+    let actual = hex::encode(hasher.finalize());
+    if matches!(&checksum, Some(c) if c != &actual) {
+        return Err(bad_request(eyre!(
+            "Checksum mismatch for {target} ({actual} != {}).",
+            checksum.unwrap()
+        )));
+    }
+
+    let dest = dir.join(path);
+    std::fs::create_dir_all(dest.parent().unwrap())
+        .and_then(|_| std::fs::write(&dest, &data))
+        .map_err(|e| {
+            (
+                "500 Internal Server Error",
+                eyre!("Failed to store {dest:?} ({e})."),
+            )
+        })?;
+
+    println!("Received {target} ({length} bytes, sha256 {actual})");
+    Ok(actual)
+}
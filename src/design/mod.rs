@@ -0,0 +1,1028 @@
+use crate::launcher::template::Rng;
+use eyre::{eyre, Context, Result};
+use serde::{Deserialize, Serialize};
+use std::cmp::Ordering;
+use std::collections::{BTreeMap, BTreeSet};
+use std::f64::consts::PI;
+use std::fmt::Write;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+/// Resolution (in seconds) at which the HRF is sampled and trial durations are integrated.
+const DT: f64 = 0.05;
+
+/// Length (in seconds) of the sampled HRF.
+const HRF_LENGTH: f64 = 32.0;
+
+/// Event-related design whose condition order and inter-trial intervals are optimized by
+/// `cog-tool design`, e.g.:
+///
+/// ```ron
+/// (
+///     tr: 2.0,
+///     conditions: [
+///         (name: "face", count: 30, duration: 1.0, src: "trials/face.ron"),
+///         (name: "house", count: 30, duration: 1.0, src: "trials/house.ron"),
+///     ],
+///     contrasts: [(name: "face > house", weights: {"face": 1.0, "house": -1.0})],
+///     iti: (min: 2.0, max: 8.0, mean: 4.0),
+///     max_repeat: Some(3),
+/// )
+/// ```
+///
+/// The design matrix holds one regressor per condition (trials convolved with the HRF and sampled
+/// at every TR), an intercept, and a linear drift. The efficiency of a contrast `c` is
+/// `1 / c' (X'X)^-1 c`, and the search maximizes the harmonic mean of the efficiencies of all
+/// contrasts (each condition against baseline if none are given).
+#[derive(Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Design {
+    tr: f64,
+    #[serde(default)]
+    hrf: Hrf,
+    conditions: Vec<Condition>,
+    #[serde(default)]
+    contrasts: Vec<Contrast>,
+    iti: Iti,
+    #[serde(default)]
+    max_repeat: Option<usize>,
+    #[serde(default)]
+    lead_in: f64,
+    #[serde(default = "defaults::lead_out")]
+    lead_out: f64,
+    #[serde(default = "defaults::iterations")]
+    iterations: usize,
+    #[serde(default = "defaults::restarts")]
+    restarts: usize,
+    #[serde(default)]
+    seed: Option<u64>,
+}
+
+/// Trial type of a design. `src` is the trial file (relative to the task directory) that is
+/// included through `Template` for every trial of the condition.
+#[derive(Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Condition {
+    name: String,
+    count: usize,
+    duration: f64,
+    src: PathBuf,
+}
+
+/// Named contrast over the conditions of a design. Missing conditions have a weight of 0.
+#[derive(Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Contrast {
+    name: String,
+    weights: BTreeMap<String, f64>,
+}
+
+/// Jitter of the interval between the end of a trial and the onset of the next one. Intervals are
+/// multiples of `step` within `[min, max]` and add up to `mean` times the number of trials, so
+/// the length of the run does not depend on the schedule.
+#[derive(Debug, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Iti {
+    min: f64,
+    max: f64,
+    mean: f64,
+    #[serde(default = "defaults::step")]
+    step: f64,
+}
+
+#[derive(Debug, Clone, Copy, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Hrf {
+    /// Difference of gammas peaking at 6 s with an undershoot at 16 s (as in SPM).
+    Canonical,
+    /// Gamma density with the given shape and scale (in seconds).
+    Gamma { shape: f64, scale: f64 },
+}
+
+impl Default for Hrf {
+    fn default() -> Self {
+        Hrf::Canonical
+    }
+}
+
+mod defaults {
+    #[inline(always)]
+    pub fn lead_out() -> f64 {
+        16.0
+    }
+
+    #[inline(always)]
+    pub fn iterations() -> usize {
+        10000
+    }
+
+    #[inline(always)]
+    pub fn restarts() -> usize {
+        4
+    }
+
+    #[inline(always)]
+    pub fn step() -> f64 {
+        0.1
+    }
+}
+
+/// A trial of an optimized schedule.
+#[derive(Debug, Clone)]
+pub struct ScheduledTrial {
+    pub condition: String,
+    pub src: PathBuf,
+    pub onset: f64,
+    pub duration: f64,
+    pub iti: f64,
+}
+
+/// Condition order and intervals found by `Design::optimize`, along with their efficiency.
+#[derive(Debug, Clone)]
+pub struct Schedule {
+    pub trials: Vec<ScheduledTrial>,
+    pub lead_in: f64,
+    pub length: f64,
+    pub scans: usize,
+    pub tr: f64,
+    pub seed: u64,
+    pub efficiency: f64,
+    pub baseline: f64,
+    pub contrasts: Vec<(String, f64)>,
+}
+
+impl Design {
+    pub fn new(path: &Path) -> Result<Self> {
+        let content = fs::read_to_string(path)
+            .wrap_err_with(|| format!("Failed to read design file ({path:?})."))?;
+        let design: Self = ron::from_str(&content)
+            .wrap_err_with(|| format!("Failed to parse design file ({path:?})."))?;
+        design.verify()?;
+        Ok(design)
+    }
+
+    fn verify(&self) -> Result<()> {
+        if self.tr <= 0.0 {
+            return Err(eyre!("Design `tr` should be positive."));
+        }
+        if self.lead_in < 0.0 || self.lead_out < 0.0 {
+            return Err(eyre!("Design `lead_in` and `lead_out` cannot be negative."));
+        }
+        if self.restarts == 0 {
+            return Err(eyre!("Design `restarts` should be at least 1."));
+        }
+        if self.max_repeat == Some(0) {
+            return Err(eyre!("Design `max_repeat` should be at least 1."));
+        }
+        if let Hrf::Gamma { shape, scale } = self.hrf {
+            if shape <= 0.0 || scale <= 0.0 {
+                return Err(eyre!("Shape and scale of `gamma` HRF should be positive."));
+            }
+        }
+
+        if self.conditions.is_empty() {
+            return Err(eyre!("Design should have at least one condition."));
+        }
+        let mut names = BTreeSet::new();
+        for c in self.conditions.iter() {
+            if !names.insert(c.name.as_str()) {
+                return Err(eyre!("Duplicate condition name in design: {}", c.name));
+            }
+            if c.count == 0 || c.duration < 0.0 {
+                return Err(eyre!(
+                    "Condition `{}` should have a positive `count` and a non-negative `duration`.",
+                    c.name
+                ));
+            }
+        }
+
+        for c in self.contrasts.iter() {
+            if let Some(name) = c.weights.keys().find(|k| !names.contains(k.as_str())) {
+                return Err(eyre!("Contrast `{}` has unknown condition: {name}", c.name));
+            }
+            if c.weights.values().all(|w| *w == 0.0) {
+                return Err(eyre!("Contrast `{}` has no non-zero weight.", c.name));
+            }
+        }
+
+        let iti = &self.iti;
+        if iti.step <= 0.0 || iti.min < 0.0 || iti.min > iti.mean || iti.mean > iti.max {
+            return Err(eyre!(
+                "Design `iti` should satisfy 0 <= min <= mean <= max and step > 0."
+            ));
+        }
+        let (min, max, total) = self.iti_units();
+        let n = self.trial_count() as u32;
+        if total < n * min || total > n * max {
+            return Err(eyre!(
+                "Design `iti` has no multiple of `step` ({}) between `min` and `max` with the \
+                requested `mean`.",
+                iti.step
+            ));
+        }
+
+        Ok(())
+    }
+
+    /// Finds the schedule with the highest efficiency, by hill climbing from `restarts` random
+    /// schedules. Each of the `iterations` steps either swaps the conditions of two trials or
+    /// moves part of the interval after one trial to another, and keeps the change unless it
+    /// lowers the efficiency. Orders that break `max_repeat` are never visited.
+    pub fn optimize(&self, seed: Option<u64>) -> Result<Schedule> {
+        let seed = seed.or(self.seed).unwrap_or_else(|| {
+            SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .map_or(1, |t| t.as_secs())
+        });
+        let mut rng = Rng::new(seed);
+        let kernel = self.hrf.kernel();
+        let contrasts = self.contrast_vectors();
+
+        let mut best: Option<(f64, Vec<usize>, Vec<u32>)> = None;
+        let mut baseline = 0.0;
+        for _ in 0..self.restarts {
+            let mut order = self.random_order(&mut rng)?;
+            let mut units = self.random_itis(&mut rng);
+            let mut score = self.score(&order, &units, &kernel, &contrasts);
+            baseline += score / self.restarts as f64;
+
+            for _ in 0..self.iterations {
+                let (old_order, old_units) = (order.clone(), units.clone());
+                if !self.perturb(&mut order, &mut units, &mut rng) {
+                    continue;
+                }
+
+                let new_score = self.score(&order, &units, &kernel, &contrasts);
+                if new_score >= score {
+                    score = new_score;
+                } else {
+                    order = old_order;
+                    units = old_units;
+                }
+            }
+
+            if best.as_ref().map_or(true, |(s, _, _)| score > *s) {
+                best = Some((score, order, units));
+            }
+        }
+
+        let (efficiency, order, units) = best.unwrap();
+        if efficiency <= 0.0 {
+            return Err(eyre!(
+                "Contrasts of the design are not estimable (design matrix is singular)."
+            ));
+        }
+
+        let efficiencies = self
+            .efficiencies(&order, &units, &kernel, &contrasts)
+            .unwrap_or_default();
+        let trials = self
+            .onsets(&order, &units)
+            .into_iter()
+            .zip(units.iter())
+            .map(|((c, onset), u)| {
+                let condition = &self.conditions[c];
+                ScheduledTrial {
+                    condition: condition.name.clone(),
+                    src: condition.src.clone(),
+                    onset,
+                    duration: condition.duration,
+                    iti: *u as f64 * self.iti.step,
+                }
+            })
+            .collect();
+
+        Ok(Schedule {
+            trials,
+            lead_in: self.lead_in,
+            length: self.length(&units),
+            scans: self.scans(&units),
+            tr: self.tr,
+            seed,
+            efficiency,
+            baseline,
+            contrasts: contrasts
+                .into_iter()
+                .map(|(name, _)| name)
+                .zip(efficiencies)
+                .collect(),
+        })
+    }
+
+    #[inline(always)]
+    fn trial_count(&self) -> usize {
+        self.conditions.iter().map(|c| c.count).sum()
+    }
+
+    /// Bounds and total of the intervals, in multiples of `step`.
+    fn iti_units(&self) -> (u32, u32, u32) {
+        let iti = &self.iti;
+        let min = (iti.min / iti.step - 1e-9).ceil() as u32;
+        let max = (iti.max / iti.step + 1e-9).floor() as u32;
+        let total = (iti.mean * self.trial_count() as f64 / iti.step).round() as u32;
+        (min, max, total)
+    }
+
+    /// Contrasts as weight vectors over the conditions, one per condition if none are given.
+    fn contrast_vectors(&self) -> Vec<(String, Vec<f64>)> {
+        if self.contrasts.is_empty() {
+            return (0..self.conditions.len())
+                .map(|i| {
+                    let mut weights = vec![0.0; self.conditions.len()];
+                    weights[i] = 1.0;
+                    (self.conditions[i].name.clone(), weights)
+                })
+                .collect();
+        }
+
+        self.contrasts
+            .iter()
+            .map(|c| {
+                let weights = self
+                    .conditions
+                    .iter()
+                    .map(|cond| c.weights.get(&cond.name).copied().unwrap_or(0.0))
+                    .collect();
+                (c.name.clone(), weights)
+            })
+            .collect()
+    }
+
+    /// Random condition order that satisfies `max_repeat`, built one trial at a time. The
+    /// condition of each trial is drawn (weighted by the trials it has left) among those that
+    /// neither break the limit nor leave the remaining trials without a valid order, and the
+    /// search backtracks if it still runs out of options.
+    fn random_order(&self, rng: &mut Rng) -> Result<Vec<usize>> {
+        let mut remaining: Vec<_> = self.conditions.iter().map(|c| c.count).collect();
+        let n = self.trial_count();
+        let max_repeat = match self.max_repeat {
+            Some(max_repeat) => max_repeat,
+            None => {
+                let mut order: Vec<_> = (0..remaining.len())
+                    .flat_map(|i| std::iter::repeat(i).take(remaining[i]))
+                    .collect();
+                rng.shuffle(&mut order);
+                return Ok(order);
+            }
+        };
+
+        let mut order = Vec::with_capacity(n);
+        // Conditions left to try at each position, next one last
+        let mut options: Vec<Vec<usize>> = vec![];
+        while order.len() < n {
+            let mut candidates: Vec<_> = (0..remaining.len())
+                .filter(|&c| {
+                    if remaining[c] == 0 {
+                        return false;
+                    }
+                    order.push(c);
+                    remaining[c] -= 1;
+                    let valid = can_complete(&order, &remaining, max_repeat);
+                    remaining[c] += 1;
+                    order.pop();
+                    valid
+                })
+                .collect();
+
+            let mut drawn = vec![];
+            while !candidates.is_empty() {
+                let total = candidates.iter().map(|&c| remaining[c]).sum();
+                let mut x = rng.below(total);
+                let i = candidates
+                    .iter()
+                    .position(|&c| match x.checked_sub(remaining[c]) {
+                        Some(rest) => {
+                            x = rest;
+                            false
+                        }
+                        None => true,
+                    })
+                    .unwrap();
+                drawn.push(candidates.swap_remove(i));
+            }
+            drawn.reverse();
+            options.push(drawn);
+
+            loop {
+                match options.last_mut() {
+                    Some(drawn) => match drawn.pop() {
+                        Some(c) => {
+                            order.push(c);
+                            remaining[c] -= 1;
+                            break;
+                        }
+                        None => {
+                            options.pop();
+                            if let Some(c) = order.pop() {
+                                remaining[c] += 1;
+                            }
+                        }
+                    },
+                    None => {
+                        return Err(eyre!(
+                            "There is no condition order with at most {max_repeat} repetitions \
+                            in a row."
+                        ))
+                    }
+                }
+            }
+        }
+        Ok(order)
+    }
+
+    /// Intervals (in multiples of `step`) that start at the minimum, with the rest of the total
+    /// handed out one step at a time to random trials.
+    fn random_itis(&self, rng: &mut Rng) -> Vec<u32> {
+        let (min, max, total) = self.iti_units();
+        let n = self.trial_count();
+        let mut units = vec![min; n];
+        let mut remaining = total - n as u32 * min;
+        while remaining > 0 {
+            let i = rng.below(n);
+            if units[i] < max {
+                units[i] += 1;
+                remaining -= 1;
+            }
+        }
+        units
+    }
+
+    /// Whether an order has no more than `max_repeat` trials of the same condition in a row.
+    fn satisfies(&self, order: &[usize]) -> bool {
+        let max_repeat = match self.max_repeat {
+            Some(max_repeat) => max_repeat,
+            None => return true,
+        };
+
+        let mut run = 0;
+        for (i, c) in order.iter().enumerate() {
+            if i > 0 && order[i - 1] == *c {
+                run += 1;
+            } else {
+                run = 1;
+            }
+            if run > max_repeat {
+                return false;
+            }
+        }
+        true
+    }
+
+    /// Applies a random change to the schedule, and returns false if nothing was changed.
+    fn perturb(&self, order: &mut [usize], units: &mut [u32], rng: &mut Rng) -> bool {
+        let n = order.len();
+        if n < 2 {
+            return false;
+        }
+
+        let (a, b) = (rng.below(n), rng.below(n));
+        if a == b {
+            return false;
+        }
+
+        if rng.below(2) == 0 {
+            if order[a] == order[b] {
+                return false;
+            }
+            order.swap(a, b);
+            if !self.satisfies(order) {
+                order.swap(a, b);
+                return false;
+            }
+        } else {
+            let (min, max, _) = self.iti_units();
+            let room = (units[a] - min).min(max - units[b]);
+            if room == 0 {
+                return false;
+            }
+            let k = rng.below(room as usize) as u32 + 1;
+            units[a] -= k;
+            units[b] += k;
+        }
+
+        true
+    }
+
+    fn onsets(&self, order: &[usize], units: &[u32]) -> Vec<(usize, f64)> {
+        let mut t = self.lead_in;
+        order
+            .iter()
+            .zip(units.iter())
+            .map(|(&c, &u)| {
+                let onset = t;
+                t += self.conditions[c].duration + u as f64 * self.iti.step;
+                (c, onset)
+            })
+            .collect()
+    }
+
+    #[inline(always)]
+    fn length(&self, units: &[u32]) -> f64 {
+        let trials: f64 = self
+            .conditions
+            .iter()
+            .map(|c| c.count as f64 * c.duration)
+            .sum();
+        let itis = units.iter().sum::<u32>() as f64 * self.iti.step;
+        self.lead_in + trials + itis + self.lead_out
+    }
+
+    #[inline(always)]
+    fn scans(&self, units: &[u32]) -> usize {
+        (self.length(units) / self.tr).ceil() as usize
+    }
+
+    /// Harmonic mean of the efficiencies of the contrasts, or 0 if any of them is not estimable.
+    fn score(
+        &self,
+        order: &[usize],
+        units: &[u32],
+        kernel: &[f64],
+        contrasts: &[(String, Vec<f64>)],
+    ) -> f64 {
+        match self.efficiencies(order, units, kernel, contrasts) {
+            Some(e) => e.len() as f64 / e.iter().map(|e| 1.0 / e).sum::<f64>(),
+            None => 0.0,
+        }
+    }
+
+    fn efficiencies(
+        &self,
+        order: &[usize],
+        units: &[u32],
+        kernel: &[f64],
+        contrasts: &[(String, Vec<f64>)],
+    ) -> Option<Vec<f64>> {
+        let k = self.conditions.len();
+        let scans = self.scans(units);
+        if scans == 0 {
+            return None;
+        }
+
+        // Condition regressors, followed by an intercept and a linear drift
+        let mut x = vec![vec![0.0; k + 2]; scans];
+        for (j, row) in x.iter_mut().enumerate() {
+            row[k] = 1.0;
+            row[k + 1] = j as f64 / scans as f64 - 0.5;
+        }
+        for (c, onset) in self.onsets(order, units) {
+            let duration = self.conditions[c].duration;
+            let steps = ((duration / DT).round() as usize).max(1);
+            let width = duration.max(DT) / steps as f64;
+            let first = (onset / self.tr).ceil() as usize;
+            let last = ((onset + duration + HRF_LENGTH) / self.tr).floor() as usize;
+            for (j, row) in x.iter_mut().enumerate().take(last + 1).skip(first) {
+                let mut response = 0.0;
+                for m in 0..steps {
+                    let lag = j as f64 * self.tr - onset - m as f64 * DT;
+                    if lag < 0.0 {
+                        break;
+                    }
+                    if let Some(h) = kernel.get((lag / DT).round() as usize) {
+                        response += h;
+                    }
+                }
+                row[c] += response * width;
+            }
+        }
+
+        let p = k + 2;
+        let mut xtx = vec![vec![0.0; p]; p];
+        for row in x.iter() {
+            for a in 0..p {
+                for b in a..p {
+                    xtx[a][b] += row[a] * row[b];
+                }
+            }
+        }
+        for a in 0..p {
+            for b in 0..a {
+                xtx[a][b] = xtx[b][a];
+            }
+        }
+
+        let inv = invert(xtx)?;
+        contrasts
+            .iter()
+            .map(|(_, weights)| {
+                let mut variance = 0.0;
+                for (a, wa) in weights.iter().enumerate() {
+                    for (b, wb) in weights.iter().enumerate() {
+                        variance += wa * inv[a][b] * wb;
+                    }
+                }
+                if variance > 0.0 {
+                    Some(1.0 / variance)
+                } else {
+                    None
+                }
+            })
+            .collect()
+    }
+}
+
+impl Hrf {
+    /// Response sampled every `DT` seconds over `HRF_LENGTH` seconds, scaled to a peak of 1.
+    fn kernel(&self) -> Vec<f64> {
+        let mut kernel: Vec<_> = (0..(HRF_LENGTH / DT) as usize)
+            .map(|i| {
+                let t = i as f64 * DT;
+                match self {
+                    Hrf::Canonical => gamma_pdf(t, 6.0, 1.0) - gamma_pdf(t, 16.0, 1.0) / 6.0,
+                    Hrf::Gamma { shape, scale } => gamma_pdf(t, *shape, *scale),
+                }
+            })
+            .collect();
+
+        let peak = kernel.iter().copied().fold(0.0, f64::max);
+        if peak > 0.0 {
+            kernel.iter_mut().for_each(|h| *h /= peak);
+        }
+        kernel
+    }
+}
+
+impl Schedule {
+    /// Action tree that runs the trials at their scheduled onsets, to be included in a block with
+    /// `template((src: "<stem>_schedule.ron"))`. Every trial is delayed by its onset from the
+    /// start of the tree (so timing errors do not add up over the run), is given its slot (its
+    /// duration and the interval after it), and is stopped when the slot is over. The tree ends
+    /// with the run. The trial files can use the `${trial}`, `${condition}`, `${onset}`,
+    /// `${duration}`, and `${iti}` parameters.
+    pub fn to_ron(&self, source: &str) -> String {
+        let mut ron = format!(
+            "// Generated by `cog-tool design` from {source} (seed {}, efficiency {:.4}).\n\
+            par(([wait(({:.3}))], [\n",
+            self.seed, self.efficiency, self.length
+        );
+        for (i, trial) in self.trials.iter().enumerate() {
+            writeln!(
+                ron,
+                "    delayed(({:.3}, timeout(({:.3}, template((src: {:?}, params: {{\"trial\": \
+                \"{}\", \"condition\": {:?}, \"onset\": \"{:.3}\", \"duration\": \"{:.3}\", \
+                \"iti\": \"{:.3}\"}})))))),",
+                trial.onset,
+                trial.duration + trial.iti,
+                trial.src.to_string_lossy(),
+                i + 1,
+                trial.condition,
+                trial.onset,
+                trial.duration,
+                trial.iti
+            )
+            .unwrap();
+        }
+        ron.push_str("]))\n");
+        ron
+    }
+
+    pub fn to_csv(&self) -> String {
+        let mut csv = "trial,condition,onset,duration,iti\n".to_owned();
+        for (i, trial) in self.trials.iter().enumerate() {
+            writeln!(
+                csv,
+                "{},{},{:.3},{:.3},{:.3}",
+                i + 1,
+                trial.condition,
+                trial.onset,
+                trial.duration,
+                trial.iti
+            )
+            .unwrap();
+        }
+        csv
+    }
+
+    pub fn report(&self) -> String {
+        let mut report = format!(
+            "Trials: {}\nRun length: {:.1} s ({} scans at TR {} s)\nSeed: {}\n\
+            Efficiency: {:.4} (random schedules: {:.4})\nContrasts:\n",
+            self.trials.len(),
+            self.length,
+            self.scans,
+            self.tr,
+            self.seed,
+            self.efficiency,
+            self.baseline,
+        );
+        for (name, efficiency) in self.contrasts.iter() {
+            writeln!(report, "  {name}: {efficiency:.4}").unwrap();
+        }
+        report
+    }
+
+    /// Writes the schedule (`<stem>_schedule.ron`), its trial list (`<stem>_schedule.csv`), and
+    /// the report (`<stem>_report.txt`) next to the design file at `path`.
+    pub fn save(&self, path: &Path) -> Result<Vec<PathBuf>> {
+        let dir = path.parent().unwrap_or_else(|| Path::new("."));
+        let stem = path
+            .file_stem()
+            .ok_or_else(|| eyre!("Invalid design file path: {path:?}"))?
+            .to_string_lossy();
+        let source = path.file_name().unwrap().to_string_lossy();
+
+        let files = [
+            (format!("{stem}_schedule.ron"), self.to_ron(&source)),
+            (format!("{stem}_schedule.csv"), self.to_csv()),
+            (
+                format!("{stem}_report.txt"),
+                format!("Design: {source}\n{}", self.report()),
+            ),
+        ];
+
+        let mut paths = vec![];
+        for (name, content) in files {
+            let path = dir.join(name);
+            fs::write(&path, content).wrap_err_with(|| format!("Failed to write {path:?}."))?;
+            paths.push(path);
+        }
+        Ok(paths)
+    }
+}
+
+/// Whether the trials in `remaining` (per condition) can follow `order` without more than
+/// `max_repeat` trials of the same condition in a row. Each condition needs enough trials of the
+/// others to separate its runs, and its first run continues the one that `order` ends with.
+fn can_complete(order: &[usize], remaining: &[usize], max_repeat: usize) -> bool {
+    let last = order.last().copied();
+    let run = order.iter().rev().take_while(|&&c| Some(c) == last).count();
+    if run > max_repeat {
+        return false;
+    }
+
+    let total: usize = remaining.iter().sum();
+    remaining.iter().enumerate().all(|(c, &count)| {
+        let slots = max_repeat * (total - count + 1);
+        let used = if Some(c) == last { run } else { 0 };
+        count + used <= slots
+    })
+}
+
+/// Inverse by Gauss-Jordan elimination with partial pivoting, or `None` if the matrix is
+/// (numerically) singular.
+fn invert(mut a: Vec<Vec<f64>>) -> Option<Vec<Vec<f64>>> {
+    let n = a.len();
+    let mut inv: Vec<_> = (0..n)
+        .map(|i| {
+            (0..n)
+                .map(|j| if i == j { 1.0 } else { 0.0 })
+                .collect::<Vec<_>>()
+        })
+        .collect();
+
+    for col in 0..n {
+        let pivot = (col..n).max_by(|&i, &j| {
+            a[i][col]
+                .abs()
+                .partial_cmp(&a[j][col].abs())
+                .unwrap_or(Ordering::Equal)
+        })?;
+        if a[pivot][col].abs() < 1e-12 {
+            return None;
+        }
+        a.swap(col, pivot);
+        inv.swap(col, pivot);
+
+        let d = a[col][col];
+        a[col].iter_mut().for_each(|v| *v /= d);
+        inv[col].iter_mut().for_each(|v| *v /= d);
+
+        let (row, inv_row) = (a[col].clone(), inv[col].clone());
+        for i in (0..n).filter(|&i| i != col) {
+            let f = a[i][col];
+            if f != 0.0 {
+                for j in 0..n {
+                    a[i][j] -= f * row[j];
+                    inv[i][j] -= f * inv_row[j];
+                }
+            }
+        }
+    }
+
+    Some(inv)
+}
+
+fn gamma_pdf(t: f64, shape: f64, scale: f64) -> f64 {
+    if t <= 0.0 {
+        return 0.0;
+    }
+    ((shape - 1.0) * t.ln() - t / scale - ln_gamma(shape) - shape * scale.ln()).exp()
+}
+
+/// Lanczos approximation of the logarithm of the gamma function.
+#[allow(clippy::excessive_precision)]
+fn ln_gamma(x: f64) -> f64 {
+    const G: f64 = 7.0;
+    const COEF: [f64; 9] = [
+        0.99999999999980993,
+        676.5203681218851,
+        -1259.1392167224028,
+        771.32342877765313,
+        -176.61502916214059,
+        12.507343278686905,
+        -0.13857109526572012,
+        9.9843695780195716e-6,
+        1.5056327351493116e-7,
+    ];
+
+    if x < 0.5 {
+        return (PI / (PI * x).sin()).ln() - ln_gamma(1.0 - x);
+    }
+
+    let x = x - 1.0;
+    let t = x + G + 0.5;
+    let a = COEF
+        .iter()
+        .enumerate()
+        .skip(1)
+        .fold(COEF[0], |a, (i, c)| a + c / (x + i as f64));
+    0.5 * (2.0 * PI).ln() + (x + 0.5) * t.ln() - t + a.ln()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn design(extra: &str) -> Design {
+        ron::from_str(&format!(
+            "(
+                tr: 2.0,
+                conditions: [
+                    (name: \"a\", count: 8, duration: 1.0, src: \"a.ron\"),
+                    (name: \"b\", count: 8, duration: 1.0, src: \"b.ron\"),
+                ],
+                iti: (min: 2.0, max: 6.0, mean: 4.0, step: 0.5),
+                iterations: 200,
+                restarts: 2,
+                {extra}
+            )"
+        ))
+        .unwrap()
+    }
+
+    #[test]
+    fn invalid_designs_are_rejected() {
+        assert!(design("").verify().is_ok());
+        assert!(design("max_repeat: Some(0),").verify().is_err());
+        assert!(design("contrasts: [(name: \"c\", weights: {\"c\": 1.0})],")
+            .verify()
+            .is_err());
+        assert!(design("contrasts: [(name: \"a\", weights: {\"a\": 0.0})],")
+            .verify()
+            .is_err());
+
+        let mut bad_iti = design("");
+        bad_iti.iti.mean = 7.0;
+        assert!(bad_iti.verify().is_err());
+    }
+
+    #[test]
+    fn repetitions_are_limited() {
+        let design = design("max_repeat: Some(2),");
+        assert!(design.satisfies(&[0, 0, 1, 1, 0]));
+        assert!(!design.satisfies(&[0, 1, 1, 1, 0]));
+
+        let mut rng = Rng::new(7);
+        for _ in 0..20 {
+            assert!(design.satisfies(&design.random_order(&mut rng).unwrap()));
+        }
+    }
+
+    #[test]
+    fn tight_repetition_limits_are_met() {
+        // Random shuffles of 2 x 30 trials almost never have runs of at most 2
+        let design: Design = ron::from_str(
+            "(
+                tr: 2.0,
+                conditions: [
+                    (name: \"a\", count: 30, duration: 1.0, src: \"a.ron\"),
+                    (name: \"b\", count: 30, duration: 1.0, src: \"b.ron\"),
+                ],
+                iti: (min: 2.0, max: 6.0, mean: 4.0),
+                max_repeat: Some(2),
+            )",
+        )
+        .unwrap();
+
+        let mut rng = Rng::new(7);
+        for _ in 0..20 {
+            let order = design.random_order(&mut rng).unwrap();
+            assert_eq!(order.len(), 60);
+            assert_eq!(order.iter().filter(|c| **c == 0).count(), 30);
+            assert!(design.satisfies(&order));
+        }
+
+        // Only alternating orders are valid, and impossible limits are reported
+        let mut design = design;
+        design.max_repeat = Some(1);
+        let order = design.random_order(&mut rng).unwrap();
+        assert!(order.windows(2).all(|w| w[0] != w[1]));
+        design.conditions[0].count = 32;
+        assert!(design.random_order(&mut rng).is_err());
+    }
+
+    #[test]
+    fn order_completion() {
+        assert!(can_complete(&[], &[3, 1], 2));
+        assert!(!can_complete(&[], &[5, 1], 2));
+        assert!(can_complete(&[0], &[1, 1], 1));
+        assert!(can_complete(&[0, 0], &[1, 1], 2));
+        assert!(!can_complete(&[0, 0], &[2, 0], 2));
+        assert!(!can_complete(&[0, 0, 0], &[0, 1], 2));
+    }
+
+    #[test]
+    fn schedule_onsets_are_absolute() {
+        let design = design("lead_in: 2.0,");
+        let schedule = design.optimize(Some(42)).unwrap();
+        let ron = schedule.to_ron("design.ron");
+
+        assert!(ron.contains(&format!("par(([wait(({:.3}))]", schedule.length)));
+        for trial in schedule.trials.iter() {
+            let slot = trial.duration + trial.iti;
+            assert!(ron.contains(&format!("delayed(({:.3}, timeout(({slot:.3},", trial.onset)));
+        }
+        assert_eq!(ron.matches('(').count(), ron.matches(')').count());
+        assert_eq!(ron.matches('[').count(), ron.matches(']').count());
+    }
+
+    #[test]
+    fn intervals_keep_their_total() {
+        let design = design("");
+        let (min, max, total) = design.iti_units();
+        assert_eq!((min, max, total), (4, 12, 128));
+
+        let mut rng = Rng::new(7);
+        let mut units = design.random_itis(&mut rng);
+        let mut order = design.random_order(&mut rng).unwrap();
+        for _ in 0..100 {
+            design.perturb(&mut order, &mut units, &mut rng);
+            assert_eq!(units.iter().sum::<u32>(), total);
+            assert!(units.iter().all(|u| (min..=max).contains(u)));
+        }
+        assert_eq!(design.length(&units), 0.0 + 16.0 + 64.0 + 16.0);
+    }
+
+    #[test]
+    fn optimization_does_not_lower_efficiency() {
+        let design = design("contrasts: [(name: \"a > b\", weights: {\"a\": 1.0, \"b\": -1.0})],");
+        let schedule = design.optimize(Some(42)).unwrap();
+
+        assert_eq!(schedule.trials.len(), 16);
+        assert!(schedule.efficiency >= schedule.baseline);
+        assert_eq!(schedule.contrasts.len(), 1);
+        assert!(schedule
+            .trials
+            .windows(2)
+            .all(|t| t[1].onset == t[0].onset + t[0].duration + t[0].iti));
+
+        // The same seed gives the same schedule
+        let again = design.optimize(Some(42)).unwrap();
+        assert_eq!(schedule.to_csv(), again.to_csv());
+    }
+
+    #[test]
+    fn efficiency_of_differences() {
+        let design = design("contrasts: [(name: \"a > b\", weights: {\"a\": 1.0, \"b\": -1.0})],");
+        let kernel = design.hrf.kernel();
+        let contrasts = design.contrast_vectors();
+        let units = vec![8; 16];
+
+        // Swapping the conditions only flips the sign of the difference
+        let order: Vec<_> = (0..16).map(|i| (i / 3) % 2).collect();
+        let swapped: Vec<_> = order.iter().map(|c| 1 - c).collect();
+        let score = design.score(&order, &units, &kernel, &contrasts);
+        assert!(score > 0.0);
+        assert!((score - design.score(&swapped, &units, &kernel, &contrasts)).abs() < 1e-9);
+
+        // A condition without trials cannot be estimated
+        assert_eq!(design.score(&[0; 16], &units, &kernel, &contrasts), 0.0);
+    }
+
+    #[test]
+    fn matrix_inverse() {
+        let inv = invert(vec![vec![4.0, 7.0], vec![2.0, 6.0]]).unwrap();
+        let expected = [[0.6, -0.7], [-0.2, 0.4]];
+        for (row, expected) in inv.iter().zip(expected.iter()) {
+            for (v, e) in row.iter().zip(expected.iter()) {
+                assert!((v - e).abs() < 1e-12);
+            }
+        }
+        assert!(invert(vec![vec![1.0, 2.0], vec![2.0, 4.0]]).is_none());
+    }
+
+    #[test]
+    fn hrf_peaks_at_one() {
+        assert!((ln_gamma(5.0) - 24f64.ln()).abs() < 1e-10);
+
+        let kernel = Hrf::Canonical.kernel();
+        let peak = kernel
+            .iter()
+            .enumerate()
+            .max_by(|a, b| a.1.partial_cmp(b.1).unwrap())
+            .unwrap();
+        assert!((peak.1 - 1.0).abs() < 1e-12);
+        assert!((peak.0 as f64 * DT - 5.0).abs() <= 1.0);
+    }
+}
@@ -1,3 +1,5 @@
+pub mod template;
+
 use crate::assets::{Icon, VERSION};
 use crate::comm::QReader;
 use crate::gui::{
@@ -5,18 +7,19 @@ use crate::gui::{
     TEXT_SIZE_DIALOGUE_TITLE,
 };
 use crate::util::SystemInfo;
-use eframe::egui::{Align, CursorIcon, Layout, Vec2, Window};
+use eframe::egui::{Align, Color32, ComboBox, CursorIcon, Grid, Layout, Vec2, Window};
 use eframe::glow::HasContext;
 use eframe::{egui, App, Storage};
 use egui::widget_text::RichText;
 use egui_extras::{Size, StripBuilder};
-use heck::ToTitleCase;
+use heck::{ToSnakeCase, ToTitleCase};
 use itertools::Itertools;
 use native_dialog::FileDialog;
 use std::env::{current_dir, current_exe};
 use std::path::PathBuf;
 use std::thread;
-use std::time::Duration;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+use template::{Params, TEMPLATES};
 
 enum Status {
     None,
@@ -34,6 +37,17 @@ pub struct Launcher {
     status: Status,
     sys_info: SystemInfo,
     sync_reader: QReader<LauncherSignal>,
+    wizard: Option<Wizard>,
+}
+
+/// State of the new-task wizard, which fills in a paradigm template.
+struct Wizard {
+    template: usize,
+    name: String,
+    params: Params,
+    stimuli: Option<PathBuf>,
+    seed: String,
+    error: Option<String>,
 }
 
 impl Default for Launcher {
@@ -80,6 +94,7 @@ impl Launcher {
                 status: Status::None,
                 sys_info: SystemInfo::new(),
                 sync_reader: QReader::new(),
+                wizard: None,
             }
         } else {
             Self {
@@ -91,6 +106,7 @@ impl Launcher {
                 status: Status::None,
                 sys_info: SystemInfo::new(),
                 sync_reader: QReader::new(),
+                wizard: None,
             }
         }
     }
@@ -213,6 +229,23 @@ impl Launcher {
     }
 }
 
+impl Wizard {
+    fn new(template: usize) -> Self {
+        let seed = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map_or(1, |t| t.as_secs());
+
+        Self {
+            template,
+            name: format!("My {}", TEMPLATES[template].name),
+            params: TEMPLATES[template].defaults(),
+            stimuli: None,
+            seed: seed.to_string(),
+            error: None,
+        }
+    }
+}
+
 #[derive(Debug, Clone, PartialEq, Eq, Hash)]
 pub enum LauncherSignal {
     TaskCrashed(String),
@@ -257,7 +290,7 @@ impl Launcher {
                 ui.output().cursor_icon = CursorIcon::NotAllowed;
             }
 
-            ui.add_enabled_ui(!self.busy, |ui| {
+            ui.add_enabled_ui(!self.busy && self.wizard.is_none(), |ui| {
                 StripBuilder::new(ui)
                     .size(Size::exact(10.0))
                     .size(Size::exact(55.0))
@@ -283,7 +316,7 @@ impl Launcher {
                         strip.cell(|ui| {
                             StripBuilder::new(ui)
                                 .size(Size::remainder())
-                                .size(Size::exact(240.0))
+                                .size(Size::exact(300.0))
                                 .size(Size::remainder())
                                 .horizontal(|mut strip| {
                                     strip.empty();
@@ -319,6 +352,10 @@ impl Launcher {
             });
         });
 
+        if self.wizard.is_some() {
+            self.show_wizard(ctx);
+        }
+
         if !matches!(self.status, Status::None) {
             self.show_status(ctx);
         }
@@ -329,6 +366,7 @@ impl Launcher {
             None,
             LoadTask,
             LoadTaskRepo,
+            NewTask,
             ShowSystemInfo,
             ShowHelp,
         }
@@ -336,7 +374,7 @@ impl Launcher {
         let mut interaction = Interaction::None;
 
         style_ui(ui, Style::IconControls);
-        ui.columns(4, |columns| {
+        ui.columns(5, |columns| {
             if columns[0]
                 .button(Icon::Folder)
                 .on_hover_text(tooltip("Load task"))
@@ -352,13 +390,20 @@ impl Launcher {
                 interaction = Interaction::LoadTaskRepo;
             }
             if columns[2]
+                .button(Icon::Plus)
+                .on_hover_text(tooltip("New task from template"))
+                .clicked()
+            {
+                interaction = Interaction::NewTask;
+            }
+            if columns[3]
                 .button(Icon::SystemInfo)
                 .on_hover_text(tooltip("System information"))
                 .clicked()
             {
                 interaction = Interaction::ShowSystemInfo;
             }
-            if columns[3]
+            if columns[4]
                 .button(Icon::Help)
                 .on_hover_text(tooltip("Help"))
                 .clicked()
@@ -403,6 +448,9 @@ impl Launcher {
                     }
                 }
             }
+            Interaction::NewTask => {
+                self.wizard = Some(Wizard::new(0));
+            }
             Interaction::ShowSystemInfo => {
                 self.status = Status::SystemInfo;
             }
@@ -450,6 +498,165 @@ impl Launcher {
         }
     }
 
+    fn show_wizard(&mut self, ctx: &egui::Context) {
+        enum Interaction {
+            None,
+            SelectTemplate(usize),
+            ChooseStimuli,
+            ClearStimuli,
+            Create,
+            Cancel,
+        }
+
+        let mut interaction = Interaction::None;
+        let wizard = self.wizard.as_mut().unwrap();
+        let template = &TEMPLATES[wizard.template];
+        let body = |text: &str| RichText::new(text).size(TEXT_SIZE_DIALOGUE_BODY * 0.8);
+
+        let mut open = true;
+        Window::new(
+            RichText::from("New Task")
+                .size(TEXT_SIZE_DIALOGUE_TITLE)
+                .strong(),
+        )
+        .collapsible(false)
+        .open(&mut open)
+        .vscroll(true)
+        .min_width(480.0)
+        .default_size(Vec2::new(480.0, 400.0))
+        .show(ctx, |ui| {
+            ComboBox::from_label(body("Template"))
+                .selected_text(body(template.name))
+                .show_ui(ui, |ui| {
+                    for (i, t) in TEMPLATES.iter().enumerate() {
+                        if ui
+                            .selectable_label(i == wizard.template, body(t.name))
+                            .clicked()
+                        {
+                            interaction = Interaction::SelectTemplate(i);
+                        }
+                    }
+                });
+            ui.label(body(template.summary).italics());
+            ui.add_space(8.0);
+
+            Grid::new("wizard_params")
+                .num_columns(2)
+                .spacing([16.0, 6.0])
+                .show(ui, |ui| {
+                    ui.label(body("Task name"));
+                    ui.text_edit_singleline(&mut wizard.name);
+                    ui.end_row();
+
+                    for param in template.params {
+                        let value = wizard.params.get_mut(param.key).unwrap();
+                        let valid = param.check(value).is_ok();
+                        ui.label(if valid {
+                            body(param.label)
+                        } else {
+                            body(param.label).color(Color32::from(gui::CUSTOM_RED))
+                        });
+                        ui.text_edit_singleline(value);
+                        ui.end_row();
+                    }
+
+                    ui.label(body("Seed"));
+                    ui.text_edit_singleline(&mut wizard.seed);
+                    ui.end_row();
+
+                    ui.label(body("Stimuli folder"));
+                    ui.horizontal(|ui| {
+                        if ui.button(body("Choose...")).clicked() {
+                            interaction = Interaction::ChooseStimuli;
+                        }
+                        if let Some(path) = wizard.stimuli.as_ref() {
+                            if ui.button(body("Clear")).clicked() {
+                                interaction = Interaction::ClearStimuli;
+                            }
+                            ui.label(body(&path.display().to_string()));
+                        } else {
+                            ui.label(body("(built-in stimuli)"));
+                        }
+                    });
+                    ui.end_row();
+                });
+
+            if let Some(error) = wizard.error.as_ref() {
+                ui.add_space(8.0);
+                ui.label(body(error).color(Color32::from(gui::CUSTOM_RED)));
+            }
+
+            ui.add_space(8.0);
+            ui.horizontal(|ui| {
+                if ui.button(body("Cancel")).clicked() {
+                    interaction = Interaction::Cancel;
+                }
+                if ui.button(body("Create and run")).clicked() {
+                    interaction = Interaction::Create;
+                }
+            });
+        });
+
+        if !open {
+            interaction = Interaction::Cancel;
+        }
+
+        match interaction {
+            Interaction::None => {}
+            Interaction::SelectTemplate(i) => {
+                *wizard = Wizard::new(i);
+            }
+            Interaction::ChooseStimuli => {
+                match FileDialog::new()
+                    .set_location(&self.root_dir)
+                    .show_open_single_dir()
+                {
+                    Ok(Some(path)) => wizard.stimuli = Some(path),
+                    Ok(None) => {}
+                    Err(e) => wizard.error = Some(format!("Failed to open file dialog: {e:?}")),
+                }
+            }
+            Interaction::ClearStimuli => {
+                wizard.stimuli = None;
+            }
+            Interaction::Create => {
+                let name = wizard.name.trim().to_owned();
+                let dir = self.root_dir.join(name.to_snake_case());
+                let result = if name.is_empty() {
+                    Err(eyre::eyre!("Task name cannot be empty."))
+                } else {
+                    wizard
+                        .seed
+                        .trim()
+                        .parse::<u64>()
+                        .map_err(|_| eyre::eyre!("Seed should be a non-negative integer."))
+                        .and_then(|seed| {
+                            template.create(
+                                &dir,
+                                &name,
+                                &wizard.params,
+                                wizard.stimuli.as_deref(),
+                                seed,
+                            )
+                        })
+                };
+
+                match result {
+                    Ok(()) => {
+                        let sys_info = self.sys_info.clone();
+                        *self = Self::new(self.root_dir.clone());
+                        self.sys_info = sys_info;
+                        self.run_task(dir);
+                    }
+                    Err(e) => wizard.error = Some(format!("{e:#}")),
+                }
+            }
+            Interaction::Cancel => {
+                self.wizard = None;
+            }
+        }
+    }
+
     fn show_status(&mut self, ctx: &egui::Context) {
         if matches!(self.status, Status::None) {
             return;
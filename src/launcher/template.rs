@@ -0,0 +1,926 @@
+use crate::assets::{
+    TEMPLATE_FLANKER, TEMPLATE_GO_NO_GO, TEMPLATE_NBACK, TEMPLATE_ODDBALL, TEMPLATE_POSNER,
+    TEMPLATE_POSNER_TRIAL, TEMPLATE_QUESTIONNAIRE, TEMPLATE_STROOP, TEMPLATE_TRIAL,
+};
+use crate::resource::Key;
+use crate::server::Task;
+use eyre::{eyre, Context, Result};
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::Path;
+
+pub type Params = BTreeMap<String, String>;
+type Condition = BTreeMap<&'static str, String>;
+
+const MAX_TRIALS: usize = 2000;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ParamKind {
+    Count,
+    Seconds,
+    Rate,
+    Text,
+}
+
+/// A parameter of a template that is asked for by the new-task wizard, and substituted for
+/// `{{key}}` in the template files.
+#[derive(Debug, Clone, Copy)]
+pub struct Param {
+    pub key: &'static str,
+    pub label: &'static str,
+    pub default: &'static str,
+    pub kind: ParamKind,
+}
+
+/// A parameterized paradigm that can be turned into a ready-to-run task directory.
+///
+/// The task file of a template has a `{{trials}}` (and `{{practice}}`) placeholder that is filled
+/// with one copy of the trial file per trial, with the placeholders of the trial file filled from
+/// the trial's condition, the parameters, and a per-trial `{{signal}}` id.
+///
+/// The `keys` parameter lists the `responses` response keys of the paradigm. A condition can give
+/// the index of the key that is the correct response as its `answer`; trials without one are
+/// scored correct if no response key is pressed. Practice trials are followed by feedback.
+pub struct Template {
+    pub name: &'static str,
+    pub summary: &'static str,
+    pub params: &'static [Param],
+    responses: usize,
+    task: &'static str,
+    trial: &'static str,
+    conditions: fn(&Params, usize, &mut Rng) -> Result<Vec<Condition>>,
+    stimuli: fn(&Params) -> Result<Vec<(String, String)>>,
+    extra: fn(&Params) -> Result<Vec<(&'static str, String)>>,
+}
+
+/// Small xorshift generator so that trial orders are reproducible from the seed that is recorded in
+/// the description of the generated task.
+pub struct Rng(u64);
+
+macro_rules! param {
+    ($key:literal, $label:literal, $default:literal, $kind:ident) => {
+        Param {
+            key: $key,
+            label: $label,
+            default: $default,
+            kind: ParamKind::$kind,
+        }
+    };
+}
+
+pub const TEMPLATES: &[Template] = &[
+    Template {
+        name: "Stroop",
+        summary: "Color-word Stroop task. Participants respond to the ink color of a color word, \
+            which is congruent or incongruent with the word itself.",
+        params: &[
+            param!("trials", "Trials", "60", Count),
+            param!("practice", "Practice trials", "9", Count),
+            param!("fixation", "Fixation (s)", "0.5", Seconds),
+            param!("response", "Response window (s)", "2.0", Seconds),
+            param!("keys", "Keys (red, green, blue)", "R, G, B", Text),
+        ],
+        responses: 3,
+        task: TEMPLATE_STROOP,
+        trial: TEMPLATE_TRIAL,
+        conditions: stroop_conditions,
+        stimuli: stroop_stimuli,
+        extra: no_extra,
+    },
+    Template {
+        name: "Flanker",
+        summary: "Arrow flanker task. Participants respond to the direction of the central arrow, \
+            which is flanked by congruent or incongruent arrows.",
+        params: &[
+            param!("trials", "Trials", "64", Count),
+            param!("practice", "Practice trials", "8", Count),
+            param!("fixation", "Fixation (s)", "0.5", Seconds),
+            param!("response", "Response window (s)", "1.5", Seconds),
+            param!("keys", "Keys (left, right)", "F, J", Text),
+        ],
+        responses: 2,
+        task: TEMPLATE_FLANKER,
+        trial: TEMPLATE_TRIAL,
+        conditions: flanker_conditions,
+        stimuli: flanker_stimuli,
+        extra: no_extra,
+    },
+    Template {
+        name: "Posner Cueing",
+        summary: "Endogenous Posner cueing task. A central arrow cues one side, and a target \
+            appears on the cued (valid) or the opposite (invalid) side.",
+        params: &[
+            param!("trials", "Trials", "80", Count),
+            param!("practice", "Practice trials", "10", Count),
+            param!("fixation", "Fixation (s)", "0.5", Seconds),
+            param!("cue", "Cue duration (s)", "0.3", Seconds),
+            param!("response", "Response window (s)", "1.5", Seconds),
+            param!("validity", "Cue validity", "0.8", Rate),
+            param!("keys", "Keys (left, right)", "F, J", Text),
+        ],
+        responses: 2,
+        task: TEMPLATE_POSNER,
+        trial: TEMPLATE_POSNER_TRIAL,
+        conditions: posner_conditions,
+        stimuli: posner_stimuli,
+        extra: no_extra,
+    },
+    Template {
+        name: "N-Back",
+        summary: "Letter n-back task. Participants respond whenever the current letter matches \
+            the one presented n letters earlier.",
+        params: &[
+            param!("trials", "Trials", "60", Count),
+            param!("practice", "Practice trials", "15", Count),
+            param!("n", "N", "2", Count),
+            param!("target_rate", "Target rate", "0.3", Rate),
+            param!("letters", "Letters", "BCDFGHKL", Text),
+            param!("fixation", "Inter-stimulus interval (s)", "0.5", Seconds),
+            param!("response", "Stimulus duration (s)", "2.0", Seconds),
+            param!("keys", "Key", "Space", Text),
+        ],
+        responses: 1,
+        task: TEMPLATE_NBACK,
+        trial: TEMPLATE_TRIAL,
+        conditions: nback_conditions,
+        stimuli: nback_stimuli,
+        extra: no_extra,
+    },
+    Template {
+        name: "Go/No-Go",
+        summary: "Go/no-go task. Participants respond to frequent go stimuli and withhold their \
+            response to rare no-go stimuli.",
+        params: &[
+            param!("trials", "Trials", "80", Count),
+            param!("practice", "Practice trials", "8", Count),
+            param!("go_rate", "Go rate", "0.75", Rate),
+            param!("fixation", "Fixation (s)", "0.5", Seconds),
+            param!("response", "Response window (s)", "1.0", Seconds),
+            param!("keys", "Key", "Space", Text),
+        ],
+        responses: 1,
+        task: TEMPLATE_GO_NO_GO,
+        trial: TEMPLATE_TRIAL,
+        conditions: go_no_go_conditions,
+        stimuli: go_no_go_stimuli,
+        extra: no_extra,
+    },
+    Template {
+        name: "Oddball",
+        summary: "Visual oddball task. Participants respond to rare deviant stimuli embedded in a \
+            stream of standard stimuli.",
+        params: &[
+            param!("trials", "Trials", "100", Count),
+            param!("practice", "Practice trials", "10", Count),
+            param!("deviant_rate", "Deviant rate", "0.2", Rate),
+            param!("fixation", "Inter-stimulus interval (s)", "0.6", Seconds),
+            param!("response", "Stimulus duration (s)", "1.0", Seconds),
+            param!("keys", "Key", "Space", Text),
+        ],
+        responses: 1,
+        task: TEMPLATE_ODDBALL,
+        trial: TEMPLATE_TRIAL,
+        conditions: oddball_conditions,
+        stimuli: oddball_stimuli,
+        extra: no_extra,
+    },
+    Template {
+        name: "Questionnaire",
+        summary: "Questionnaire without any stimuli. Every statement is rated on the same scale.",
+        params: &[
+            param!(
+                "items",
+                "Statements (separated by |)",
+                "I enjoy solving puzzles.|I find it easy to stay focused.|I often feel tired.",
+                Text
+            ),
+            param!(
+                "options",
+                "Scale (separated by |)",
+                "Strongly disagree|Disagree|Neutral|Agree|Strongly agree",
+                Text
+            ),
+        ],
+        responses: 0,
+        task: TEMPLATE_QUESTIONNAIRE,
+        trial: "",
+        conditions: no_conditions,
+        stimuli: no_stimuli,
+        extra: questionnaire_items,
+    },
+];
+
+impl Template {
+    pub fn defaults(&self) -> Params {
+        self.params
+            .iter()
+            .map(|p| (p.key.to_owned(), p.default.to_owned()))
+            .collect()
+    }
+
+    /// Fills in the task file of the template.
+    pub fn render(&self, name: &str, params: &Params, seed: u64) -> Result<String> {
+        let mut values = BTreeMap::new();
+        for param in self.params {
+            let value = params
+                .get(param.key)
+                .ok_or_else(|| eyre!("Missing value for parameter `{}`.", param.label))?;
+            let value = param
+                .check(value)
+                .wrap_err_with(|| format!("Invalid value for parameter `{}`.", param.label))?;
+            values.insert(param.key.to_owned(), value);
+        }
+        values.insert("name".to_owned(), escape(name));
+        for (key, value) in (self.extra)(params)? {
+            values.insert(key.to_owned(), value);
+        }
+
+        let keys = if self.responses > 0 {
+            let keys = response_keys(params)?;
+            if keys.len() != self.responses {
+                return Err(eyre!(
+                    "Expected {} response key(s), found {}.",
+                    self.responses,
+                    keys.len()
+                ));
+            }
+            values.insert("response_keys".to_owned(), keys.join(", "));
+            keys
+        } else {
+            vec![]
+        };
+
+        let mut rng = Rng::new(seed);
+        for (placeholder, count) in [("practice", "practice"), ("trials", "trials")] {
+            if !self.task.contains(&format!("{{{{{placeholder}}}}}")) {
+                continue;
+            }
+
+            let count = count_param(params, count)?;
+            let mut trials = vec![];
+            for (i, mut condition) in (self.conditions)(params, count, &mut rng)?
+                .into_iter()
+                .enumerate()
+            {
+                let mut values = values.clone();
+                let (times, correct_keys) = match condition.remove("answer") {
+                    Some(answer) => ("0.0".to_owned(), keys[answer.parse::<usize>()?].clone()),
+                    None => ("".to_owned(), "".to_owned()),
+                };
+                values.insert("times".to_owned(), times);
+                values.insert("correct_keys".to_owned(), correct_keys);
+
+                let (signal, success) = (2 * i + 1, 2 * i + 2);
+                values.insert("signal".to_owned(), signal.to_string());
+                if placeholder == "practice" {
+                    values.insert(
+                        "out_success".to_owned(),
+                        format!("\n{INDENT}    out_success: {success},"),
+                    );
+                    values.insert("feedback".to_owned(), feedback(success));
+                } else {
+                    values.insert("out_success".to_owned(), "".to_owned());
+                    values.insert("feedback".to_owned(), "".to_owned());
+                }
+
+                values.extend(condition.into_iter().map(|(k, v)| (k.to_owned(), v)));
+                trials.push(fill(self.trial, &values)?);
+            }
+            values.insert(placeholder.to_owned(), trials.join(""));
+        }
+
+        fill(self.task, &values)
+    }
+
+    /// Generates a new task directory at `dir` with the task file, a description, and the default
+    /// stimuli of the template. Files in `stimuli` (if any) are copied over the default stimuli.
+    pub fn create(
+        &self,
+        dir: &Path,
+        name: &str,
+        params: &Params,
+        stimuli: Option<&Path>,
+        seed: u64,
+    ) -> Result<()> {
+        if dir.exists() {
+            return Err(eyre!("Task directory already exists: {dir:?}"));
+        }
+
+        let content = self.render(name, params, seed)?;
+        ron::from_str::<Task>(&content).wrap_err("Generated task file is invalid.")?;
+
+        let mut description = format!(
+            "{}\n\nGenerated from the \"{}\" template with:\n",
+            self.summary, self.name
+        );
+        for param in self.params {
+            description.push_str(&format!("  {}: {}\n", param.label, params[param.key]));
+        }
+        description.push_str(&format!("  Seed: {seed}\n"));
+
+        let data = dir.join("data");
+        fs::create_dir_all(&data)
+            .wrap_err_with(|| format!("Failed to create task directory: {data:?}"))?;
+        fs::write(dir.join("task.ron"), content).wrap_err("Failed to write task file.")?;
+        fs::write(dir.join("description.txt"), description)
+            .wrap_err("Failed to write task description.")?;
+
+        let feedback = match self.responses {
+            0 => vec![],
+            _ => feedback_stimuli(),
+        };
+        for (file, svg) in (self.stimuli)(params)?.into_iter().chain(feedback) {
+            fs::write(data.join(&file), svg)
+                .wrap_err_with(|| format!("Failed to write stimulus file ({file})."))?;
+        }
+        if let Some(stimuli) = stimuli {
+            copy_dir(stimuli, &data)
+                .wrap_err_with(|| format!("Failed to copy stimuli from {stimuli:?}."))?;
+        }
+
+        Ok(())
+    }
+}
+
+impl Param {
+    /// Validates a raw value, and returns it in a form that can be put inside the task file.
+    pub fn check(&self, value: &str) -> Result<String> {
+        let value = value.trim();
+        match self.kind {
+            ParamKind::Count => {
+                let v: usize = value.parse().wrap_err("Expected a non-negative integer.")?;
+                if v > MAX_TRIALS {
+                    Err(eyre!("Value should be at most {MAX_TRIALS}."))
+                } else {
+                    Ok(v.to_string())
+                }
+            }
+            ParamKind::Seconds => {
+                let v: f32 = value.parse().wrap_err("Expected a number of seconds.")?;
+                if v > 0.0 {
+                    Ok(format!("{v:?}"))
+                } else {
+                    Err(eyre!("Duration should be positive."))
+                }
+            }
+            ParamKind::Rate => {
+                let v: f64 = value.parse().wrap_err("Expected a number.")?;
+                if (0.0..=1.0).contains(&v) {
+                    Ok(format!("{v:?}"))
+                } else {
+                    Err(eyre!("Rate should be between 0 and 1."))
+                }
+            }
+            ParamKind::Text => Ok(escape(value)),
+        }
+    }
+}
+
+impl Rng {
+    pub fn new(seed: u64) -> Self {
+        Self(seed.max(1))
+    }
+
+    pub fn next_u64(&mut self) -> u64 {
+        self.0 ^= self.0 << 13;
+        self.0 ^= self.0 >> 7;
+        self.0 ^= self.0 << 17;
+        self.0
+    }
+
+    pub fn below(&mut self, n: usize) -> usize {
+        (self.next_u64() % n as u64) as usize
+    }
+
+    pub fn shuffle<T>(&mut self, items: &mut [T]) {
+        for i in (1..items.len()).rev() {
+            items.swap(i, self.below(i + 1));
+        }
+    }
+}
+
+fn fill(template: &str, values: &BTreeMap<String, String>) -> Result<String> {
+    let mut content = template.to_owned();
+    for (key, value) in values {
+        content = content.replace(&format!("{{{{{key}}}}}"), value);
+    }
+
+    if let Some(i) = content.find("{{") {
+        let end = content[i..].find("}}").map_or(content.len(), |j| i + j + 2);
+        Err(eyre!(
+            "Unfilled placeholder in template: {}",
+            &content[i..end]
+        ))
+    } else {
+        Ok(content)
+    }
+}
+
+/// Names of the response keys in the `keys` parameter (e.g., `F, J` or `ArrowLeft`), as they are
+/// given to `reaction` (e.g., `f, j` or `arrow_left`).
+fn response_keys(params: &Params) -> Result<Vec<String>> {
+    params
+        .get("keys")
+        .ok_or_else(|| eyre!("Missing value for parameter `keys`."))?
+        .split(',')
+        .map(|k| k.trim())
+        .filter(|k| !k.is_empty())
+        .map(|k| {
+            let name = snake_case(k);
+            ron::from_str::<Key>(&name)
+                .map(|_| name)
+                .wrap_err_with(|| format!("Invalid response key: {k:?}"))
+        })
+        .collect()
+}
+
+fn snake_case(name: &str) -> String {
+    let mut snake = String::new();
+    let mut prev: Option<char> = None;
+    for c in name.chars() {
+        if c.is_uppercase() && prev.map_or(false, |p| p.is_lowercase() || p.is_ascii_digit()) {
+            snake.push('_');
+        }
+        snake.extend(c.to_lowercase());
+        prev = Some(c);
+    }
+    snake
+}
+
+/// Shows whether the preceding practice trial was answered correctly. The short blank gap lets the
+/// `out_success` signal of the trial reach the state before the switch reads it.
+fn feedback(success: usize) -> String {
+    let indent = &INDENT[4..];
+    format!(
+        "\n{indent}wait((0.1)),\n\
+        {indent}timeout((0.8, switch((\n\
+        {indent}    in_control: {success},\n\
+        {indent}    if: image((src: \"feedback_correct.svg\")),\n\
+        {indent}    else: image((src: \"feedback_incorrect.svg\")),\n\
+        {indent})))),"
+    )
+}
+
+fn feedback_stimuli() -> Vec<(String, String)> {
+    vec![
+        (
+            "feedback_correct.svg".to_owned(),
+            text_svg("Correct", "#2ca02c", 600),
+        ),
+        (
+            "feedback_incorrect.svg".to_owned(),
+            text_svg("Incorrect", "#d62728", 600),
+        ),
+    ]
+}
+
+fn escape(value: &str) -> String {
+    value.replace('\\', "\\\\").replace('"', "\\\"")
+}
+
+fn count_param(params: &Params, key: &str) -> Result<usize> {
+    params
+        .get(key)
+        .ok_or_else(|| eyre!("Missing value for parameter `{key}`."))?
+        .trim()
+        .parse()
+        .wrap_err_with(|| format!("Invalid value for parameter `{key}`."))
+}
+
+fn rate_param(params: &Params, key: &str) -> Result<f64> {
+    params
+        .get(key)
+        .ok_or_else(|| eyre!("Missing value for parameter `{key}`."))?
+        .trim()
+        .parse()
+        .wrap_err_with(|| format!("Invalid value for parameter `{key}`."))
+}
+
+fn split_param(params: &Params, key: &str) -> Result<Vec<String>> {
+    let items: Vec<_> = params
+        .get(key)
+        .ok_or_else(|| eyre!("Missing value for parameter `{key}`."))?
+        .split('|')
+        .map(|s| s.trim().to_owned())
+        .filter(|s| !s.is_empty())
+        .collect();
+
+    if items.is_empty() {
+        Err(eyre!("Parameter `{key}` should have at least one item."))
+    } else {
+        Ok(items)
+    }
+}
+
+/// Repeats the given conditions (in order) until there are `count`, then shuffles them.
+fn balanced(conditions: Vec<Condition>, count: usize, rng: &mut Rng) -> Vec<Condition> {
+    let mut trials: Vec<_> = conditions.into_iter().cycle().take(count).collect();
+    rng.shuffle(&mut trials);
+    trials
+}
+
+/// Picks `rate * count` (rounded) trials of the rare condition and fills the rest with the common
+/// condition, in shuffled order.
+fn rare(
+    common: Condition,
+    rare: Condition,
+    rate: f64,
+    count: usize,
+    rng: &mut Rng,
+) -> Vec<Condition> {
+    let n_rare = (rate * count as f64).round() as usize;
+    let mut trials: Vec<_> = (0..count)
+        .map(|i| {
+            if i < n_rare {
+                rare.clone()
+            } else {
+                common.clone()
+            }
+        })
+        .collect();
+    rng.shuffle(&mut trials);
+    trials
+}
+
+fn condition(label: String, stimulus: String) -> Condition {
+    Condition::from([("label", label), ("stimulus", stimulus)])
+}
+
+/// Index of the response key for a `left` or `right` target.
+fn side(target: &str) -> String {
+    match target {
+        "left" => "0".to_owned(),
+        _ => "1".to_owned(),
+    }
+}
+
+fn text_svg(text: &str, fill: &str, x: u32) -> String {
+    let text = text
+        .replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;");
+    format!(
+        "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"1200\" height=\"300\" \
+        viewBox=\"0 0 1200 300\"><text x=\"{x}\" y=\"200\" font-family=\"sans-serif\" \
+        font-size=\"140\" font-weight=\"bold\" fill=\"{fill}\" text-anchor=\"middle\">\
+        {text}</text></svg>\n"
+    )
+}
+
+fn shape_svg(shape: &str) -> String {
+    format!(
+        "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"300\" height=\"300\" \
+        viewBox=\"0 0 300 300\">{shape}</svg>\n"
+    )
+}
+
+const STROOP_COLORS: [(&str, &str); 3] = [
+    ("red", "#d62728"),
+    ("green", "#2ca02c"),
+    ("blue", "#1f77b4"),
+];
+
+fn stroop_conditions(_params: &Params, count: usize, rng: &mut Rng) -> Result<Vec<Condition>> {
+    let mut conditions = vec![];
+    for (word, _) in STROOP_COLORS {
+        for (answer, &(ink, _)) in STROOP_COLORS.iter().enumerate() {
+            let congruency = if word == ink {
+                "congruent"
+            } else {
+                "incongruent"
+            };
+            let mut condition = condition(
+                format!("stroop_{word}_{ink}_{congruency}"),
+                format!("{word}_{ink}.svg"),
+            );
+            condition.insert("answer", answer.to_string());
+            conditions.push(condition);
+        }
+    }
+    Ok(balanced(conditions, count, rng))
+}
+
+fn stroop_stimuli(_params: &Params) -> Result<Vec<(String, String)>> {
+    let mut stimuli = vec![];
+    for (word, _) in STROOP_COLORS {
+        for (ink, fill) in STROOP_COLORS {
+            stimuli.push((
+                format!("{word}_{ink}.svg"),
+                text_svg(&word.to_uppercase(), fill, 600),
+            ));
+        }
+    }
+    Ok(stimuli)
+}
+
+const FLANKER_STIMULI: [(&str, &str, &str); 4] = [
+    ("left", "congruent", "<<<<<"),
+    ("left", "incongruent", ">><>>"),
+    ("right", "congruent", ">>>>>"),
+    ("right", "incongruent", "<<><<"),
+];
+
+fn flanker_conditions(_params: &Params, count: usize, rng: &mut Rng) -> Result<Vec<Condition>> {
+    let conditions = FLANKER_STIMULI
+        .iter()
+        .map(|(target, congruency, _)| {
+            let mut condition = condition(
+                format!("flanker_{target}_{congruency}"),
+                format!("flanker_{target}_{congruency}.svg"),
+            );
+            condition.insert("answer", side(target));
+            condition
+        })
+        .collect();
+    Ok(balanced(conditions, count, rng))
+}
+
+fn flanker_stimuli(_params: &Params) -> Result<Vec<(String, String)>> {
+    Ok(FLANKER_STIMULI
+        .iter()
+        .map(|(target, congruency, text)| {
+            (
+                format!("flanker_{target}_{congruency}.svg"),
+                text_svg(text, "black", 600),
+            )
+        })
+        .collect())
+}
+
+fn posner_conditions(params: &Params, count: usize, rng: &mut Rng) -> Result<Vec<Condition>> {
+    let validity = rate_param(params, "validity")?;
+    let n_invalid = ((1.0 - validity) * count as f64).round() as usize;
+
+    let mut trials: Vec<_> = (0..count)
+        .map(|i| {
+            let cue = if i % 2 == 0 { "left" } else { "right" };
+            let valid = i >= n_invalid;
+            let target = match (cue, valid) {
+                ("left", true) | ("right", false) => "left",
+                _ => "right",
+            };
+            let validity = if valid { "valid" } else { "invalid" };
+
+            let mut condition = condition(
+                format!("posner_cue_{cue}_target_{target}_{validity}"),
+                format!("target_{target}.svg"),
+            );
+            condition.insert("cue_stimulus", format!("cue_{cue}.svg"));
+            condition.insert("answer", side(target));
+            condition
+        })
+        .collect();
+    rng.shuffle(&mut trials);
+    Ok(trials)
+}
+
+fn posner_stimuli(_params: &Params) -> Result<Vec<(String, String)>> {
+    Ok(vec![
+        ("cue_left.svg".to_owned(), text_svg("<", "black", 600)),
+        ("cue_right.svg".to_owned(), text_svg(">", "black", 600)),
+        ("target_left.svg".to_owned(), text_svg("*", "black", 150)),
+        ("target_right.svg".to_owned(), text_svg("*", "black", 1050)),
+    ])
+}
+
+/// Distinct letters of the n-back, in the order they were given. Repeated letters are dropped, so
+/// that non-targets can always be drawn among letters other than the n-back one.
+fn nback_letters(params: &Params) -> Result<Vec<char>> {
+    let mut letters: Vec<char> = vec![];
+    for c in params
+        .get("letters")
+        .ok_or_else(|| eyre!("Missing value for parameter `letters`."))?
+        .chars()
+        .filter(|c| c.is_ascii_alphanumeric())
+        .map(|c| c.to_ascii_uppercase())
+    {
+        if !letters.contains(&c) {
+            letters.push(c);
+        }
+    }
+
+    if letters.len() < 2 {
+        Err(eyre!("N-back needs at least two distinct letters."))
+    } else {
+        Ok(letters)
+    }
+}
+
+fn nback_conditions(params: &Params, count: usize, rng: &mut Rng) -> Result<Vec<Condition>> {
+    let n = count_param(params, "n")?;
+    if n == 0 {
+        return Err(eyre!("N should be at least 1."));
+    }
+    let letters = nback_letters(params)?;
+    let rate = rate_param(params, "target_rate")?;
+
+    // Target positions are drawn among trials that have an n-back predecessor
+    let eligible = count.saturating_sub(n);
+    let mut is_target: Vec<_> = (0..eligible)
+        .map(|i| i < (rate * eligible as f64).round() as usize)
+        .collect();
+    rng.shuffle(&mut is_target);
+
+    let mut sequence: Vec<char> = vec![];
+    let mut trials = vec![];
+    for i in 0..count {
+        let target = i >= n && is_target[i - n];
+        let letter = if target {
+            sequence[i - n]
+        } else {
+            loop {
+                let letter = letters[rng.below(letters.len())];
+                if i < n || letter != sequence[i - n] {
+                    break letter;
+                }
+            }
+        };
+        sequence.push(letter);
+
+        let kind = if target { "target" } else { "nontarget" };
+        let mut condition = condition(
+            format!("nback_{letter}_{kind}"),
+            format!("letter_{letter}.svg"),
+        );
+        if target {
+            condition.insert("answer", "0".to_owned());
+        }
+        trials.push(condition);
+    }
+    Ok(trials)
+}
+
+fn nback_stimuli(params: &Params) -> Result<Vec<(String, String)>> {
+    Ok(nback_letters(params)?
+        .into_iter()
+        .map(|c| {
+            (
+                format!("letter_{c}.svg"),
+                text_svg(&c.to_string(), "black", 600),
+            )
+        })
+        .collect())
+}
+
+fn go_no_go_conditions(params: &Params, count: usize, rng: &mut Rng) -> Result<Vec<Condition>> {
+    let go_rate = rate_param(params, "go_rate")?;
+    let mut go = condition("go".to_owned(), "go.svg".to_owned());
+    go.insert("answer", "0".to_owned());
+    Ok(rare(
+        go,
+        condition("no_go".to_owned(), "no_go.svg".to_owned()),
+        1.0 - go_rate,
+        count,
+        rng,
+    ))
+}
+
+fn go_no_go_stimuli(_params: &Params) -> Result<Vec<(String, String)>> {
+    Ok(vec![
+        ("go.svg".to_owned(), text_svg("O", "#2ca02c", 600)),
+        ("no_go.svg".to_owned(), text_svg("X", "#d62728", 600)),
+    ])
+}
+
+fn oddball_conditions(params: &Params, count: usize, rng: &mut Rng) -> Result<Vec<Condition>> {
+    let deviant_rate = rate_param(params, "deviant_rate")?;
+    let mut deviant = condition("deviant".to_owned(), "deviant.svg".to_owned());
+    deviant.insert("answer", "0".to_owned());
+    Ok(rare(
+        condition("standard".to_owned(), "standard.svg".to_owned()),
+        deviant,
+        deviant_rate,
+        count,
+        rng,
+    ))
+}
+
+fn oddball_stimuli(_params: &Params) -> Result<Vec<(String, String)>> {
+    Ok(vec![
+        (
+            "standard.svg".to_owned(),
+            shape_svg("<circle cx=\"150\" cy=\"150\" r=\"100\" fill=\"#1f77b4\"/>"),
+        ),
+        (
+            "deviant.svg".to_owned(),
+            shape_svg("<rect x=\"50\" y=\"50\" width=\"200\" height=\"200\" fill=\"#d62728\"/>"),
+        ),
+    ])
+}
+
+fn questionnaire_items(params: &Params) -> Result<Vec<(&'static str, String)>> {
+    let items = split_param(params, "items")?;
+    let options = split_param(params, "options")?;
+    let options = options
+        .iter()
+        .map(|o| format!("\"{}\"", escape(o)))
+        .collect::<Vec<_>>()
+        .join(", ");
+
+    let items = items
+        .iter()
+        .enumerate()
+        .map(|(i, item)| {
+            format!(
+                "{INDENT}single_choice(\n\
+                {INDENT}    id: \"q{}\",\n\
+                {INDENT}    prompt: \"{}\",\n\
+                {INDENT}    options: [{options}],\n\
+                {INDENT}),\n",
+                i + 1,
+                escape(item)
+            )
+        })
+        .collect();
+
+    Ok(vec![("items", items)])
+}
+
+const INDENT: &str = "                        ";
+
+fn no_conditions(_params: &Params, _count: usize, _rng: &mut Rng) -> Result<Vec<Condition>> {
+    Ok(vec![])
+}
+
+fn no_stimuli(_params: &Params) -> Result<Vec<(String, String)>> {
+    Ok(vec![])
+}
+
+fn no_extra(_params: &Params) -> Result<Vec<(&'static str, String)>> {
+    Ok(vec![])
+}
+
+fn copy_dir(src: &Path, dst: &Path) -> Result<()> {
+    for entry in src.read_dir()? {
+        let path = entry?.path();
+        let target = dst.join(path.file_name().unwrap());
+        if path.is_dir() {
+            fs::create_dir_all(&target)?;
+            copy_dir(&path, &target)?;
+        } else {
+            fs::copy(&path, &target)?;
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn templates_render_valid_tasks() {
+        for template in TEMPLATES {
+            let content = template
+                .render("test", &template.defaults(), 1)
+                .unwrap_or_else(|e| panic!("{}: {e:?}", template.name));
+            ron::from_str::<Task>(&content).unwrap_or_else(|e| panic!("{}: {e:?}", template.name));
+        }
+    }
+
+    #[test]
+    fn nback_letters_are_distinct() {
+        let params = |letters: &str| Params::from([("letters".to_owned(), letters.to_owned())]);
+        assert!(nback_letters(&params("AA")).is_err());
+        assert!(nback_letters(&params("a, A")).is_err());
+        assert_eq!(nback_letters(&params("BaAb")).unwrap(), ['B', 'A']);
+
+        let nback = TEMPLATES.iter().find(|t| t.name == "N-Back").unwrap();
+        let mut params = nback.defaults();
+        params.insert("letters".to_owned(), "AAB".to_owned());
+        assert!(nback.render("test", &params, 1).is_ok());
+        params.insert("letters".to_owned(), "AAA".to_owned());
+        assert!(nback.render("test", &params, 1).is_err());
+    }
+
+    #[test]
+    fn response_keys_are_checked() {
+        let flanker = TEMPLATES.iter().find(|t| t.name == "Flanker").unwrap();
+        let mut params = flanker.defaults();
+        params.insert("keys".to_owned(), "F".to_owned());
+        assert!(flanker.render("test", &params, 1).is_err());
+        params.insert("keys".to_owned(), "F, NotAKey".to_owned());
+        assert!(flanker.render("test", &params, 1).is_err());
+    }
+
+    #[test]
+    fn response_keys_are_named_like_reaction_keys() {
+        let params = Params::from([("keys".to_owned(), "F, Space, ArrowLeft, num1".to_owned())]);
+        assert_eq!(
+            response_keys(&params).unwrap(),
+            ["f", "space", "arrow_left", "num1"]
+        );
+    }
+
+    #[test]
+    fn only_practice_trials_get_feedback() {
+        let go_no_go = TEMPLATES.iter().find(|t| t.name == "Go/No-Go").unwrap();
+        let mut params = go_no_go.defaults();
+        params.insert("practice".to_owned(), "4".to_owned());
+        params.insert("trials".to_owned(), "8".to_owned());
+        let content = go_no_go.render("test", &params, 1).unwrap();
+        assert_eq!(content.matches("out_success").count(), 4);
+        assert_eq!(content.matches("feedback_correct.svg").count(), 4);
+        assert_eq!(content.matches("reaction((").count(), 12);
+    }
+}
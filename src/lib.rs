@@ -1,10 +1,13 @@
 pub mod action;
 pub mod assets;
 pub mod comm;
+pub mod design;
 pub mod gui;
 pub mod launcher;
+pub mod monitor;
 pub mod resource;
 pub mod server;
+pub mod timeline;
 pub mod util;
 
 #[cfg(all(feature = "audio", not(any(feature = "rodio"))))]
@@ -53,6 +56,7 @@ impl_verify_features!(
     "ffmpeg",
     "savage",
     "python",
+    "arrow",
     "audio",
     "stream"
 );
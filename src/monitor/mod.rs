@@ -0,0 +1,316 @@
+use crate::gui::{CUSTOM_BLUE, CUSTOM_RED, FOREST_GREEN};
+use crate::server::{
+    read_message, send_command, send_token, MonitorCommand, MonitorStatus, MSG_FRAME, MSG_STATUS,
+};
+use eframe::egui::{self, Color32, ColorImage, RichText, TextEdit, TextureHandle, Vec2};
+use eframe::App;
+use eyre::{Context, Result};
+use std::net::TcpStream;
+use std::sync::{Arc, Mutex};
+use std::thread;
+
+#[derive(Default)]
+struct Feed {
+    status: MonitorStatus,
+    frame: Option<ColorImage>,
+    error: Option<String>,
+}
+
+/// Experimenter window that connects to a running server (see `MonitorConfig`), mirrors the
+/// participant display, and overlays the state of the running block. Since it runs in its own
+/// process, nothing shown here can leak into the participant display.
+pub struct MonitorWindow {
+    address: String,
+    stream: TcpStream,
+    feed: Arc<Mutex<Feed>>,
+    texture: Option<TextureHandle>,
+    note: String,
+    confirm_end: bool,
+}
+
+impl MonitorWindow {
+    /// Connects to the server at `address`, sending `token` first if the server requires one.
+    pub fn new(address: &str, token: Option<&str>) -> Result<Self> {
+        let mut stream = TcpStream::connect(address)
+            .wrap_err_with(|| format!("Failed to connect to server at {address}."))?;
+        let _ = stream.set_nodelay(true);
+        if let Some(token) = token {
+            send_token(&mut stream, token)?;
+        }
+
+        Ok(Self {
+            address: address.to_owned(),
+            stream,
+            feed: Arc::new(Mutex::new(Feed::default())),
+            texture: None,
+            note: String::new(),
+            confirm_end: false,
+        })
+    }
+
+    pub fn run(self) {
+        let options = eframe::NativeOptions {
+            initial_window_size: Some(Vec2::new(1280.0, 800.0)),
+            default_theme: eframe::Theme::Light,
+            ..Default::default()
+        };
+
+        eframe::run_native(
+            &format!("CogTask Monitor -- {}", self.address),
+            options,
+            Box::new(|cc| {
+                let ctx = cc.egui_ctx.clone();
+                let feed = self.feed.clone();
+                let stream = self.stream.try_clone();
+                thread::spawn(move || match stream {
+                    Ok(mut stream) => receive(&mut stream, &feed, &ctx),
+                    Err(e) => feed.lock().unwrap().error = Some(format!("{e}")),
+                });
+                Box::new(self)
+            }),
+        );
+    }
+
+    fn send(&mut self, command: MonitorCommand) {
+        if let Err(e) = send_command(&mut self.stream, &command) {
+            self.feed.lock().unwrap().error = Some(format!("{e:#}"));
+        }
+    }
+
+    fn show_mirror(&self, ui: &mut egui::Ui, status: &MonitorStatus) {
+        let available = ui.available_size();
+        let response = match self.texture.as_ref() {
+            Some(texture) => {
+                let size = texture.size_vec2();
+                let scale = (available.x / size.x).min(available.y / size.y);
+                ui.centered_and_justified(|ui| ui.image(texture, size * scale))
+                    .inner
+            }
+            None => {
+                ui.centered_and_justified(|ui| {
+                    ui.label(RichText::new("Participant display is not mirrored.").weak())
+                })
+                .inner
+            }
+        };
+
+        let mut lines = vec![format!(
+            "{} / {} -- {:.1} s{}",
+            status.subject,
+            status.block.as_deref().unwrap_or("(no block running)"),
+            status.elapsed,
+            if status.paused { " (paused)" } else { "" }
+        )];
+        lines.extend(deepest(&status.active));
+
+        let painter = ui.painter_at(response.rect);
+        let mut pos = response.rect.left_top() + Vec2::new(8.0, 8.0);
+        for line in lines {
+            let galley =
+                painter.layout_no_wrap(line, egui::FontId::monospace(14.0), Color32::WHITE);
+            let rect = egui::Rect::from_min_size(pos, galley.size()).expand(3.0);
+            painter.rect_filled(rect, 2.0, Color32::from_black_alpha(160));
+            let height = galley.size().y;
+            painter.galley(pos, galley);
+            pos.y += height + 6.0;
+        }
+    }
+
+    fn show_details(&self, ui: &mut egui::Ui, status: &MonitorStatus) {
+        egui::ScrollArea::vertical().show(ui, |ui| {
+            ui.heading("Alerts");
+            if status.alerts.is_empty() {
+                ui.label(RichText::new("None").weak());
+            }
+            for alert in status.alerts.iter() {
+                ui.label(RichText::new(alert).color(Color32::from(CUSTOM_RED)));
+            }
+
+            ui.separator();
+            ui.heading("Counters");
+            for (path, count) in status.counters.iter() {
+                ui.label(format!("{count:>4} x {path}"));
+            }
+
+            ui.separator();
+            ui.heading("Recent events");
+            egui::Grid::new("monitor_events")
+                .striped(true)
+                .show(ui, |ui| {
+                    for (time, group, name, value) in status.events.iter() {
+                        ui.label(format!("{time:.2} s"));
+                        ui.label(
+                            RichText::new(format!("{group}/{name}"))
+                                .color(Color32::from(CUSTOM_BLUE)),
+                        );
+                        ui.label(value);
+                        ui.end_row();
+                    }
+                });
+
+            ui.separator();
+            ui.heading("Signals");
+            egui::Grid::new("monitor_signals")
+                .striped(true)
+                .show(ui, |ui| {
+                    for (id, value) in status.signals.iter() {
+                        ui.label(format!("#{id}"));
+                        ui.label(value);
+                        ui.end_row();
+                    }
+                });
+        });
+    }
+
+    fn show_controls(&mut self, ui: &mut egui::Ui, running: bool, paused: bool) {
+        enum Interaction {
+            None,
+            Note,
+            Pause,
+            Resume,
+            End,
+        }
+
+        let mut interaction = Interaction::None;
+
+        ui.horizontal(|ui| {
+            let response = ui.add(
+                TextEdit::singleline(&mut self.note)
+                    .hint_text("Note")
+                    .desired_width(600.0),
+            );
+            let submitted = response.lost_focus() && ui.input().key_pressed(egui::Key::Enter);
+            let valid = running && !self.note.trim().is_empty();
+            if ui
+                .add_enabled(valid, egui::Button::new("Add note"))
+                .clicked()
+                || (valid && submitted)
+            {
+                interaction = Interaction::Note;
+            }
+
+            ui.add_space(40.0);
+            ui.add_enabled_ui(running, |ui| {
+                if paused {
+                    if ui.button("Resume block").clicked() {
+                        interaction = Interaction::Resume;
+                    }
+                } else if ui.button("Pause block").clicked() {
+                    interaction = Interaction::Pause;
+                }
+
+                if self.confirm_end {
+                    ui.label(RichText::new("End the block?").color(Color32::from(CUSTOM_RED)));
+                    if ui.button("Confirm").clicked() {
+                        interaction = Interaction::End;
+                    }
+                    if ui.button("Cancel").clicked() {
+                        self.confirm_end = false;
+                    }
+                } else if ui.button("End block").clicked() {
+                    self.confirm_end = true;
+                }
+            });
+        });
+
+        match interaction {
+            Interaction::None => {}
+            Interaction::Note => {
+                let note = self.note.trim().to_owned();
+                self.note.clear();
+                self.send(MonitorCommand::Note(note));
+            }
+            Interaction::Pause => self.send(MonitorCommand::Pause),
+            Interaction::Resume => self.send(MonitorCommand::Resume),
+            Interaction::End => {
+                self.confirm_end = false;
+                self.send(MonitorCommand::End);
+            }
+        }
+    }
+}
+
+impl App for MonitorWindow {
+    fn update(&mut self, ctx: &egui::Context, _frame: &mut eframe::Frame) {
+        let (status, frame, error) = {
+            let mut feed = self.feed.lock().unwrap();
+            (feed.status.clone(), feed.frame.take(), feed.error.clone())
+        };
+
+        if let Some(frame) = frame {
+            match self.texture.as_mut() {
+                Some(texture) => texture.set(frame, Default::default()),
+                None => self.texture = Some(ctx.load_texture("mirror", frame, Default::default())),
+            }
+        }
+
+        egui::TopBottomPanel::top("monitor_header").show(ctx, |ui| {
+            ui.horizontal(|ui| {
+                match &error {
+                    Some(e) => ui.label(RichText::new(e).color(Color32::from(CUSTOM_RED))),
+                    None => ui.label(
+                        RichText::new(format!("Connected to {}", self.address))
+                            .color(Color32::from(FOREST_GREEN)),
+                    ),
+                };
+            });
+        });
+
+        egui::TopBottomPanel::bottom("monitor_controls").show(ctx, |ui| {
+            ui.add_space(6.0);
+            self.show_controls(ui, error.is_none() && status.block.is_some(), status.paused);
+            ui.add_space(6.0);
+        });
+
+        egui::SidePanel::right("monitor_details")
+            .default_width(460.0)
+            .show(ctx, |ui| self.show_details(ui, &status));
+
+        egui::CentralPanel::default().show(ctx, |ui| self.show_mirror(ui, &status));
+    }
+}
+
+fn receive(stream: &mut TcpStream, feed: &Mutex<Feed>, ctx: &egui::Context) {
+    loop {
+        // The server was chosen by the experimenter, so frames of any size are accepted from it
+        let (kind, payload) = match read_message(stream, u32::MAX as usize) {
+            Ok(message) => message,
+            Err(e) => {
+                feed.lock().unwrap().error = Some(format!("Disconnected from server ({e})."));
+                ctx.request_repaint();
+                return;
+            }
+        };
+
+        match kind {
+            MSG_STATUS => {
+                if let Ok(status) = serde_cbor::from_slice(&payload) {
+                    feed.lock().unwrap().status = status;
+                }
+            }
+            MSG_FRAME if payload.len() >= 8 => {
+                let width = u32::from_be_bytes(payload[0..4].try_into().unwrap()) as usize;
+                let height = u32::from_be_bytes(payload[4..8].try_into().unwrap()) as usize;
+                if payload.len() == 8 + width * height * 4 {
+                    let image = ColorImage::from_rgba_unmultiplied([width, height], &payload[8..]);
+                    feed.lock().unwrap().frame = Some(image);
+                }
+            }
+            _ => {}
+        }
+        ctx.request_repaint();
+    }
+}
+
+/// Tree paths that are not a prefix of another active path, i.e., the innermost running actions.
+fn deepest(active: &[String]) -> Vec<String> {
+    active
+        .iter()
+        .filter(|p| {
+            !active
+                .iter()
+                .any(|q| q.starts_with(p.as_str()) && q[p.len()..].starts_with('['))
+        })
+        .cloned()
+        .collect()
+}
@@ -1,3 +1,4 @@
+use eyre::{eyre, Result};
 use std::path::{Path, PathBuf};
 
 #[derive(Clone, Debug, PartialEq, Eq, Hash)]
@@ -8,36 +9,86 @@ pub enum ResourceAddr {
     Audio(PathBuf),
     Video(PathBuf),
     Stream(PathBuf),
+    Pipeline(String),
 }
 
 impl ResourceAddr {
+    /// Path of a file-based resource. Pipelines are described by their (GStreamer) description
+    /// instead, so they have none.
     #[inline]
-    pub fn path(&self) -> &Path {
+    pub fn path(&self) -> Option<&Path> {
         match self {
-            ResourceAddr::Ref(p) => p,
-            ResourceAddr::Text(p) => p,
-            ResourceAddr::Image(p) => p,
-            ResourceAddr::Audio(p) => p,
-            ResourceAddr::Video(p) => p,
-            ResourceAddr::Stream(p) => p,
+            ResourceAddr::Ref(p) => Some(p),
+            ResourceAddr::Text(p) => Some(p),
+            ResourceAddr::Image(p) => Some(p),
+            ResourceAddr::Audio(p) => Some(p),
+            ResourceAddr::Video(p) => Some(p),
+            ResourceAddr::Stream(p) => Some(p),
+            ResourceAddr::Pipeline(_) => None,
         }
     }
 
     #[inline]
-    pub fn prefix(&self, parent: &Path) -> Self {
-        match self {
+    pub fn prefix(&self, parent: &Path) -> Result<Self> {
+        Ok(match self {
             ResourceAddr::Ref(p) => ResourceAddr::Ref(parent.join(p)),
             ResourceAddr::Text(p) => ResourceAddr::Text(parent.join(p)),
             ResourceAddr::Image(p) => ResourceAddr::Image(parent.join(p)),
             ResourceAddr::Audio(p) => ResourceAddr::Audio(parent.join(p)),
             ResourceAddr::Video(p) => ResourceAddr::Video(parent.join(p)),
             ResourceAddr::Stream(p) => ResourceAddr::Stream(parent.join(p)),
-        }
+            ResourceAddr::Pipeline(p) if p.contains("{resource}") => {
+                let dir = parent.to_str().ok_or_else(|| {
+                    eyre!("Pipeline uses `{{resource}}`, but the path is not UTF-8: {parent:?}")
+                })?;
+                ResourceAddr::Pipeline(p.replace("{resource}", dir))
+            }
+            ResourceAddr::Pipeline(p) => ResourceAddr::Pipeline(p.clone()),
+        })
     }
 
     pub fn extension(&self) -> Option<String> {
-        self.path()
+        self.path()?
             .extension()
-            .map(|ext| ext.to_str().unwrap().to_lowercase())
+            .map(|ext| ext.to_string_lossy().to_lowercase())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn pipelines_have_no_path() {
+        let pipeline = ResourceAddr::Pipeline("videotestsrc ! appsink name=video".to_owned());
+        assert_eq!(pipeline.path(), None);
+        assert_eq!(pipeline.extension(), None);
+
+        let image = ResourceAddr::Image("a/b.SVG".into());
+        assert_eq!(image.path(), Some(Path::new("a/b.SVG")));
+        assert_eq!(image.extension().as_deref(), Some("svg"));
+    }
+
+    #[test]
+    fn pipelines_are_prefixed_with_resource_dir() {
+        let pipeline = ResourceAddr::Pipeline("filesrc location={resource}/a.mp4".to_owned());
+        assert_eq!(
+            pipeline.prefix(Path::new("/data")).unwrap(),
+            ResourceAddr::Pipeline("filesrc location=/data/a.mp4".to_owned())
+        );
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn non_utf8_resource_dir_is_an_error_in_pipelines() {
+        use std::ffi::OsStr;
+        use std::os::unix::ffi::OsStrExt;
+
+        let parent = Path::new(OsStr::from_bytes(b"/data/\xff"));
+        let pipeline = ResourceAddr::Pipeline("filesrc location={resource}/a.mp4".to_owned());
+        assert!(pipeline.prefix(parent).is_err());
+
+        let pipeline = ResourceAddr::Pipeline("videotestsrc ! appsink".to_owned());
+        assert!(pipeline.prefix(parent).is_ok());
     }
 }
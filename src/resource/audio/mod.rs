@@ -2,8 +2,9 @@ use crate::server::Config;
 use eyre::{eyre, Result};
 use serde::{Deserialize, Serialize};
 use std::fmt::{Debug, Formatter};
-use std::path::Path;
-use std::time::Duration;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
 
 #[cfg(feature = "rodio")]
 mod rodio;
@@ -36,16 +37,66 @@ pub enum AudioDevice {
     Rodio(rodio::Device),
 }
 
+/// Physical (or virtual) output that a named audio device refers to.
+///
+/// `Named` matches the first output device whose name contains the given string. `Offline` does not
+/// use any hardware; every sink created on it is rendered in real time to a WAV file (with the given
+/// number of channels and sampling rate) inside the given directory, which is useful for testing a
+/// task on a machine without the target audio interfaces.
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum OutputDevice {
+    Default,
+    Named(String),
+    Offline(PathBuf, u16, u32),
+}
+
+/// Instants at which the output callback of a sink pulled the first and the last samples of the
+/// queued audio. These precede the acoustic onset/offset by at most the latency of the device
+/// buffer, which makes them much tighter than the time at which playback was requested.
+#[derive(Debug, Default, Clone)]
+pub struct PlaybackMarks(Arc<Mutex<(Option<Instant>, Option<Instant>)>>);
+
+impl PlaybackMarks {
+    #[inline(always)]
+    pub fn onset(&self) -> Option<Instant> {
+        self.0.lock().unwrap().0
+    }
+
+    #[inline(always)]
+    pub fn offset(&self) -> Option<Instant> {
+        self.0.lock().unwrap().1
+    }
+
+    pub(crate) fn mark_onset(&self, time: Instant) {
+        let mut marks = self.0.lock().unwrap();
+        if marks.0.is_none() {
+            marks.0 = Some(time);
+        }
+    }
+
+    pub(crate) fn mark_offset(&self, time: Instant) {
+        self.0.lock().unwrap().1 = Some(time);
+    }
+}
+
 impl AudioDevice {
     pub fn try_clone(&self) -> Result<Self> {
         match self {
             AudioDevice::None => Ok(AudioDevice::None),
             #[cfg(feature = "rodio")]
-            AudioDevice::Rodio(_) => rodio::Device::new().map(AudioDevice::Rodio),
+            AudioDevice::Rodio(device) => device.try_clone().map(AudioDevice::Rodio),
         }
     }
 }
 
+impl Default for OutputDevice {
+    #[inline(always)]
+    fn default() -> Self {
+        OutputDevice::Default
+    }
+}
+
 impl Default for AudioBackend {
     #[inline(always)]
     fn default() -> Self {
@@ -183,6 +234,25 @@ pub fn audio_from_file(path: &Path, config: &Config) -> Result<AudioBuffer> {
     }
 }
 
+#[allow(unused_variables)]
+pub fn audio_from_samples(
+    channels: u16,
+    sample_rate: u32,
+    samples: Vec<i16>,
+    config: &Config,
+) -> Result<AudioBuffer> {
+    match config.audio_backend() {
+        AudioBackend::None => Err(eyre!("Cannot create audio buffer with backend=None.")),
+        AudioBackend::Inherit => Err(eyre!("Cannot create audio buffer with backend=Inherit.")),
+        #[cfg(feature = "rodio")]
+        AudioBackend::Rodio => Ok(AudioBuffer::Rodio(rodio::Buffer::from_samples(
+            channels,
+            sample_rate,
+            samples,
+        ))),
+    }
+}
+
 impl AudioBuffer {
     pub fn duration(&self) -> Duration {
         match self {
@@ -225,6 +295,17 @@ impl AudioBuffer {
             AudioBuffer::Rodio(x) => x.drop_last().map(AudioBuffer::Rodio),
         }
     }
+
+    /// Splits off the last channel (e.g., an integrated trigger) into a separate mono buffer.
+    pub fn split_last(self) -> Result<(AudioBuffer, AudioBuffer)> {
+        match self {
+            AudioBuffer::None => Err(eyre!("Cannot split audio buffer with backend=None.")),
+            #[cfg(feature = "rodio")]
+            AudioBuffer::Rodio(x) => x
+                .split_last()
+                .map(|(x, y)| (AudioBuffer::Rodio(x), AudioBuffer::Rodio(y))),
+        }
+    }
 }
 
 impl AudioSink {
@@ -307,6 +388,14 @@ impl AudioSink {
         }
     }
 
+    pub fn marks(&self) -> PlaybackMarks {
+        match self {
+            AudioSink::None => PlaybackMarks::default(),
+            #[cfg(feature = "rodio")]
+            AudioSink::Rodio(sink) => sink.marks(),
+        }
+    }
+
     pub fn detach(self) -> Result<()> {
         match self {
             AudioSink::None => Ok(()),
@@ -321,11 +410,37 @@ impl AudioSink {
 
 impl AudioDevice {
     pub fn new(config: &Config) -> Result<Self> {
+        let output = config
+            .audio_devices()
+            .get("default")
+            .cloned()
+            .unwrap_or_default();
+        Self::open(&output, config)
+    }
+
+    #[allow(unused_variables)]
+    pub fn open(output: &OutputDevice, config: &Config) -> Result<Self> {
         match config.audio_backend() {
             AudioBackend::None => Err(eyre!("Cannot obtain audio device with backend=None.")),
             AudioBackend::Inherit => Err(eyre!("Cannot obtain audio device with backend=None.")),
             #[cfg(feature = "rodio")]
-            AudioBackend::Rodio => rodio::Device::new().map(Self::Rodio),
+            AudioBackend::Rodio => rodio::Device::new(output).map(Self::Rodio),
+        }
+    }
+
+    pub fn channels(&self) -> u16 {
+        match self {
+            AudioDevice::None => 0,
+            #[cfg(feature = "rodio")]
+            AudioDevice::Rodio(device) => device.channels(),
+        }
+    }
+
+    pub fn sample_rate(&self) -> u32 {
+        match self {
+            AudioDevice::None => 0,
+            #[cfg(feature = "rodio")]
+            AudioDevice::Rodio(device) => device.sample_rate(),
         }
     }
 
@@ -337,3 +452,27 @@ impl AudioDevice {
         }
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn marks_keep_the_first_onset_and_the_last_offset() {
+        let marks = PlaybackMarks::default();
+        assert_eq!((marks.onset(), marks.offset()), (None, None));
+
+        let start = Instant::now();
+        let later = start + Duration::from_millis(10);
+        marks.mark_onset(start);
+        marks.mark_onset(later);
+        assert_eq!(marks.onset(), Some(start));
+        assert_eq!(marks.offset(), None);
+
+        // Clones share the marks, as the sink and the action that reports them do
+        let shared = marks.clone();
+        shared.mark_offset(start);
+        shared.mark_offset(later);
+        assert_eq!(marks.offset(), Some(later));
+    }
+}
@@ -1,30 +1,199 @@
+use super::{OutputDevice, PlaybackMarks};
 use crate::server::Config;
+use crate::util::spin_sleeper;
 use eyre::{eyre, Context, Result};
 use rodio::buffer::SamplesBuffer;
-use rodio::source::Buffered;
-use rodio::{Decoder, OutputStream, OutputStreamHandle, Source};
-use std::fs::File;
-use std::io::BufReader;
-use std::path::Path;
-use std::time::Duration;
+use rodio::cpal::traits::{DeviceTrait, HostTrait};
+use rodio::source::{Buffered, UniformSourceIterator};
+use rodio::{Decoder, OutputStream, OutputStreamHandle, Sample, Source};
+use std::fs::{self, File};
+use std::io::{BufReader, BufWriter, Write};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicU8, AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::thread;
+use std::time::{Duration, Instant};
 
 #[derive(Clone)]
 pub struct Buffer(Buffered<SamplesBuffer<i16>>);
-pub struct Sink(rodio::Sink);
-pub struct Device(OutputStream, OutputStreamHandle);
+pub struct Sink(rodio::Sink, PlaybackMarks, Option<Rendering>);
+pub struct Device(Output, u16, u32, OutputDevice);
+
+enum Output {
+    Stream(OutputStream, OutputStreamHandle),
+    Offline(PathBuf),
+}
+
+/// Handle to the thread rendering an offline sink. The thread stops when the sink is dropped, or,
+/// if the sink was detached, when its queue runs out.
+struct Rendering(Arc<AtomicU8>);
+
+const RENDER_OPEN: u8 = 0;
+const RENDER_CLOSED: u8 = 1;
+const RENDER_DETACHED: u8 = 2;
+const RENDER_PERIOD: Duration = Duration::from_millis(10);
+
+static RENDER_COUNT: AtomicUsize = AtomicUsize::new(0);
+
+/// Source adapter that stamps the time at which the output callback pulls its first and last
+/// samples.
+struct Marked<S> {
+    inner: S,
+    marks: PlaybackMarks,
+    started: bool,
+    finished: bool,
+}
 
 impl Device {
-    pub fn new() -> Result<Self> {
-        let (audio_stream, audio_stream_handle) =
-            OutputStream::try_default().wrap_err("Failed to obtain audio output stream.")?;
-        Ok(Self(audio_stream, audio_stream_handle))
+    pub fn new(output: &OutputDevice) -> Result<Self> {
+        let host = rodio::cpal::default_host();
+        let device = match output {
+            OutputDevice::Default => host
+                .default_output_device()
+                .ok_or_else(|| eyre!("Failed to find the default audio output device."))?,
+            OutputDevice::Named(name) => host
+                .output_devices()
+                .wrap_err("Failed to list audio output devices.")?
+                .find(|d| d.name().map_or(false, |n| n.contains(name.as_str())))
+                .ok_or_else(|| eyre!("Failed to find audio output device matching `{name}`."))?,
+            OutputDevice::Offline(dir, channels, sample_rate) => {
+                fs::create_dir_all(dir).wrap_err_with(|| {
+                    format!("Failed to create directory for offline audio: {dir:?}")
+                })?;
+                return Ok(Self(
+                    Output::Offline(dir.clone()),
+                    *channels,
+                    *sample_rate,
+                    output.clone(),
+                ));
+            }
+        };
+
+        let config = device
+            .default_output_config()
+            .wrap_err("Failed to query configuration of audio output device.")?;
+        let (audio_stream, audio_stream_handle) = OutputStream::try_from_device(&device)
+            .wrap_err("Failed to obtain audio output stream.")?;
+        Ok(Self(
+            Output::Stream(audio_stream, audio_stream_handle),
+            config.channels(),
+            config.sample_rate().0,
+            output.clone(),
+        ))
+    }
+
+    #[inline(always)]
+    pub fn try_clone(&self) -> Result<Self> {
+        Self::new(&self.3)
+    }
+
+    #[inline(always)]
+    pub fn channels(&self) -> u16 {
+        self.1
+    }
+
+    #[inline(always)]
+    pub fn sample_rate(&self) -> u32 {
+        self.2
     }
 
     pub fn sink(&self) -> Result<Sink> {
-        let sink = rodio::Sink::try_new(&self.1)?;
-        sink.pause();
-        Ok(Sink(sink))
+        match &self.0 {
+            Output::Stream(_, handle) => {
+                let sink = rodio::Sink::try_new(handle)?;
+                sink.pause();
+                Ok(Sink(sink, PlaybackMarks::default(), None))
+            }
+            Output::Offline(dir) => {
+                let (sink, output) = rodio::Sink::new_idle();
+                sink.pause();
+
+                let marks = PlaybackMarks::default();
+                let state = Arc::new(AtomicU8::new(RENDER_OPEN));
+                let path = dir.join(format!(
+                    "{}_{:04}.wav",
+                    chrono::Local::now().format("%Y%m%d-%H%M%S"),
+                    RENDER_COUNT.fetch_add(1, Ordering::Relaxed)
+                ));
+                let source = UniformSourceIterator::new(output, self.1, self.2);
+                render(source, path, self.1, self.2, marks.clone(), state.clone());
+
+                Ok(Sink(sink, marks, Some(Rendering(state))))
+            }
+        }
+    }
+}
+
+impl Drop for Rendering {
+    fn drop(&mut self) {
+        let _ = self.0.compare_exchange(
+            RENDER_OPEN,
+            RENDER_CLOSED,
+            Ordering::SeqCst,
+            Ordering::SeqCst,
+        );
+    }
+}
+
+/// Pulls samples from `source` in real time (as a sound card would) and writes everything that was
+/// pulled, including silence before and after playback, to a WAV file once the sink is gone.
+fn render<S>(
+    mut source: S,
+    path: PathBuf,
+    channels: u16,
+    sample_rate: u32,
+    marks: PlaybackMarks,
+    state: Arc<AtomicU8>,
+) where
+    S: Iterator<Item = f32> + Send + 'static,
+{
+    thread::spawn(move || {
+        let sleeper = spin_sleeper();
+        let chunk = (sample_rate as usize * channels as usize) / 100;
+        let mut samples: Vec<i16> = vec![];
+        let mut next = Instant::now();
+        loop {
+            match state.load(Ordering::SeqCst) {
+                RENDER_CLOSED => break,
+                RENDER_DETACHED if marks.offset().is_some() => break,
+                _ => {}
+            }
+
+            samples.extend((0..chunk).map(|_| source.next().unwrap_or(0.0).to_i16()));
+            next += RENDER_PERIOD;
+            sleeper.sleep(next.saturating_duration_since(Instant::now()));
+        }
+
+        if let Err(e) = write_wav(&path, channels, sample_rate, &samples) {
+            eprintln!("Failed to write offline audio to {path:?}: {e:#?}");
+        }
+    });
+}
+
+fn write_wav(path: &Path, channels: u16, sample_rate: u32, samples: &[i16]) -> Result<()> {
+    let data_len = (samples.len() * 2) as u32;
+    let block_align = channels * 2;
+    let mut file = BufWriter::new(
+        File::create(path).wrap_err_with(|| format!("Failed to create file: {path:?}"))?,
+    );
+
+    file.write_all(b"RIFF")?;
+    file.write_all(&(36 + data_len).to_le_bytes())?;
+    file.write_all(b"WAVEfmt ")?;
+    file.write_all(&16u32.to_le_bytes())?;
+    file.write_all(&1u16.to_le_bytes())?;
+    file.write_all(&channels.to_le_bytes())?;
+    file.write_all(&sample_rate.to_le_bytes())?;
+    file.write_all(&(sample_rate * block_align as u32).to_le_bytes())?;
+    file.write_all(&block_align.to_le_bytes())?;
+    file.write_all(&16u16.to_le_bytes())?;
+    file.write_all(b"data")?;
+    file.write_all(&data_len.to_le_bytes())?;
+    for s in samples {
+        file.write_all(&s.to_le_bytes())?;
     }
+    file.flush()?;
+    Ok(())
 }
 
 impl Sink {
@@ -40,12 +209,13 @@ impl Sink {
 
     #[inline(always)]
     pub fn queue(&self, buffer: Buffer) {
-        self.0.append(buffer.0);
+        self.0.append(Marked::new(buffer.0, self.1.clone()));
     }
 
     #[inline(always)]
     pub fn repeat(&self, buffer: Buffer) {
-        self.0.append(buffer.0.repeat_infinite());
+        self.0
+            .append(Marked::new(buffer.0.repeat_infinite(), self.1.clone()));
     }
 
     #[inline(always)]
@@ -63,9 +233,18 @@ impl Sink {
         self.0.empty()
     }
 
+    #[inline(always)]
+    pub fn marks(&self) -> PlaybackMarks {
+        self.1.clone()
+    }
+
     #[inline(always)]
     pub fn detach(self) {
-        self.0.detach()
+        let Sink(sink, _, rendering) = self;
+        if let Some(rendering) = rendering {
+            rendering.0.store(RENDER_DETACHED, Ordering::SeqCst);
+        }
+        sink.detach()
     }
 }
 
@@ -92,6 +271,10 @@ impl Buffer {
         ))
     }
 
+    pub fn from_samples(channels: u16, sample_rate: u32, samples: Vec<i16>) -> Self {
+        Self(SamplesBuffer::new(channels, sample_rate, samples).buffered())
+    }
+
     #[inline(always)]
     pub fn duration(&self) -> Duration {
         self.0.total_duration().unwrap_or_default()
@@ -164,4 +347,118 @@ impl Buffer {
             SamplesBuffer::new(out_channels as u16, sample_rate, samples).buffered(),
         ))
     }
+
+    pub fn split_last(self) -> Result<(Self, Self)> {
+        let sample_rate = self.0.sample_rate();
+        let in_channels = self.0.channels() as i16;
+        if in_channels < 2 {
+            return Err(eyre!(
+                "Audio with internal trigger should have at least two channels to split."
+            ));
+        }
+
+        let mut c = -1;
+        let mut samples = vec![];
+        let mut trigger = vec![];
+        for s in self.0 {
+            c = (c + 1) % in_channels;
+            if c < in_channels - 1 {
+                samples.push(s);
+            } else {
+                trigger.push(s);
+            }
+        }
+
+        Ok((
+            Self(SamplesBuffer::new(in_channels as u16 - 1, sample_rate, samples).buffered()),
+            Self(SamplesBuffer::new(1, sample_rate, trigger).buffered()),
+        ))
+    }
+}
+
+impl<S> Marked<S> {
+    fn new(inner: S, marks: PlaybackMarks) -> Self {
+        Self {
+            inner,
+            marks,
+            started: false,
+            finished: false,
+        }
+    }
+}
+
+impl<S> Iterator for Marked<S>
+where
+    S: Source,
+    S::Item: Sample,
+{
+    type Item = S::Item;
+
+    #[inline]
+    fn next(&mut self) -> Option<Self::Item> {
+        let sample = self.inner.next();
+
+        if !self.started {
+            self.started = true;
+            self.marks.mark_onset(Instant::now());
+        }
+        if sample.is_none() && !self.finished {
+            self.finished = true;
+            self.marks.mark_offset(Instant::now());
+        }
+
+        sample
+    }
+}
+
+impl<S> Source for Marked<S>
+where
+    S: Source,
+    S::Item: Sample,
+{
+    #[inline(always)]
+    fn current_frame_len(&self) -> Option<usize> {
+        self.inner.current_frame_len()
+    }
+
+    #[inline(always)]
+    fn channels(&self) -> u16 {
+        self.inner.channels()
+    }
+
+    #[inline(always)]
+    fn sample_rate(&self) -> u32 {
+        self.inner.sample_rate()
+    }
+
+    #[inline(always)]
+    fn total_duration(&self) -> Option<Duration> {
+        self.inner.total_duration()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn marked_sources_mark_the_first_and_last_pull() {
+        let marks = PlaybackMarks::default();
+        let mut source = Marked::new(SamplesBuffer::new(1, 44100, vec![0.0f32; 3]), marks.clone());
+
+        let before = Instant::now();
+        assert!(source.next().is_some());
+        let onset = marks.onset().unwrap();
+        assert!(onset >= before);
+        assert_eq!(marks.offset(), None);
+
+        assert_eq!(source.by_ref().count(), 2);
+        let offset = marks.offset().unwrap();
+        assert!(offset >= onset);
+        assert_eq!(marks.onset(), Some(onset));
+
+        // Pulling past the end does not move the offset
+        assert!(source.next().is_none());
+        assert_eq!(marks.offset(), Some(offset));
+    }
 }
@@ -0,0 +1,423 @@
+use crate::resource::logger::Serializable;
+use arrow::array::{
+    Array, ArrayRef, BooleanArray, Float64Array, Int64Array, StringArray, TimestampMicrosecondArray,
+};
+use arrow::datatypes::{DataType, Field, Schema, TimeUnit};
+use arrow::ipc::reader::StreamReader;
+use arrow::ipc::writer::StreamWriter;
+use arrow::record_batch::RecordBatch;
+use chrono::{DateTime, FixedOffset, Local, TimeZone, Utc};
+use eyre::{eyre, Context, Result};
+use serde_cbor::Value;
+use std::fmt::{Debug, Formatter};
+use std::fs::File;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
+#[derive(Debug, Copy, Clone, PartialEq)]
+enum ColumnType {
+    Null,
+    Bool,
+    Int,
+    Float,
+    Text,
+    Json,
+}
+
+impl ColumnType {
+    fn of(value: &Value) -> Self {
+        match value {
+            Value::Null => ColumnType::Null,
+            Value::Bool(_) => ColumnType::Bool,
+            Value::Integer(_) => ColumnType::Int,
+            Value::Float(_) => ColumnType::Float,
+            Value::Text(_) => ColumnType::Text,
+            _ => ColumnType::Json,
+        }
+    }
+
+    fn merge(self, other: Self) -> Self {
+        match (self, other) {
+            (a, b) if a == b => a,
+            (ColumnType::Null, t) | (t, ColumnType::Null) => t,
+            (ColumnType::Int, ColumnType::Float) | (ColumnType::Float, ColumnType::Int) => {
+                ColumnType::Float
+            }
+            _ => ColumnType::Json,
+        }
+    }
+
+    fn data_type(&self) -> DataType {
+        match self {
+            ColumnType::Null | ColumnType::Text | ColumnType::Json => DataType::Utf8,
+            ColumnType::Bool => DataType::Boolean,
+            ColumnType::Int => DataType::Int64,
+            ColumnType::Float => DataType::Float64,
+        }
+    }
+}
+
+/// Writes a log group as an Arrow IPC stream. Entries logged together (same timestamp) form a
+/// single row, and every distinct entry name becomes a typed, nullable column. Time is stored in
+/// microseconds since the UNIX epoch, as converted by the logger from monotonic instants.
+///
+/// Each flush appends the entries logged since the previous one as a new record batch (rows
+/// sorted by time), so the cost of a flush does not grow with the length of the session. The file
+/// is only rewritten from scratch when new entries add a column or widen the type of an existing
+/// one (since the schema of a stream is fixed), or when they are older than rows that were already
+/// written (e.g., an onset that is only logged once it was confirmed), so that rows stay sorted
+/// across batches.
+pub struct ColumnarWriter {
+    path: PathBuf,
+    written: usize,
+    last: Option<i64>,
+    names: Vec<String>,
+    types: Vec<ColumnType>,
+    writer: Option<StreamWriter<File>>,
+}
+
+impl Debug for ColumnarWriter {
+    fn fmt(&self, f: &mut Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("ColumnarWriter")
+            .field("path", &self.path)
+            .field("written", &self.written)
+            .field("names", &self.names)
+            .finish()
+    }
+}
+
+impl ColumnarWriter {
+    pub fn new(path: PathBuf) -> Self {
+        Self {
+            path,
+            written: 0,
+            last: None,
+            names: vec![],
+            types: vec![],
+            writer: None,
+        }
+    }
+
+    /// Writes the entries of `vec` that were not written yet. `vec` holds all entries of the
+    /// group so far, in the order they were logged.
+    pub fn write(&mut self, vec: &[(DateTime<Local>, String, Value)]) -> Result<()> {
+        if self.written >= vec.len() {
+            return Ok(());
+        }
+
+        let (names, types) = (self.names.clone(), self.types.clone());
+        let new_rows = rows(&vec[self.written..], &mut self.names, &mut self.types)?;
+        let in_order = match (self.last, new_rows.first()) {
+            (Some(last), Some((t, _))) => *t >= last,
+            _ => true,
+        };
+        if self.writer.is_some() && in_order && names == self.names && types == self.types {
+            self.last = new_rows.last().map(|(t, _)| *t).max(self.last);
+            let batch = batch(&self.names, &self.types, new_rows)?;
+            self.writer
+                .as_mut()
+                .unwrap()
+                .write(&batch)
+                .wrap_err_with(|| format!("Failed to append to columnar log ({:?}).", self.path))?;
+        } else {
+            self.names.clear();
+            self.types.clear();
+            let all_rows = rows(vec, &mut self.names, &mut self.types)?;
+            self.last = all_rows.last().map(|(t, _)| *t);
+            let batch = batch(&self.names, &self.types, all_rows)?;
+
+            let path = &self.path;
+            let file = File::create(path)
+                .wrap_err_with(|| format!("Failed to create log file ({path:?})."))?;
+            let mut writer = StreamWriter::try_new(file, &batch.schema())
+                .wrap_err_with(|| format!("Failed to open columnar log file ({path:?})."))?;
+            writer
+                .write(&batch)
+                .wrap_err_with(|| format!("Failed to write to columnar log file ({path:?})."))?;
+            self.writer = Some(writer);
+        }
+
+        self.written = vec.len();
+        Ok(())
+    }
+
+    /// Terminates the stream. Readers also accept streams that were not terminated, e.g., after
+    /// a crash.
+    pub fn finish(&mut self) -> Result<()> {
+        match self.writer.take() {
+            Some(mut writer) => writer
+                .finish()
+                .wrap_err_with(|| format!("Failed to close columnar log file ({:?}).", self.path)),
+            None => Ok(()),
+        }
+    }
+
+    #[inline(always)]
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+}
+
+type Row<'a> = (i64, Vec<Option<&'a Value>>);
+
+/// Groups entries into rows, adding to `names` (and `types`) the columns of entries not seen yet
+/// and widening the types of existing columns as needed. Rows are sorted by time.
+fn rows<'a>(
+    vec: &'a [(DateTime<Local>, String, Value)],
+    names: &mut Vec<String>,
+    types: &mut Vec<ColumnType>,
+) -> Result<Vec<Row<'a>>> {
+    let mut rows: Vec<Row> = vec![];
+
+    let mut last_time = None;
+    for (time, name, value) in vec {
+        let col = match names.iter().position(|n| n == name) {
+            Some(i) => i,
+            None => {
+                names.push(name.clone());
+                types.push(ColumnType::Null);
+                rows.iter_mut().for_each(|(_, row)| row.push(None));
+                names.len() - 1
+            }
+        };
+        types[col] = types[col].merge(ColumnType::of(value));
+
+        let new_row = match rows.last() {
+            Some((_, row)) => last_time != Some(time) || row[col].is_some(),
+            None => true,
+        };
+        if new_row {
+            rows.push((time.timestamp_micros(), vec![None; names.len()]));
+            last_time = Some(time);
+        }
+
+        rows.last_mut().unwrap().1[col] = Some(value);
+    }
+    rows.sort_by_key(|(t, _)| *t);
+
+    Ok(rows)
+}
+
+fn batch(names: &[String], types: &[ColumnType], rows: Vec<Row>) -> Result<RecordBatch> {
+    let mut fields = vec![Field::new(
+        "time",
+        DataType::Timestamp(TimeUnit::Microsecond, None),
+        false,
+    )];
+    let mut columns: Vec<ArrayRef> = vec![Arc::new(TimestampMicrosecondArray::from(
+        rows.iter().map(|(t, _)| *t).collect::<Vec<_>>(),
+    ))];
+
+    for (col, (name, dtype)) in names.iter().zip(types.iter()).enumerate() {
+        let cells = rows.iter().map(|(_, row)| row.get(col).copied().flatten());
+        let column: ArrayRef = match dtype {
+            ColumnType::Bool => Arc::new(
+                cells
+                    .map(|v| match v {
+                        Some(Value::Bool(b)) => Some(*b),
+                        _ => None,
+                    })
+                    .collect::<BooleanArray>(),
+            ),
+            ColumnType::Int => Arc::new(
+                cells
+                    .map(|v| match v {
+                        Some(Value::Integer(i)) => Some(*i as i64),
+                        _ => None,
+                    })
+                    .collect::<Int64Array>(),
+            ),
+            ColumnType::Float => Arc::new(
+                cells
+                    .map(|v| match v {
+                        Some(Value::Float(x)) => Some(*x),
+                        Some(Value::Integer(i)) => Some(*i as f64),
+                        _ => None,
+                    })
+                    .collect::<Float64Array>(),
+            ),
+            ColumnType::Null | ColumnType::Text | ColumnType::Json => Arc::new(
+                cells
+                    .map(|v| match v {
+                        None | Some(Value::Null) => Ok(None),
+                        Some(Value::Text(s)) => Ok(Some(s.clone())),
+                        Some(v) => serde_json::to_string(&Serializable::try_from(v)?)
+                            .map(Some)
+                            .wrap_err("Failed to serialize log value as JSON."),
+                    })
+                    .collect::<Result<Vec<_>>>()?
+                    .into_iter()
+                    .collect::<StringArray>(),
+            ),
+        };
+
+        fields.push(Field::new(name, dtype.data_type(), true));
+        columns.push(column);
+    }
+
+    let schema = Arc::new(Schema::new(fields));
+    RecordBatch::try_new(schema, columns).wrap_err("Failed to assemble columnar log.")
+}
+
+/// Reads a log group that was written in columnar format (see `ColumnarWriter`).
+pub fn read_columnar(path: &Path) -> Result<Vec<RecordBatch>> {
+    let file = File::open(path).wrap_err_with(|| format!("Failed to open log file ({path:?})."))?;
+    let reader = StreamReader::try_new(file, None)
+        .wrap_err_with(|| format!("Failed to read columnar log file ({path:?})."))?;
+
+    reader
+        .collect::<Result<Vec<_>, _>>()
+        .map_err(|e| eyre!("Failed to read record batch from ({path:?}): {e}"))
+}
+
+/// Reads a log group that was written in columnar format as entries in the shape of `read_log`,
+/// one for each non-empty cell. Values of JSON columns are returned as text.
+pub fn read_columnar_log(path: &Path) -> Result<Vec<(DateTime<FixedOffset>, String, Value)>> {
+    let mut entries = vec![];
+    for batch in read_columnar(path)? {
+        let times = batch
+            .column(0)
+            .as_any()
+            .downcast_ref::<TimestampMicrosecondArray>()
+            .ok_or_else(|| eyre!("Columnar log file has no time column ({path:?})."))?;
+
+        let schema = batch.schema();
+        for row in 0..batch.num_rows() {
+            let t = times.value(row);
+            let time = Utc
+                .timestamp_opt(
+                    t.div_euclid(1_000_000),
+                    t.rem_euclid(1_000_000) as u32 * 1000,
+                )
+                .single()
+                .ok_or_else(|| eyre!("Invalid timestamp in columnar log file ({path:?}): {t}"))?;
+
+            for (col, field) in schema.fields().iter().enumerate().skip(1) {
+                let column = batch.column(col);
+                if column.is_null(row) {
+                    continue;
+                }
+
+                let column = column.as_any();
+                let value = if let Some(array) = column.downcast_ref::<BooleanArray>() {
+                    Value::Bool(array.value(row))
+                } else if let Some(array) = column.downcast_ref::<Int64Array>() {
+                    Value::Integer(array.value(row) as i128)
+                } else if let Some(array) = column.downcast_ref::<Float64Array>() {
+                    Value::Float(array.value(row))
+                } else if let Some(array) = column.downcast_ref::<StringArray>() {
+                    Value::Text(array.value(row).to_owned())
+                } else {
+                    return Err(eyre!(
+                        "Unsupported column `{}` in columnar log file ({path:?}).",
+                        field.name()
+                    ));
+                };
+                entries.push((time.into(), field.name().clone(), value));
+            }
+        }
+    }
+    Ok(entries)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn entry(time: &str, name: &str, value: Value) -> (DateTime<Local>, String, Value) {
+        let time = DateTime::parse_from_str(time, "%Y-%m-%d %H:%M:%S%.f %:z").unwrap();
+        (time.with_timezone(&Local), name.to_owned(), value)
+    }
+
+    const T0: &str = "2024-01-01 10:00:00.000001 +00:00";
+    const T1: &str = "2024-01-01 10:00:01.000001 +00:00";
+
+    #[test]
+    fn column_types_merge() {
+        assert_eq!(ColumnType::Null.merge(ColumnType::Int), ColumnType::Int);
+        assert_eq!(ColumnType::Int.merge(ColumnType::Float), ColumnType::Float);
+        assert_eq!(ColumnType::Text.merge(ColumnType::Int), ColumnType::Json);
+        assert_eq!(ColumnType::Bool.merge(ColumnType::Bool), ColumnType::Bool);
+    }
+
+    #[test]
+    fn entries_logged_together_share_a_row() {
+        let vec = vec![
+            entry(T0, "a", Value::Integer(1)),
+            entry(T0, "b", Value::Text("x".to_owned())),
+            entry(T1, "a", Value::Float(2.5)),
+        ];
+        let (mut names, mut types) = (vec![], vec![]);
+        let rows = rows(&vec, &mut names, &mut types).unwrap();
+
+        assert_eq!(names, ["a", "b"]);
+        assert_eq!(types, [ColumnType::Float, ColumnType::Text]);
+        assert_eq!(rows.len(), 2);
+        assert_eq!(rows[0].1, [Some(&vec[0].2), Some(&vec[1].2)]);
+        assert_eq!(rows[1].1, [Some(&vec[2].2), None]);
+        assert_eq!(rows[1].0 - rows[0].0, 1_000_000);
+    }
+
+    #[test]
+    fn flushes_append_batches() {
+        let path = std::env::temp_dir().join(format!("cog_columnar_{}.arrow", std::process::id()));
+        let mut writer = ColumnarWriter::new(path.clone());
+
+        let mut vec = vec![entry(T0, "a", Value::Integer(1))];
+        writer.write(&vec).unwrap();
+        vec.push(entry(T1, "a", Value::Integer(2)));
+        writer.write(&vec).unwrap();
+        let batches = read_columnar(&path).unwrap();
+        assert_eq!(batches.len(), 2);
+        assert_eq!(batches.iter().map(|b| b.num_rows()).sum::<usize>(), 2);
+
+        // A new column changes the schema, so the stream is rewritten as a single batch.
+        vec.push(entry(T1, "b", Value::Bool(true)));
+        writer.write(&vec).unwrap();
+        writer.finish().unwrap();
+        let batches = read_columnar(&path).unwrap();
+        assert_eq!(batches.len(), 1);
+        assert_eq!(batches[0].num_columns(), 3);
+        assert_eq!(batches[0].num_rows(), 2);
+
+        let entries = read_columnar_log(&path).unwrap();
+        let values: Vec<_> = entries.iter().map(|(_, n, v)| (n.as_str(), v)).collect();
+        assert_eq!(
+            values,
+            [
+                ("a", &Value::Integer(1)),
+                ("a", &Value::Integer(2)),
+                ("b", &Value::Bool(true))
+            ]
+        );
+        assert_eq!(entries[1].0 - entries[0].0, chrono::Duration::seconds(1));
+        assert_eq!(
+            entries[0].0.to_string(),
+            "2024-01-01 10:00:00.000001 +00:00"
+        );
+
+        std::fs::remove_file(path).ok();
+    }
+
+    #[test]
+    fn late_entries_keep_rows_sorted() {
+        let path =
+            std::env::temp_dir().join(format!("cog_columnar_late_{}.arrow", std::process::id()));
+        let mut writer = ColumnarWriter::new(path.clone());
+
+        let mut vec = vec![entry(T1, "a", Value::Integer(2))];
+        writer.write(&vec).unwrap();
+        vec.push(entry(T0, "a", Value::Integer(1)));
+        writer.write(&vec).unwrap();
+        writer.finish().unwrap();
+
+        let batches = read_columnar(&path).unwrap();
+        assert_eq!(batches.len(), 1);
+        let entries = read_columnar_log(&path).unwrap();
+        let values: Vec<_> = entries.iter().map(|(_, _, v)| v).collect();
+        assert_eq!(values, [&Value::Integer(1), &Value::Integer(2)]);
+        assert!(entries[0].0 < entries[1].0);
+
+        std::fs::remove_file(path).ok();
+    }
+}
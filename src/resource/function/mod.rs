@@ -32,6 +32,16 @@ pub enum Evaluator {
     Python(python::Evaluator),
 }
 
+/// Checks that a module can be imported by the python interpreter.
+#[allow(unused_variables)]
+pub fn verify_python_module(name: &str) -> Result<()> {
+    #[cfg(feature = "python")]
+    return python::verify_module(name);
+
+    #[cfg(not(feature = "python"))]
+    Err(eyre!("Python modules require the `python` feature."))
+}
+
 impl Default for Interpreter {
     fn default() -> Self {
         Interpreter::Inherit
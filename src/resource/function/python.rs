@@ -209,6 +209,17 @@ impl TryFrom<Value> for PyValue {
     }
 }
 
+/// Checks that `name` can be imported by the python interpreter.
+pub fn verify_module(name: &str) -> Result<()> {
+    init_python()?;
+
+    let gil = Python::acquire_gil();
+    let py = gil.python();
+    py.import(name)
+        .map(|_| ())
+        .map_err(|e| eyre!("Failed to import python module `{name}`: {e:?}"))
+}
+
 pub fn init_python() -> Result<()> {
     if PYTHON_INIT.get().is_some() {
         return Ok(());
@@ -0,0 +1,254 @@
+use crate::server::Env;
+use eyre::{eyre, Context, Result};
+use serde::{Deserialize, Serialize};
+use serde_cbor::Value;
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+/// A step that generates stimulus files while a block is being loaded, e.g., a script that renders
+/// a random-dot movie or a personalized word list for the current subject.
+///
+/// The executable (`src`, relative to the resource directory) is run inside the resource directory.
+/// It receives the subject, block, seed, and output directory through the `COG_SUBJECT`,
+/// `COG_BLOCK`, `COG_SEED`, and `COG_OUT_DIR` environment variables, and through the `{subject}`,
+/// `{block}`, `{seed}`, and `{out_dir}` placeholders in `args`. Files written to the output
+/// directory take precedence over the resource directory when the block loads its resources.
+///
+/// Scripts can be run by a specific `interpreter` (e.g., `"python3"` or the path to the python of
+/// a virtual environment), in which case `src` is passed as its first argument.
+#[derive(Debug, Clone, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Generator {
+    src: PathBuf,
+    #[serde(default)]
+    args: Vec<String>,
+    #[serde(default)]
+    seed: Option<u64>,
+    #[serde(default)]
+    interpreter: Option<PathBuf>,
+}
+
+impl Generator {
+    /// Fixed seed if one is given, otherwise a seed derived from the subject, block, and position
+    /// of the step, so that re-running a block for the same subject reproduces its stimuli.
+    pub fn seed(&self, subject: &str, block: &str, index: usize) -> u64 {
+        if let Some(seed) = self.seed {
+            return seed;
+        }
+
+        use sha2::{Digest, Sha256};
+        let mut hasher = Sha256::default();
+        hasher.update(format!("{subject}/{block}/{index}").as_bytes());
+        let digest = hasher.finalize();
+        u64::from_le_bytes(digest[..8].try_into().unwrap())
+    }
+
+    /// Arguments of the step with the placeholders filled in. Since arguments are text, the output
+    /// directory has to be valid UTF-8 if it is referenced.
+    fn args(&self, subject: &str, block: &str, seed: u64, out_dir: &Path) -> Result<Vec<String>> {
+        let needs_out_dir = self.args.iter().any(|arg| arg.contains("{out_dir}"));
+        let out_dir = match out_dir.to_str() {
+            Some(out_dir) => out_dir,
+            None if needs_out_dir => {
+                return Err(eyre!(
+                    "Generator output directory is not valid UTF-8, so it cannot be passed as \
+                    `{{out_dir}}` (use `COG_OUT_DIR` instead): {out_dir:?}"
+                ))
+            }
+            None => "",
+        };
+
+        Ok(self
+            .args
+            .iter()
+            .map(|arg| {
+                arg.replace("{subject}", subject)
+                    .replace("{block}", block)
+                    .replace("{seed}", &seed.to_string())
+                    .replace("{out_dir}", out_dir)
+            })
+            .collect())
+    }
+
+    pub fn run(
+        &self,
+        env: &Env,
+        subject: &str,
+        block: &str,
+        seed: u64,
+        out_dir: &Path,
+    ) -> Result<()> {
+        let src = env.resource().join(&self.src);
+        let args = self.args(subject, block, seed, out_dir)?;
+
+        let mut command = match &self.interpreter {
+            Some(interpreter) => {
+                let mut command = Command::new(interpreter);
+                command.arg(&src);
+                command
+            }
+            None => Command::new(&src),
+        };
+        let output = command
+            .args(args)
+            .current_dir(env.resource())
+            .env("COG_SUBJECT", subject)
+            .env("COG_BLOCK", block)
+            .env("COG_SEED", seed.to_string())
+            .env("COG_OUT_DIR", out_dir)
+            .output()
+            .wrap_err_with(|| match &self.interpreter {
+                Some(interpreter) => {
+                    format!(
+                        "Failed to spawn generator ({src:?}) with interpreter ({interpreter:?})."
+                    )
+                }
+                None => format!("Failed to spawn generator ({src:?})."),
+            })?;
+
+        if output.status.success() {
+            Ok(())
+        } else {
+            Err(eyre!(
+                "Generator ({src:?}) exited with {}:\n{}",
+                output.status,
+                String::from_utf8_lossy(&output.stderr)
+            ))
+        }
+    }
+}
+
+/// Runs the generators of a block in order, and returns log entries describing each step and the
+/// SHA-256 hash of every file that was written to `out_dir`.
+pub fn run_generators(
+    generators: &[Generator],
+    env: &Env,
+    subject: &str,
+    block: &str,
+    out_dir: &Path,
+) -> Result<Vec<(String, Value)>> {
+    fs::create_dir_all(out_dir)
+        .wrap_err_with(|| format!("Failed to create directory for generated files: {out_dir:?}"))?;
+
+    let mut entries = vec![];
+    for (i, generator) in generators.iter().enumerate() {
+        let seed = generator.seed(subject, block, i);
+        generator
+            .run(env, subject, block, seed, out_dir)
+            .wrap_err_with(|| format!("Failed to run generator #{i}."))?;
+
+        entries.push((
+            "generator".to_owned(),
+            Value::Map(BTreeMap::from([
+                (
+                    Value::Text("src".to_owned()),
+                    Value::Text(generator.src.to_string_lossy().into_owned()),
+                ),
+                (
+                    Value::Text("interpreter".to_owned()),
+                    match &generator.interpreter {
+                        Some(interpreter) => {
+                            Value::Text(interpreter.to_string_lossy().into_owned())
+                        }
+                        None => Value::Null,
+                    },
+                ),
+                (
+                    Value::Text("args".to_owned()),
+                    Value::Array(
+                        generator
+                            .args
+                            .iter()
+                            .map(|a| Value::Text(a.clone()))
+                            .collect(),
+                    ),
+                ),
+                (Value::Text("seed".to_owned()), Value::Integer(seed as i128)),
+            ])),
+        ));
+    }
+
+    let mut files = vec![];
+    collect_files(out_dir, &mut files)?;
+    files.sort();
+    for path in files {
+        use sha2::{Digest, Sha256};
+        let content = fs::read(&path)
+            .wrap_err_with(|| format!("Failed to read generated file ({path:?})."))?;
+        let mut hasher = Sha256::default();
+        hasher.update(&content);
+
+        let name = path
+            .strip_prefix(out_dir)
+            .unwrap_or(&path)
+            .to_string_lossy()
+            .into_owned();
+        entries.push((
+            "generated".to_owned(),
+            Value::Array(vec![
+                Value::Text(name),
+                Value::Text(hex::encode(hasher.finalize())),
+            ]),
+        ));
+    }
+
+    Ok(entries)
+}
+
+fn collect_files(dir: &Path, files: &mut Vec<PathBuf>) -> Result<()> {
+    let content = dir
+        .read_dir()
+        .wrap_err_with(|| format!("Failed to read directory ({dir:?})."))?;
+    for entry in content {
+        let path = entry?.path();
+        if path.is_dir() {
+            collect_files(&path, files)?;
+        } else {
+            files.push(path);
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn generator(text: &str) -> Generator {
+        ron::from_str(text).unwrap()
+    }
+
+    #[test]
+    fn seeds_are_reproducible() {
+        let g = generator(r#"(src: "gen.py")"#);
+        assert_eq!(g.seed("s01", "main", 0), g.seed("s01", "main", 0));
+        assert_ne!(g.seed("s01", "main", 0), g.seed("s02", "main", 0));
+        assert_ne!(g.seed("s01", "main", 0), g.seed("s01", "main", 1));
+        assert_eq!(
+            generator(r#"(src: "gen.py", seed: Some(7))"#).seed("s01", "main", 0),
+            7
+        );
+    }
+
+    #[test]
+    fn placeholders_are_filled() {
+        let g = generator(r#"(src: "gen.py", args: ["{subject}-{block}", "{seed}", "{out_dir}"])"#);
+        let args = g.args("s01", "main", 42, Path::new("/tmp/out")).unwrap();
+        assert_eq!(args, ["s01-main", "42", "/tmp/out"]);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn non_utf8_out_dir_is_an_error_only_when_used() {
+        use std::ffi::OsStr;
+        use std::os::unix::ffi::OsStrExt;
+
+        let out_dir = Path::new(OsStr::from_bytes(b"/tmp/\xff"));
+        let g = generator(r#"(src: "gen.py", args: ["{out_dir}"])"#);
+        assert!(g.args("s01", "main", 1, out_dir).is_err());
+        let g = generator(r#"(src: "gen.py", args: ["{seed}"])"#);
+        assert_eq!(g.args("s01", "main", 1, out_dir).unwrap(), ["1"]);
+    }
+}
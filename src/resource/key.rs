@@ -53,3 +53,267 @@ key!(
     Num9, A, B, C, D, E, F, G, H, I, J, K, L, M, N, O, P, Q, R, S, T, U, V, W, X, Y, Z, F1, F2, F3,
     F4, F5, F6, F7, F8, F9, F10, F11, F12, F13, F14, F15, F16, F17, F18, F19, F20,
 );
+
+macro_rules! key_code {
+    ($($name:ident),* $(,)?) => {
+        /// Physical position of a key, named after the key found at that position on a US QWERTY
+        /// keyboard (e.g., `key_z` is the leftmost key of the bottom letter row, regardless of the
+        /// letter printed on it).
+        #[derive(Debug, Clone, Copy, Deserialize, Serialize, PartialEq, Eq, Hash, PartialOrd, Ord)]
+        #[serde(rename_all = "snake_case")]
+        pub enum KeyCode {
+            $($name,)*
+        }
+    }
+}
+
+key_code!(
+    ArrowDown, ArrowLeft, ArrowRight, ArrowUp, Escape, Tab, Backspace, Enter, Space, Insert,
+    Delete, Home, End, PageUp, PageDown, Digit0, Digit1, Digit2, Digit3, Digit4, Digit5, Digit6,
+    Digit7, Digit8, Digit9, KeyA, KeyB, KeyC, KeyD, KeyE, KeyF, KeyG, KeyH, KeyI, KeyJ, KeyK, KeyL,
+    KeyM, KeyN, KeyO, KeyP, KeyQ, KeyR, KeyS, KeyT, KeyU, KeyV, KeyW, KeyX, KeyY, KeyZ, Semicolon,
+    Comma, Period, Slash, F1, F2, F3, F4, F5, F6, F7, F8, F9, F10, F11, F12, F13, F14, F15, F16,
+    F17, F18, F19, F20,
+);
+
+/// Keyboard layout of the machine running the task, used to find the physical position of the
+/// (logical) keys reported by the windowing backend, which does not expose scancodes.
+#[derive(Debug, Default, Clone, Copy, Deserialize, Serialize, PartialEq, Eq)]
+#[serde(rename_all = "snake_case")]
+pub enum KeyboardLayout {
+    #[default]
+    Qwerty,
+    Azerty,
+    Qwertz,
+    Dvorak,
+}
+
+impl KeyboardLayout {
+    /// Position of a logical key under this layout. Keys that are not listed for a layout are in
+    /// the same position as on QWERTY. Positions are only as accurate as the configured layout,
+    /// since they are not read from the keyboard.
+    pub fn code(&self, key: Key) -> KeyCode {
+        use KeyCode::*;
+
+        let qwerty = match key {
+            Key::ArrowDown => ArrowDown,
+            Key::ArrowLeft => ArrowLeft,
+            Key::ArrowRight => ArrowRight,
+            Key::ArrowUp => ArrowUp,
+            Key::Escape => Escape,
+            Key::Tab => Tab,
+            Key::Backspace => Backspace,
+            Key::Enter => Enter,
+            Key::Space => Space,
+            Key::Insert => Insert,
+            Key::Delete => Delete,
+            Key::Home => Home,
+            Key::End => End,
+            Key::PageUp => PageUp,
+            Key::PageDown => PageDown,
+            Key::Num0 => Digit0,
+            Key::Num1 => Digit1,
+            Key::Num2 => Digit2,
+            Key::Num3 => Digit3,
+            Key::Num4 => Digit4,
+            Key::Num5 => Digit5,
+            Key::Num6 => Digit6,
+            Key::Num7 => Digit7,
+            Key::Num8 => Digit8,
+            Key::Num9 => Digit9,
+            Key::A => KeyA,
+            Key::B => KeyB,
+            Key::C => KeyC,
+            Key::D => KeyD,
+            Key::E => KeyE,
+            Key::F => KeyF,
+            Key::G => KeyG,
+            Key::H => KeyH,
+            Key::I => KeyI,
+            Key::J => KeyJ,
+            Key::K => KeyK,
+            Key::L => KeyL,
+            Key::M => KeyM,
+            Key::N => KeyN,
+            Key::O => KeyO,
+            Key::P => KeyP,
+            Key::Q => KeyQ,
+            Key::R => KeyR,
+            Key::S => KeyS,
+            Key::T => KeyT,
+            Key::U => KeyU,
+            Key::V => KeyV,
+            Key::W => KeyW,
+            Key::X => KeyX,
+            Key::Y => KeyY,
+            Key::Z => KeyZ,
+            Key::F1 => F1,
+            Key::F2 => F2,
+            Key::F3 => F3,
+            Key::F4 => F4,
+            Key::F5 => F5,
+            Key::F6 => F6,
+            Key::F7 => F7,
+            Key::F8 => F8,
+            Key::F9 => F9,
+            Key::F10 => F10,
+            Key::F11 => F11,
+            Key::F12 => F12,
+            Key::F13 => F13,
+            Key::F14 => F14,
+            Key::F15 => F15,
+            Key::F16 => F16,
+            Key::F17 => F17,
+            Key::F18 => F18,
+            Key::F19 => F19,
+            Key::F20 => F20,
+        };
+
+        match (self, key) {
+            (KeyboardLayout::Qwerty, _) => qwerty,
+            (KeyboardLayout::Azerty, Key::A) => KeyQ,
+            (KeyboardLayout::Azerty, Key::Q) => KeyA,
+            (KeyboardLayout::Azerty, Key::Z) => KeyW,
+            (KeyboardLayout::Azerty, Key::W) => KeyZ,
+            (KeyboardLayout::Azerty, Key::M) => Semicolon,
+            // Digits are typed with Shift on AZERTY, on the same keys as on QWERTY
+            (KeyboardLayout::Azerty, Key::Num0) => Digit0,
+            (KeyboardLayout::Azerty, Key::Num1) => Digit1,
+            (KeyboardLayout::Azerty, Key::Num2) => Digit2,
+            (KeyboardLayout::Azerty, Key::Num3) => Digit3,
+            (KeyboardLayout::Azerty, Key::Num4) => Digit4,
+            (KeyboardLayout::Azerty, Key::Num5) => Digit5,
+            (KeyboardLayout::Azerty, Key::Num6) => Digit6,
+            (KeyboardLayout::Azerty, Key::Num7) => Digit7,
+            (KeyboardLayout::Azerty, Key::Num8) => Digit8,
+            (KeyboardLayout::Azerty, Key::Num9) => Digit9,
+            (KeyboardLayout::Azerty, _) => qwerty,
+            (KeyboardLayout::Qwertz, Key::Y) => KeyZ,
+            (KeyboardLayout::Qwertz, Key::Z) => KeyY,
+            (KeyboardLayout::Qwertz, _) => qwerty,
+            (KeyboardLayout::Dvorak, key) => match key {
+                Key::P => KeyR,
+                Key::Y => KeyT,
+                Key::F => KeyY,
+                Key::G => KeyU,
+                Key::C => KeyI,
+                Key::R => KeyO,
+                Key::L => KeyP,
+                Key::O => KeyS,
+                Key::E => KeyD,
+                Key::U => KeyF,
+                Key::I => KeyG,
+                Key::D => KeyH,
+                Key::H => KeyJ,
+                Key::T => KeyK,
+                Key::N => KeyL,
+                Key::S => Semicolon,
+                Key::Q => KeyX,
+                Key::J => KeyC,
+                Key::K => KeyV,
+                Key::X => KeyB,
+                Key::B => KeyN,
+                Key::W => Comma,
+                Key::V => Period,
+                Key::Z => Slash,
+                _ => qwerty,
+            },
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::collections::BTreeSet;
+
+    const LAYOUTS: [KeyboardLayout; 4] = [
+        KeyboardLayout::Qwerty,
+        KeyboardLayout::Azerty,
+        KeyboardLayout::Qwertz,
+        KeyboardLayout::Dvorak,
+    ];
+
+    const LETTERS: [Key; 26] = [
+        Key::A,
+        Key::B,
+        Key::C,
+        Key::D,
+        Key::E,
+        Key::F,
+        Key::G,
+        Key::H,
+        Key::I,
+        Key::J,
+        Key::K,
+        Key::L,
+        Key::M,
+        Key::N,
+        Key::O,
+        Key::P,
+        Key::Q,
+        Key::R,
+        Key::S,
+        Key::T,
+        Key::U,
+        Key::V,
+        Key::W,
+        Key::X,
+        Key::Y,
+        Key::Z,
+    ];
+
+    const DIGITS: [(Key, KeyCode); 10] = [
+        (Key::Num0, KeyCode::Digit0),
+        (Key::Num1, KeyCode::Digit1),
+        (Key::Num2, KeyCode::Digit2),
+        (Key::Num3, KeyCode::Digit3),
+        (Key::Num4, KeyCode::Digit4),
+        (Key::Num5, KeyCode::Digit5),
+        (Key::Num6, KeyCode::Digit6),
+        (Key::Num7, KeyCode::Digit7),
+        (Key::Num8, KeyCode::Digit8),
+        (Key::Num9, KeyCode::Digit9),
+    ];
+
+    #[test]
+    fn letters_have_distinct_positions() {
+        for layout in LAYOUTS {
+            let codes: BTreeSet<_> = LETTERS.iter().map(|k| layout.code(*k)).collect();
+            assert_eq!(codes.len(), LETTERS.len(), "{layout:?}");
+        }
+    }
+
+    #[test]
+    fn digit_row_is_shared() {
+        for layout in LAYOUTS {
+            for (key, code) in DIGITS {
+                assert_eq!(layout.code(key), code, "{layout:?}");
+            }
+        }
+    }
+
+    #[test]
+    fn letters_are_moved_by_layout() {
+        assert_eq!(KeyboardLayout::Qwerty.code(Key::Z), KeyCode::KeyZ);
+        assert_eq!(KeyboardLayout::Azerty.code(Key::W), KeyCode::KeyZ);
+        assert_eq!(KeyboardLayout::Azerty.code(Key::A), KeyCode::KeyQ);
+        assert_eq!(KeyboardLayout::Azerty.code(Key::M), KeyCode::Semicolon);
+        assert_eq!(KeyboardLayout::Qwertz.code(Key::Y), KeyCode::KeyZ);
+        assert_eq!(KeyboardLayout::Dvorak.code(Key::S), KeyCode::Semicolon);
+        assert_eq!(KeyboardLayout::Dvorak.code(Key::Z), KeyCode::Slash);
+        assert_eq!(KeyboardLayout::Dvorak.code(Key::A), KeyCode::KeyA);
+    }
+
+    #[test]
+    fn layouts_are_named_in_snake_case() {
+        assert_eq!(
+            ron::from_str::<KeyboardLayout>("azerty").unwrap(),
+            KeyboardLayout::Azerty
+        );
+        assert_eq!(
+            ron::from_str::<Vec<KeyCode>>("[key_z, slash, digit1]").unwrap(),
+            [KeyCode::KeyZ, KeyCode::Slash, KeyCode::Digit1]
+        );
+    }
+}
@@ -1,32 +1,49 @@
 use crate::action::Action;
 use crate::comm::QWriter;
-use crate::server::{AsyncSignal, Config, Info};
-use chrono::{DateTime, Local};
+use crate::server::{sha256_file, AsyncSignal, Config, Info};
+use chrono::{DateTime, FixedOffset, Local};
 use eyre::{eyre, Context, Error, Result};
 use itertools::Itertools;
 use ron::ser::PrettyConfig;
+use serde::de::DeserializeOwned;
 use serde::{Deserialize, Serialize, Serializer};
 use serde_cbor::{from_slice, Value};
 use std::collections::HashMap;
 use std::fmt::Debug;
 use std::fs::{create_dir_all, File};
-use std::io::Write;
-use std::path::PathBuf;
-use std::time::Duration;
+use std::io::{Seek, SeekFrom, Write};
+use std::path::{Path, PathBuf};
+use std::time::{Duration, Instant};
 use std::{fs, thread};
 
 pub const TAG_INFO: u64 = 0x01;
 pub const TAG_CONFIG: u64 = 0x02;
 pub const TAG_ACTION: u64 = 0x03;
 
-pub type LogGroup = (Vec<(String, String, Value)>, bool);
+/// File (inside the run directory) that lists the differences found between the run directory and
+/// its mirror (see `mirror_output` in the task config).
+pub const MIRROR_LOG: &str = "mirror_error.log";
 
-#[derive(Debug, Default)]
+pub type LogGroup = (Vec<(DateTime<Local>, String, Value)>, bool);
+
+/// Bytes of the last trailing part of a mirrored file that are kept to find where a rewritten file
+/// starts to differ from its mirror (e.g., the closing bracket of a JSON log before new entries).
+const MIRROR_TAIL: usize = 4096;
+
+#[derive(Debug)]
 pub struct Logger {
+    clock: (Instant, DateTime<Local>),
     out_dir: PathBuf,
+    mirror_dir: Option<PathBuf>,
+    mirror_errors: Vec<String>,
+    mirrored: HashMap<PathBuf, MirroredFile>,
     content: HashMap<String, LogGroup>,
     needs_flush: bool,
     log_format: LogFormat,
+    #[cfg(feature = "arrow")]
+    columnar: std::collections::BTreeSet<String>,
+    #[cfg(feature = "arrow")]
+    columnar_writers: HashMap<String, crate::resource::ColumnarWriter>,
 }
 
 #[derive(Debug, Clone)]
@@ -37,6 +54,16 @@ pub enum LoggerSignal {
     Flush,
 }
 
+/// Description of an entry that an action can write to a log group, used to generate codebooks.
+#[derive(Debug, Clone, Serialize)]
+pub struct LogEntry {
+    pub group: String,
+    pub name: String,
+    pub dtype: String,
+    pub unit: String,
+    pub meaning: String,
+}
+
 #[derive(Debug, Copy, Clone, Deserialize, Serialize)]
 #[serde(rename_all = "lowercase")]
 pub enum LogFormat {
@@ -63,6 +90,18 @@ impl LogFormat {
     }
 }
 
+impl LogEntry {
+    pub fn new(group: &str, name: &str, dtype: &str, unit: &str, meaning: &str) -> Self {
+        Self {
+            group: group.to_owned(),
+            name: name.to_owned(),
+            dtype: dtype.to_owned(),
+            unit: unit.to_owned(),
+            meaning: meaning.to_owned(),
+        }
+    }
+}
+
 impl LoggerSignal {
     #[inline(always)]
     fn requires_flush(&self) -> bool {
@@ -75,7 +114,7 @@ impl LoggerSignal {
 
 impl From<LoggerSignal> for AsyncSignal {
     fn from(signal: LoggerSignal) -> Self {
-        AsyncSignal::Logger(Local::now(), signal)
+        AsyncSignal::Logger(Instant::now(), signal)
     }
 }
 
@@ -92,16 +131,100 @@ impl Logger {
         create_dir_all(&out_dir)
             .wrap_err_with(|| format!("Failed to create output directory: {out_dir:?}"))?;
 
+        // An unavailable mirror does not keep the block from running, since the primary output
+        // remains usable. The failure is reported along with the other mirror errors.
+        let task_output = info.output().parent().unwrap_or(Path::new(""));
+        let mirror_dir = mirror_path(config, task_output, &out_dir);
+        let mut mirror_errors = vec![];
+        if let Some(dir) = mirror_dir.as_ref() {
+            if let Err(e) = create_dir_all(dir) {
+                eprintln!("Failed to create mirror directory {dir:?}: {e}");
+                mirror_errors.push(format!(
+                    "Failed to create mirror directory {dir:?} at {}: {e}",
+                    Local::now().format("%T")
+                ));
+            }
+        }
+
         Ok(Self {
+            clock: (Instant::now(), Local::now()),
             out_dir,
+            mirror_dir,
+            mirror_errors,
+            mirrored: HashMap::new(),
             content: HashMap::new(),
             needs_flush: false,
             log_format: config.log_format(),
+            #[cfg(feature = "arrow")]
+            columnar: config
+                .columnar()
+                .iter()
+                .map(|g| normalized_name(g))
+                .collect(),
+            #[cfg(feature = "arrow")]
+            columnar_writers: HashMap::new(),
         })
     }
 
-    fn append(&mut self, time: DateTime<Local>, group: String, entry: (String, Value)) {
-        let time = time.to_string();
+    /// Wall-clock time of a monotonic instant. All instants of a run are converted relative to the
+    /// same reference (taken when the logger was created), so their order and spacing is kept even
+    /// if the system clock is adjusted during the run.
+    pub fn local_time(&self, time: Instant) -> DateTime<Local> {
+        let (instant, wall) = self.clock;
+        let shift = |d| chrono::Duration::from_std(d).unwrap_or_else(|_| chrono::Duration::zero());
+        if time >= instant {
+            wall + shift(time - instant)
+        } else {
+            wall - shift(instant - time)
+        }
+    }
+
+    #[inline(always)]
+    pub fn out_dir(&self) -> &Path {
+        &self.out_dir
+    }
+
+    #[inline(always)]
+    pub fn mirror_dir(&self) -> Option<&Path> {
+        self.mirror_dir.as_deref()
+    }
+
+    /// Copies a file that was just written to the run directory to the mirror. Only the part of the
+    /// file that changed since it was last mirrored is written, since log groups are rewritten on
+    /// every flush but only grow at the end. Failures are only recorded, since the primary output
+    /// remains usable, and are reported when the run ends.
+    fn mirror(&mut self, path: &Path) {
+        let dest = match self.mirror_dir.as_ref() {
+            Some(dir) => dir.join(path.strip_prefix(&self.out_dir).unwrap_or(path)),
+            None => return,
+        };
+
+        let result = dest
+            .parent()
+            .map_or(Ok(()), create_dir_all)
+            .and_then(|_| fs::read(path))
+            .and_then(|content| {
+                mirror_changes(&dest, &content, self.mirrored.get(path))?;
+                Ok(content)
+            });
+        match result {
+            Ok(content) => {
+                self.mirrored
+                    .insert(path.to_owned(), MirroredFile::new(&content));
+            }
+            Err(e) => {
+                self.mirrored.remove(path);
+                eprintln!("Failed to mirror log file to {dest:?}: {e}");
+                self.mirror_errors.push(format!(
+                    "Failed to mirror {dest:?} at {}: {e}",
+                    Local::now().format("%T")
+                ));
+            }
+        }
+    }
+
+    fn append(&mut self, time: Instant, group: String, entry: (String, Value)) {
+        let time = self.local_time(time);
         let (name, value) = entry;
         let (vec, flush) = self.content.entry(group).or_default();
         vec.push((time, name, value));
@@ -109,14 +232,10 @@ impl Logger {
         self.needs_flush = true;
     }
 
-    fn extend(&mut self, time: DateTime<Local>, group: String, entries: Vec<(String, Value)>) {
-        let time = time.to_string();
+    fn extend(&mut self, time: Instant, group: String, entries: Vec<(String, Value)>) {
+        let time = self.local_time(time);
         let (vec, flush) = self.content.entry(group).or_default();
-        vec.extend(
-            entries
-                .into_iter()
-                .map(|(name, value)| (time.clone(), name, value)),
-        );
+        vec.extend(entries.into_iter().map(|(name, value)| (time, name, value)));
         *flush = true;
         self.needs_flush = true;
     }
@@ -134,6 +253,7 @@ impl Logger {
             write_as(file, &content, self.log_format)
                 .wrap_err_with(|| format!("Failed to write to log file ({path:?})."))?;
         }
+        self.mirror(&path);
 
         #[cfg(debug_assertions)]
         println!("{:?} -> Wrote to file: {path:?}", Local::now());
@@ -141,7 +261,25 @@ impl Logger {
     }
 
     fn flush(&mut self) -> Result<()> {
+        let mut written = vec![];
         for (group, (vec, flush)) in self.content.iter_mut().filter(|(_, (_, flush))| *flush) {
+            #[cfg(feature = "arrow")]
+            if self.columnar.contains(&normalized_name(group)) {
+                let writer = self
+                    .columnar_writers
+                    .entry(group.clone())
+                    .or_insert_with(|| {
+                        crate::resource::ColumnarWriter::new(
+                            self.out_dir
+                                .join(format!("{}.arrow", normalized_name(group))),
+                        )
+                    });
+                writer.write(vec)?;
+                *flush = false;
+                written.push(writer.path().to_owned());
+                continue;
+            }
+
             let name = format!("{}.log", normalized_name(group));
             let path = self.out_dir.join(name);
             let mut file = File::create(&path)
@@ -149,17 +287,81 @@ impl Logger {
 
             write_vec(&mut file, self.log_format, vec)?;
             *flush = false;
+            written.push(path.clone());
 
             #[cfg(debug_assertions)]
             println!("{:?} -> Wrote to file: {path:?}", Local::now());
         }
         self.needs_flush = false;
+
+        for path in written {
+            self.mirror(&path);
+        }
+        Ok(())
+    }
+
+    /// Compares every file in the run directory with its mirror, copying over any file that the
+    /// mirror is missing (e.g., ones written outside the logger). Divergences, along with mirror
+    /// writes that failed during the run, are written to `MIRROR_LOG` in the run directory.
+    fn verify_mirror(&mut self) -> Result<()> {
+        let mirror_dir = match self.mirror_dir.as_ref() {
+            Some(dir) => dir.clone(),
+            None => return Ok(()),
+        };
+
+        let mut problems: Vec<String> = self.mirror_errors.drain(..).collect();
+
+        let files = list_files(&self.out_dir, Path::new(""));
+        for file in files.iter() {
+            let (src, dest) = (self.out_dir.join(file), mirror_dir.join(file));
+            let expected = sha256_file(&src)?;
+            let copy = match sha256_file(&dest) {
+                Ok(actual) if actual == expected => false,
+                Ok(_) => {
+                    problems.push(format!("{file:?} differs from the original"));
+                    true
+                }
+                Err(_) => true,
+            };
+
+            if copy {
+                let result = dest
+                    .parent()
+                    .map_or(Ok(()), create_dir_all)
+                    .and_then(|_| fs::copy(&src, &dest));
+                match result.map(|_| sha256_file(&dest)) {
+                    Ok(Ok(actual)) if actual == expected => {}
+                    Ok(Ok(_)) => problems.push(format!("{file:?} could not be repaired")),
+                    Ok(Err(e)) => problems.push(format!("{file:?} could not be verified: {e:#}")),
+                    Err(e) => problems.push(format!("{file:?} could not be copied: {e}")),
+                }
+            }
+        }
+
+        for file in list_files(&mirror_dir, Path::new("")) {
+            if !files.contains(&file) {
+                problems.push(format!("{file:?} only exists in the mirror"));
+            }
+        }
+
+        if !problems.is_empty() {
+            let time = Local::now().to_string();
+            let entries = problems
+                .into_iter()
+                .map(|p| (time.clone(), "divergence".to_owned(), Value::Text(p)))
+                .collect();
+            let path = self.out_dir.join(MIRROR_LOG);
+            write_entries(&path, self.log_format, &entries)?;
+            if let Err(e) = fs::copy(&path, mirror_dir.join(MIRROR_LOG)) {
+                eprintln!("Failed to mirror {MIRROR_LOG}: {e}");
+            }
+        }
         Ok(())
     }
 
     pub fn update(
         &mut self,
-        time: DateTime<Local>,
+        time: Instant,
         signal: LoggerSignal,
         async_writer: &QWriter<AsyncSignal>,
     ) -> Result<()> {
@@ -193,12 +395,93 @@ impl Logger {
     pub fn finish(&mut self) -> Result<()> {
         self.flush()
             .wrap_err("Failed to graciously close logger.")?;
+        #[cfg(feature = "arrow")]
+        for (_, mut writer) in std::mem::take(&mut self.columnar_writers) {
+            writer
+                .finish()
+                .wrap_err("Failed to graciously close logger.")?;
+            self.mirror(writer.path());
+        }
+        self.verify_mirror()
+            .wrap_err_with(|| format!("Failed to verify output mirror ({:?}).", self.mirror_dir))?;
 
         self.content.clear();
         Ok(())
     }
 }
 
+/// Length and trailing bytes of the content of a file when it was last mirrored.
+#[derive(Debug, Default)]
+struct MirroredFile {
+    len: usize,
+    tail: Vec<u8>,
+}
+
+impl MirroredFile {
+    fn new(content: &[u8]) -> Self {
+        let start = content.len().saturating_sub(MIRROR_TAIL);
+        Self {
+            len: content.len(),
+            tail: content[start..].to_vec(),
+        }
+    }
+
+    /// Length of the leading part of `content` that is already in the mirror. Only the trailing
+    /// bytes are compared, since everything before them is never rewritten by the logger;
+    /// divergences elsewhere are caught when the mirror is verified at the end of the run.
+    fn unchanged(&self, content: &[u8]) -> usize {
+        let start = self.len - self.tail.len();
+        if content.len() < start {
+            return 0;
+        }
+        start
+            + content[start..]
+                .iter()
+                .zip(self.tail.iter())
+                .take_while(|(a, b)| a == b)
+                .count()
+    }
+}
+
+/// Brings the mirror `dest` up to date with `content`, writing only what changed since `previous`
+/// was mirrored. The whole file is written if the mirror does not match what was last written.
+fn mirror_changes(
+    dest: &Path,
+    content: &[u8],
+    previous: Option<&MirroredFile>,
+) -> std::io::Result<()> {
+    let start = previous.map_or(0, |p| p.unchanged(content));
+    let expected = previous.map(|p| p.len as u64);
+    let mut file = match fs::OpenOptions::new().write(true).open(dest) {
+        Ok(file) if start > 0 && Some(file.metadata()?.len()) == expected => file,
+        _ => return fs::write(dest, content),
+    };
+    file.set_len(start as u64)?;
+    file.seek(SeekFrom::Start(start as u64))?;
+    file.write_all(&content[start..])
+}
+
+/// Path under the `mirror_output` root (if any) that mirrors `path`, a file or directory inside
+/// the output directory of a task (`task_output`). The mirror keeps the layout of the output
+/// directory (`<task>/<subject>/...`).
+pub fn mirror_path(config: &Config, task_output: &Path, path: &Path) -> Option<PathBuf> {
+    let root = config.mirror_output()?;
+    let output = task_output.parent().unwrap_or(Path::new(""));
+    Some(root.join(path.strip_prefix(output).unwrap_or(path)))
+}
+
+/// Copies a file that is written to a run directory after its logger has been closed (e.g., the
+/// cleanup error, or the reason a run was invalidated) to the mirror, if any.
+pub fn mirror_file(config: &Config, task_output: &Path, path: &Path) -> Result<()> {
+    if let Some(dest) = mirror_path(config, task_output, path) {
+        dest.parent()
+            .map_or(Ok(()), create_dir_all)
+            .and_then(|_| fs::copy(path, &dest))
+            .wrap_err_with(|| format!("Failed to mirror {path:?} to {dest:?}."))?;
+    }
+    Ok(())
+}
+
 pub fn normalized_name(name: &str) -> String {
     name.to_lowercase()
         .split_whitespace()
@@ -206,10 +489,68 @@ pub fn normalized_name(name: &str) -> String {
         .replace('-', "_")
 }
 
-fn write_vec(file: &mut File, fmt: LogFormat, vec: &Vec<(String, String, Value)>) -> Result<()> {
-    let mut vec_t: Vec<(&str, &str, Serializable)> = vec![];
+/// Paths of all files under a directory, recursively, relative to `dir` and joined to `prefix`.
+pub fn list_files(dir: &Path, prefix: &Path) -> Vec<PathBuf> {
+    let mut files = vec![];
+    if let Ok(entries) = dir.read_dir() {
+        for entry in entries.flatten() {
+            let path = prefix.join(entry.file_name());
+            if entry.path().is_dir() {
+                files.extend(list_files(&entry.path(), &path));
+            } else {
+                files.push(path);
+            }
+        }
+    }
+    files
+}
+
+/// Writes a standalone list of `(time, name, value)` entries to a file, laid out like a log group.
+pub fn write_entries(
+    path: &Path,
+    fmt: LogFormat,
+    entries: &Vec<(String, String, Value)>,
+) -> Result<()> {
+    let mut file =
+        File::create(path).wrap_err_with(|| format!("Failed to create log file ({path:?})."))?;
+    write_vec(&mut file, fmt, entries)
+        .wrap_err_with(|| format!("Failed to write to log file ({path:?})."))
+}
+
+/// Reads the `(time, name, value)` entries of a log group written in any of the log formats.
+pub fn read_log(path: &Path) -> Result<Vec<(DateTime<FixedOffset>, String, Value)>> {
+    parse_log::<(String, String, Value)>(path)?
+        .into_iter()
+        .map(|(time, name, value)| Ok((parse_log_time(&time, path)?, name, value)))
+        .collect()
+}
+
+/// Parses the entries of a log group written in any of the log formats as `T`, so that callers can
+/// skip values they do not need (e.g., with `serde::de::IgnoredAny`).
+pub fn parse_log<T: DeserializeOwned>(path: &Path) -> Result<Vec<T>> {
+    let content = fs::read_to_string(path)
+        .wrap_err_with(|| format!("Failed to read log file ({path:?})."))?;
+
+    serde_json::from_str(&content)
+        .or_else(|_| serde_yaml::from_str(&content))
+        .or_else(|_| ron::from_str(&content))
+        .wrap_err_with(|| format!("Failed to parse log file ({path:?})."))
+}
+
+/// Parses the timestamp of a log entry read from the file at `path`.
+pub fn parse_log_time(time: &str, path: &Path) -> Result<DateTime<FixedOffset>> {
+    DateTime::parse_from_str(time, "%Y-%m-%d %H:%M:%S%.f %:z")
+        .wrap_err_with(|| format!("Invalid timestamp in log file ({path:?}): {time}"))
+}
+
+fn write_vec<T: ToString>(
+    file: &mut File,
+    fmt: LogFormat,
+    vec: &[(T, String, Value)],
+) -> Result<()> {
+    let mut vec_t: Vec<(String, &str, Serializable)> = vec![];
     for (a, b, v) in vec {
-        vec_t.push((a, b, Serializable::try_from(v)?));
+        vec_t.push((a.to_string(), b, Serializable::try_from(v)?));
     }
 
     write_as(file, &vec_t, fmt)
@@ -238,7 +579,7 @@ where
     }
 }
 
-enum Serializable<'a> {
+pub(crate) enum Serializable<'a> {
     Info(Info),
     Config(Config),
     Action(Box<dyn Action>),
@@ -280,3 +621,82 @@ impl<'a> TryFrom<&'a Value> for Serializable<'a> {
         })
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn mirror_keeps_output_layout() {
+        let config: Config = ron::from_str("(mirror_output: Some(\"/mnt/mirror\"))").unwrap();
+        let run = Path::new("/data/output/task/subject/2026-10-17/block/12-00-00");
+        assert_eq!(
+            mirror_path(
+                &config,
+                Path::new("/data/output/task"),
+                &run.join("main.log")
+            ),
+            Some(PathBuf::from(
+                "/mnt/mirror/task/subject/2026-10-17/block/12-00-00/main.log"
+            ))
+        );
+        assert_eq!(
+            mirror_path(&Config::default(), Path::new("/data/output/task"), run),
+            None
+        );
+    }
+
+    #[test]
+    fn mirror_only_writes_changes() {
+        let dir = std::env::temp_dir().join(format!("cog_logger_mirror_{}", std::process::id()));
+        create_dir_all(&dir).unwrap();
+        let dest = dir.join("main.log");
+
+        let first = b"[\n  (\"a\", 1),\n]".to_vec();
+        mirror_changes(&dest, &first, None).unwrap();
+        assert_eq!(fs::read(&dest).unwrap(), first);
+
+        // A byte that is not rewritten keeps the marker, which shows that only the end of the file
+        // (from the closing bracket on) was written again
+        let mut marked = first.clone();
+        marked[0] = b'X';
+        fs::write(&dest, &marked).unwrap();
+        let previous = MirroredFile::new(&first);
+        let second = b"[\n  (\"a\", 1),\n  (\"b\", 2),\n]".to_vec();
+        assert_eq!(previous.unchanged(&second), first.len() - 1);
+        mirror_changes(&dest, &second, Some(&previous)).unwrap();
+        let mirrored = fs::read(&dest).unwrap();
+        assert_eq!(mirrored[0], b'X');
+        assert_eq!(mirrored[1..], second[1..]);
+
+        // A mirror that was changed by someone else is rewritten entirely
+        fs::write(&dest, b"[]").unwrap();
+        let previous = MirroredFile::new(&second);
+        let third = b"[\n  (\"a\", 1),\n  (\"b\", 2),\n  (\"c\", 3),\n]".to_vec();
+        mirror_changes(&dest, &third, Some(&previous)).unwrap();
+        assert_eq!(fs::read(&dest).unwrap(), third);
+
+        // Content that shrank is truncated
+        let previous = MirroredFile::new(&third);
+        mirror_changes(&dest, &first, Some(&previous)).unwrap();
+        assert_eq!(fs::read(&dest).unwrap(), first);
+
+        fs::remove_dir_all(&dir).ok();
+    }
+
+    #[test]
+    fn only_trailing_bytes_are_compared() {
+        let content = vec![b'a'; MIRROR_TAIL * 2];
+        let previous = MirroredFile::new(&content);
+        assert_eq!(previous.tail.len(), MIRROR_TAIL);
+
+        let mut longer = content.clone();
+        longer.extend_from_slice(b"bc");
+        assert_eq!(previous.unchanged(&longer), content.len());
+
+        let mut rewritten = longer.clone();
+        rewritten[MIRROR_TAIL + 1] = b'z';
+        assert_eq!(previous.unchanged(&rewritten), MIRROR_TAIL + 1);
+        assert_eq!(previous.unchanged(&content[..MIRROR_TAIL / 2]), 0);
+    }
+}
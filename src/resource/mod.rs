@@ -1,7 +1,10 @@
 pub mod address;
 pub mod audio;
 pub mod color;
+#[cfg(feature = "arrow")]
+pub mod columnar;
 pub mod function;
+pub mod generator;
 pub mod image;
 pub mod key;
 pub mod logger;
@@ -14,7 +17,10 @@ pub use crate::resource::image::*;
 pub use address::*;
 pub use audio::*;
 pub use color::*;
+#[cfg(feature = "arrow")]
+pub use columnar::*;
 pub use function::*;
+pub use generator::*;
 pub use key::*;
 pub use logger::*;
 pub use stream::*;
@@ -27,58 +33,94 @@ use crate::server::{Config, Env};
 use eframe::egui::mutex::RwLock;
 use eframe::epaint;
 use eyre::{eyre, Context, Result};
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap, HashSet};
 use std::fmt::{Debug, Formatter};
+use std::path::Path;
 use std::sync::{Arc, Mutex};
 
+/// Resources loaded for the active block, kept across blocks that use them under the same config.
+/// Resources loaded from the files generated for a block are tracked separately (third field),
+/// since they are only valid for that run of the block.
 #[derive(Debug, Clone)]
-pub struct ResourceManager(Arc<Mutex<HashMap<ResourceAddr, ResourceValue>>>);
+pub struct ResourceManager(
+    Arc<Mutex<HashMap<ResourceAddr, ResourceValue>>>,
+    Arc<Mutex<Vec<u8>>>,
+    Arc<Mutex<HashSet<ResourceAddr>>>,
+);
 
 pub struct IoManager {
     audio: AudioDevice,
+    outputs: BTreeMap<String, AudioDevice>,
+    fallback: bool,
 }
 
 impl ResourceManager {
     #[inline(always)]
     pub fn new(_config: &Config) -> Result<Self> {
-        Ok(Self(Default::default()))
+        Ok(Self(
+            Default::default(),
+            Default::default(),
+            Default::default(),
+        ))
     }
 
     pub fn preload_block(
         &mut self,
         resources: Vec<ResourceAddr>,
         tex_manager: Arc<RwLock<epaint::TextureManager>>,
-        #[allow(unused)] config: &Config,
+        config: &Config,
         env: &Env,
+        generated: Option<&Path>,
     ) -> Result<()> {
         // Lock map
         let mut map = self.0.lock().unwrap();
 
-        // Clean up existing resource map
-        map.clear();
+        // Drop resources generated for the previous block, so that they are never reused
+        let mut generated_srcs = self.2.lock().unwrap();
+        for src in generated_srcs.drain() {
+            map.remove(&src);
+        }
+
+        // Drop resources not used in new block, or everything if they were loaded under a
+        // different configuration
+        let signature = serde_cbor::to_vec(config).wrap_err("Failed to serialize config.")?;
+        let mut loaded_with = self.1.lock().unwrap();
+        if *loaded_with == signature {
+            let wanted: HashSet<_> = resources.iter().collect();
+            map.retain(|src, _| wanted.contains(src));
+        } else {
+            map.clear();
+            *loaded_with = signature;
+        }
 
         // Load default fixation image
-        let src = ResourceAddr::Image("fixation.svg".into());
+        let path = Path::new("fixation.svg");
+        let src = ResourceAddr::Image(path.into());
         map.entry(src.clone()).or_insert({
             let tex_manager = tex_manager.clone();
-            let (texture, size) = svg_from_bytes(tex_manager, IMAGE_FIXATION, src.path())?;
+            let (texture, size) = svg_from_bytes(tex_manager, IMAGE_FIXATION, path)?;
             ResourceValue::Image(texture, size)
         });
         let mut default_fixation = true;
 
         // Load default rustacean image
-        let src = ResourceAddr::Image("rustacean.svg".into());
+        let path = Path::new("rustacean.svg");
+        let src = ResourceAddr::Image(path.into());
         map.entry(src.clone()).or_insert({
             let tex_manager = tex_manager.clone();
-            let (texture, size) = svg_from_bytes(tex_manager, IMAGE_RUSTACEAN, src.path())?;
+            let (texture, size) = svg_from_bytes(tex_manager, IMAGE_RUSTACEAN, path)?;
             ResourceValue::Image(texture, size)
         });
         let mut default_rustacean = true;
 
         // Load resources used in new block
         for src in resources {
-            let mut is_new = !map.contains_key(&src);
-            match src.path().to_str().unwrap() {
+            // Generated files are looked up first, and are only kept for this block
+            let gen_dir =
+                generated.filter(|dir| src.path().map_or(false, |p| dir.join(p).exists()));
+
+            let mut is_new = !map.contains_key(&src) || gen_dir.is_some();
+            match src.path().and_then(|p| p.to_str()).unwrap_or_default() {
                 "fixation.svg" => {
                     if default_fixation {
                         is_new = true;
@@ -95,7 +137,7 @@ impl ResourceManager {
             }
 
             if is_new {
-                let data = match src.prefix(env.resource()) {
+                let data = match src.prefix(gen_dir.unwrap_or(env.resource()))? {
                     ResourceAddr::Ref(path) => ResourceValue::Ref(path),
                     ResourceAddr::Text(path) => {
                         let text = std::fs::read_to_string(&path)
@@ -134,8 +176,19 @@ impl ResourceManager {
                             })?,
                         )
                     }
+                    ResourceAddr::Pipeline(description) => {
+                        let tex_manager = tex_manager.clone();
+                        ResourceValue::Stream(
+                            stream_from_pipeline(tex_manager, &description, config).wrap_err_with(
+                                || eyre!("Failed to load stream pipeline ({description})"),
+                            )?,
+                        )
+                    }
                 };
                 println!("+ {src:?} : {data:?}");
+                if gen_dir.is_some() {
+                    generated_srcs.insert(src.clone());
+                }
                 map.insert(src, data);
             }
         }
@@ -160,18 +213,108 @@ impl Debug for IoManager {
 
 impl IoManager {
     pub fn new(config: &Config) -> Result<Self> {
+        let fallback = config.audio_fallback();
+        let mut outputs = BTreeMap::new();
+        for (name, output) in config.audio_devices() {
+            if name == "default" {
+                continue;
+            }
+
+            match AudioDevice::open(output, config) {
+                Ok(device) => {
+                    outputs.insert(name.clone(), device);
+                }
+                Err(e) if fallback => {
+                    eprintln!(
+                        "Audio device `{name}` is unavailable, falling back to default: {e:#}"
+                    );
+                }
+                Err(e) => {
+                    return Err(e)
+                        .wrap_err_with(|| format!("Failed to open audio device `{name}`."))
+                }
+            }
+        }
+
         Ok(Self {
             audio: AudioDevice::new(config)?,
+            outputs,
+            fallback,
         })
     }
 
     pub fn try_clone(&self) -> Result<Self> {
+        let mut outputs = BTreeMap::new();
+        for (name, device) in self.outputs.iter() {
+            outputs.insert(name.clone(), device.try_clone()?);
+        }
+
         Ok(Self {
             audio: self.audio.try_clone()?,
+            outputs,
+            fallback: self.fallback,
         })
     }
 
     pub fn audio(&self) -> Result<AudioSink> {
         self.audio.sink()
     }
+
+    /// Creates a sink on the named output device (from the `audio_devices` config), or on the
+    /// default device if `name` is `None`, is `"default"`, or (with `audio_fallback`) is unavailable.
+    pub fn audio_on(&self, name: Option<&str>) -> Result<AudioSink> {
+        match name {
+            None | Some("default") => self.audio.sink(),
+            Some(name) => match self.outputs.get(name) {
+                Some(device) => device.sink(),
+                None if self.fallback => self.audio.sink(),
+                None => Err(eyre!("Unknown audio device: `{name}`")),
+            },
+        }
+    }
+
+    #[inline(always)]
+    pub fn audio_device(&self) -> &AudioDevice {
+        &self.audio
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::PathBuf;
+
+    #[test]
+    fn generated_resources_are_not_reused_by_later_blocks() {
+        let dir = std::env::temp_dir().join(format!("cog_generated_{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("stim.txt"), "generated").unwrap();
+
+        let config = Config::default();
+        let env = Env::default();
+        let tex_manager = Arc::new(RwLock::new(epaint::TextureManager::default()));
+        let mut res = ResourceManager::new(&config).unwrap();
+        let src = ResourceAddr::Ref("stim.txt".into());
+        let fetch = |res: &ResourceManager| match res.fetch(&src).unwrap() {
+            ResourceValue::Ref(path) => path,
+            v => panic!("Unexpected resource value: {v:?}"),
+        };
+
+        // First block generates the file, the next one uses the one from the task.
+        res.preload_block(
+            vec![src.clone()],
+            tex_manager.clone(),
+            &config,
+            &env,
+            Some(&dir),
+        )
+        .unwrap();
+        assert_eq!(fetch(&res), dir.join("stim.txt"));
+        res.preload_block(vec![src.clone()], tex_manager.clone(), &config, &env, None)
+            .unwrap();
+        assert_eq!(fetch(&res), PathBuf::from("stim.txt"));
+        assert!(res.2.lock().unwrap().is_empty());
+
+        std::fs::remove_dir_all(dir).ok();
+    }
 }
@@ -1,4 +1,4 @@
-use crate::resource::{FrameBuffer, MediaStream, StreamMode};
+use crate::resource::{FrameBuffer, MediaStream, OutputDevice, StreamMode};
 use crate::server::Config;
 use crate::util::spin_sleeper;
 use eframe::egui::mutex::RwLock;
@@ -98,6 +98,7 @@ impl MediaStream for Stream {
         frame: Arc<Mutex<Option<(TextureId, Vec2)>>>,
         media_mode: StreamMode,
         _volume: f32,
+        _output: &OutputDevice,
     ) -> Result<Self> {
         let (_media_mode, audio_chan) = match (media_mode, self.audio_chan) {
             (StreamMode::SansIntTrigger, 0) => Err(eyre!(
@@ -1,4 +1,4 @@
-use crate::resource::{FrameBuffer, MediaStream, StreamMode};
+use crate::resource::{FrameBuffer, MediaStream, OutputDevice, StreamMode};
 use crate::server::Config;
 use eframe::egui::mutex::RwLock;
 use eframe::egui::{ColorImage, ImageData, TextureFilter, TextureId, Vec2};
@@ -19,14 +19,25 @@ use thiserror::Error;
 
 static GST_INIT: OnceCell<()> = OnceCell::new();
 
+/// Placeholders that a custom pipeline description ends its video/audio branches in. They are
+/// replaced by the same conversion and output elements that are used for media files.
+const VIDEO_SINK: &str = "appsink name=video_sink";
+const AUDIO_SINK: &str = "appsink name=audio_sink";
+
+#[derive(Debug, Clone)]
+enum Source {
+    File(PathBuf),
+    Pipeline(String),
+}
+
 /// A video handle that uses GStreamer to stream video content.
 /// This `struct` and its associated `impl` is a simplified version of the
 /// `VideoPlayer` struct found at: https://github.com/jazzfool/iced_video_player.
 #[derive(Clone)]
 pub struct Stream {
-    path: PathBuf,
+    src: Source,
     source: gst::Bin,
-    playbin: gst::Bin,
+    playbin: Option<gst::Element>,
     bus: gst::Bus,
     frame_size: [u32; 2],
     frame_rate: f64,
@@ -45,50 +56,7 @@ impl MediaStream for Stream {
         path: &Path,
         _config: &Config,
     ) -> Result<Self> {
-        init()?;
-
-        let (source, playbin) = launch(path, &StreamMode::Query, 1.0)?;
-        let bus = source.bus().unwrap();
-
-        let video_sink = get_video_sink(&playbin, false);
-        let (width, height, frame_rate) = match video_sink.as_ref() {
-            Some(sink) => video_meta_from_sink(sink)?,
-            None => (0, 0, 0.0),
-        };
-
-        let audio_sink = get_audio_sink(&playbin, false);
-        let (audio_chan, audio_rate) = match audio_sink.as_ref() {
-            Some(sink) => audio_meta_from_sink(sink)?,
-            None => (0, 0),
-        };
-        println!("--> width={width} height={height} framerate={frame_rate} audio_chan={audio_chan} audio_sr={audio_rate}");
-
-        let duration = Duration::from_nanos(
-            source
-                .query_duration::<gst::ClockTime>()
-                .ok_or(Error::Duration)
-                .unwrap()
-                .nseconds(),
-        );
-
-        source
-            .set_state(gst::State::Null)
-            .wrap_err_with(|| eyre!("Failed to close video graciously ({path:?})"))?;
-
-        Ok(Stream {
-            path: path.to_owned(),
-            source,
-            playbin,
-            bus,
-            frame_size: [width as u32, height as u32],
-            frame_rate,
-            audio_chan,
-            audio_rate,
-            duration,
-            is_eos: false,
-            paused: true,
-            tex_manager,
-        })
+        Self::open(tex_manager, Source::File(path.to_owned()))
     }
 
     fn cloned(
@@ -96,35 +64,43 @@ impl MediaStream for Stream {
         frame: Arc<Mutex<Option<(TextureId, Vec2)>>>,
         media_mode: StreamMode,
         volume: f32,
+        output: &OutputDevice,
     ) -> Result<Self> {
         let (media_mode, audio_chan) = match (media_mode, self.audio_chan) {
             (StreamMode::SansIntTrigger, 0) => Err(eyre!(
                 "Cannot assume integrated trigger due to missing audio stream: {:?}",
-                self.path
+                self.src
             )),
             (StreamMode::SansIntTrigger, 1) => Ok((StreamMode::Muted, 0)),
             (StreamMode::SansIntTrigger, 2) => Ok((StreamMode::SansIntTrigger, 1)),
             (StreamMode::SansIntTrigger, _) => Err(eyre!(
                 "Cannot use integrated trigger with multichannel (n = {} > 2) audio: {:?}",
                 self.audio_chan,
-                self.path,
+                self.src,
             )),
             (StreamMode::WithExtTrigger(t), c @ 0..=1) => Ok((StreamMode::WithExtTrigger(t), c)),
             (StreamMode::WithExtTrigger(_), c) if c > 1 => Err(eyre!(
                 "Cannot add trigger stream to non-mono (n = {}) audio stream: {:?}",
                 self.audio_chan,
-                self.path
+                self.src
             )),
             (mode, c) => Ok((mode, c)),
         }?;
 
-        let (source, playbin) = launch(&self.path, &media_mode, volume)?;
+        // The output device is only looked up if something is played on it
+        let sink = match (&media_mode, audio_chan) {
+            (StreamMode::Query | StreamMode::Muted, _) | (StreamMode::Normal, 0) => {
+                "fakesink".to_owned()
+            }
+            _ => audio_sink(output)?,
+        };
+        let (source, playbin) = launch(&self.src, &media_mode, volume, &sink)?;
         let bus = source.bus().unwrap();
 
-        let video_sink = get_video_sink(&playbin, true);
+        let video_sink = get_app_sink(&source, playbin.as_ref(), &self.src, "video_sink", true);
         if let Some(sink) = video_sink {
             sink.set_max_buffers(5 * self.frame_rate.ceil() as u32);
-            let path = self.path.clone();
+            let name = format!("{:?}", self.src);
             let [width, height] = self.size();
             let tex_manager = self.tex_manager.clone();
 
@@ -138,7 +114,7 @@ impl MediaStream for Stream {
 
                             *frame.lock().map_err(|_| gst::FlowError::Error)? = Some((
                                 tex_manager.write().alloc(
-                                    format!("{path:?}:@:[current]"),
+                                    format!("{name}:@:[current]"),
                                     ImageData::Color(ColorImage::from_rgba_unmultiplied(
                                         [width as _, height as _],
                                         map.as_slice(),
@@ -156,7 +132,7 @@ impl MediaStream for Stream {
         }
 
         Ok(Stream {
-            path: self.path.clone(),
+            src: self.src.clone(),
             source,
             playbin,
             bus,
@@ -235,23 +211,25 @@ impl MediaStream for Stream {
     }
 
     fn pull_samples(&self) -> Result<(FrameBuffer, f64)> {
-        let (source, playbin) = launch(&self.path, &StreamMode::Query, 1.0)?;
+        let (source, playbin) = launch(&self.src, &StreamMode::Query, 1.0)?;
 
-        let video_sink = get_video_sink(&playbin, false);
+        let video_sink = get_app_sink(&source, playbin.as_ref(), &self.src, "video_sink", false);
         if let Some(sink) = video_sink.as_ref() {
             sink.set_max_lateness(0);
             sink.set_max_buffers(5 * self.frame_rate.ceil() as u32);
         }
 
-        let audio_sink = get_audio_sink(&playbin, false);
+        let audio_sink = get_app_sink(&source, playbin.as_ref(), &self.src, "audio_sink", false);
         if let Some(sink) = audio_sink.as_ref() {
             sink.set_max_buffers(5 * self.audio_rate * 2);
         }
 
-        playbin.set_property("mute", true);
+        if let Some(playbin) = playbin.as_ref() {
+            playbin.set_property("mute", true);
+        }
         source
             .set_state(gst::State::Playing)
-            .wrap_err_with(|| format!("Failed to change video state (\"{:?}\")", self.path))?;
+            .wrap_err_with(|| format!("Failed to change video state (\"{:?}\")", self.src))?;
 
         let video_sink =
             video_sink.ok_or_else(|| eyre!("Tried to pull on non-existent video sink."))?;
@@ -261,14 +239,14 @@ impl MediaStream for Stream {
         while let Ok(sample) = video_sink.pull_sample() {
             let buffer = sample
                 .buffer()
-                .ok_or_else(|| eyre!("Failed to obtain buffer on video sample: {:?}", self.path))?;
+                .ok_or_else(|| eyre!("Failed to obtain buffer on video sample: {:?}", self.src))?;
             let map = buffer.map_readable().wrap_err_with(|| {
-                format!("Failed to obtain map on buffered sample: {:?}", self.path)
+                format!("Failed to obtain map on buffered sample: {:?}", self.src)
             })?;
 
             frames.push((
                 self.tex_manager.write().alloc(
-                    format!("{:?}:@:{}", self.path, frames.len()),
+                    format!("{:?}:@:{}", self.src, frames.len()),
                     ImageData::Color(ColorImage::from_rgba_unmultiplied(
                         [self.frame_size[0] as _, self.frame_size[1] as _],
                         map.as_slice(),
@@ -310,15 +288,92 @@ impl MediaStream for Stream {
 }
 
 impl Stream {
+    /// Create a new stream object from a custom pipeline description, which should contain an
+    /// `appsink name=video_sink` and/or an `appsink name=audio_sink` element at the end of its
+    /// video and audio branches.
+    pub fn from_pipeline(
+        tex_manager: Arc<RwLock<TextureManager>>,
+        description: &str,
+        _config: &Config,
+    ) -> Result<Self> {
+        if !description.contains(VIDEO_SINK) && !description.contains(AUDIO_SINK) {
+            return Err(eyre!(
+                "Stream pipeline needs to end in `{VIDEO_SINK}` and/or `{AUDIO_SINK}`."
+            ));
+        }
+
+        Self::open(tex_manager, Source::Pipeline(description.to_owned()))
+    }
+
+    fn open(tex_manager: Arc<RwLock<TextureManager>>, src: Source) -> Result<Self> {
+        init()?;
+
+        let (source, playbin) = launch(&src, &StreamMode::Query, 1.0, "fakesink")?;
+        let bus = source.bus().unwrap();
+
+        // Live sources (e.g., webcams) do not preroll, so they need to be playing to negotiate caps
+        if let Source::Pipeline(_) = &src {
+            source
+                .set_state(gst::State::Playing)
+                .wrap_err_with(|| format!("Failed to change state for stream ({src:?})."))?;
+        }
+
+        let video_sink = get_app_sink(&source, playbin.as_ref(), &src, "video_sink", false);
+        let (width, height, frame_rate) = match video_sink.as_ref() {
+            Some(sink) => video_meta_from_sink(sink)?,
+            None => (0, 0, 0.0),
+        };
+
+        let audio_sink = get_app_sink(&source, playbin.as_ref(), &src, "audio_sink", false);
+        let (audio_chan, audio_rate) = match audio_sink.as_ref() {
+            Some(sink) => audio_meta_from_sink(sink)?,
+            None => (0, 0),
+        };
+        println!("--> width={width} height={height} framerate={frame_rate} audio_chan={audio_chan} audio_sr={audio_rate}");
+
+        // Live and generated sources might not have a known duration
+        let duration = match source.query_duration::<gst::ClockTime>() {
+            Some(duration) => Duration::from_nanos(duration.nseconds()),
+            None if matches!(src, Source::Pipeline(_)) => Duration::ZERO,
+            None => {
+                return Err(Error::Duration)
+                    .wrap_err_with(|| format!("Failed to query duration of stream ({src:?})."))
+            }
+        };
+
+        source
+            .set_state(gst::State::Null)
+            .wrap_err_with(|| eyre!("Failed to close video graciously ({src:?})"))?;
+
+        Ok(Stream {
+            src,
+            source,
+            playbin,
+            bus,
+            frame_size: [width as u32, height as u32],
+            frame_rate,
+            audio_chan,
+            audio_rate,
+            duration,
+            is_eos: false,
+            paused: true,
+            tex_manager,
+        })
+    }
+
     /// Set the volume multiplier of the audio.
     /// `0.0` = 0% volume, `1.0` = 100% volume.
     pub fn set_volume(&mut self, volume: f64) {
-        self.playbin.set_property("volume", &volume);
+        if let Some(playbin) = self.playbin.as_ref() {
+            playbin.set_property("volume", &volume);
+        }
     }
 
     /// Set if the audio is muted or not, without changing the volume.
     pub fn set_muted(&mut self, muted: bool) {
-        self.playbin.set_property("mute", &muted);
+        if let Some(playbin) = self.playbin.as_ref() {
+            playbin.set_property("mute", &muted);
+        }
     }
 
     /// Get if the stream is paused.
@@ -381,7 +436,60 @@ pub fn init() -> Result<()> {
         .wrap_err("Failed to initialize GStreamer: required because there is a video element in this block.")
 }
 
-fn pipeline(path: &Path, mode: &StreamMode) -> Result<String> {
+/// Audio sink (in `gst-launch` syntax) that plays on the given output device. A named device is
+/// looked up among the audio sinks known to GStreamer (by display name, like the audio backend
+/// does), and the sink is configured with its device property.
+fn audio_sink(output: &OutputDevice) -> Result<String> {
+    let name = match output {
+        OutputDevice::Default => return Ok("autoaudiosink".to_owned()),
+        OutputDevice::Named(name) => name,
+        OutputDevice::Offline(..) => {
+            return Err(eyre!(
+                "Stream audio cannot be rendered to an offline device ({output:?})."
+            ))
+        }
+    };
+
+    init()?;
+    let monitor = gst::DeviceMonitor::new();
+    monitor.add_filter(Some("Audio/Sink"), None);
+    monitor
+        .start()
+        .wrap_err("Failed to start GStreamer device monitor.")?;
+    let device = monitor
+        .devices()
+        .into_iter()
+        .find(|d| d.display_name().contains(name.as_str()));
+    monitor.stop();
+
+    let device =
+        device.ok_or_else(|| eyre!("Failed to find GStreamer audio sink matching `{name}`."))?;
+    let element = device
+        .create_element(None)
+        .wrap_err_with(|| format!("Failed to create audio sink for `{name}`."))?;
+    let factory = element
+        .factory()
+        .ok_or_else(|| eyre!("Failed to find the element factory of audio sink `{name}`."))?;
+    if element.find_property("device").is_none() {
+        return Err(eyre!(
+            "Audio sink of `{name}` ({}) cannot be pointed to a device.",
+            factory.name()
+        ));
+    }
+    let device = element
+        .property_value("device")
+        .serialize()
+        .wrap_err_with(|| format!("Failed to read the device of audio sink `{name}`."))?;
+
+    Ok(format!("{} device={device}", factory.name()))
+}
+
+fn pipeline(src: &Source, mode: &StreamMode, sink: &str) -> Result<String> {
+    let path = match src {
+        Source::File(path) => path,
+        Source::Pipeline(description) => return custom_pipeline(description, mode, sink),
+    };
+
     let mut pipeline = format!(
         "\
         playbin uri=\"file://{}\" name=playbin \
@@ -399,20 +507,25 @@ fn pipeline(path: &Path, mode: &StreamMode) -> Result<String> {
             " \
             audio-sink=\"audioconvert ! appsink name=audio_sink caps=audio/x-raw,format=S16LE,layout=interleaved\""
         ),
-        StreamMode::Normal => {},
+        StreamMode::Normal => write!(
+            pipeline,
+            " \
+            audio-sink=\"audioconvert ! {sink}\""
+        ).unwrap(),
         StreamMode::Muted => pipeline.push_str(
             " \
             audio-sink=\"audioconvert ! fakesink\""
         ),
-        StreamMode::SansIntTrigger => pipeline.push_str(
+        StreamMode::SansIntTrigger => write!(
+            pipeline,
             " \
-            audio-sink=\"audioconvert ! deinterleave name=d ! d.src_0 ! playsink\""
-        ),
+            audio-sink=\"audioconvert ! deinterleave name=d ! d.src_0 ! audioconvert ! {sink}\""
+        ).unwrap(),
         StreamMode::WithExtTrigger(trigger) => write!(
             pipeline,
             " \
-            audio-sink=\"audioconvert ! audiopanorama panorama=-1 ! playsink\" \
-            uridecodebin uri=\"file://{}\" ! audioconvert ! audiopanorama panorama=1 ! playsink",
+            audio-sink=\"audioconvert ! audiopanorama panorama=-1 ! {sink}\" \
+            uridecodebin uri=\"file://{}\" ! audioconvert ! audiopanorama panorama=1 ! {sink}",
             trigger
                 .canonicalize()
                 .wrap_err_with(|| format!("Could not find trigger: {trigger:?}"))?
@@ -424,66 +537,98 @@ fn pipeline(path: &Path, mode: &StreamMode) -> Result<String> {
     Ok(pipeline)
 }
 
-fn launch(path: &Path, mode: &StreamMode, volume: f32) -> Result<(gst::Bin, gst::Bin)> {
-    let source = gst::parse_launch(&pipeline(path, mode)?)
-        .wrap_err_with(|| format!("Failed to parse gstreamer command for video: {path:?}"))?
+/// Replaces the app sinks at the end of a custom pipeline with the elements used for the given mode,
+/// mirroring what `pipeline` does for media files. A `volume` element is added to the audio branch
+/// to control its volume and muting.
+fn custom_pipeline(description: &str, mode: &StreamMode, sink: &str) -> Result<String> {
+    let video = "videoconvert ! videoscale ! appsink name=video_sink caps=video/x-raw,format=RGBA,pixel-aspect-ratio=1/1";
+    let audio = match mode {
+        StreamMode::Query => {
+            "audioconvert ! appsink name=audio_sink caps=audio/x-raw,format=S16LE,layout=interleaved"
+                .to_owned()
+        }
+        StreamMode::Normal => format!("audioconvert ! volume name=volume ! {sink}"),
+        StreamMode::Muted => "audioconvert ! volume name=volume mute=true ! fakesink".to_owned(),
+        // The second channel holds the internal trigger, which is dropped rather than left unlinked
+        StreamMode::SansIntTrigger => format!(
+            "\
+            audioconvert ! deinterleave name=d \
+            d.src_0 ! queue ! audioconvert ! volume name=volume ! {sink} \
+            d.src_1 ! queue ! fakesink"
+        ),
+        StreamMode::WithExtTrigger(trigger) => format!(
+            "\
+            audioconvert ! audiopanorama panorama=-1 ! volume name=volume ! {sink} \
+            uridecodebin uri=\"file://{}\" ! audioconvert ! audiopanorama panorama=1 ! {sink}",
+            trigger
+                .canonicalize()
+                .wrap_err_with(|| format!("Could not find trigger: {trigger:?}"))?
+                .to_str()
+                .unwrap()
+        ),
+    };
+
+    Ok(description
+        .replace(VIDEO_SINK, video)
+        .replace(AUDIO_SINK, &audio))
+}
+
+fn launch(
+    src: &Source,
+    mode: &StreamMode,
+    volume: f32,
+    sink: &str,
+) -> Result<(gst::Bin, Option<gst::Element>)> {
+    let source = gst::parse_launch(&pipeline(src, mode, sink)?)
+        .wrap_err_with(|| format!("Failed to parse gstreamer command for stream: {src:?}"))?
         .downcast::<gst::Bin>()
         .unwrap();
 
-    let playbin = if matches!(mode, StreamMode::WithExtTrigger(_)) {
-        source
-            .by_name("playbin")
-            .unwrap()
-            .downcast::<gst::Bin>()
-            .unwrap()
-    } else {
-        source.clone()
+    let playbin = match src {
+        Source::File(_) if matches!(mode, StreamMode::WithExtTrigger(_)) => {
+            Some(source.by_name("playbin").unwrap())
+        }
+        Source::File(_) => Some(source.clone().upcast::<gst::Element>()),
+        Source::Pipeline(_) => source.by_name("volume"),
     };
 
-    playbin.set_property("volume", volume as f64);
+    if let Some(playbin) = playbin.as_ref() {
+        playbin.set_property("volume", volume as f64);
+    }
 
     source
         .set_state(gst::State::Paused)
-        .wrap_err_with(|| format!("Failed to change state for video ({path:?})."))?;
+        .wrap_err_with(|| format!("Failed to change state for stream ({src:?})."))?;
     source
         .state(gst::ClockTime::from_seconds(5))
         .0
-        .wrap_err_with(|| format!("Failed to read state for video ({path:?})."))?;
+        .wrap_err_with(|| format!("Failed to read state for stream ({src:?})."))?;
 
     Ok((source, playbin))
 }
 
-fn get_video_sink(source: &gst::Bin, sync: bool) -> Option<gst_app::AppSink> {
-    let video_sink: gst::Element = source.property("video-sink");
-    let pad = video_sink.pads().get(0).cloned().unwrap();
-    let pad = pad.dynamic_cast::<gst::GhostPad>().unwrap();
-    let bin = pad.parent_element().unwrap();
-    let bin = bin.downcast::<gst::Bin>().unwrap();
-
-    let app_sink = bin.by_name("video_sink").unwrap();
-    let app_sink = app_sink.downcast::<gst_app::AppSink>().unwrap();
-    app_sink.set_async(true);
-    app_sink.set_sync(sync);
-    app_sink.set_max_lateness(0);
-    app_sink.set_max_buffers(10);
-
-    let timeout = gst::ClockTime::from_seconds(5);
-    if app_sink.try_pull_preroll(Some(timeout)).is_some() {
-        Some(app_sink)
-    } else {
-        None
-    }
-}
-
-fn get_audio_sink(source: &gst::Bin, sync: bool) -> Option<gst_app::AppSink> {
-    let audio_sink: gst::Element = source.property("audio-sink");
-    let pad = audio_sink.pads().get(0).cloned().unwrap();
-    let pad = pad.dynamic_cast::<gst::GhostPad>().unwrap();
-    let bin = pad.parent_element().unwrap();
-    let bin = bin.downcast::<gst::Bin>().unwrap();
+/// Finds the app sink with the given name (`video_sink` or `audio_sink`). For media files, it is
+/// nested in the bin assigned to the corresponding (`video-sink` or `audio-sink`) playbin property.
+fn get_app_sink(
+    source: &gst::Bin,
+    playbin: Option<&gst::Element>,
+    src: &Source,
+    name: &str,
+    sync: bool,
+) -> Option<gst_app::AppSink> {
+    let app_sink = match (src, playbin) {
+        (Source::File(_), Some(playbin)) => {
+            let sink: gst::Element = playbin.property(&name.replace('_', "-"));
+            let pad = sink.pads().get(0).cloned().unwrap();
+            let pad = pad.dynamic_cast::<gst::GhostPad>().unwrap();
+            let bin = pad.parent_element().unwrap();
+            let bin = bin.downcast::<gst::Bin>().unwrap();
+            bin.by_name(name)?
+        }
+        _ => source.by_name(name)?,
+    };
 
-    let app_sink = bin.by_name("audio_sink").unwrap();
-    let app_sink = app_sink.downcast::<gst_app::AppSink>().unwrap();
+    let app_sink = app_sink.downcast::<gst_app::AppSink>().ok()?;
     app_sink.set_async(true);
     app_sink.set_sync(sync);
     app_sink.set_max_lateness(0);
@@ -1,3 +1,4 @@
+use crate::resource::OutputDevice;
 use crate::server::Config;
 use eframe::egui::mutex::RwLock;
 use eframe::egui::{TextureId, Vec2};
@@ -34,6 +35,14 @@ pub fn stream_from_file(
     Stream::new(tex_manager, path, config)
 }
 
+pub fn stream_from_pipeline(
+    tex_manager: Arc<RwLock<TextureManager>>,
+    description: &str,
+    config: &Config,
+) -> Result<Stream> {
+    Stream::from_pipeline(tex_manager, description, config)
+}
+
 pub fn video_from_file(
     tex_manager: Arc<RwLock<TextureManager>>,
     path: &Path,
@@ -52,6 +61,7 @@ where
         frame: Arc<Mutex<Option<(TextureId, Vec2)>>>,
         media_mode: StreamMode,
         volume: f32,
+        output: &OutputDevice,
     ) -> Result<Self>;
 
     fn eos(&self) -> bool;
@@ -142,6 +152,24 @@ impl Stream {
         }
     }
 
+    /// Create a new stream object from a custom pipeline description (GStreamer backend only).
+    #[allow(unused_variables)]
+    pub fn from_pipeline(
+        tex_manager: Arc<RwLock<TextureManager>>,
+        description: &str,
+        config: &Config,
+    ) -> Result<Self> {
+        match config.stream_backend() {
+            #[cfg(feature = "gstreamer")]
+            StreamBackend::Gst => {
+                gst::Stream::from_pipeline(tex_manager, description, config).map(Stream::Gst)
+            }
+            backend => Err(eyre!(
+                "Custom stream pipelines require the gstreamer backend (backend={backend:?})."
+            )),
+        }
+    }
+
     /// Check if stream has reached its end.
     #[inline(always)]
     pub fn eos(&self) -> bool {
@@ -312,13 +340,16 @@ impl Stream {
         frame: Arc<Mutex<Option<(TextureId, Vec2)>>>,
         mode: StreamMode,
         volume: f32,
+        output: &OutputDevice,
     ) -> Result<Self> {
         match self {
             Stream::None => Err(eyre!("Cloning stream with backend=None is pointless.")),
             #[cfg(feature = "gstreamer")]
-            Stream::Gst(stream) => stream.cloned(frame, mode, volume).map(Stream::Gst),
+            Stream::Gst(stream) => stream.cloned(frame, mode, volume, output).map(Stream::Gst),
             #[cfg(feature = "ffmpeg")]
-            Stream::Ffmpeg(stream) => stream.cloned(frame, mode, volume).map(Stream::Ffmpeg),
+            Stream::Ffmpeg(stream) => stream
+                .cloned(frame, mode, volume, output)
+                .map(Stream::Ffmpeg),
         }
     }
 
@@ -0,0 +1,308 @@
+use crate::resource::list_files;
+use crate::server::sha256_file;
+use chrono::Local;
+use eyre::{eyre, Context, Result};
+use once_cell::sync::Lazy;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+
+/// File (inside the output directory of a subject, next to the session directories) that holds
+/// the audit trail of the subject.
+pub const AUDIT_LOG: &str = "audit.log";
+
+/// Hash that the first entry of an audit trail is chained to.
+const GENESIS: &str = "0000000000000000000000000000000000000000000000000000000000000000";
+
+/// Serializes appends from the server and the upload thread.
+static LOCK: Lazy<Mutex<()>> = Lazy::new(|| Mutex::new(()));
+
+/// A single event of the audit trail. Each line of the audit log holds the SHA-256 of the line
+/// before it (`prev`) followed by a tab and the entry as JSON. The hash of a line is taken over
+/// `prev` and the JSON exactly as written, so any later edit, insertion, or removal of a line
+/// breaks the chain. `files` seals the SHA-256 of run files (relative to the subject directory)
+/// at the time of the event.
+#[derive(Debug, Clone, Deserialize, Serialize)]
+pub struct AuditEntry {
+    pub seq: u64,
+    pub time: String,
+    pub prev: String,
+    pub event: String,
+    #[serde(default)]
+    pub details: BTreeMap<String, String>,
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub files: BTreeMap<String, String>,
+}
+
+/// Appends an event to the audit trail in the subject directory `dir`, sealing the checksums of
+/// the given files. The trail is then copied to `mirror`, the mirror of the subject directory (see
+/// `mirror_output` in the task config), if any.
+pub fn record(
+    dir: &Path,
+    mirror: Option<&Path>,
+    event: &str,
+    details: Vec<(&str, String)>,
+    files: &[PathBuf],
+) -> Result<()> {
+    let _guard = LOCK.lock().unwrap();
+
+    let path = dir.join(AUDIT_LOG);
+    let (seq, prev) = match read_chain(&path)?.last() {
+        Some((hash, entry)) => (entry.seq + 1, hash.clone()),
+        None => (0, GENESIS.to_owned()),
+    };
+
+    let mut sealed = BTreeMap::new();
+    for file in files {
+        sealed.insert(relative_path(dir, file), sha256_file(file)?);
+    }
+
+    let entry = AuditEntry {
+        seq,
+        time: Local::now().to_string(),
+        prev: prev.clone(),
+        event: event.to_owned(),
+        details: details
+            .into_iter()
+            .map(|(k, v)| (k.to_owned(), v))
+            .collect(),
+        files: sealed,
+    };
+    let body = serde_json::to_string(&entry).wrap_err("Failed to serialize audit entry.")?;
+
+    fs::create_dir_all(dir)
+        .wrap_err_with(|| format!("Unable to create subject output directory: {dir:?}"))?;
+    let mut file = fs::OpenOptions::new()
+        .create(true)
+        .append(true)
+        .open(&path)
+        .wrap_err_with(|| format!("Failed to open audit log ({path:?})."))?;
+    writeln!(file, "{}\t{body}", chain_hash(&prev, &body))
+        .and_then(|_| file.sync_all())
+        .wrap_err_with(|| format!("Failed to append to audit log ({path:?})."))?;
+
+    // The entry is in the primary trail, so an unavailable mirror is only reported
+    if let Some(mirror) = mirror {
+        let dest = mirror.join(AUDIT_LOG);
+        if let Err(e) = fs::create_dir_all(mirror).and_then(|_| fs::copy(&path, &dest)) {
+            eprintln!("Failed to mirror audit log to {dest:?}: {e}");
+        }
+    }
+    Ok(())
+}
+
+/// Reads the entries of the audit trail in the subject directory `dir`, without verifying them.
+pub fn read_audit(dir: &Path) -> Result<Vec<AuditEntry>> {
+    Ok(read_chain(&dir.join(AUDIT_LOG))?
+        .into_iter()
+        .map(|(_, entry)| entry)
+        .collect())
+}
+
+/// Verifies the audit trail in the subject directory `dir`: the hash chain of its entries, the
+/// checksums of all sealed files against their current content, and that no files were added to
+/// the runs sealed at `block_end`. Returns the hash of the last entry, which can be noted down to
+/// detect truncation later, along with the problems found.
+pub fn verify_audit(dir: &Path) -> Result<(String, Vec<String>)> {
+    let path = dir.join(AUDIT_LOG);
+    let content = fs::read_to_string(&path)
+        .wrap_err_with(|| format!("Failed to read audit log ({path:?})."))?;
+
+    let mut problems = vec![];
+    let mut prev = GENESIS.to_owned();
+    let mut sealed = BTreeMap::new();
+    let mut runs = BTreeSet::new();
+    for (i, line) in content.lines().enumerate() {
+        let (hash, body) = match line.split_once('\t') {
+            Some(parts) => parts,
+            None => {
+                problems.push(format!("Line {}: malformed entry", i + 1));
+                continue;
+            }
+        };
+
+        if hash != chain_hash(&prev, body) {
+            problems.push(format!("Line {}: hash does not match its content", i + 1));
+        }
+        match serde_json::from_str::<AuditEntry>(body) {
+            Ok(entry) => {
+                if entry.prev != prev || entry.seq != i as u64 {
+                    problems.push(format!(
+                        "Line {}: chain is broken (entry {})",
+                        i + 1,
+                        entry.seq
+                    ));
+                }
+                if entry.event == "block_end" {
+                    if let Some(run) = entry.details.get("run") {
+                        runs.insert(run.clone());
+                    }
+                }
+                sealed.extend(entry.files);
+            }
+            Err(e) => problems.push(format!("Line {}: {e}", i + 1)),
+        }
+        prev = hash.to_owned();
+    }
+
+    for (file, checksum) in sealed.iter() {
+        match sha256_file(&dir.join(file)) {
+            Ok(actual) if &actual == checksum => {}
+            Ok(_) => problems.push(format!("{file}: modified after it was sealed")),
+            Err(_) => problems.push(format!("{file}: missing")),
+        }
+    }
+
+    for run in runs {
+        for file in list_files(&dir.join(&run), Path::new(&run)) {
+            let file = file.to_string_lossy().replace('\\', "/");
+            if !sealed.contains_key(&file) {
+                problems.push(format!("{file}: added after the run was sealed"));
+            }
+        }
+    }
+
+    Ok((prev, problems))
+}
+
+fn read_chain(path: &Path) -> Result<Vec<(String, AuditEntry)>> {
+    if !path.exists() {
+        return Ok(vec![]);
+    }
+
+    let content = fs::read_to_string(path)
+        .wrap_err_with(|| format!("Failed to read audit log ({path:?})."))?;
+    content
+        .lines()
+        .map(|line| {
+            let (hash, body) = line
+                .split_once('\t')
+                .ok_or_else(|| eyre!("Malformed entry in audit log ({path:?})."))?;
+            let entry = serde_json::from_str(body)
+                .wrap_err_with(|| format!("Failed to parse audit log ({path:?})."))?;
+            Ok((hash.to_owned(), entry))
+        })
+        .collect()
+}
+
+fn chain_hash(prev: &str, body: &str) -> String {
+    use sha2::{Digest, Sha256};
+    let mut hasher = Sha256::default();
+    hasher.update(prev.as_bytes());
+    hasher.update(body.as_bytes());
+    hex::encode(hasher.finalize())
+}
+
+/// Path of `path` relative to the subject directory, with `/` separators on every platform.
+pub fn relative_path(dir: &Path, path: &Path) -> String {
+    path.strip_prefix(dir)
+        .unwrap_or(path)
+        .components()
+        .map(|c| c.as_os_str().to_string_lossy().into_owned())
+        .collect::<Vec<_>>()
+        .join("/")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn subject_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("cog_audit_{name}_{}", std::process::id()));
+        let _ = fs::remove_dir_all(&dir);
+        fs::create_dir_all(&dir).unwrap();
+        dir
+    }
+
+    fn lines(dir: &Path) -> Vec<String> {
+        fs::read_to_string(dir.join(AUDIT_LOG))
+            .unwrap()
+            .lines()
+            .map(|l| l.to_owned())
+            .collect()
+    }
+
+    #[test]
+    fn entries_are_chained() {
+        let dir = subject_dir("chain");
+        for event in ["session_start", "block_start", "session_end"] {
+            record(&dir, None, event, vec![("block", "a".to_owned())], &[]).unwrap();
+        }
+
+        let entries = read_audit(&dir).unwrap();
+        let hashes: Vec<_> = lines(&dir)
+            .iter()
+            .map(|l| l.split_once('\t').unwrap().0.to_owned())
+            .collect();
+        assert_eq!(entries.len(), 3);
+        assert_eq!(entries[0].prev, GENESIS);
+        for i in 1..3 {
+            assert_eq!(entries[i].seq, i as u64);
+            assert_eq!(entries[i].prev, hashes[i - 1]);
+        }
+
+        let (last, problems) = verify_audit(&dir).unwrap();
+        assert!(problems.is_empty(), "{problems:?}");
+        assert_eq!(last, hashes[2]);
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn edited_or_removed_lines_break_the_chain() {
+        let dir = subject_dir("tamper");
+        for event in ["session_start", "block_start", "session_end"] {
+            record(&dir, None, event, vec![], &[]).unwrap();
+        }
+        let original = lines(&dir);
+
+        let edited = original.join("\n").replace("block_start", "block_other");
+        fs::write(dir.join(AUDIT_LOG), edited).unwrap();
+        assert!(!verify_audit(&dir).unwrap().1.is_empty());
+
+        let removed = [original[0].clone(), original[2].clone()].join("\n");
+        fs::write(dir.join(AUDIT_LOG), removed).unwrap();
+        assert!(!verify_audit(&dir).unwrap().1.is_empty());
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn sealed_runs_cannot_change() {
+        let dir = subject_dir("seal");
+        let run = dir.join("2026-10-17").join("block").join("12-00-00");
+        fs::create_dir_all(&run).unwrap();
+        fs::write(run.join("main.log"), "[]").unwrap();
+        record(
+            &dir,
+            None,
+            "block_end",
+            vec![("run", "2026-10-17/block/12-00-00".to_owned())],
+            &[run.join("main.log")],
+        )
+        .unwrap();
+        assert!(verify_audit(&dir).unwrap().1.is_empty());
+
+        fs::write(run.join("extra.log"), "[]").unwrap();
+        let problems = verify_audit(&dir).unwrap().1;
+        assert_eq!(problems.len(), 1);
+        assert!(problems[0].contains("added after"));
+
+        fs::remove_file(run.join("extra.log")).unwrap();
+        fs::write(run.join("main.log"), "[1]").unwrap();
+        let problems = verify_audit(&dir).unwrap().1;
+        assert_eq!(problems.len(), 1);
+        assert!(problems[0].contains("modified"));
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn relative_paths_use_forward_slashes() {
+        let dir = Path::new("/output/task/subject");
+        assert_eq!(
+            relative_path(dir, &dir.join("2026-10-17").join("block")),
+            "2026-10-17/block"
+        );
+    }
+}
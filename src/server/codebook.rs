@@ -0,0 +1,311 @@
+use crate::action::{Action, ActionEnumAsRef};
+use crate::resource::LogEntry;
+use crate::server::{Task, NOTES_GROUP};
+use itertools::Itertools;
+use serde::Serialize;
+
+/// Entries written to the `main` group of every block, regardless of its action tree.
+const MAIN_ENTRIES: [(&str, &str, &str, &str); 12] = [
+    (
+        "info",
+        "info",
+        "",
+        "Subject, output directory, and version/hash of the server, task, and block",
+    ),
+    (
+        "config",
+        "config",
+        "",
+        "Configuration in effect for the block",
+    ),
+    ("tree", "action", "", "Action tree of the block"),
+    (
+        "params",
+        "map",
+        "",
+        "Values of the block parameters chosen by the experimenter",
+    ),
+    (
+        "generator",
+        "map",
+        "",
+        "Source, interpreter, arguments, and seed of a generator step run while loading the block",
+    ),
+    (
+        "generated",
+        "[text, text]",
+        "",
+        "Path (relative to `generated/`) and SHA-256 hash of a generated file",
+    ),
+    (
+        "start",
+        "text",
+        "",
+        "Marks the start of the action tree (`ok`)",
+    ),
+    ("pause", "text", "", "Reason the block was paused"),
+    ("resume", "text", "", "Marks the end of a pause (`ok`)"),
+    ("interrupt", "text", "", "Reason the block was interrupted"),
+    ("crash", "text", "", "Error that caused the block to crash"),
+    (
+        "finish",
+        "text",
+        "",
+        "Marks the end of the block, with its outcome (`ok`, `interrupted`, or `crashed`)",
+    ),
+];
+
+/// Entries written to the `trace` group of blocks with `trace` enabled, used to reconstruct their
+/// timeline.
+const TRACE_ENTRIES: [(&str, &str, &str, &str); 3] = [
+    ("start", "text", "", "Tree path of an action that started"),
+    ("stop", "text", "", "Tree path of an action that stopped"),
+    (
+        "signal",
+        "[int, any]",
+        "",
+        "Signal id and its new value, timestamped at emission",
+    ),
+];
+
+/// Entries written to the `notes` group by experimenter monitors, if the task enables them.
+const NOTES_ENTRIES: [(&str, &str, &str, &str); 1] = [(
+    "note",
+    "text",
+    "",
+    "Note taken by the experimenter during the run",
+)];
+
+#[derive(Debug, Serialize)]
+pub struct CodebookRow {
+    block: String,
+    path: String,
+    action: String,
+    #[serde(flatten)]
+    entry: LogEntry,
+}
+
+/// Describes every log group that can be written by the blocks of a task: the name, type, unit,
+/// and meaning of each entry, along with the action (and its path in the tree) that produces it.
+#[derive(Debug, Serialize)]
+pub struct Codebook {
+    task: String,
+    version: String,
+    blocks: Vec<(String, String)>,
+    columnar: Vec<String>,
+    rows: Vec<CodebookRow>,
+}
+
+impl Codebook {
+    pub fn new(task: &Task) -> Self {
+        let mut blocks = vec![];
+        let mut rows = vec![];
+        let notes: &[_] = match task.config().monitor() {
+            Some(_) => &NOTES_ENTRIES,
+            None => &[],
+        };
+        for block in task.blocks() {
+            let config = block.config(task.config());
+            blocks.push((
+                block.label().to_owned(),
+                format!("{:?}", config.log_format()),
+            ));
+            let trace: &[_] = if config.trace() { &TRACE_ENTRIES } else { &[] };
+
+            rows.extend(
+                MAIN_ENTRIES
+                    .iter()
+                    .map(|entry| ("main", entry))
+                    .chain(trace.iter().map(|entry| ("trace", entry)))
+                    .chain(notes.iter().map(|entry| (NOTES_GROUP, entry)))
+                    .map(|(group, (name, dtype, unit, meaning))| CodebookRow {
+                        block: block.label().to_owned(),
+                        path: "".to_owned(),
+                        action: "".to_owned(),
+                        entry: LogEntry::new(group, name, dtype, unit, meaning),
+                    }),
+            );
+
+            let tree = block.action_tree();
+            let path = ActionEnumAsRef::from(tree).name().to_owned();
+            collect(block.label(), tree, path, &mut rows);
+        }
+
+        Self {
+            task: task.name().to_owned(),
+            version: task.version().to_owned(),
+            blocks,
+            columnar: task.config().columnar().clone(),
+            rows,
+        }
+    }
+
+    pub fn to_markdown(&self) -> String {
+        let mut md = format!("# Codebook: {} ({})\n\n", self.task, self.version);
+        md.push_str(
+            "Each block run writes its log groups to `<group>.log` in \
+            `output/<task>/<subject>/<date>/<block>/<time>/`. Every entry is stored as a \
+            `(time, name, value)` triplet. Paths locate the producing action in the tree: \
+            `seq[0]/par[1]/audio` is the second child of the `par` that is the first child \
+            of the root `seq`.\n",
+        );
+        if !self.columnar.is_empty() {
+            md.push_str(&format!(
+                "\nThe following groups are instead stored in Arrow IPC format as \
+                `<group>.arrow`, with one row per logging event, a `time` column (microseconds \
+                since the UNIX epoch), and one typed column per entry: {}\n",
+                self.columnar.iter().map(|g| format!("`{g}`")).join(", ")
+            ));
+        }
+
+        for (block, format) in self.blocks.iter() {
+            md.push_str(&format!("\n## Block: {block}\n\nLog format: `{format}`\n"));
+
+            for (group, rows) in self.groups(block) {
+                md.push_str(&format!(
+                    "\n### Group: `{group}`\n\n\
+                    | Entry | Type | Unit | Meaning | Action | Path |\n\
+                    |-------|------|------|---------|--------|------|\n",
+                ));
+
+                for row in rows {
+                    md.push_str(&format!(
+                        "| `{}` | {} | {} | {} | {} | {} |\n",
+                        row.entry.name,
+                        row.entry.dtype,
+                        row.entry.unit,
+                        row.entry.meaning.replace('|', "\\|"),
+                        row.action,
+                        if row.path.is_empty() {
+                            "".to_owned()
+                        } else {
+                            format!("`{}`", row.path)
+                        }
+                    ));
+                }
+            }
+        }
+
+        md
+    }
+
+    /// Rows of a block grouped by log group, in order of first appearance. Actions in different
+    /// parts of the tree can log to the same group.
+    fn groups(&self, block: &str) -> Vec<(&str, Vec<&CodebookRow>)> {
+        let mut groups: Vec<(&str, Vec<&CodebookRow>)> = vec![];
+        for row in self.rows.iter().filter(|r| r.block == block) {
+            match groups.iter_mut().find(|(g, _)| *g == row.entry.group) {
+                Some((_, rows)) => rows.push(row),
+                None => groups.push((&row.entry.group, vec![row])),
+            }
+        }
+        groups
+    }
+
+    pub fn to_csv(&self) -> String {
+        let mut csv = "block,group,entry,type,unit,meaning,action,path\n".to_owned();
+        for row in self.rows.iter() {
+            let fields = [
+                &row.block,
+                &row.entry.group,
+                &row.entry.name,
+                &row.entry.dtype,
+                &row.entry.unit,
+                &row.entry.meaning,
+                &row.action,
+                &row.path,
+            ];
+            csv.push_str(&fields.map(|f| csv_field(f)).join(","));
+            csv.push('\n');
+        }
+        csv
+    }
+}
+
+fn collect(block: &str, action: &dyn Action, path: String, rows: &mut Vec<CodebookRow>) {
+    let name = ActionEnumAsRef::from(action).name();
+
+    let mut entries = action.log_entries();
+    entries.sort_by(|a, b| a.group.cmp(&b.group));
+    rows.extend(entries.into_iter().map(|entry| CodebookRow {
+        block: block.to_owned(),
+        path: path.clone(),
+        action: name.to_owned(),
+        entry,
+    }));
+
+    for (i, child) in action.children().into_iter().enumerate() {
+        let child_name = ActionEnumAsRef::from(child).name();
+        collect(block, child, format!("{path}[{i}]/{child_name}"), rows);
+    }
+}
+
+fn csv_field(field: &str) -> String {
+    if field.contains([',', '"', '\n']) {
+        format!("\"{}\"", field.replace('"', "\"\""))
+    } else {
+        field.to_owned()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn row(block: &str, group: &str, name: &str, action: &str) -> CodebookRow {
+        CodebookRow {
+            block: block.to_owned(),
+            path: "".to_owned(),
+            action: action.to_owned(),
+            entry: LogEntry::new(group, name, "text", "", "meaning"),
+        }
+    }
+
+    fn codebook(rows: Vec<CodebookRow>) -> Codebook {
+        Codebook {
+            task: "task".to_owned(),
+            version: "1.0".to_owned(),
+            blocks: vec![("a".to_owned(), "Ron".to_owned())],
+            columnar: vec![],
+            rows,
+        }
+    }
+
+    #[test]
+    fn group_header_is_written_once_per_group() {
+        let md = codebook(vec![
+            row("a", "main", "info", ""),
+            row("a", "keys", "key", "key_logger"),
+            row("a", "main", "finish", ""),
+            row("a", "keys", "key", "reaction"),
+        ])
+        .to_markdown();
+
+        assert_eq!(md.matches("### Group: `main`").count(), 1);
+        assert_eq!(md.matches("### Group: `keys`").count(), 1);
+        assert!(md.find("`info`").unwrap() < md.find("`finish`").unwrap());
+        assert!(md.find("`finish`").unwrap() < md.find("### Group: `keys`").unwrap());
+    }
+
+    #[test]
+    fn groups_are_kept_per_block() {
+        let book = codebook(vec![
+            row("a", "main", "info", ""),
+            row("b", "main", "info", ""),
+            row("b", "keys", "key", "key_logger"),
+        ]);
+
+        let groups = book.groups("a");
+        assert_eq!(groups.len(), 1);
+        assert_eq!(groups[0].0, "main");
+        assert_eq!(groups[0].1.len(), 1);
+        assert_eq!(book.groups("b").len(), 2);
+    }
+
+    #[test]
+    fn csv_fields_are_quoted_when_needed() {
+        assert_eq!(csv_field("plain"), "plain");
+        assert_eq!(csv_field("a, b"), "\"a, b\"");
+        assert_eq!(csv_field("say \"hi\""), "\"say \"\"hi\"\"\"");
+    }
+}
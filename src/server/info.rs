@@ -1,6 +1,7 @@
 use crate::assets::VERSION;
 use crate::server::{Block, Server, Task};
 use crate::util::Hash;
+use eyre::{Context, Result};
 use serde::{Deserialize, Serialize};
 use std::path::PathBuf;
 
@@ -18,12 +19,16 @@ pub struct TaskInfo {
     name: String,
     version: String,
     hash: String,
+    #[serde(default)]
+    canonical_hash: String,
 }
 
 #[derive(Debug, Default, Deserialize, Serialize)]
 pub struct BlockInfo {
     name: String,
     hash: String,
+    #[serde(default)]
+    canonical_hash: String,
 }
 
 #[derive(Debug, Default, Deserialize, Serialize)]
@@ -33,8 +38,8 @@ pub struct ServerInfo {
 }
 
 impl Info {
-    pub fn new(server: &Server, task: &Task, block: &Block) -> Self {
-        Self {
+    pub fn new(server: &Server, task: &Task, block: &Block) -> Result<Self> {
+        Ok(Self {
             subject: server.subject().to_owned(),
             output: server.env().output().join(server.subject()),
             server: ServerInfo {
@@ -45,12 +50,18 @@ impl Info {
                 name: task.name().to_owned(),
                 version: task.version().to_owned(),
                 hash: task.hash(),
+                canonical_hash: task
+                    .canonical_hash()
+                    .wrap_err("Failed to compute canonical hash of task.")?,
             },
             block: BlockInfo {
                 name: block.label().to_owned(),
                 hash: block.hash(),
+                canonical_hash: block
+                    .canonical_hash()
+                    .wrap_err("Failed to compute canonical hash of block.")?,
             },
-        }
+        })
     }
 
     #[inline(always)]
@@ -1,26 +1,36 @@
+pub mod audit;
+pub mod codebook;
 pub mod env;
 pub mod info;
+pub mod monitor;
 pub mod page;
 pub mod scheduler;
 pub mod task;
+pub mod upload;
 
+pub use audit::*;
+pub use codebook::Codebook;
 pub use env::Env;
 pub use info::*;
+pub use monitor::*;
 pub use page::*;
 pub use scheduler::*;
 pub use task::*;
+pub use upload::*;
 
 use crate::comm::{QReader, QWriter};
 use crate::gui;
-use crate::resource::LoggerSignal;
-use crate::util::SystemInfo;
+use crate::resource::{list_files, mirror_file, mirror_path, LoggerSignal, ResourceManager};
+use crate::util::{Hash, SystemInfo};
 use chrono::{DateTime, Local, NaiveDateTime};
 use eframe::egui::CentralPanel;
-use eframe::glow::HasContext;
+use eframe::glow::{self, HasContext};
 use eframe::{egui, App};
-use eyre::{Context, Error, Result};
+use eyre::{eyre, Context, Error, Result};
 use serde_cbor::Value;
-use std::path::PathBuf;
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
 use std::time::Duration;
 
 #[derive(Debug)]
@@ -49,6 +59,19 @@ pub struct Server {
     sys_info: SystemInfo,
     sync_reader: QReader<ServerSignal>,
     cleaning_up: u32,
+    check: Option<EquipmentCheck>,
+    history: Option<RunHistory>,
+    last_run: Option<PathBuf>,
+    display: DisplayMeter,
+    screen: ((u32, u32), Option<f64>),
+    unmet: Option<Vec<(String, Vec<String>)>>,
+    uploader: Option<Uploader>,
+    monitor: Option<Monitor>,
+    gl: Option<Arc<glow::Context>>,
+    resources: ResourceManager,
+    confirm_reset: bool,
+    params: BTreeMap<usize, Vec<Value>>,
+    param_dialog: Option<(usize, Vec<Value>)>,
 }
 
 impl Server {
@@ -62,6 +85,28 @@ impl Server {
             .map(|label| (label, Progress::None))
             .collect();
 
+        let resources = ResourceManager::new(task.config())
+            .wrap_err("Failed to initialize resource manager.")?;
+
+        let uploader = match task.config().upload() {
+            Some(target) => Some(
+                Uploader::new(
+                    env.output(),
+                    mirror_path(task.config(), env.output(), env.output()),
+                    target.clone(),
+                )
+                .wrap_err("Failed to initialize run uploader.")?,
+            ),
+            None => None,
+        };
+
+        let monitor = match task.config().monitor() {
+            Some(config) => {
+                Some(Monitor::start(config).wrap_err("Failed to start experimenter monitor.")?)
+            }
+            None => None,
+        };
+
         println!("Saving output to: {:?}", env.output());
 
         Ok(Self {
@@ -80,6 +125,19 @@ impl Server {
             sys_info: SystemInfo::new(),
             sync_reader: QReader::new(),
             cleaning_up: 0,
+            check: None,
+            history: None,
+            last_run: None,
+            display: DisplayMeter::new(),
+            screen: ((0, 0), None),
+            unmet: None,
+            uploader,
+            monitor,
+            gl: None,
+            resources,
+            confirm_reset: false,
+            params: BTreeMap::new(),
+            param_dialog: None,
         })
     }
 
@@ -97,7 +155,7 @@ impl Server {
             max_window_size: None,
             resizable: false,
             transparent: false,
-            vsync: false,
+            vsync: self.config().vsync(),
             multisampling: 0,
             depth_buffer: 0,
             stencil_buffer: 0,
@@ -121,6 +179,7 @@ impl Server {
                         .renderer
                         .push_str(&format!(" ({:?})", gl.version()))
                 }
+                self.gl = cc.gl.clone();
                 Box::new(self)
             }),
         );
@@ -146,6 +205,25 @@ impl Server {
         self.active_block.map(|i| self.task.block(i))
     }
 
+    /// Parameters of the active block along with the values chosen by the experimenter (or their
+    /// defaults), in the order they are declared.
+    pub fn block_params(&self) -> Vec<(&BlockParam, Value)> {
+        let (i, block) = match self.active_block {
+            Some(i) => (i, self.task.block(i)),
+            None => return vec![],
+        };
+
+        block
+            .params()
+            .iter()
+            .enumerate()
+            .map(|(j, p)| {
+                let value = self.params.get(&i).and_then(|v| v.get(j).cloned());
+                (p, value.unwrap_or_else(|| p.default_value()))
+            })
+            .collect()
+    }
+
     #[inline(always)]
     pub fn config(&self) -> &Config {
         self.task.config()
@@ -169,6 +247,16 @@ impl Server {
         &self.task
     }
 
+    #[inline(always)]
+    pub fn resources(&self) -> &ResourceManager {
+        &self.resources
+    }
+
+    #[inline(always)]
+    pub fn monitor(&self) -> Option<&Monitor> {
+        self.monitor.as_ref()
+    }
+
     fn process(&mut self, _ctx: &egui::Context, signal: ServerSignal) {
         match (self.page, signal) {
             (Page::Loading, ServerSignal::LoadComplete) => {
@@ -180,6 +268,9 @@ impl Server {
                 }
             }
             (Page::Loading, ServerSignal::BlockCrashed(e)) => {
+                if let Some(scheduler) = self.scheduler.as_mut() {
+                    scheduler.crash(&e);
+                }
                 self.status = Progress::Failure(Local::now(), e);
                 self.drop_scheduler();
             }
@@ -193,10 +284,7 @@ impl Server {
             }
             (Page::Activity, ServerSignal::BlockCrashed(e)) => {
                 if let Some(scheduler) = self.scheduler.as_mut() {
-                    scheduler.async_writer().push(LoggerSignal::Write(
-                        "crash".to_owned(),
-                        Value::Text(format!("{e:?}")),
-                    ));
+                    scheduler.crash(&e);
                 }
                 self.status = Progress::Failure(Local::now(), e);
                 self.drop_scheduler();
@@ -206,8 +294,24 @@ impl Server {
                 self.cleaning_up -= 1;
                 if self.cleaning_up == 0 {
                     if let (Progress::Success(_), Err(e)) = (&self.status, success) {
+                        if let Some(dir) = self.last_run.as_ref() {
+                            let path = dir.join(CLEANUP_LOG);
+                            if std::fs::write(&path, format!("{e:?}")).is_ok() {
+                                if let Err(e) =
+                                    mirror_file(self.config(), self.env().output(), &path)
+                                {
+                                    eprintln!("{e:?}");
+                                }
+                            }
+                        }
                         self.status = Progress::CleanupError(Local::now(), e);
                     }
+                    self.audit_block_end();
+                    if let (Some(uploader), Some(dir)) = (&self.uploader, &self.last_run) {
+                        if let Err(e) = uploader.enqueue(dir) {
+                            eprintln!("Failed to queue run for upload: {e:#}");
+                        }
+                    }
                     self.page = Page::Selection;
                 }
             }
@@ -228,12 +332,247 @@ impl Server {
                 .all(|c| c.is_alphabetic() || c.is_alphanumeric() | "-_".contains(c))
     }
 
+    /// Whether any block is yet to be completed by the current subject.
+    fn has_unfinished_blocks(&self) -> bool {
+        self.blocks
+            .iter()
+            .any(|(_, p)| !matches!(p, Progress::Success(_) | Progress::LastRun(_)))
+    }
+
+    /// Returns to the startup page for the next subject, keeping the loaded task and resources.
+    fn new_participant(&mut self) {
+        for (_, progress) in self.blocks.iter_mut() {
+            *progress = Progress::None;
+        }
+        self.subject.clear();
+        self.active_block = None;
+        self.status = Progress::None;
+        self.check = None;
+        self.history = None;
+        self.last_run = None;
+        self.unmet = None;
+        self.confirm_reset = false;
+        self.params.clear();
+        self.param_dialog = None;
+        self.page = Page::Startup;
+    }
+
+    /// Unmet runtime requirements of the task and of each of its blocks, as (scope, message) pairs.
+    /// System checks (audio devices, peripherals, python modules) are run once and cached, while
+    /// display checks use the latest measurement.
+    fn unmet_requirements(&mut self) -> Vec<(String, String)> {
+        if self.unmet.is_none() {
+            let mut unmet = vec![(
+                "Task".to_owned(),
+                self.task.requires().check_system(self.config()),
+            )];
+            for block in self.task.blocks() {
+                unmet.push((
+                    format!("Block '{}'", block.label()),
+                    block.requires().check_system(&block.config(self.config())),
+                ));
+            }
+            self.unmet = Some(unmet);
+        }
+
+        let (resolution, rate) = self.screen;
+        let mut display = vec![self
+            .task
+            .requires()
+            .check_display(self.config(), resolution, rate)];
+        for block in self.task.blocks() {
+            display.push(block.requires().check_display(
+                &block.config(self.config()),
+                resolution,
+                rate,
+            ));
+        }
+
+        self.unmet
+            .as_ref()
+            .unwrap()
+            .iter()
+            .zip(display)
+            .flat_map(|((scope, system), display)| {
+                system
+                    .iter()
+                    .cloned()
+                    .chain(display)
+                    .map(|msg| (scope.clone(), msg))
+                    .collect::<Vec<_>>()
+            })
+            .collect()
+    }
+
+    /// Checks the runtime requirements of the task and block `i` right before starting the block.
+    fn verify_requirements(&self, i: usize) -> Result<()> {
+        let block = self.task.block(i);
+        let config = block.config(self.config());
+        let requires = self.task.requires().and(block.requires());
+
+        let (resolution, rate) = self.screen;
+        let mut unmet = requires.check_system(&config);
+        unmet.extend(requires.check_display(&config, resolution, rate));
+
+        if unmet.is_empty() {
+            Ok(())
+        } else {
+            Err(eyre!(
+                "Runtime requirements of this block are not met:\n- {}",
+                unmet.join("\n- ")
+            ))
+        }
+    }
+
+    /// Whether the refresh rate needs to be measured, which requires continuous repainting.
+    fn measures_refresh_rate(&self) -> bool {
+        self.task.requires().refresh_rate().is_some()
+            || self
+                .task
+                .blocks()
+                .iter()
+                .any(|b| b.requires().refresh_rate().is_some())
+    }
+
     #[inline(always)]
     pub fn hash(&self) -> String {
         self.bin_hash.clone()
     }
 
+    /// Appends an event to the audit trail of the current subject. Failures are reported, but do
+    /// not interrupt the session.
+    pub(crate) fn audit(&self, event: &str, details: Vec<(&str, String)>, files: &[PathBuf]) {
+        let dir = self.env.output().join(&self.subject);
+        let mirror = mirror_path(self.config(), self.env.output(), &dir);
+        if let Err(e) = record(&dir, mirror.as_deref(), event, details, files) {
+            eprintln!("Failed to write to audit log: {e:#}");
+        }
+    }
+
+    /// Audits the start of block `i` in `run_dir`, preceded by a `config_changed` event if the
+    /// effective config of the block differs from the one it last ran with.
+    fn audit_block_start(&self, i: usize, run_dir: &Path) {
+        let dir = self.env.output().join(&self.subject);
+        let block = self.task.block(i);
+        let label = block.label().to_owned();
+        let config = block.config(self.config()).hash();
+
+        let previous = read_audit(&dir)
+            .unwrap_or_default()
+            .into_iter()
+            .rev()
+            .find(|e| e.event == "block_start" && e.details.get("block") == Some(&label))
+            .and_then(|e| e.details.get("config").cloned());
+        if let Some(previous) = previous.filter(|c| c != &config) {
+            self.audit(
+                "config_changed",
+                vec![
+                    ("block", label.clone()),
+                    ("previous", previous),
+                    ("current", config.clone()),
+                ],
+                &[],
+            );
+        }
+
+        let mut details = vec![
+            ("block", label),
+            ("run", relative_path(&dir, run_dir)),
+            ("block_hash", block.hash()),
+            ("config", config),
+        ];
+        let params = self.block_params();
+        if !params.is_empty() {
+            let params = params
+                .iter()
+                .map(|(p, v)| format!("{}={}", p.name(), param_text(v)))
+                .collect::<Vec<_>>();
+            details.push(("params", params.join(", ")));
+        }
+        self.audit("block_start", details, &[]);
+    }
+
+    /// Audits the end of the last run, sealing the checksums of all of its files.
+    fn audit_block_end(&self) {
+        let outcome = match &self.status {
+            Progress::Success(_) => "finished",
+            Progress::Interrupt(_) => "interrupted",
+            Progress::Failure(_, _) => "crashed",
+            Progress::CleanupError(_, _) => "cleanup_error",
+            Progress::None | Progress::LastRun(_) => "unknown",
+        };
+        let block = self.active_block().map(|b| b.label().to_owned());
+
+        match self.last_run.as_ref() {
+            Some(run) => self.audit(
+                "block_end",
+                vec![
+                    ("block", block.unwrap_or_default()),
+                    (
+                        "run",
+                        relative_path(&self.env.output().join(&self.subject), run),
+                    ),
+                    ("outcome", outcome.to_owned()),
+                ],
+                &list_files(run, run),
+            ),
+            None => self.audit(
+                "block_end",
+                vec![
+                    ("block", block.unwrap_or_default()),
+                    ("outcome", outcome.to_owned()),
+                ],
+                &[],
+            ),
+        }
+    }
+
+    /// Handles the commands sent by experimenter monitors since the last frame.
+    fn process_monitor(&mut self, ctx: &egui::Context) {
+        let monitor = match self.monitor.as_ref() {
+            Some(monitor) => monitor.clone(),
+            None => return,
+        };
+
+        monitor.set_context(ctx);
+        while let Some(command) = monitor.try_command() {
+            match (command, self.page, self.scheduler.as_mut()) {
+                (MonitorCommand::End, Page::Activity, Some(scheduler)) => {
+                    scheduler.interrupt("experimenter request");
+                }
+                (MonitorCommand::Note(note), _, Some(scheduler)) => {
+                    scheduler.async_writer().push(LoggerSignal::Append(
+                        NOTES_GROUP.to_owned(),
+                        ("note".to_owned(), Value::Text(note)),
+                    ));
+                }
+                (MonitorCommand::Pause, Page::Activity, Some(scheduler)) => {
+                    if scheduler.paused() {
+                        monitor.alert("The block is already paused.");
+                    }
+                    scheduler.pause("experimenter request");
+                }
+                (MonitorCommand::Resume, Page::Activity, Some(scheduler)) => {
+                    if !scheduler.paused() {
+                        monitor.alert("The block is not paused.");
+                    }
+                    scheduler.resume();
+                }
+                (MonitorCommand::End, _, _) => monitor.alert("No block is running to end."),
+                (MonitorCommand::Pause | MonitorCommand::Resume, _, _) => {
+                    monitor.alert("No block is running to pause or resume.")
+                }
+                (MonitorCommand::Note(_), _, _) => {
+                    monitor.alert("Notes can only be taken while a block is running.")
+                }
+            }
+        }
+    }
+
     fn drop_scheduler(&mut self) {
+        if let Some(monitor) = self.monitor.as_ref() {
+            monitor.end_block();
+        }
         self.page = Page::CleanUp;
         self.cleaning_up = 2;
         self.scheduler.take();
@@ -255,6 +594,18 @@ impl App for Server {
         while let Some(signal) = self.sync_reader.try_pop() {
             self.process(ctx, signal);
         }
+        self.process_monitor(ctx);
+
+        if matches!(self.page, Page::Startup | Page::Selection) {
+            let continuous = self.measures_refresh_rate();
+            let (resolution, rate) = self.display.measure(ctx, continuous, self.config().vsync());
+            self.screen = (resolution, rate.filter(|_| self.display.is_full()));
+            if continuous {
+                ctx.request_repaint();
+            }
+        } else {
+            self.display.reset();
+        }
 
         let frame = egui::Frame::window(&ctx.style())
             .inner_margin(0.0)
@@ -268,6 +619,8 @@ impl App for Server {
                 Page::Activity => self.show_activity(ui),
                 Page::Loading => self.show_loading(ui),
                 Page::CleanUp => self.show_cleanup(ui),
+                Page::Check => self.show_check(ui),
+                Page::History => self.show_history(ui),
             });
 
         if !self.hold_on_rescale {
@@ -277,4 +630,30 @@ impl App for Server {
             ctx.request_repaint_after(Duration::from_millis(250));
         }
     }
+
+    /// Reads back the frame that was just rendered (before it is shown) to mirror it on monitors.
+    fn post_rendering(&mut self, window_size_px: [u32; 2], _frame: &eframe::Frame) {
+        let (monitor, gl) = match (&self.monitor, &self.gl) {
+            (Some(monitor), Some(gl)) => (monitor, gl),
+            _ => return,
+        };
+        if !monitor.wants_frame() {
+            return;
+        }
+
+        let [width, height] = window_size_px;
+        let mut pixels = vec![0; (width * height * 4) as usize];
+        unsafe {
+            gl.read_pixels(
+                0,
+                0,
+                width as i32,
+                height as i32,
+                glow::RGBA,
+                glow::UNSIGNED_BYTE,
+                glow::PixelPackData::Slice(&mut pixels),
+            );
+        }
+        monitor.push_frame(width, height, pixels);
+    }
 }
@@ -0,0 +1,544 @@
+use crate::resource::LoggerSignal;
+use chrono::{DateTime, Local};
+use eframe::egui;
+use eyre::{eyre, Context, Result};
+use serde::{Deserialize, Serialize};
+use serde_cbor::Value;
+use std::collections::{BTreeMap, BTreeSet, VecDeque};
+use std::io::{self, Read, Write};
+use std::net::{TcpListener, TcpStream, ToSocketAddrs};
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::{Duration, Instant};
+
+pub const MSG_STATUS: u8 = 0;
+pub const MSG_FRAME: u8 = 1;
+pub const MSG_COMMAND: u8 = 2;
+pub const MSG_AUTH: u8 = 3;
+
+/// Log group that holds the notes taken by the experimenter during a run.
+pub const NOTES_GROUP: &str = "notes";
+
+const PUBLISH_INTERVAL: Duration = Duration::from_millis(100);
+const MAX_EVENTS: usize = 20;
+const MAX_ALERTS: usize = 10;
+const MAX_VALUE_LENGTH: usize = 120;
+const AUTH_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// Longest message (in bytes) that the server accepts from monitors. Tokens and commands are
+/// small, so longer messages are rejected before their payload is allocated.
+pub const MAX_REQUEST_LENGTH: usize = 4096;
+
+/// Experimenter monitor that `cog-monitor` can connect to (over TCP) from a separate window or
+/// machine, so nothing it shows ever ends up on the participant display:
+/// - `address`: address to listen on (default `127.0.0.1:7878`, which only accepts monitors on
+///   the same machine).
+/// - `token_env`: environment variable that holds a token that monitors have to send before they
+///   can observe the block or send commands. It is required if `address` is not a loopback
+///   address, since monitors can end the running block.
+/// - `mirror_rate`: rate (Hz) at which the participant display is mirrored (default `0.0`, i.e.,
+///   disabled). Reading back a frame stalls the GPU for a few milliseconds, so it should stay
+///   disabled for tasks with tight visual timing.
+/// - `mirror_width`: width (px) of the mirrored frames.
+#[derive(Debug, Clone, PartialEq, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct MonitorConfig {
+    #[serde(default = "defaults::address")]
+    address: String,
+    #[serde(default)]
+    token_env: Option<String>,
+    #[serde(default = "defaults::mirror_rate")]
+    mirror_rate: f64,
+    #[serde(default = "defaults::mirror_width")]
+    mirror_width: u32,
+}
+
+mod defaults {
+    #[inline(always)]
+    pub fn address() -> String {
+        "127.0.0.1:7878".to_owned()
+    }
+
+    #[inline(always)]
+    pub fn mirror_rate() -> f64 {
+        0.0
+    }
+
+    #[inline(always)]
+    pub fn mirror_width() -> u32 {
+        480
+    }
+}
+
+/// Snapshot of the running block that is sent to connected monitors.
+#[derive(Debug, Default, Clone, Deserialize, Serialize)]
+pub struct MonitorStatus {
+    pub subject: String,
+    pub block: Option<String>,
+    pub elapsed: f64,
+    /// Tree paths of the actions that are currently running.
+    pub active: Vec<String>,
+    /// Number of times each action that ran more than once has been started (e.g., trials).
+    pub counters: Vec<(String, u32)>,
+    /// Most recent log entries of the action tree (responses, key presses, etc.), newest first,
+    /// as (time since start, group, name, value).
+    pub events: Vec<(f64, String, String, String)>,
+    /// Current value of each signal that has been emitted.
+    pub signals: Vec<(u16, String)>,
+    pub alerts: Vec<String>,
+    pub paused: bool,
+}
+
+/// Commands that monitors can send to the server. While a block is paused, its action tree
+/// receives no signals (see `Scheduler::pause`).
+#[derive(Debug, Clone, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum MonitorCommand {
+    End,
+    Note(String),
+    Pause,
+    Resume,
+}
+
+struct Shared {
+    config: MonitorConfig,
+    status: MonitorStatus,
+    start: Option<DateTime<Local>>,
+    running: BTreeSet<String>,
+    starts: BTreeMap<String, u32>,
+    signals: BTreeMap<u16, String>,
+    events: VecDeque<(f64, String, String, String)>,
+    alerts: VecDeque<String>,
+    frame: Option<(u32, u32, Vec<u8>)>,
+    last_capture: Option<Instant>,
+    clients: Vec<TcpStream>,
+    commands: VecDeque<MonitorCommand>,
+    ctx: Option<egui::Context>,
+}
+
+/// Server side of the experimenter monitor. It only observes the log entries of the running
+/// block and (optionally) frames read back from the participant display, and queues commands
+/// received from monitors until the server handles them.
+#[derive(Clone)]
+pub struct Monitor(Arc<Mutex<Shared>>);
+
+impl Monitor {
+    pub fn start(config: &MonitorConfig) -> Result<Self> {
+        let token = match config.token_env.as_ref() {
+            Some(var) => Some(
+                std::env::var(var)
+                    .wrap_err_with(|| format!("Monitor token variable `{var}` is not set."))?,
+            ),
+            None if is_local(&config.address) => None,
+            None => {
+                return Err(eyre!(
+                    "Monitor address ({}) accepts connections from other machines, so it requires \
+                    a `token_env`.",
+                    config.address
+                ))
+            }
+        };
+
+        let listener = TcpListener::bind(&config.address)
+            .wrap_err_with(|| format!("Failed to listen for monitors on {}.", config.address))?;
+
+        let monitor = Self(Arc::new(Mutex::new(Shared {
+            config: config.clone(),
+            status: MonitorStatus::default(),
+            start: None,
+            running: BTreeSet::new(),
+            starts: BTreeMap::new(),
+            signals: BTreeMap::new(),
+            events: VecDeque::new(),
+            alerts: VecDeque::new(),
+            frame: None,
+            last_capture: None,
+            clients: vec![],
+            commands: VecDeque::new(),
+            ctx: None,
+        })));
+
+        let shared = monitor.0.clone();
+        thread::spawn(move || {
+            for stream in listener.incoming().flatten() {
+                let _ = stream.set_nodelay(true);
+                let mut reader = match stream.try_clone() {
+                    Ok(reader) => reader,
+                    Err(_) => continue,
+                };
+
+                let shared = shared.clone();
+                let token = token.clone();
+                thread::spawn(move || {
+                    if let Some(token) = token.as_deref() {
+                        if !authenticate(&mut reader, token) {
+                            return;
+                        }
+                    }
+
+                    shared.lock().unwrap().clients.push(stream);
+                    listen(reader, shared);
+                });
+            }
+        });
+
+        let shared = monitor.0.clone();
+        thread::spawn(move || loop {
+            thread::sleep(PUBLISH_INTERVAL);
+            publish(&shared);
+        });
+
+        Ok(monitor)
+    }
+
+    /// Context of the participant display, which is woken up when a command arrives.
+    pub fn set_context(&self, ctx: &egui::Context) {
+        let mut shared = self.0.lock().unwrap();
+        if shared.ctx.is_none() {
+            shared.ctx = Some(ctx.clone());
+        }
+    }
+
+    pub fn begin_block(&self, subject: &str, block: &str) {
+        let mut shared = self.0.lock().unwrap();
+        shared.status.subject = subject.to_owned();
+        shared.status.block = Some(block.to_owned());
+        shared.status.paused = false;
+        shared.start = None;
+        shared.running.clear();
+        shared.starts.clear();
+        shared.signals.clear();
+        shared.events.clear();
+        shared.alerts.clear();
+    }
+
+    pub fn end_block(&self) {
+        let mut shared = self.0.lock().unwrap();
+        shared.status.block = None;
+        shared.status.paused = false;
+        shared.running.clear();
+    }
+
+    pub fn alert(&self, message: impl Into<String>) {
+        let mut shared = self.0.lock().unwrap();
+        shared.alerts.push_front(message.into());
+        shared.alerts.truncate(MAX_ALERTS);
+    }
+
+    /// Updates the status from an entry that is about to be logged.
+    pub fn observe(&self, time: DateTime<Local>, signal: &LoggerSignal) {
+        let entries: Vec<(&str, &str, &Value)> = match signal {
+            LoggerSignal::Append(group, (name, value)) => {
+                vec![(group.as_str(), name.as_str(), value)]
+            }
+            LoggerSignal::Extend(group, entries) => entries
+                .iter()
+                .map(|(name, value)| (group.as_str(), name.as_str(), value))
+                .collect(),
+            _ => return,
+        };
+
+        let mut shared = self.0.lock().unwrap();
+        let elapsed = shared
+            .start
+            .map_or(0.0, |t| (time - t).num_milliseconds() as f64 / 1000.0);
+
+        for (group, name, value) in entries {
+            match (group, name, value) {
+                ("trace", "start", Value::Text(path)) => {
+                    shared.running.insert(path.clone());
+                    *shared.starts.entry(path.clone()).or_default() += 1;
+                }
+                ("trace", "stop", Value::Text(path)) => {
+                    shared.running.remove(path);
+                }
+                ("trace", "signal", Value::Array(v)) if v.len() == 2 => {
+                    if let Value::Integer(id) = v[0] {
+                        shared.signals.insert(id as u16, describe(&v[1]));
+                    }
+                }
+                ("main", "start", _) => shared.start = Some(time),
+                ("main", "pause", _) => shared.status.paused = true,
+                ("main", "resume", _) => shared.status.paused = false,
+                ("main", "crash" | "interrupt", value) => {
+                    let alert = format!("{name}: {}", describe(value));
+                    shared.alerts.push_front(alert);
+                    shared.alerts.truncate(MAX_ALERTS);
+                }
+                ("main" | "trace", _, _) => {}
+                (group, name, value) => {
+                    let event = (elapsed, group.to_owned(), name.to_owned(), describe(value));
+                    shared.events.push_front(event);
+                    shared.events.truncate(MAX_EVENTS);
+                }
+            }
+        }
+    }
+
+    /// Whether a frame of the participant display should be read back for mirroring. If a frame is
+    /// skipped because of the mirroring rate, another repaint is requested for when it is due, so
+    /// the mirror does not go stale while the display is static.
+    pub fn wants_frame(&self) -> bool {
+        let shared = self.0.lock().unwrap();
+        let rate = shared.config.mirror_rate;
+        if shared.clients.is_empty() || rate <= 0.0 {
+            return false;
+        }
+
+        let interval = Duration::from_secs_f64(1.0 / rate);
+        match shared.last_capture.map(|t| t.elapsed()) {
+            Some(elapsed) if elapsed < interval => {
+                if let Some(ctx) = shared.ctx.as_ref() {
+                    ctx.request_repaint_after(interval - elapsed);
+                }
+                false
+            }
+            _ => true,
+        }
+    }
+
+    /// Queues a frame (RGBA, bottom row first, as read from the framebuffer) to be downscaled and
+    /// sent to monitors by the publisher thread.
+    pub fn push_frame(&self, width: u32, height: u32, pixels: Vec<u8>) {
+        let mut shared = self.0.lock().unwrap();
+        shared.last_capture = Some(Instant::now());
+        shared.frame = Some((width, height, pixels));
+    }
+
+    pub fn try_command(&self) -> Option<MonitorCommand> {
+        self.0.lock().unwrap().commands.pop_front()
+    }
+}
+
+/// Whether the monitor at the other end of `stream` sends the expected token as its first message.
+fn authenticate(stream: &mut TcpStream, token: &str) -> bool {
+    if stream.set_read_timeout(Some(AUTH_TIMEOUT)).is_err() {
+        return false;
+    }
+    let accepted = matches!(
+        read_message(stream, MAX_REQUEST_LENGTH),
+        Ok((MSG_AUTH, payload)) if payload == token.as_bytes()
+    );
+    accepted && stream.set_read_timeout(None).is_ok()
+}
+
+/// Whether every address that `address` resolves to is a loopback address.
+fn is_local(address: &str) -> bool {
+    match address.to_socket_addrs() {
+        Ok(addrs) => {
+            let addrs: Vec<_> = addrs.collect();
+            !addrs.is_empty() && addrs.iter().all(|a| a.ip().is_loopback())
+        }
+        Err(_) => false,
+    }
+}
+
+fn listen(mut stream: TcpStream, shared: Arc<Mutex<Shared>>) {
+    while let Ok((kind, payload)) = read_message(&mut stream, MAX_REQUEST_LENGTH) {
+        if kind != MSG_COMMAND {
+            continue;
+        }
+        if let Ok(command) = serde_cbor::from_slice(&payload) {
+            let mut shared = shared.lock().unwrap();
+            shared.commands.push_back(command);
+            if let Some(ctx) = shared.ctx.as_ref() {
+                ctx.request_repaint();
+            }
+        }
+    }
+}
+
+fn publish(shared: &Mutex<Shared>) {
+    let (status, frame, width, mut clients) = {
+        let mut shared = shared.lock().unwrap();
+        if shared.clients.is_empty() {
+            return;
+        }
+
+        let elapsed = shared.start.map_or(0.0, |t| {
+            (Local::now() - t).num_milliseconds() as f64 / 1000.0
+        });
+        let status = MonitorStatus {
+            elapsed: if shared.status.block.is_some() {
+                elapsed
+            } else {
+                0.0
+            },
+            active: shared.running.iter().cloned().collect(),
+            counters: shared
+                .starts
+                .iter()
+                .filter(|(_, n)| **n > 1)
+                .map(|(path, n)| (path.clone(), *n))
+                .collect(),
+            events: shared.events.iter().cloned().collect(),
+            signals: shared
+                .signals
+                .iter()
+                .map(|(k, v)| (*k, v.clone()))
+                .collect(),
+            alerts: shared.alerts.iter().cloned().collect(),
+            ..shared.status.clone()
+        };
+
+        let clients: Vec<_> = shared.clients.drain(..).collect();
+        let width = shared.config.mirror_width;
+        (status, shared.frame.take(), width, clients)
+    };
+
+    let status = serde_cbor::to_vec(&status).unwrap();
+    let frame = frame.map(|(w, h, pixels)| downscale(w, h, &pixels, width));
+
+    clients.retain_mut(|client| {
+        write_message(client, MSG_STATUS, &status).is_ok()
+            && frame
+                .as_ref()
+                .map_or(true, |f| write_message(client, MSG_FRAME, f).is_ok())
+    });
+
+    shared.lock().unwrap().clients.extend(clients);
+}
+
+/// Downscales a frame to the given width (nearest neighbor), flipping it upright, and encodes it
+/// as `[width, height, RGBA...]` with the dimensions as big-endian `u32`.
+fn downscale(width: u32, height: u32, pixels: &[u8], target: u32) -> Vec<u8> {
+    let tw = target.min(width).max(1);
+    let th = ((height as u64 * tw as u64) / width.max(1) as u64).max(1) as u32;
+
+    let mut data = Vec::with_capacity(8 + (tw * th * 4) as usize);
+    data.extend(tw.to_be_bytes());
+    data.extend(th.to_be_bytes());
+    for y in 0..th {
+        let sy = height - 1 - (y as u64 * height as u64 / th as u64) as u32;
+        for x in 0..tw {
+            let sx = (x as u64 * width as u64 / tw as u64) as u32;
+            let i = ((sy * width + sx) * 4) as usize;
+            data.extend(&pixels[i..i + 4]);
+        }
+    }
+    data
+}
+
+fn describe(value: &Value) -> String {
+    let mut text = match value {
+        Value::Null => "null".to_owned(),
+        Value::Bool(v) => v.to_string(),
+        Value::Integer(v) => v.to_string(),
+        Value::Float(v) => format!("{v:.3}"),
+        Value::Text(v) => v.clone(),
+        v => format!("{v:?}"),
+    };
+
+    if text.chars().count() > MAX_VALUE_LENGTH {
+        text = text.chars().take(MAX_VALUE_LENGTH).collect::<String>() + "...";
+    }
+    text
+}
+
+/// Writes a message of the monitor protocol: a kind byte, the payload length as a big-endian
+/// `u32`, and the payload.
+pub fn write_message(stream: &mut impl Write, kind: u8, payload: &[u8]) -> io::Result<()> {
+    let len = u32::try_from(payload.len())
+        .map_err(|_| io::Error::new(io::ErrorKind::InvalidInput, "Message is too long."))?;
+    stream.write_all(&[kind])?;
+    stream.write_all(&len.to_be_bytes())?;
+    stream.write_all(payload)?;
+    stream.flush()
+}
+
+/// Reads a message of the monitor protocol, failing without reading its payload if it is longer
+/// than `max_len` bytes.
+pub fn read_message(stream: &mut impl Read, max_len: usize) -> io::Result<(u8, Vec<u8>)> {
+    let mut header = [0; 5];
+    stream.read_exact(&mut header)?;
+    let len = u32::from_be_bytes(header[1..].try_into().unwrap()) as usize;
+    if len > max_len {
+        return Err(io::Error::new(
+            io::ErrorKind::InvalidData,
+            format!("Message is too long ({len} > {max_len} bytes)."),
+        ));
+    }
+    let mut payload = vec![0; len];
+    stream.read_exact(&mut payload)?;
+    Ok((header[0], payload))
+}
+
+pub fn send_token(stream: &mut impl Write, token: &str) -> Result<()> {
+    write_message(stream, MSG_AUTH, token.as_bytes())
+        .map_err(|e| eyre!("Failed to send monitor token ({e})."))
+}
+
+pub fn send_command(stream: &mut impl Write, command: &MonitorCommand) -> Result<()> {
+    let payload = serde_cbor::to_vec(command).wrap_err("Failed to serialize monitor command.")?;
+    if payload.len() > MAX_REQUEST_LENGTH {
+        return Err(eyre!(
+            "Command is too long to send ({} > {MAX_REQUEST_LENGTH} bytes).",
+            payload.len()
+        ));
+    }
+    write_message(stream, MSG_COMMAND, &payload).map_err(|e| eyre!("Failed to send command ({e})."))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn monitor_is_local_and_not_mirrored_by_default() {
+        let config: MonitorConfig = ron::from_str("()").unwrap();
+        assert_eq!(config.address, "127.0.0.1:7878");
+        assert_eq!(config.mirror_rate, 0.0);
+        assert!(config.token_env.is_none());
+    }
+
+    #[test]
+    fn only_loopback_addresses_are_local() {
+        assert!(is_local("127.0.0.1:7878"));
+        assert!(is_local("[::1]:7878"));
+        assert!(!is_local("0.0.0.0:7878"));
+        assert!(!is_local("192.168.1.10:7878"));
+        assert!(!is_local("not an address"));
+    }
+
+    #[test]
+    fn remote_monitor_requires_token() {
+        let config: MonitorConfig = ron::from_str("(address: \"0.0.0.0:0\")").unwrap();
+        assert!(Monitor::start(&config).is_err());
+    }
+
+    #[test]
+    fn messages_round_trip() {
+        let mut buffer = vec![];
+        send_token(&mut buffer, "secret").unwrap();
+        let (kind, payload) = read_message(&mut buffer.as_slice(), MAX_REQUEST_LENGTH).unwrap();
+        assert_eq!(kind, MSG_AUTH);
+        assert_eq!(payload, b"secret");
+    }
+
+    #[test]
+    fn long_messages_are_rejected_before_reading() {
+        // Header of a message that claims a 4 GiB payload, which is never sent.
+        let header = [MSG_COMMAND, 0xff, 0xff, 0xff, 0xff];
+        let error = read_message(&mut header.as_slice(), MAX_REQUEST_LENGTH).unwrap_err();
+        assert_eq!(error.kind(), io::ErrorKind::InvalidData);
+
+        let mut buffer = vec![];
+        let note = MonitorCommand::Note("x".repeat(MAX_REQUEST_LENGTH));
+        assert!(send_command(&mut buffer, &note).is_err());
+        assert!(buffer.is_empty());
+    }
+
+    #[test]
+    fn pauses_are_observed() {
+        let config: MonitorConfig = ron::from_str("(address: \"127.0.0.1:0\")").unwrap();
+        let monitor = Monitor::start(&config).unwrap();
+        monitor.begin_block("subject", "block");
+
+        let entry =
+            |name: &str| LoggerSignal::Append("main".to_owned(), (name.to_owned(), Value::Null));
+        monitor.observe(Local::now(), &entry("pause"));
+        assert!(monitor.0.lock().unwrap().status.paused);
+        monitor.observe(Local::now(), &entry("resume"));
+        assert!(!monitor.0.lock().unwrap().status.paused);
+    }
+}
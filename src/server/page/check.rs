@@ -0,0 +1,562 @@
+use crate::gui::text::{body, button1, button2};
+use crate::gui::{
+    center_x, header_body_controls, style_ui, Style, CUSTOM_RED, FOREST_GREEN,
+    TEXT_SIZE_DIALOGUE_BODY,
+};
+use crate::resource::{audio_from_samples, mirror_file, write_entries, AudioSink, IoManager, Key};
+use crate::server::{Config, Page, Server};
+use crate::util::instant_to_local;
+use chrono::Local;
+use eframe::egui;
+use eframe::egui::{Color32, Grid, Id, LayerId, Order, Rect, RichText, ScrollArea, Vec2};
+use egui_extras::StripBuilder;
+use eyre::{eyre, Context, Error, Result};
+use once_cell::sync::Lazy;
+use serde_cbor::Value;
+use std::collections::{BTreeMap, VecDeque};
+use std::f64::consts::PI;
+use std::sync::Mutex;
+use std::time::Instant;
+
+const TONE_FREQUENCY: f64 = 440.0;
+const TONE_DURATION: f64 = 1.0;
+const TONE_AMPLITUDE: f64 = 0.5;
+const TRIGGER_DURATION: f64 = 0.01;
+const RAMP_DURATION: f64 = 0.01;
+const FRAME_WINDOW: usize = 120;
+const REFRESH_TOLERANCE: f64 = 1.0;
+const PHOTODIODE_SIZE: f32 = 100.0;
+
+/// Refresh rate last measured over a full window of continuously repainted frames, which is
+/// dropped as soon as the display it was measured on changes.
+static MEASURED_RATE: Lazy<Mutex<Option<MeasuredRate>>> = Lazy::new(|| Mutex::new(None));
+
+/// A measured refresh rate (Hz), along with the resolution and vsync setting it was measured with.
+#[derive(Debug, Clone, Copy, PartialEq)]
+struct MeasuredRate {
+    rate: f64,
+    resolution: (u32, u32),
+    vsync: bool,
+}
+
+/// A key press on the check page, whose feedback (the photodiode patch turning white) is painted in
+/// the next frame.
+#[derive(Debug)]
+struct Press {
+    key: String,
+    code: Option<String>,
+    time: Instant,
+    painted: bool,
+}
+
+/// State of the equipment check page, which lets the experimenter verify the audio channels,
+/// trigger, photodiode patch, response device, and display before running any blocks.
+pub struct EquipmentCheck {
+    io: Result<IoManager>,
+    sinks: Vec<AudioSink>,
+    outcomes: BTreeMap<String, bool>,
+    photodiode: Option<Instant>,
+    presses: Vec<Press>,
+    display: DisplayMeter,
+    responses: VecDeque<(String, f64)>,
+    log: Vec<(String, String, Value)>,
+    save_error: Option<Error>,
+}
+
+impl EquipmentCheck {
+    pub fn new(config: &Config) -> Self {
+        Self {
+            io: IoManager::new(config),
+            sinks: vec![],
+            outcomes: BTreeMap::new(),
+            photodiode: None,
+            presses: vec![],
+            display: DisplayMeter::new(),
+            responses: VecDeque::new(),
+            log: vec![],
+            save_error: None,
+        }
+    }
+
+    fn record(&mut self, name: &str, value: Value) {
+        self.log
+            .push((Local::now().to_string(), name.to_owned(), value));
+    }
+
+    fn channels(&self) -> u16 {
+        match &self.io {
+            Ok(io) => io.audio_device().channels(),
+            Err(_) => 0,
+        }
+    }
+
+    fn play(&mut self, channel: u16, duration: f64, tone: bool, config: &Config) -> Result<()> {
+        let io = self.io.as_ref().map_err(|e| eyre!("{e:#}"))?;
+        let channels = io.audio_device().channels();
+        let sample_rate = io.audio_device().sample_rate();
+
+        let len = (duration * sample_rate as f64) as usize;
+        let ramp = (RAMP_DURATION * sample_rate as f64) as usize;
+        let mut samples = vec![0_i16; len * channels as usize];
+        for i in 0..len {
+            let value = if tone {
+                let t = i as f64 / sample_rate as f64;
+                let envelope = (i.min(len - i) as f64 / ramp as f64).min(1.0);
+                TONE_AMPLITUDE * envelope * (2.0 * PI * TONE_FREQUENCY * t).sin()
+            } else {
+                1.0
+            };
+            samples[i * channels as usize + channel as usize] = (value * i16::MAX as f64) as i16;
+        }
+
+        let buffer = audio_from_samples(channels, sample_rate, samples, config)?;
+        let mut sink = io.audio()?;
+        sink.set_volume(config.volume().value())?;
+        sink.queue(buffer)?;
+        sink.play()?;
+
+        self.sinks.retain(|s| !matches!(s.empty(), Ok(true)));
+        self.sinks.push(sink);
+        Ok(())
+    }
+}
+
+/// Refresh rate (Hz) most recently measured by a `DisplayMeter` over a full window of frames that
+/// were repainted continuously, for actions that modulate their stimuli frame by frame. There is
+/// none if it was measured with a different `vsync` setting, or if the resolution of the display
+/// changed since (e.g., the window moved to another display).
+pub fn measured_refresh_rate(vsync: bool) -> Option<f64> {
+    MEASURED_RATE
+        .lock()
+        .unwrap()
+        .filter(|m| m.vsync == vsync)
+        .map(|m| m.rate)
+}
+
+/// Measures the screen resolution and the refresh rate over the last frames. The rate is only
+/// meaningful while the screen is being repainted continuously, so it is only recorded as the
+/// measured refresh rate when the caller says so.
+#[derive(Debug, Default)]
+pub struct DisplayMeter {
+    frames: VecDeque<Instant>,
+    resolution: Option<(u32, u32)>,
+}
+
+impl DisplayMeter {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn measure(
+        &mut self,
+        ctx: &egui::Context,
+        continuous: bool,
+        vsync: bool,
+    ) -> ((u32, u32), Option<f64>) {
+        let size = ctx.input().screen_rect().size() * ctx.pixels_per_point();
+        let resolution = (size.x.round() as u32, size.y.round() as u32);
+        let rate = self.record(Instant::now(), resolution, continuous, vsync);
+        (resolution, rate)
+    }
+
+    fn record(
+        &mut self,
+        now: Instant,
+        resolution: (u32, u32),
+        continuous: bool,
+        vsync: bool,
+    ) -> Option<f64> {
+        // Frames from before a change of display do not tell anything about the current one
+        if self.resolution.replace(resolution) != Some(resolution) {
+            self.frames.clear();
+        }
+        let mut measured = MEASURED_RATE.lock().unwrap();
+        if matches!(*measured, Some(m) if m.resolution != resolution || m.vsync != vsync) {
+            *measured = None;
+        }
+
+        self.frames.push_back(now);
+        while self.frames.len() > FRAME_WINDOW {
+            self.frames.pop_front();
+        }
+
+        let rate = if self.frames.len() > 1 {
+            let span = now - *self.frames.front().unwrap();
+            Some((self.frames.len() - 1) as f64 / span.as_secs_f64())
+        } else {
+            None
+        };
+        if continuous && self.is_full() {
+            *measured = rate.map(|rate| MeasuredRate {
+                rate,
+                resolution,
+                vsync,
+            });
+        }
+
+        rate
+    }
+
+    /// Whether enough frames have been measured for a stable estimate of the refresh rate.
+    #[inline(always)]
+    pub fn is_full(&self) -> bool {
+        self.frames.len() == FRAME_WINDOW
+    }
+
+    #[inline(always)]
+    pub fn reset(&mut self) {
+        self.frames.clear();
+        self.resolution = None;
+    }
+}
+
+impl Server {
+    pub(crate) fn show_check(&mut self, ui: &mut egui::Ui) {
+        let mut check = match self.check.take() {
+            Some(check) => check,
+            None => EquipmentCheck::new(self.config()),
+        };
+
+        header_body_controls(ui, |strip| {
+            strip.cell(|ui| {
+                ui.centered_and_justified(|ui| ui.heading("Equipment Check"));
+            });
+            strip.empty();
+            strip.strip(|builder| {
+                center_x(builder, 1520.0, |ui| self.show_check_items(ui, &mut check));
+            });
+            strip.empty();
+            strip.strip(|builder| self.show_check_controls(builder, &mut check));
+        });
+
+        // Besides flashing on request, the patch turns white for a frame after every key press, so
+        // that a photodiode recorded along with the response device shows the latency from key
+        // press to visual feedback. Otherwise, it stays black.
+        let feedback = check.presses.iter().any(|p| !p.painted);
+        for press in check.presses.iter_mut() {
+            press.painted = true;
+        }
+        let flashing = check
+            .photodiode
+            .map_or(false, |since| (since.elapsed().as_secs_f64() % 1.0) < 0.5);
+        let screen = ui.ctx().input().screen_rect();
+        let patch = Rect::from_min_size(
+            screen.left_bottom() - Vec2::new(0.0, PHOTODIODE_SIZE),
+            Vec2::splat(PHOTODIODE_SIZE),
+        );
+        let layer = LayerId::new(Order::Foreground, Id::new("photodiode_patch"));
+        ui.ctx().layer_painter(layer).rect_filled(
+            patch,
+            0.0,
+            if feedback || flashing {
+                Color32::WHITE
+            } else {
+                Color32::BLACK
+            },
+        );
+
+        if matches!(self.page, Page::Check) {
+            self.check = Some(check);
+            ui.ctx().request_repaint();
+        }
+    }
+
+    fn show_check_items(&mut self, ui: &mut egui::Ui, check: &mut EquipmentCheck) {
+        enum Interaction {
+            None,
+            Tone(u16),
+            Trigger,
+            Photodiode,
+            Outcome(String, bool),
+        }
+
+        let mut interaction = Interaction::None;
+        let config = self.config().clone();
+        let use_trigger = config.use_trigger().value();
+        let channels = check.channels();
+
+        let (resolution, rate) = check.display.measure(ui.ctx(), true, config.vsync());
+
+        // The feedback painted in the last frame has been presented by the time this one starts
+        // (with vsync, the buffer swap blocks until then), so this is when it appeared on screen
+        let now = Instant::now();
+        let (shown, pending) = std::mem::take(&mut check.presses)
+            .into_iter()
+            .partition::<Vec<_>, _>(|p| p.painted);
+        check.presses = pending;
+        for press in shown {
+            let latency = (now - press.time).as_secs_f64() * 1000.0;
+            let label = match press.code.as_ref() {
+                Some(code) => format!("{} ({code})", press.key),
+                None => press.key.clone(),
+            };
+            check.responses.push_front((label, latency));
+            check.responses.truncate(5);
+            let mut value = vec![
+                Value::Text(press.key),
+                Value::Text(instant_to_local(press.time).to_string()),
+                Value::Text(instant_to_local(now).to_string()),
+                Value::Float(latency),
+            ];
+            value.extend(press.code.map(Value::Text));
+            check.record("response", Value::Array(value));
+        }
+
+        // Presses are timed when they are read, like during blocks
+        let events = ui.input().events.clone();
+        for event in events {
+            if let egui::Event::Key {
+                key, pressed: true, ..
+            } = event
+            {
+                // Positions are derived from the configured layout, so they are only shown if set
+                let key = Key::from(key);
+                let code = config
+                    .keyboard_layout()
+                    .map(|layout| format!("{:?}", layout.code(key)));
+                check.presses.push(Press {
+                    key: format!("{key:?}"),
+                    code,
+                    time: now,
+                    painted: false,
+                });
+            }
+        }
+
+        let outcome = |ui: &mut egui::Ui, name: &str, interaction: &mut Interaction| {
+            let state = check.outcomes.get(name).copied();
+            for (label, value, color) in [("Pass", true, FOREST_GREEN), ("Fail", false, CUSTOM_RED)]
+            {
+                let mut text = button2(label);
+                if state == Some(value) {
+                    text = text.color(color).strong();
+                }
+                if ui.button(text).clicked() {
+                    *interaction = Interaction::Outcome(name.to_owned(), value);
+                }
+            }
+        };
+
+        ScrollArea::vertical().show(ui, |ui| {
+            Grid::new("equipment_check")
+                .num_columns(4)
+                .spacing([40.0, 20.0])
+                .show(ui, |ui| {
+                    let refresh = rate.map_or("?".to_owned(), |r| format!("{r:.1}"));
+                    let mut status = format!("{}x{} px @ {refresh} Hz", resolution.0, resolution.1);
+                    if !config.vsync() {
+                        status.push_str(" (frame rate, vsync is off)");
+                    }
+                    let mut valid = true;
+                    if let Some((w, h)) = config.resolution() {
+                        status.push_str(&format!("\nExpected: {w}x{h} px"));
+                        valid &= (w, h) == resolution;
+                    }
+                    if let (Some(expected), Some(rate)) = (config.refresh_rate(), rate) {
+                        status.push_str(&format!("\nExpected: {expected:.1} Hz"));
+                        valid &= !config.vsync() || (rate - expected).abs() <= REFRESH_TOLERANCE;
+                    }
+                    ui.label(body("Display").strong());
+                    ui.label(body(status).color(if valid { FOREST_GREEN } else { CUSTOM_RED }));
+                    ui.end_row();
+
+                    if let Err(e) = &check.io {
+                        ui.label(body("Audio").strong());
+                        ui.label(body(format!("{e:#}")).color(CUSTOM_RED));
+                        ui.end_row();
+                    }
+
+                    for c in 0..channels {
+                        let name = format!("channel {}", c + 1);
+                        ui.label(body(format!("Audio {name}")).strong());
+                        if ui.button(button2("Play tone")).clicked() {
+                            interaction = Interaction::Tone(c);
+                        }
+                        ui.horizontal(|ui| outcome(ui, &name, &mut interaction));
+                        ui.end_row();
+                    }
+
+                    if use_trigger && channels > 0 {
+                        ui.label(body("Trigger").strong());
+                        if ui.button(button2("Fire trigger")).clicked() {
+                            interaction = Interaction::Trigger;
+                        }
+                        ui.horizontal(|ui| outcome(ui, "trigger", &mut interaction));
+                        ui.end_row();
+                    }
+
+                    ui.label(body("Photodiode").strong());
+                    let label = if check.photodiode.is_some() {
+                        "Stop flashing"
+                    } else {
+                        "Flash patch"
+                    };
+                    if ui.button(button2(label)).clicked() {
+                        interaction = Interaction::Photodiode;
+                    }
+                    ui.horizontal(|ui| outcome(ui, "photodiode", &mut interaction));
+                    ui.end_row();
+
+                    ui.label(body("Response device").strong());
+                    let echo = if check.responses.is_empty() {
+                        "Press any key...".to_owned()
+                    } else {
+                        check
+                            .responses
+                            .iter()
+                            .map(|(key, latency)| format!("{key} (feedback after {latency:.1} ms)"))
+                            .collect::<Vec<_>>()
+                            .join("\n")
+                    };
+                    ui.label(RichText::new(echo).size(TEXT_SIZE_DIALOGUE_BODY));
+                    ui.horizontal(|ui| outcome(ui, "response", &mut interaction));
+                    ui.end_row();
+
+                    if let Some(e) = &check.save_error {
+                        ui.label(body("Saving").strong());
+                        ui.label(body(format!("{e:#}")).color(CUSTOM_RED));
+                        ui.end_row();
+                    }
+                });
+        });
+
+        let result = match interaction {
+            Interaction::None => Ok(()),
+            Interaction::Tone(c) => {
+                check.record("tone", Value::Integer(c as i128 + 1));
+                check.play(c, TONE_DURATION, true, &config)
+            }
+            Interaction::Trigger => {
+                check.record("trigger", Value::Text("fired".to_owned()));
+                check.play(channels - 1, TRIGGER_DURATION, false, &config)
+            }
+            Interaction::Photodiode => {
+                check.photodiode = match check.photodiode {
+                    Some(_) => None,
+                    None => Some(Instant::now()),
+                };
+                check.record("photodiode", Value::Bool(check.photodiode.is_some()));
+                Ok(())
+            }
+            Interaction::Outcome(name, pass) => {
+                check.outcomes.insert(name, pass);
+                Ok(())
+            }
+        };
+
+        if let Err(e) = result {
+            check.io = Err(e.wrap_err("Failed to play test audio."));
+        }
+
+        if check.display.is_full() && !check.log.iter().any(|(_, n, _)| n == "display") {
+            check.record(
+                "display",
+                Value::Array(vec![
+                    Value::Integer(resolution.0 as i128),
+                    Value::Integer(resolution.1 as i128),
+                    rate.map_or(Value::Null, Value::Float),
+                ]),
+            );
+        }
+    }
+
+    fn show_check_controls(&mut self, builder: StripBuilder, check: &mut EquipmentCheck) {
+        enum Interaction {
+            None,
+            Done,
+        }
+
+        let mut interaction = Interaction::None;
+
+        center_x(builder, 200.0, |ui| {
+            ui.horizontal_centered(|ui| {
+                style_ui(ui, Style::SubmitButton);
+                let label = if check.save_error.is_some() {
+                    "Discard"
+                } else {
+                    "Done"
+                };
+                if ui.button(button1(label)).clicked() {
+                    interaction = Interaction::Done;
+                }
+            });
+        });
+
+        match interaction {
+            Interaction::None => {}
+            Interaction::Done => {
+                // A check that failed to save stays on the page with the error, unless it is
+                // discarded
+                if check.save_error.take().is_none() {
+                    if let Err(e) = self.save_check(check) {
+                        check.save_error = Some(e.wrap_err("Failed to save equipment check."));
+                        return;
+                    }
+                }
+                check.sinks.clear();
+                self.page = Page::Selection;
+            }
+        }
+    }
+
+    fn save_check(&self, check: &mut EquipmentCheck) -> Result<()> {
+        let outcomes = check
+            .outcomes
+            .iter()
+            .map(|(k, v)| (Value::Text(k.clone()), Value::Bool(*v)))
+            .collect();
+        check.record("outcome", Value::Map(outcomes));
+
+        let now = Local::now();
+        let dir = self
+            .env
+            .output()
+            .join(&self.subject)
+            .join(now.format("%F").to_string());
+        std::fs::create_dir_all(&dir)
+            .wrap_err_with(|| format!("Failed to create output directory: {dir:?}"))?;
+
+        let time = now.format("%T").to_string().replace(':', "-");
+        let path = dir.join(format!("check_{time}.log"));
+        write_entries(&path, self.config().log_format(), &check.log)?;
+        if let Err(e) = mirror_file(self.config(), self.env.output(), &path) {
+            eprintln!("{e:?}");
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Duration;
+
+    #[test]
+    fn measured_rate_follows_the_display() {
+        let mut meter = DisplayMeter::new();
+        let start = Instant::now();
+        let frame = |i: usize| start + Duration::from_micros(i as u64 * 8333);
+
+        for i in 0..FRAME_WINDOW {
+            meter.record(frame(i), (1920, 1080), true, true);
+        }
+        let rate = measured_refresh_rate(true).unwrap();
+        assert!((rate - 120.0).abs() < 0.1, "{rate}");
+        assert_eq!(measured_refresh_rate(false), None);
+
+        // A different resolution (e.g., another display) drops the rate and restarts the window
+        meter.record(frame(FRAME_WINDOW), (1280, 1024), true, true);
+        assert_eq!(measured_refresh_rate(true), None);
+        assert!(!meter.is_full());
+
+        for i in 1..=FRAME_WINDOW {
+            meter.record(frame(FRAME_WINDOW + i), (1280, 1024), true, true);
+        }
+        assert!(measured_refresh_rate(true).is_some());
+
+        // So does a different vsync setting, even without a full window
+        meter.record(frame(2 * FRAME_WINDOW + 1), (1280, 1024), false, false);
+        assert_eq!(measured_refresh_rate(true), None);
+        assert_eq!(measured_refresh_rate(false), None);
+    }
+}
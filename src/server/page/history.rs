@@ -0,0 +1,774 @@
+use crate::gui::text::{body, button1, button2, inactive, tooltip};
+use crate::gui::{
+    center_x, header_body_controls, style_ui, Style, CUSTOM_BLUE, CUSTOM_ORANGE, CUSTOM_RED,
+    FOREST_GREEN, TEXT_SIZE_DIALOGUE_BODY, TEXT_SIZE_DIALOGUE_TITLE,
+};
+use crate::resource::{
+    mirror_file, mirror_path, normalized_name, parse_log, parse_log_time, read_log, write_entries,
+    MIRROR_LOG,
+};
+use crate::server::{record, relative_path, Page, Server, SyncStatus};
+use chrono::{DateTime, FixedOffset, Local, NaiveDate, NaiveDateTime, NaiveTime};
+use eframe::egui;
+use eframe::egui::{ComboBox, Grid, Pos2, Rgba, ScrollArea, TextEdit, Vec2, Widget, Window};
+use egui_extras::StripBuilder;
+use eyre::{eyre, Context, Result};
+use serde::de::{self, IgnoredAny, SeqAccess, Visitor};
+use serde::{Deserialize, Deserializer};
+use serde_cbor::Value;
+use std::env::current_exe;
+use std::fmt;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+/// File (inside the run directory) that marks a run as invalid, along with the reason.
+pub const INVALID_LOG: &str = "invalid.log";
+
+/// File (inside the run directory) that holds the error raised while cleaning up after a run.
+pub const CLEANUP_LOG: &str = "cleanup_error.log";
+
+/// File (inside the run directory) that holds the full error that crashed a run, including
+/// crashes while loading the block or in the action tree, which are not always in the main log.
+pub const CRASH_LOG: &str = "crash.log";
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Outcome {
+    Finished,
+    Interrupted,
+    Crashed,
+    CleanupError,
+    Unreadable,
+}
+
+impl Outcome {
+    fn label(&self) -> &'static str {
+        match self {
+            Outcome::Finished => "Finished",
+            Outcome::Interrupted => "Interrupted",
+            Outcome::Crashed => "Crashed",
+            Outcome::CleanupError => "Cleanup error",
+            Outcome::Unreadable => "Unreadable",
+        }
+    }
+
+    fn color(&self) -> Rgba {
+        match self {
+            Outcome::Finished => FOREST_GREEN,
+            Outcome::Interrupted => CUSTOM_BLUE,
+            Outcome::Crashed => CUSTOM_RED,
+            Outcome::CleanupError | Outcome::Unreadable => CUSTOM_ORANGE,
+        }
+    }
+}
+
+/// A single attempt at running a block, reconstructed from its output directory.
+#[derive(Debug, Clone)]
+pub struct Run {
+    block: String,
+    dir: PathBuf,
+    start: NaiveDateTime,
+    duration: Option<f64>,
+    outcome: Outcome,
+    details: Option<String>,
+    notes: Vec<String>,
+    invalid: Option<String>,
+    mirror: Option<String>,
+}
+
+impl Run {
+    /// Reads the `main` log of the run in `dir` to determine its duration and outcome. Runs that
+    /// never logged `finish` (e.g., the server was killed) are considered crashed, and runs whose
+    /// `main` log cannot be read or parsed are marked unreadable.
+    fn load(block: &str, dir: PathBuf, start: NaiveDateTime) -> Self {
+        let mut run = Self {
+            block: block.to_owned(),
+            dir,
+            start,
+            duration: None,
+            outcome: Outcome::Crashed,
+            details: None,
+            notes: vec![],
+            invalid: None,
+            mirror: None,
+        };
+
+        // Errors that crash the action tree or the loading of the block are written in full to
+        // `crash.log`, and are not always in the main log.
+        let crash_log = fs::read_to_string(run.dir.join(CRASH_LOG)).ok();
+
+        match read_main_log(&run.dir.join("main.log")) {
+            Ok(entries) => {
+                let first = entries.first().map(|(t, _, _)| *t);
+                let mut end = entries.last().map(|(t, _, _)| *t);
+                let mut finished = false;
+                let mut interrupted = false;
+                let mut crashed = crash_log.is_some();
+                let mut crash = None;
+                for (time, name, value) in entries.into_iter() {
+                    match name.as_str() {
+                        "crash" => crash = Some(value.unwrap_or_default()),
+                        "interrupt" => interrupted = true,
+                        "finish" => {
+                            finished = true;
+                            end = Some(time);
+                            match value.as_deref() {
+                                Some("interrupted") => interrupted = true,
+                                Some("crashed") => crashed = true,
+                                _ => {}
+                            }
+                        }
+                        _ => {}
+                    }
+                }
+
+                if let (Some(first), Some(end)) = (first, end) {
+                    run.duration = Some((end - first).num_milliseconds() as f64 / 1000.0);
+                }
+                run.outcome = if crash.is_some() || crashed || !finished {
+                    Outcome::Crashed
+                } else if interrupted {
+                    Outcome::Interrupted
+                } else {
+                    Outcome::Finished
+                };
+                run.details = crash.or(crash_log).or_else(|| {
+                    (!finished).then(|| "The main log ends without a `finish` entry.".to_owned())
+                });
+            }
+            Err(e) => match crash_log {
+                Some(error) => run.details = Some(error),
+                None => {
+                    run.outcome = Outcome::Unreadable;
+                    run.details = Some(format!("{e:#}"));
+                }
+            },
+        }
+
+        if let Ok(error) = fs::read_to_string(run.dir.join(CLEANUP_LOG)) {
+            if run.outcome == Outcome::Finished {
+                run.outcome = Outcome::CleanupError;
+                run.details = Some(error);
+            }
+        }
+
+        if let Ok(entries) = read_log(&run.dir.join("notes.log")) {
+            run.notes = entries.iter().map(|(_, _, v)| text(v)).collect();
+        }
+
+        if let Ok(entries) = read_log(&run.dir.join(INVALID_LOG)) {
+            run.invalid = Some(
+                entries
+                    .iter()
+                    .map(|(_, _, v)| text(v))
+                    .collect::<Vec<_>>()
+                    .join("; "),
+            );
+        }
+
+        if let Ok(entries) = read_log(&run.dir.join(MIRROR_LOG)) {
+            run.mirror = Some(
+                entries
+                    .iter()
+                    .map(|(_, _, v)| text(v))
+                    .collect::<Vec<_>>()
+                    .join("\n"),
+            );
+        }
+
+        run
+    }
+
+    #[inline(always)]
+    pub fn start(&self) -> NaiveDateTime {
+        self.start
+    }
+
+    #[inline(always)]
+    pub fn is_valid(&self) -> bool {
+        self.invalid.is_none()
+    }
+}
+
+/// State of the history page, which lists every attempt at every block by the current subject.
+pub struct RunHistory {
+    runs: Vec<Run>,
+    filter: Option<String>,
+    invalidate: Option<(usize, String)>,
+    error: Option<String>,
+}
+
+impl RunHistory {
+    pub fn new(output: &Path, blocks: &[String]) -> Self {
+        Self {
+            runs: list_runs(output, blocks),
+            filter: None,
+            invalidate: None,
+            error: None,
+        }
+    }
+}
+
+/// Lists all runs of the given blocks found under the output directory of a subject, sorted by
+/// start time. Run directories are laid out as `<date>/<block>/<time>`.
+pub fn list_runs(output: &Path, blocks: &[String]) -> Vec<Run> {
+    let mut runs = vec![];
+    if let Ok(sessions) = output.read_dir() {
+        for session in sessions.flatten() {
+            let date = session.file_name().to_str().unwrap_or_default().to_owned();
+            let date = match NaiveDate::parse_from_str(&date, "%Y-%m-%d") {
+                Ok(date) => date,
+                Err(_) => continue,
+            };
+
+            for block in blocks {
+                let dir = session.path().join(normalized_name(block));
+                if let Ok(attempts) = dir.read_dir() {
+                    for attempt in attempts.flatten() {
+                        let time = attempt.file_name().to_str().unwrap_or_default().to_owned();
+                        if let Ok(time) = NaiveTime::parse_from_str(&time, "%H-%M-%S") {
+                            runs.push(Run::load(block, attempt.path(), date.and_time(time)));
+                        }
+                    }
+                }
+            }
+        }
+    }
+
+    runs.sort_by_key(|r| r.start);
+    runs
+}
+
+impl Server {
+    pub(crate) fn show_history(&mut self, ui: &mut egui::Ui) {
+        let mut history = match self.history.take() {
+            Some(history) => history,
+            None => RunHistory::new(
+                &self.env.output().join(&self.subject),
+                &self.task.block_labels(),
+            ),
+        };
+
+        let enabled = history.invalidate.is_none() && history.error.is_none();
+        ui.add_enabled_ui(enabled, |ui| {
+            header_body_controls(ui, |strip| {
+                strip.cell(|ui| {
+                    ui.centered_and_justified(|ui| {
+                        ui.heading(format!("History of \"{}\"", self.subject))
+                    });
+                });
+                strip.empty();
+                strip.strip(|builder| {
+                    center_x(builder, 1520.0, |ui| {
+                        self.show_history_runs(ui, &mut history)
+                    });
+                });
+                strip.empty();
+                strip.strip(|builder| self.show_history_controls(builder));
+            });
+        });
+
+        if history.invalidate.is_some() {
+            self.show_history_invalidate(ui.ctx(), &mut history);
+        }
+
+        if let Some(e) = history.error.clone() {
+            let mut open = true;
+            Window::new(body("Error").strong().size(TEXT_SIZE_DIALOGUE_TITLE))
+                .collapsible(false)
+                .open(&mut open)
+                .min_width(920.0)
+                .fixed_size(Vec2::new(920.0, 360.0))
+                .fixed_pos(Pos2::new(500.0, 280.0))
+                .show(ui.ctx(), |ui| {
+                    ui.label(body(e).color(CUSTOM_RED).size(TEXT_SIZE_DIALOGUE_BODY));
+                });
+            if !open {
+                history.error = None;
+            }
+        }
+
+        if matches!(self.page, Page::History) {
+            self.history = Some(history);
+        }
+    }
+
+    fn show_history_runs(&mut self, ui: &mut egui::Ui, history: &mut RunHistory) {
+        enum Interaction {
+            None,
+            Open(usize),
+            Timeline(usize),
+            Invalidate(usize),
+        }
+
+        let mut interaction = Interaction::None;
+
+        ui.horizontal(|ui| {
+            ui.label(body("Block:"));
+            ComboBox::from_id_source("history_block")
+                .selected_text(body(history.filter.as_deref().unwrap_or("All blocks")))
+                .show_ui(ui, |ui| {
+                    ui.selectable_value(&mut history.filter, None, body("All blocks"));
+                    for label in self.task.block_labels() {
+                        let text = body(&label);
+                        ui.selectable_value(&mut history.filter, Some(label), text);
+                    }
+                });
+        });
+        ui.add_space(20.0);
+
+        ScrollArea::vertical().show(ui, |ui| {
+            if history.runs.is_empty() {
+                ui.label(inactive("No runs recorded for this subject yet."));
+                return;
+            }
+
+            let uploader = self.uploader.as_ref();
+            let mut headers = vec!["Block", "Date", "Duration", "Outcome", "Notes", ""];
+            if uploader.is_some() {
+                headers.insert(4, "Sync");
+            }
+
+            Grid::new("run_history")
+                .num_columns(headers.len())
+                .striped(true)
+                .spacing([30.0, 12.0])
+                .show(ui, |ui| {
+                    for header in headers.iter() {
+                        ui.label(body(*header).strong());
+                    }
+                    ui.end_row();
+
+                    for (i, run) in history.runs.iter().enumerate().rev() {
+                        if matches!(&history.filter, Some(b) if b != &run.block) {
+                            continue;
+                        }
+
+                        let mut name = body(&run.block);
+                        if !run.is_valid() {
+                            name = name.strikethrough();
+                        }
+                        ui.label(name);
+                        ui.label(body(run.start.format("%Y-%m-%d %H:%M:%S").to_string()));
+                        ui.label(body(run.duration.map_or("-".to_owned(), format_duration)));
+
+                        let response =
+                            ui.label(body(run.outcome.label()).color(run.outcome.color()));
+                        if let Some(details) = &run.details {
+                            response.on_hover_text(tooltip(details));
+                        }
+
+                        if let Some(uploader) = uploader {
+                            let (label, color, details) = match uploader.status(&run.dir) {
+                                None => ("Not queued", CUSTOM_BLUE, None),
+                                Some(SyncStatus::Synced(time)) => {
+                                    ("Synced", FOREST_GREEN, Some(format!("Synced at {time}")))
+                                }
+                                Some(SyncStatus::Pending { attempts: 0, .. }) => {
+                                    ("Queued", CUSTOM_ORANGE, None)
+                                }
+                                Some(SyncStatus::Pending { attempts, error }) => (
+                                    "Retrying",
+                                    CUSTOM_RED,
+                                    Some(format!(
+                                        "Failed {attempts} time(s): {}",
+                                        error.unwrap_or_default()
+                                    )),
+                                ),
+                            };
+                            let response = ui.label(body(label).color(color));
+                            if let Some(details) = details {
+                                response.on_hover_text(tooltip(details));
+                            }
+                        }
+
+                        let mut notes = run.notes.clone();
+                        if let Some(reason) = &run.invalid {
+                            notes.insert(0, format!("Invalid: {reason}"));
+                        }
+                        ui.vertical(|ui| {
+                            ui.label(body(notes.join("\n")));
+                            if let Some(mirror) = &run.mirror {
+                                ui.label(body("Mirror diverged").color(CUSTOM_RED))
+                                    .on_hover_text(tooltip(mirror));
+                            }
+                        });
+
+                        ui.horizontal(|ui| {
+                            if ui.button(button2("Open")).clicked() {
+                                interaction = Interaction::Open(i);
+                            }
+                            if ui
+                                .button(button2("Timeline"))
+                                .on_hover_text(tooltip("Open the QC timeline of this run"))
+                                .clicked()
+                            {
+                                interaction = Interaction::Timeline(i);
+                            }
+                            ui.add_enabled_ui(run.is_valid(), |ui| {
+                                if ui.button(button2("Mark invalid")).clicked() {
+                                    interaction = Interaction::Invalidate(i);
+                                }
+                            });
+                        });
+                        ui.end_row();
+                    }
+                });
+        });
+
+        let result = match interaction {
+            Interaction::None => Ok(()),
+            Interaction::Open(i) => open_dir(&history.runs[i].dir),
+            Interaction::Timeline(i) => open_timeline(&history.runs[i].dir),
+            Interaction::Invalidate(i) => {
+                history.invalidate = Some((i, String::new()));
+                Ok(())
+            }
+        };
+
+        if let Err(e) = result {
+            history.error = Some(format!("{e:#}"));
+        }
+    }
+
+    fn show_history_controls(&mut self, builder: StripBuilder) {
+        enum Interaction {
+            None,
+            Back,
+        }
+
+        let mut interaction = Interaction::None;
+
+        center_x(builder, 200.0, |ui| {
+            ui.horizontal_centered(|ui| {
+                style_ui(ui, Style::CancelButton);
+                if ui.button(button1("Back")).clicked() {
+                    interaction = Interaction::Back;
+                }
+            });
+        });
+
+        match interaction {
+            Interaction::None => {}
+            Interaction::Back => {
+                self.page = Page::Selection;
+                for i in 0..self.blocks.len() {
+                    let _ = self.update_history(i);
+                }
+            }
+        }
+    }
+
+    fn show_history_invalidate(&mut self, ctx: &egui::Context, history: &mut RunHistory) {
+        enum Interaction {
+            None,
+            Cancel,
+            Confirm,
+        }
+
+        let mut interaction = Interaction::None;
+        let (i, reason) = history.invalidate.as_mut().unwrap();
+        let run = &history.runs[*i];
+
+        let mut open = true;
+        Window::new(
+            body("Mark run as invalid")
+                .strong()
+                .size(TEXT_SIZE_DIALOGUE_TITLE),
+        )
+        .collapsible(false)
+        .open(&mut open)
+        .vscroll(false)
+        .hscroll(false)
+        .min_width(920.0)
+        .fixed_size(Vec2::new(920.0, 360.0))
+        .fixed_pos(Pos2::new(500.0, 280.0))
+        .show(ctx, |ui| {
+            ui.vertical_centered(|ui| {
+                ui.add_space(20.0);
+                ui.label(
+                    body(format!(
+                        "{} @ {}",
+                        run.block,
+                        run.start.format("%Y-%m-%d %H:%M:%S")
+                    ))
+                    .size(TEXT_SIZE_DIALOGUE_BODY),
+                );
+                ui.add_space(20.0);
+                style_ui(ui, Style::SingleLineTextEdit);
+                TextEdit::singleline(reason)
+                    .hint_text(inactive("Reason"))
+                    .desired_width(760.0)
+                    .ui(ui);
+                ui.add_space(40.0);
+                ui.horizontal(|ui| {
+                    ui.add_space(240.0);
+                    style_ui(ui, Style::CancelButton);
+                    if ui.button(button1("Cancel")).clicked() {
+                        interaction = Interaction::Cancel;
+                    }
+                    ui.add_space(40.0);
+                    style_ui(ui, Style::SubmitButton);
+                    ui.add_enabled_ui(!reason.trim().is_empty(), |ui| {
+                        if ui.button(button1("Confirm")).clicked() {
+                            interaction = Interaction::Confirm;
+                        }
+                    });
+                });
+            });
+        });
+
+        match interaction {
+            Interaction::None if open => {}
+            Interaction::None | Interaction::Cancel => history.invalidate = None,
+            Interaction::Confirm => {
+                let (i, reason) = history.invalidate.take().unwrap();
+                let run = &mut history.runs[i];
+                match self.invalidate_run(&run.dir, reason.trim()) {
+                    Ok(()) => *run = Run::load(&run.block, run.dir.clone(), run.start),
+                    Err(e) => history.error = Some(format!("{e:#}")),
+                }
+            }
+        }
+    }
+
+    /// Marks a run as invalid by writing the reason to a log file inside its directory. The rest
+    /// of the logs are left untouched. Runs that were queued for upload are queued again, so that
+    /// the target also receives the reason (even if the run was already synced).
+    fn invalidate_run(&self, dir: &Path, reason: &str) -> Result<()> {
+        let path = dir.join(INVALID_LOG);
+        let entries = vec![(
+            Local::now().to_string(),
+            "invalid".to_owned(),
+            Value::Text(reason.to_owned()),
+        )];
+        write_entries(&path, self.config().log_format(), &entries)?;
+        if let Err(e) = mirror_file(self.config(), self.env().output(), &path) {
+            eprintln!("{e:?}");
+        }
+
+        let subject = self.env().output().join(self.subject());
+        let mirror = mirror_path(self.config(), self.env().output(), &subject);
+        record(
+            &subject,
+            mirror.as_deref(),
+            "run_invalidated",
+            vec![
+                ("run", relative_path(&subject, dir)),
+                ("reason", reason.to_owned()),
+            ],
+            &[path],
+        )?;
+
+        if let Some(uploader) = self.uploader.as_ref() {
+            if uploader.status(dir).is_some() {
+                uploader
+                    .requeue(dir)
+                    .wrap_err("Failed to queue invalidated run for upload.")?;
+            }
+        }
+        Ok(())
+    }
+}
+
+/// An entry of a `main` log that only keeps the value of `crash` entries. Other values (e.g., the
+/// config or the action tree) are skipped without being parsed, so entries that cannot be
+/// represented as a `Value` (or are unknown to this version) do not make the log unreadable.
+struct MainEntry(String, String, Option<String>);
+
+impl<'de> Deserialize<'de> for MainEntry {
+    fn deserialize<D>(deserializer: D) -> std::result::Result<Self, D::Error>
+    where
+        D: Deserializer<'de>,
+    {
+        struct EntryVisitor;
+
+        impl<'de> Visitor<'de> for EntryVisitor {
+            type Value = MainEntry;
+
+            fn expecting(&self, f: &mut fmt::Formatter) -> fmt::Result {
+                f.write_str("a (time, name, value) log entry")
+            }
+
+            fn visit_seq<A>(self, mut seq: A) -> std::result::Result<MainEntry, A::Error>
+            where
+                A: SeqAccess<'de>,
+            {
+                let time: String = seq
+                    .next_element()?
+                    .ok_or_else(|| de::Error::invalid_length(0, &self))?;
+                let name: String = seq
+                    .next_element()?
+                    .ok_or_else(|| de::Error::invalid_length(1, &self))?;
+                let value = if name == "crash" || name == "finish" {
+                    seq.next_element::<Value>()?.map(|v| text(&v))
+                } else {
+                    seq.next_element::<IgnoredAny>()?;
+                    None
+                };
+                Ok(MainEntry(time, name, value))
+            }
+        }
+
+        deserializer.deserialize_tuple(3, EntryVisitor)
+    }
+}
+
+fn read_main_log(path: &Path) -> Result<Vec<(DateTime<FixedOffset>, String, Option<String>)>> {
+    parse_log::<MainEntry>(path)?
+        .into_iter()
+        .map(|MainEntry(time, name, value)| Ok((parse_log_time(&time, path)?, name, value)))
+        .collect()
+}
+
+fn text(value: &Value) -> String {
+    match value {
+        Value::Text(s) => s.clone(),
+        v => format!("{v:?}"),
+    }
+}
+
+fn format_duration(secs: f64) -> String {
+    let secs = secs.max(0.0).round() as u64;
+    format!("{}:{:02}", secs / 60, secs % 60)
+}
+
+fn open_dir(path: &Path) -> Result<()> {
+    let opener = if cfg!(target_os = "windows") {
+        "explorer"
+    } else if cfg!(target_os = "macos") {
+        "open"
+    } else {
+        "xdg-open"
+    };
+
+    Command::new(opener)
+        .arg(path)
+        .spawn()
+        .map(|_| ())
+        .wrap_err_with(|| format!("Failed to open directory ({path:?})."))
+}
+
+fn open_timeline(path: &Path) -> Result<()> {
+    let tool = current_exe()
+        .wrap_err("Could not obtain path to current executable.")?
+        .parent()
+        .ok_or_else(|| eyre!("Executable has no parent directory."))?
+        .join("cog-tool");
+
+    Command::new(&tool)
+        .arg("timeline")
+        .arg(path)
+        .spawn()
+        .map(|_| ())
+        .wrap_err_with(|| format!("Failed to spawn `cog-tool` ({tool:?})."))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn load(name: &str, main: &str) -> Run {
+        load_with(name, main, &[])
+    }
+
+    fn load_with(name: &str, main: &str, files: &[(&str, &str)]) -> Run {
+        let dir = std::env::temp_dir().join(format!("cog_history_{name}_{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        fs::write(dir.join("main.log"), main).unwrap();
+        for (file, content) in files {
+            fs::write(dir.join(file), content).unwrap();
+        }
+        let run = Run::load("block", dir.clone(), NaiveDateTime::default());
+        fs::remove_dir_all(&dir).unwrap();
+        run
+    }
+
+    #[test]
+    fn finished_run_ignores_other_entries() {
+        let run = load(
+            "finished",
+            r#"[
+                ("2026-01-01 10:00:00.000 +00:00", "info", (subject: "s", tags: [Some(Yes), None])),
+                ("2026-01-01 10:00:01.000 +00:00", "start", "ok"),
+                ("2026-01-01 10:00:02.000 +00:00", "unknown_entry", {"a": [1, 2.5]}),
+                ("2026-01-01 10:01:00.000 +00:00", "finish", "ok"),
+            ]"#,
+        );
+        assert_eq!(run.outcome, Outcome::Finished);
+        assert_eq!(run.duration, Some(60.0));
+        assert!(run.details.is_none());
+    }
+
+    #[test]
+    fn crashed_run_keeps_error() {
+        let run = load(
+            "crashed",
+            r#"[
+                ["2026-01-01 10:00:00.000 +00:00", "start", "ok"],
+                ["2026-01-01 10:00:05.000 +00:00", "crash", "Failed to start block."]
+            ]"#,
+        );
+        assert_eq!(run.outcome, Outcome::Crashed);
+        assert_eq!(run.details.as_deref(), Some("Failed to start block."));
+
+        let run = load(
+            "killed",
+            r#"[("2026-01-01 10:00:00.000 +00:00", "start", "ok")]"#,
+        );
+        assert_eq!(run.outcome, Outcome::Crashed);
+    }
+
+    #[test]
+    fn crash_log_marks_run_as_crashed() {
+        // Crashes in the action tree are only written to `crash.log`.
+        let main = r#"[
+            ["2026-01-01 10:00:00.000 +00:00", "start", "ok"],
+            ["2026-01-01 10:00:05.000 +00:00", "finish", "ok"]
+        ]"#;
+        let run = load_with("crash_log", main, &[(CRASH_LOG, "Failed to update graph.")]);
+        assert_eq!(run.outcome, Outcome::Crashed);
+        assert_eq!(run.details.as_deref(), Some("Failed to update graph."));
+
+        // Crashes while loading the block, before it started.
+        let main = r#"[["2026-01-01 10:00:00.000 +00:00", "info", {}]]"#;
+        let run = load_with(
+            "load_crash",
+            main,
+            &[(CRASH_LOG, "Failed to load resources.")],
+        );
+        assert_eq!(run.outcome, Outcome::Crashed);
+        assert_eq!(run.details.as_deref(), Some("Failed to load resources."));
+    }
+
+    #[test]
+    fn finish_entry_keeps_outcome() {
+        let run = load(
+            "finish_interrupted",
+            r#"[
+                ["2026-01-01 10:00:00.000 +00:00", "start", "ok"],
+                ["2026-01-01 10:00:05.000 +00:00", "finish", "interrupted"]
+            ]"#,
+        );
+        assert_eq!(run.outcome, Outcome::Interrupted);
+
+        let run = load(
+            "finish_crashed",
+            r#"[
+                ["2026-01-01 10:00:00.000 +00:00", "start", "ok"],
+                ["2026-01-01 10:00:05.000 +00:00", "finish", "crashed"]
+            ]"#,
+        );
+        assert_eq!(run.outcome, Outcome::Crashed);
+    }
+
+    #[test]
+    fn unparseable_run_is_not_crashed() {
+        let run = load(
+            "unparseable",
+            "[(\"2026-01-01 10:00:00.000 +00:00\", \"start\"",
+        );
+        assert_eq!(run.outcome, Outcome::Unreadable);
+        assert!(run.details.is_some());
+    }
+}
@@ -1,9 +1,14 @@
 mod activity;
+mod check;
 mod cleanup;
+mod history;
 mod loading;
 mod selection;
 mod startup;
 
+pub use check::{measured_refresh_rate, DisplayMeter, EquipmentCheck};
+pub use history::{list_runs, Outcome, Run, RunHistory, CLEANUP_LOG, CRASH_LOG, INVALID_LOG};
+
 #[derive(Debug, Clone, Copy, PartialEq, Eq)]
 pub enum Page {
     Startup,
@@ -11,4 +16,6 @@ pub enum Page {
     Loading,
     Activity,
     CleanUp,
+    Check,
+    History,
 }
@@ -3,14 +3,22 @@ use crate::gui::{
     center_x, header_body_controls, style_ui, Style, CUSTOM_BLUE, CUSTOM_ORANGE, CUSTOM_RED,
     FOREST_GREEN, TEXT_SIZE_DIALOGUE_BODY, TEXT_SIZE_DIALOGUE_TITLE,
 };
-use crate::server::{Page, Progress, Scheduler, Server, ServerSignal};
+use crate::server::{BlockParam, Page, ParamKind, Progress, Scheduler, Server, ServerSignal};
+use chrono::Local;
 use eframe::egui;
-use eframe::egui::{Direction, Label, Layout, Pos2, RichText, ScrollArea, Vec2, Window};
+use eframe::egui::{
+    Checkbox, ComboBox, Direction, Grid, Label, Layout, Pos2, RichText, ScrollArea, Slider, Vec2,
+    Window,
+};
 use egui_extras::{Size, StripBuilder};
+use serde_cbor::Value;
 
 impl Server {
     pub(crate) fn show_selection(&mut self, ui: &mut egui::Ui) {
-        ui.add_enabled_ui(matches!(self.status, Progress::None), |ui| {
+        let enabled = matches!(self.status, Progress::None)
+            && !self.confirm_reset
+            && self.param_dialog.is_none();
+        ui.add_enabled_ui(enabled, |ui| {
             header_body_controls(ui, |strip| {
                 strip.cell(|ui| {
                     ui.centered_and_justified(|ui| ui.heading(self.task.title()));
@@ -28,6 +36,14 @@ impl Server {
             self.show_selection_status(ui.ctx());
         }
 
+        if self.confirm_reset {
+            self.show_selection_reset(ui.ctx());
+        }
+
+        if self.param_dialog.is_some() {
+            self.show_selection_params(ui.ctx());
+        }
+
         if ui.input().key_pressed(egui::Key::Escape) && !matches!(self.status, Progress::None) {
             self.blocks.get_mut(self.active_block.unwrap()).unwrap().1 =
                 std::mem::replace(&mut self.status, Progress::None);
@@ -166,17 +182,106 @@ impl Server {
         match interaction {
             Interaction::None => {}
             Interaction::StartBlock(i) => {
-                if self.scheduler.is_none() {
-                    println!("\nStarting experiment block {i}...");
-                    self.active_block = Some(i);
-                    self.page = Page::Loading;
-                    match Scheduler::new(self, ui.ctx()) {
-                        Ok(scheduler) => self.scheduler = Some(scheduler),
-                        Err(e) => self.sync_reader.push(ServerSignal::BlockCrashed(
-                            e.wrap_err("Failed to initialize scheduler."),
-                        )),
+                let params = self.task.block(i).params();
+                if params.is_empty() {
+                    self.start_block(i, ui.ctx());
+                } else {
+                    let values = self
+                        .params
+                        .get(&i)
+                        .cloned()
+                        .unwrap_or_else(|| params.iter().map(|p| p.default_value()).collect());
+                    self.param_dialog = Some((i, values));
+                }
+            }
+        }
+    }
+
+    fn start_block(&mut self, i: usize, ctx: &egui::Context) {
+        if self.scheduler.is_some() {
+            return;
+        }
+
+        if let Err(e) = self.verify_requirements(i) {
+            self.active_block = Some(i);
+            self.status = Progress::Failure(Local::now(), e);
+            return;
+        }
+
+        println!("\nStarting experiment block {i}...");
+        self.active_block = Some(i);
+        self.page = Page::Loading;
+        self.last_run = None;
+        match Scheduler::new(self, ctx) {
+            Ok(scheduler) => {
+                self.audit_block_start(i, scheduler.run_dir());
+                self.last_run = Some(scheduler.run_dir().to_owned());
+                self.scheduler = Some(scheduler);
+            }
+            Err(e) => self.sync_reader.push(ServerSignal::BlockCrashed(
+                e.wrap_err("Failed to initialize scheduler."),
+            )),
+        }
+    }
+
+    /// Dialog for choosing the parameters of a block before starting it. The chosen values are
+    /// kept as the defaults for the next run of the block by the same subject.
+    fn show_selection_params(&mut self, ctx: &egui::Context) {
+        enum Interaction {
+            None,
+            Cancel,
+            Start,
+        }
+
+        let mut interaction = Interaction::None;
+        let (i, mut values) = self.param_dialog.take().unwrap();
+        let block = self.task.block(i);
+
+        let mut open = true;
+        Window::new(
+            body(format!("Parameters of {}", block.label()))
+                .strong()
+                .size(TEXT_SIZE_DIALOGUE_TITLE),
+        )
+        .collapsible(false)
+        .open(&mut open)
+        .vscroll(true)
+        .hscroll(false)
+        .min_width(920.0)
+        .fixed_pos(Pos2::new(500.0, 240.0))
+        .show(ctx, |ui| {
+            ui.add_space(20.0);
+            Grid::new("block_params")
+                .num_columns(2)
+                .spacing([40.0, 16.0])
+                .show(ui, |ui| {
+                    for (param, value) in block.params().iter().zip(values.iter_mut()) {
+                        ui.label(body(param.label()).size(TEXT_SIZE_DIALOGUE_BODY));
+                        show_param(ui, param, value);
+                        ui.end_row();
                     }
+                });
+            ui.add_space(40.0);
+            ui.horizontal(|ui| {
+                ui.add_space(240.0);
+                style_ui(ui, Style::CancelButton);
+                if ui.button(button1("Cancel")).clicked() {
+                    interaction = Interaction::Cancel;
+                }
+                ui.add_space(40.0);
+                style_ui(ui, Style::SubmitButton);
+                if ui.button(button1("Start")).clicked() {
+                    interaction = Interaction::Start;
                 }
+            });
+        });
+
+        match interaction {
+            Interaction::None if open => self.param_dialog = Some((i, values)),
+            Interaction::None | Interaction::Cancel => {}
+            Interaction::Start => {
+                self.params.insert(i, values);
+                self.start_block(i, ctx);
             }
         }
     }
@@ -185,22 +290,114 @@ impl Server {
         enum Interaction {
             None,
             Back,
+            Check,
+            History,
+            NewParticipant,
         }
 
         let mut interaction = Interaction::None;
 
-        center_x(builder, 200.0, |ui| {
+        center_x(builder, 1020.0, |ui| {
             ui.horizontal_centered(|ui| {
                 style_ui(ui, Style::CancelButton);
                 if ui.button(button1("Back")).clicked() {
                     interaction = Interaction::Back;
                 }
+
+                ui.add_space(20.0);
+                style_ui(ui, Style::SelectButton);
+                if ui.button(button1("Check")).clicked() {
+                    interaction = Interaction::Check;
+                }
+
+                ui.add_space(20.0);
+                if ui.button(button1("History")).clicked() {
+                    interaction = Interaction::History;
+                }
+
+                ui.add_space(20.0);
+                if ui.button(button1("New participant")).clicked() {
+                    interaction = Interaction::NewParticipant;
+                }
             });
         });
 
         match interaction {
             Interaction::None => {}
             Interaction::Back => self.page = Page::Startup,
+            Interaction::Check => self.page = Page::Check,
+            Interaction::History => {
+                self.history = None;
+                self.page = Page::History;
+            }
+            Interaction::NewParticipant => {
+                if self.has_unfinished_blocks() {
+                    self.confirm_reset = true;
+                } else {
+                    self.new_participant();
+                }
+            }
+        }
+    }
+
+    fn show_selection_reset(&mut self, ctx: &egui::Context) {
+        enum Interaction {
+            None,
+            Cancel,
+            Confirm,
+        }
+
+        let mut interaction = Interaction::None;
+        let unfinished: Vec<_> = self
+            .blocks
+            .iter()
+            .filter(|(_, p)| !matches!(p, Progress::Success(_) | Progress::LastRun(_)))
+            .map(|(label, _)| label.as_str())
+            .collect();
+        let content = format!(
+            "Subject \"{}\" has not completed the following blocks:\n\n{}\n\n\
+            Switch to a new participant anyway?",
+            self.subject,
+            unfinished.join(", ")
+        );
+
+        let mut open = true;
+        Window::new(
+            body("New participant")
+                .strong()
+                .size(TEXT_SIZE_DIALOGUE_TITLE),
+        )
+        .collapsible(false)
+        .open(&mut open)
+        .vscroll(false)
+        .hscroll(false)
+        .min_width(920.0)
+        .fixed_size(Vec2::new(920.0, 360.0))
+        .fixed_pos(Pos2::new(500.0, 280.0))
+        .show(ctx, |ui| {
+            ui.vertical_centered(|ui| {
+                ui.add_space(20.0);
+                ui.add(Label::new(body(content).size(TEXT_SIZE_DIALOGUE_BODY)).wrap(true));
+                ui.add_space(40.0);
+                ui.horizontal(|ui| {
+                    ui.add_space(240.0);
+                    style_ui(ui, Style::CancelButton);
+                    if ui.button(button1("Cancel")).clicked() {
+                        interaction = Interaction::Cancel;
+                    }
+                    ui.add_space(40.0);
+                    style_ui(ui, Style::SubmitButton);
+                    if ui.button(button1("Continue")).clicked() {
+                        interaction = Interaction::Confirm;
+                    }
+                });
+            });
+        });
+
+        match interaction {
+            Interaction::None if open => {}
+            Interaction::None | Interaction::Cancel => self.confirm_reset = false,
+            Interaction::Confirm => self.new_participant(),
         }
     }
 
@@ -262,3 +459,33 @@ impl Server {
         }
     }
 }
+
+/// Widget for choosing the value of a block parameter within its range.
+fn show_param(ui: &mut egui::Ui, param: &BlockParam, value: &mut Value) {
+    match (param.kind(), value) {
+        (ParamKind::Int { min, max, .. }, Value::Integer(v)) => {
+            let mut x = *v as i64;
+            ui.add(Slider::new(&mut x, *min..=*max));
+            *v = x as i128;
+        }
+        (ParamKind::Float { min, max, .. }, Value::Float(v)) => {
+            ui.add(Slider::new(v, *min..=*max));
+        }
+        (ParamKind::Choice { options, .. }, Value::Text(v)) => {
+            ComboBox::from_id_source(param.name())
+                .selected_text(body(v.as_str()))
+                .show_ui(ui, |ui| {
+                    for option in options {
+                        let text = body(option);
+                        ui.selectable_value(v, option.clone(), text);
+                    }
+                });
+        }
+        (ParamKind::Bool(_), Value::Bool(v)) => {
+            ui.add(Checkbox::new(v, ""));
+        }
+        (_, value) => {
+            ui.label(body(format!("{value:?}")));
+        }
+    }
+}
@@ -1,17 +1,19 @@
 use crate::assets::Icon;
 use crate::gui::{
-    header_body_controls, style_ui, text::body, text::button1, text::inactive, text::tooltip, Style,
+    header_body_controls, style_ui, text::body, text::button1, text::inactive, text::tooltip,
+    Style, CUSTOM_RED,
 };
-use crate::server::{Page, Progress, Server};
-use chrono::{NaiveDate, NaiveTime};
+use crate::server::{list_runs, Page, Progress, Server};
+use crate::util::Hash;
 use eframe::egui;
 use egui::{ScrollArea, TextEdit, Widget};
 use egui_extras::{Size, StripBuilder};
 use eyre::Result;
-use heck::ToSnakeCase;
 
 impl Server {
     pub(crate) fn show_startup(&mut self, ui: &mut egui::Ui) {
+        let unmet = self.unmet_requirements();
+
         header_body_controls(ui, |strip| {
             strip.cell(|ui| {
                 ui.centered_and_justified(|ui| ui.heading(self.task.title()));
@@ -26,9 +28,24 @@ impl Server {
                         strip.empty();
                         strip.cell(|ui| {
                             ScrollArea::vertical().show(ui, |ui| {
-                                ui.centered_and_justified(|ui| {
-                                    ui.label(self.task.description());
-                                });
+                                if unmet.is_empty() {
+                                    ui.centered_and_justified(|ui| {
+                                        ui.label(self.task.description());
+                                    });
+                                } else {
+                                    ui.vertical_centered(|ui| {
+                                        ui.label(self.task.description());
+                                        ui.add_space(30.0);
+                                        ui.label(
+                                            body("Unmet requirements:").strong().color(CUSTOM_RED),
+                                        );
+                                        for (scope, msg) in unmet.iter() {
+                                            ui.label(
+                                                body(format!("{scope}: {msg}")).color(CUSTOM_RED),
+                                            );
+                                        }
+                                    });
+                                }
                             });
                         });
                         strip.empty();
@@ -151,48 +168,43 @@ impl Server {
             Interaction::ToggleMagnification => self.show_magnification = !self.show_magnification,
             Interaction::Start => {
                 self.page = Page::Selection;
+                self.audit(
+                    "subject",
+                    vec![
+                        ("subject", self.subject.clone()),
+                        ("task", self.task.name().clone()),
+                        ("task_hash", self.task.hash()),
+                        ("server_hash", self.hash()),
+                    ],
+                    &[],
+                );
                 for i in 0..self.blocks.len() {
-                    if matches!(self.blocks[i].1, Progress::None) {
-                        let _ = self.update_history(i);
-                    }
+                    let _ = self.update_history(i);
                 }
                 println!("\n{:#?}", self.task.config());
             }
         }
     }
 
-    fn update_history(&mut self, i: usize) -> Result<()> {
-        let name = self.blocks[i].0.to_snake_case();
-        let progress = &mut self.blocks[i].1;
-
-        let mut last = None;
-        let dir = self.env.output().join(&self.subject);
-        if let Ok(sessions) = dir.read_dir() {
-            for session in sessions {
-                let date = session.unwrap().file_name().to_str().unwrap().to_owned();
-                let dir = dir.join(&date);
-                if let Ok(date) = NaiveDate::parse_from_str(&date, "%Y-%m-%d") {
-                    if let Ok(runs) = dir.join(&name).read_dir() {
-                        for run in runs {
-                            let time = run.unwrap().file_name().to_str().unwrap().to_owned();
-                            if let Ok(time) = NaiveTime::parse_from_str(&time, "%H-%M-%S") {
-                                let datetime = date.and_time(time);
-
-                                match last {
-                                    None => last = Some(datetime),
-                                    Some(t) if datetime > t => last = Some(datetime),
-                                    _ => {}
-                                }
-                            }
-                        }
-                    }
-                }
-            }
+    /// Marks a block with the start time of its latest valid run (in any session), unless it has
+    /// already been run in the current session.
+    pub(crate) fn update_history(&mut self, i: usize) -> Result<()> {
+        let (label, progress) = &mut self.blocks[i];
+        if !matches!(progress, Progress::None | Progress::LastRun(_)) {
+            return Ok(());
         }
 
-        if let Some(t) = last {
-            *progress = Progress::LastRun(t);
-        }
+        let dir = self.env.output().join(&self.subject);
+        let last = list_runs(&dir, &[label.clone()])
+            .into_iter()
+            .filter(|run| run.is_valid())
+            .map(|run| run.start())
+            .max();
+
+        *progress = match last {
+            Some(t) => Progress::LastRun(t),
+            None => Progress::None,
+        };
 
         Ok(())
     }
@@ -6,13 +6,15 @@ pub use p_sync::*;
 
 use crate::action::StatefulAction;
 use crate::comm::QWriter;
-use crate::resource::{LoggerSignal, TAG_ACTION, TAG_CONFIG, TAG_INFO};
-use crate::server::{Config, Info, Server, ServerSignal};
+use crate::resource::{mirror_path, LoggerSignal, TAG_ACTION, TAG_CONFIG, TAG_INFO};
+use crate::server::{record, relative_path, Config, Info, Server, ServerSignal};
 use eframe::egui;
 use eframe::egui::{CentralPanel, CursorIcon, Frame};
-use eyre::Result;
-use serde_cbor::{ser::to_vec, Value};
+use eyre::{Context, Error, Result};
+use serde_cbor::ser::{to_vec, to_vec_packed};
+use serde_cbor::Value;
 use std::collections::{BTreeMap, BTreeSet};
+use std::path::{Path, PathBuf};
 use std::sync::{Arc, Mutex};
 use std::time::{Duration, Instant, SystemTime};
 
@@ -22,7 +24,10 @@ pub type Atomic = Arc<Mutex<(Box<dyn StatefulAction>, State)>>;
 pub struct Scheduler {
     atomic: Atomic,
     info: Info,
+    run_dir: PathBuf,
     last_esc: Option<SystemTime>,
+    paused: bool,
+    outcome: &'static str,
     config: Config,
     ctx: egui::Context,
     sync_writer: QWriter<SyncSignal>,
@@ -35,36 +40,78 @@ impl Scheduler {
         let env = server.env();
         let task = server.task();
         let block = server.active_block().unwrap();
-        let info = Info::new(server, task, block);
+        let info = Info::new(server, task, block)?;
         let config = block.config(server.config());
 
+        let params = server.block_params();
+        let tree = block
+            .expand(&params)
+            .wrap_err("Failed to expand templates with the chosen block params.")?;
+        let tree_vec = to_vec_packed(&tree).unwrap();
+
         let server_writer = server.callback_channel();
-        let mut async_writer = AsyncProcessor::spawn(&info, &config, &server_writer)?;
-        let (sync_writer, atomic) =
-            SyncProcessor::spawn(block, env, &config, ctx, &async_writer, &server_writer)?;
+        let monitor = server.monitor().cloned();
+        if let Some(monitor) = monitor.as_ref() {
+            monitor.begin_block(server.subject(), block.label());
+        }
+        let (mut async_writer, run_dir) =
+            AsyncProcessor::spawn(&info, &config, &server_writer, monitor)?;
 
-        async_writer.push(LoggerSignal::Extend(
-            "main".to_owned(),
-            vec![
-                (
-                    "info".to_owned(),
-                    Value::Tag(TAG_INFO, Box::new(Value::Bytes(to_vec(&info).unwrap()))),
-                ),
-                (
-                    "config".to_owned(),
-                    Value::Tag(TAG_CONFIG, Box::new(Value::Bytes(to_vec(&config).unwrap()))),
-                ),
-                (
-                    "tree".to_owned(),
-                    Value::Tag(TAG_ACTION, Box::new(Value::Bytes(block.action_tree_vec()))),
+        let mut state = block.default_state().clone();
+        for (param, value) in params.iter() {
+            if param.signal() > 0 {
+                state.insert(param.signal(), value.clone());
+            }
+        }
+
+        let (sync_writer, atomic) = SyncProcessor::spawn(
+            block,
+            tree,
+            state,
+            env,
+            &info,
+            &run_dir,
+            &config,
+            server.resources(),
+            ctx,
+            &async_writer,
+            &server_writer,
+        )?;
+
+        let mut entries = vec![
+            (
+                "info".to_owned(),
+                Value::Tag(TAG_INFO, Box::new(Value::Bytes(to_vec(&info).unwrap()))),
+            ),
+            (
+                "config".to_owned(),
+                Value::Tag(TAG_CONFIG, Box::new(Value::Bytes(to_vec(&config).unwrap()))),
+            ),
+            (
+                "tree".to_owned(),
+                Value::Tag(TAG_ACTION, Box::new(Value::Bytes(tree_vec))),
+            ),
+        ];
+        if !params.is_empty() {
+            entries.push((
+                "params".to_owned(),
+                Value::Map(
+                    params
+                        .into_iter()
+                        .map(|(p, v)| (Value::Text(p.name().to_owned()), v))
+                        .collect(),
                 ),
-            ],
-        ));
+            ));
+        }
+        async_writer.push(LoggerSignal::Extend("main".to_owned(), entries));
 
         Ok(Self {
             atomic,
             info,
+            run_dir,
             last_esc: None,
+            paused: false,
+            outcome: "ok",
             config,
             ctx: ctx.clone(),
             sync_writer,
@@ -78,24 +125,100 @@ impl Scheduler {
         &self.info
     }
 
+    #[inline(always)]
+    pub fn run_dir(&self) -> &Path {
+        &self.run_dir
+    }
+
     #[inline(always)]
     pub fn config(&self) -> &Config {
         &self.config
     }
 
     pub fn request_interrupt(&mut self) {
+        self.interrupt("user request");
+    }
+
+    pub fn interrupt(&mut self, reason: &str) {
+        self.outcome = "interrupted";
         self.async_writer.push(LoggerSignal::Append(
             "main".to_owned(),
-            (
-                "interrupt".to_owned(),
-                Value::Text("user request".to_owned()),
-            ),
+            ("interrupt".to_owned(), Value::Text(reason.to_owned())),
         ));
 
+        let details = vec![
+            ("block", self.info.block().clone()),
+            ("run", relative_path(self.info.output(), &self.run_dir)),
+            ("reason", reason.to_owned()),
+        ];
+        let task_output = self.info.output().parent().unwrap_or(Path::new(""));
+        let mirror = mirror_path(&self.config, task_output, self.info.output());
+        if let Err(e) = record(
+            self.info.output(),
+            mirror.as_deref(),
+            "interrupt",
+            details,
+            &[],
+        ) {
+            eprintln!("Failed to write to audit log: {e:#}");
+        }
+
         self.server_writer.push(ServerSignal::BlockInterrupted);
         self.ctx.request_repaint();
     }
 
+    /// Records a crash of the block in its run directory, whether it happened while loading the
+    /// block or while running it: a short description in the `main` log group, and the full error
+    /// in `crash.log`.
+    pub fn crash(&mut self, error: &Error) {
+        self.outcome = "crashed";
+        self.async_writer.push(LoggerSignal::Append(
+            "main".to_owned(),
+            ("crash".to_owned(), Value::Text(format!("{error:#}"))),
+        ));
+        self.async_writer.push(LoggerSignal::Write(
+            "crash".to_owned(),
+            Value::Text(format!("{error:?}")),
+        ));
+    }
+
+    #[inline(always)]
+    pub fn paused(&self) -> bool {
+        self.paused
+    }
+
+    /// Pauses the block: until it is resumed, the participant display only shows the background,
+    /// key presses are ignored, and the action tree receives no signals (those that arrive, e.g.,
+    /// from timers that run out, are processed when it resumes). Audio, video, and streams that
+    /// are playing are not paused.
+    pub fn pause(&mut self, reason: &str) {
+        if self.paused {
+            return;
+        }
+
+        self.paused = true;
+        self.sync_writer.push(SyncSignal::Pause);
+        self.async_writer.push(LoggerSignal::Append(
+            "main".to_owned(),
+            ("pause".to_owned(), Value::Text(reason.to_owned())),
+        ));
+        self.ctx.request_repaint();
+    }
+
+    pub fn resume(&mut self) {
+        if !self.paused {
+            return;
+        }
+
+        self.paused = false;
+        self.async_writer.push(LoggerSignal::Append(
+            "main".to_owned(),
+            ("resume".to_owned(), Value::Text("ok".to_owned())),
+        ));
+        self.sync_writer.push(SyncSignal::Resume);
+        self.ctx.request_repaint();
+    }
+
     pub fn show(&mut self, ui: &mut egui::Ui) -> Result<()> {
         if ui.input().key_pressed(egui::Key::Escape) {
             let time = SystemTime::now();
@@ -108,6 +231,13 @@ impl Scheduler {
             self.last_esc = Some(time);
         }
 
+        if self.paused {
+            CentralPanel::default()
+                .frame(Frame::default().fill(self.config.background().into()))
+                .show_inside(ui, |ui| ui.output().cursor_icon = CursorIcon::None);
+            return Ok(());
+        }
+
         let keys_pressed: BTreeSet<_> = ui
             .input()
             .keys_down
@@ -125,28 +255,37 @@ impl Scheduler {
                 .push(SyncSignal::KeyPress(Instant::now(), keys_pressed))
         }
 
-        let result = {
-            let (tree, state) = &mut *self.atomic.lock().unwrap();
-            CentralPanel::default()
-                .frame(Frame::default().fill(self.config.background().into()))
-                .show_inside(ui, |ui| {
-                    if tree.props().visual() {
-                        tree.show(ui, &mut self.sync_writer, &mut self.async_writer, state)
-                    } else {
-                        ui.output().cursor_icon = CursorIcon::None;
-                        Ok(())
-                    }
-                })
-                .inner
-        };
-
-        if let Err(e) = &result {
-            self.async_writer.push(LoggerSignal::Append(
-                "main".to_owned(),
-                ("crash".to_owned(), Value::Text(format!("{e:#?}"))),
-            ));
+        let keys_released: BTreeSet<_> = ui
+            .input()
+            .events
+            .iter()
+            .filter_map(|e| match e {
+                egui::Event::Key {
+                    key,
+                    pressed: false,
+                    ..
+                } => Some(key.into()),
+                _ => None,
+            })
+            .collect();
+        if !keys_released.is_empty() {
+            self.sync_writer
+                .push(SyncSignal::KeyRelease(Instant::now(), keys_released))
         }
 
+        // Errors are recorded by the server when it handles the crash (see `crash`)
+        let (tree, state) = &mut *self.atomic.lock().unwrap();
+        let result = CentralPanel::default()
+            .frame(Frame::default().fill(self.config.background().into()))
+            .show_inside(ui, |ui| {
+                if tree.props().visual() {
+                    tree.show(ui, &mut self.sync_writer, &mut self.async_writer, state)
+                } else {
+                    ui.output().cursor_icon = CursorIcon::None;
+                    Ok(())
+                }
+            })
+            .inner;
         result
     }
 
@@ -163,7 +302,7 @@ impl Drop for Scheduler {
     fn drop(&mut self) {
         self.async_writer.push(LoggerSignal::Append(
             "main".to_owned(),
-            ("finish".to_owned(), Value::Text("ok".to_owned())),
+            ("finish".to_owned(), Value::Text(self.outcome.to_owned())),
         ));
 
         self.sync_writer.push(SyncSignal::Finish);
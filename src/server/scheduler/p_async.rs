@@ -1,13 +1,14 @@
 use crate::comm::{QReader, QWriter};
 use crate::resource::{Logger, LoggerSignal};
-use crate::server::{Config, Info, ServerSignal};
-use chrono::{DateTime, Local};
+use crate::server::{Config, Info, Monitor, ServerSignal};
 use eyre::Result;
+use std::path::PathBuf;
 use std::thread;
+use std::time::Instant;
 
 #[derive(Debug, Clone)]
 pub enum AsyncSignal {
-    Logger(DateTime<Local>, LoggerSignal),
+    Logger(Instant, LoggerSignal),
     Finish,
 }
 
@@ -23,7 +24,8 @@ impl AsyncProcessor {
         info: &Info,
         config: &Config,
         server_writer: &QWriter<ServerSignal>,
-    ) -> Result<QWriter<AsyncSignal>> {
+        monitor: Option<Monitor>,
+    ) -> Result<(QWriter<AsyncSignal>, PathBuf)> {
         let async_reader = QReader::new();
         let async_writer = async_reader.writer();
         let mut proc = Self {
@@ -34,11 +36,15 @@ impl AsyncProcessor {
         };
 
         let async_writer = proc.async_writer.clone();
+        let out_dir = proc.logger.out_dir().to_owned();
 
         thread::spawn(move || {
             while let Some(signal) = proc.async_reader.pop() {
                 match signal {
                     AsyncSignal::Logger(time, signal) => {
+                        if let Some(monitor) = monitor.as_ref() {
+                            monitor.observe(proc.logger.local_time(time), &signal);
+                        }
                         proc.logger
                             .update(time, signal, &proc.async_writer)
                             .unwrap();
@@ -51,6 +57,6 @@ impl AsyncProcessor {
                 .push(ServerSignal::AsyncComplete(proc.logger.finish()));
         });
 
-        Ok(async_writer)
+        Ok((async_writer, out_dir))
     }
 }
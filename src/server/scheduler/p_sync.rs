@@ -1,12 +1,14 @@
 use crate::action::nil::StatefulNil;
-use crate::action::{Action, ActionSignal, StatefulAction};
+use crate::action::{Action, ActionSignal, Scope, SharedRoutes, StatefulAction};
 use crate::comm::{QReader, QWriter, Signal, MAX_QUEUE_SIZE};
-use crate::resource::{IoManager, Key, LoggerSignal, ResourceManager};
-use crate::server::{AsyncSignal, Atomic, Block, Config, Env, ServerSignal};
+use crate::resource::{run_generators, IoManager, Key, LoggerSignal, ResourceManager};
+use crate::server::{AsyncSignal, Atomic, Block, Config, Env, Info, ServerSignal, State};
 use eframe::egui;
 use eyre::{eyre, Context, Error, Result};
+use serde_cbor::ser::to_vec_packed;
 use serde_cbor::{from_slice, Value};
 use std::collections::{BTreeSet, VecDeque};
+use std::path::Path;
 use std::sync::{Arc, Mutex};
 use std::thread;
 use std::time::{Duration, Instant};
@@ -15,11 +17,14 @@ use std::time::{Duration, Instant};
 pub enum SyncSignal {
     UpdateGraph,
     KeyPress(Instant, BTreeSet<Key>),
+    KeyRelease(Instant, BTreeSet<Key>),
     Emit(Instant, Signal),
     Error(Error),
     Repaint,
     Finish,
     Go,
+    Pause,
+    Resume,
 }
 
 pub struct SyncProcessor {
@@ -29,6 +34,7 @@ pub struct SyncProcessor {
     sync_writer: QWriter<SyncSignal>,
     async_writer: QWriter<AsyncSignal>,
     server_writer: QWriter<ServerSignal>,
+    trace: bool,
 }
 
 impl PartialEq for SyncSignal {
@@ -36,6 +42,7 @@ impl PartialEq for SyncSignal {
         match (self, other) {
             (SyncSignal::UpdateGraph, SyncSignal::UpdateGraph) => true,
             (SyncSignal::KeyPress(t1, _), SyncSignal::KeyPress(t2, _)) => t1 == t2,
+            (SyncSignal::KeyRelease(t1, _), SyncSignal::KeyRelease(t2, _)) => t1 == t2,
             (SyncSignal::Emit(_, _), SyncSignal::Emit(_, _)) => false,
             (SyncSignal::Repaint, SyncSignal::Repaint) => true,
             (SyncSignal::Finish, SyncSignal::Finish) => true,
@@ -55,8 +62,13 @@ impl From<Signal> for SyncSignal {
 impl SyncProcessor {
     pub fn spawn(
         block: &Block,
+        tree: Box<dyn Action>,
+        state: State,
         env: &Env,
+        info: &Info,
+        run_dir: &Path,
         config: &Config,
+        res_manager: &ResourceManager,
         ctx: &egui::Context,
         async_writer: &QWriter<AsyncSignal>,
         server_writer: &QWriter<ServerSignal>,
@@ -65,7 +77,7 @@ impl SyncProcessor {
         let sync_writer = sync_reader.writer();
         let atomic = Arc::new(Mutex::new((
             Box::new(StatefulNil::new()) as Box<dyn StatefulAction>,
-            block.default_state().clone(),
+            state,
         )));
         let mut proc = Self {
             ctx: ctx.clone(),
@@ -74,6 +86,7 @@ impl SyncProcessor {
             sync_writer,
             async_writer: async_writer.clone(),
             server_writer: server_writer.clone(),
+            trace: config.trace(),
         };
 
         let sync_writer = proc.sync_writer.clone();
@@ -81,9 +94,14 @@ impl SyncProcessor {
 
         let env = env.clone();
         let config = config.clone();
-        let tree = block.action_tree_vec();
-        let resources = block.resources(&config);
+        let resources = tree.resources(&config);
+        let tree = to_vec_packed(&tree).unwrap();
         let tex_manager = ctx.tex_manager();
+        let mut res_manager = res_manager.clone();
+        let generators = block.generators().to_vec();
+        let generated = run_dir.join("generated");
+        let subject = info.subject().clone();
+        let block_name = block.label().to_owned();
 
         thread::spawn(move || {
             let io_manager = match IoManager::new(&config) {
@@ -98,19 +116,27 @@ impl SyncProcessor {
                 }
             };
 
-            let mut res_manager = match ResourceManager::new(&config) {
-                Ok(r) => r,
-                Err(e) => {
-                    proc.server_writer.push(ServerSignal::BlockCrashed(
-                        e.wrap_err("Failed to initialize resource manager."),
-                    ));
-                    proc.server_writer.push(ServerSignal::SyncComplete(Ok(())));
-                    proc.ctx.request_repaint();
-                    return;
+            if !generators.is_empty() {
+                match run_generators(&generators, &env, &subject, &block_name, &generated) {
+                    Ok(entries) => {
+                        proc.async_writer
+                            .push(LoggerSignal::Extend("main".to_owned(), entries));
+                    }
+                    Err(e) => {
+                        proc.server_writer.push(ServerSignal::BlockCrashed(
+                            e.wrap_err("Failed to generate resources for block."),
+                        ));
+                        proc.server_writer.push(ServerSignal::SyncComplete(Ok(())));
+                        proc.ctx.request_repaint();
+                        return;
+                    }
                 }
-            };
+            }
 
-            if let Err(e) = res_manager.preload_block(resources, tex_manager, &config, &env) {
+            let generated = Some(generated.as_path()).filter(|_| !generators.is_empty());
+            if let Err(e) =
+                res_manager.preload_block(resources, tex_manager, &config, &env, generated)
+            {
                 proc.server_writer.push(ServerSignal::BlockCrashed(
                     e.wrap_err("Failed to load resources for block."),
                 ));
@@ -131,13 +157,20 @@ impl SyncProcessor {
                 }
             };
 
-            let tree = match tree.stateful(
-                &io_manager,
-                &res_manager,
-                &config,
-                &proc.sync_writer,
-                &proc.async_writer,
-            ) {
+            // Every action of the tree (including the root) registers its subscriptions with the
+            // same routing index, so signals that no action subscribes to stop at the root
+            let routes = SharedRoutes::default();
+            let tree = {
+                let _routing = Scope::routing(&routes);
+                tree.routed(
+                    &io_manager,
+                    &res_manager,
+                    &config,
+                    &proc.sync_writer,
+                    &proc.async_writer,
+                )
+            };
+            let tree = match tree {
                 Ok(t) => t,
                 Err(e) => {
                     proc.server_writer.push(ServerSignal::BlockCrashed(
@@ -168,6 +201,10 @@ impl SyncProcessor {
                 return;
             }
 
+            // Signals received while the block is paused, to be processed once it resumes
+            let mut paused = false;
+            let mut held: VecDeque<SyncSignal> = VecDeque::new();
+
             'mainloop: while let Ok(signals) = proc.sync_reader.poll() {
                 let mut n_signal = signals.len();
                 let mut signals = VecDeque::from(signals);
@@ -175,6 +212,29 @@ impl SyncProcessor {
                     #[cfg(debug_assertions)]
                     println!("{signal:?}");
 
+                    let signal = match signal {
+                        SyncSignal::Pause => {
+                            paused = true;
+                            continue;
+                        }
+                        SyncSignal::Resume => {
+                            paused = false;
+                            n_signal += held.len();
+                            while let Some(signal) = held.pop_back() {
+                                signals.push_front(signal);
+                            }
+                            continue;
+                        }
+                        SyncSignal::Error(_) | SyncSignal::Repaint | SyncSignal::Finish => signal,
+                        signal if paused => {
+                            if !held.contains(&signal) {
+                                held.push_back(signal);
+                            }
+                            continue;
+                        }
+                        signal => signal,
+                    };
+
                     let news = match signal {
                         SyncSignal::UpdateGraph => {
                             let (tree, state) = &mut *proc.atomic.lock().unwrap();
@@ -196,17 +256,44 @@ impl SyncProcessor {
                             )
                             .wrap_err("Failed to process key press.")
                         }
+                        SyncSignal::KeyRelease(time, keys) => {
+                            let (tree, state) = &mut *proc.atomic.lock().unwrap();
+                            tree.update(
+                                &ActionSignal::KeyRelease(time, keys),
+                                &mut proc.sync_writer,
+                                &mut proc.async_writer,
+                                state,
+                            )
+                            .wrap_err("Failed to process key release.")
+                        }
                         SyncSignal::Emit(time, signal) => {
                             let (tree, state) = &mut *proc.atomic.lock().unwrap();
 
                             let mut changed = BTreeSet::new();
+                            let mut trace = vec![];
                             for (k, v) in signal.into_iter() {
                                 if k > 0 {
+                                    if proc.trace {
+                                        trace.push((
+                                            "signal".to_owned(),
+                                            Value::Array(vec![
+                                                Value::Integer(k as i128),
+                                                v.clone(),
+                                            ]),
+                                        ));
+                                    }
                                     state.insert(k, v);
                                     changed.insert(k);
                                 }
                             }
 
+                            if !trace.is_empty() {
+                                proc.async_writer.push(AsyncSignal::Logger(
+                                    time,
+                                    LoggerSignal::Extend("trace".to_owned(), trace),
+                                ));
+                            }
+
                             tree.update(
                                 &ActionSignal::StateChanged(time, changed),
                                 &mut proc.sync_writer,
@@ -221,7 +308,9 @@ impl SyncProcessor {
                             Ok(Signal::none())
                         }
                         SyncSignal::Finish => break 'mainloop,
-                        SyncSignal::Go => Ok(Signal::none()),
+                        SyncSignal::Go | SyncSignal::Pause | SyncSignal::Resume => {
+                            Ok(Signal::none())
+                        }
                     };
 
                     let news = match news {
@@ -1,12 +1,14 @@
+use crate::action::core::template::Template;
 use crate::action::Action;
 use crate::comm::SignalId;
-use crate::resource::ResourceAddr;
-use crate::server::{config::OptionalConfig, Config, State};
-use crate::util::Hash;
-use eyre::{eyre, Result};
+use crate::resource::{Generator, ResourceAddr};
+use crate::server::{config::OptionalConfig, param_text, BlockParam, Config, Requirements, State};
+use crate::util::{canonical, canonical_action, canonical_hash, Hash};
+use eyre::{eyre, Context, Result};
+use once_cell::sync::OnceCell;
 use serde::{Deserialize, Serialize};
 use serde_cbor::ser::to_vec_packed;
-use serde_cbor::Value;
+use serde_cbor::{from_slice, Value};
 use std::collections::BTreeMap;
 
 #[derive(Deserialize, Serialize, Debug)]
@@ -18,11 +20,27 @@ pub struct Block {
     tree: Box<dyn Action>,
     #[serde(default)]
     state: BTreeMap<SignalId, Value>,
+    #[serde(default)]
+    generators: Vec<Generator>,
+    #[serde(default)]
+    requires: Requirements,
+    #[serde(default)]
+    params: Vec<BlockParam>,
+    #[serde(skip)]
+    expanded: Option<Box<dyn Action>>,
+    #[serde(skip)]
+    canonical_hash: OnceCell<String>,
 }
 
 impl Block {
     pub fn init(&mut self) -> Result<()> {
         self.verify_name()?;
+        self.verify_params()?;
+        let defaults: Vec<_> = self.params.iter().map(|p| (p, p.default_value())).collect();
+        self.expanded = Some(
+            self.expand(&defaults)
+                .wrap_err("Failed to expand templates with the default block params.")?,
+        );
         self.verify_connections()?;
         Ok(())
     }
@@ -44,9 +62,23 @@ impl Block {
         }
     }
 
+    fn verify_params(&self) -> Result<()> {
+        for (i, param) in self.params.iter().enumerate() {
+            param.verify()?;
+            if self.params[..i].iter().any(|p| p.name() == param.name()) {
+                return Err(eyre!("Duplicate block parameter name: `{}`", param.name()));
+            }
+        }
+
+        Ok(())
+    }
+
     fn verify_connections(&self) -> Result<()> {
-        let mut in_signals = self.tree.in_signals();
-        let mut out_signals = self.tree.out_signals();
+        let mut in_signals = self.action_tree().in_signals();
+        let mut out_signals = self.action_tree().out_signals();
+
+        // Parameters are set by the experimenter before the block starts
+        out_signals.extend(self.params.iter().map(|p| p.signal()));
 
         in_signals.insert(0);
         out_signals.insert(0);
@@ -64,17 +96,26 @@ impl Block {
     }
 
     pub fn resources(&self, config: &Config) -> Vec<ResourceAddr> {
-        self.tree.resources(config)
+        self.action_tree().resources(config)
     }
 
+    /// Action tree with templates expanded using the default block params.
     #[inline(always)]
     pub fn action_tree(&self) -> &dyn Action {
-        &*self.tree
+        &**self.expanded.as_ref().unwrap_or(&self.tree)
     }
 
-    #[inline(always)]
-    pub fn action_tree_vec(&self) -> Vec<u8> {
-        to_vec_packed(&self.tree).unwrap()
+    /// Action tree with the placeholders in its templates that are left open by the template
+    /// `params` filled with the values chosen for the block params.
+    pub fn expand(&self, params: &[(&BlockParam, Value)]) -> Result<Box<dyn Action>> {
+        let values = params
+            .iter()
+            .map(|(p, v)| (p.name().to_owned(), param_text(v)))
+            .collect();
+
+        let _filling = Template::filling(values);
+        let tree = to_vec_packed(&self.tree).wrap_err("Failed to serialize action tree.")?;
+        from_slice::<Box<dyn Action>>(&tree).wrap_err("Failed to expand action tree.")
     }
 
     #[inline(always)]
@@ -82,6 +123,21 @@ impl Block {
         &self.state
     }
 
+    #[inline(always)]
+    pub fn params(&self) -> &[BlockParam] {
+        &self.params
+    }
+
+    #[inline(always)]
+    pub fn generators(&self) -> &[Generator] {
+        &self.generators
+    }
+
+    #[inline(always)]
+    pub fn requires(&self) -> &Requirements {
+        &self.requires
+    }
+
     #[inline(always)]
     pub fn label(&self) -> &str {
         &self.name
@@ -91,13 +147,154 @@ impl Block {
     pub fn config(&self, base_config: &Config) -> Config {
         self.config.fill_blanks(base_config)
     }
+
+    /// Hash of the normalized block content (see [`canonical`]), which stays the same across
+    /// versions that only add defaulted attributes or reorder fields. It is computed once, when
+    /// it is first needed.
+    pub fn canonical_hash(&self) -> Result<String> {
+        self.canonical_hash
+            .get_or_try_init(|| self.compute_canonical_hash())
+            .cloned()
+    }
+
+    fn compute_canonical_hash(&self) -> Result<String> {
+        let mut content = BTreeMap::from([
+            (
+                Value::Text("tree".to_owned()),
+                canonical_action(self.action_tree())?,
+            ),
+            (Value::Text("config".to_owned()), canonical(&self.config)?),
+        ]);
+        if !self.generators.is_empty() {
+            content.insert(
+                Value::Text("generators".to_owned()),
+                canonical(&self.generators)?,
+            );
+        }
+
+        Ok(canonical_hash(&Value::Map(content)))
+    }
 }
 
 impl Hash for Block {
     fn hash(&self) -> String {
         use sha2::{Digest, Sha256};
+        let tree = self.expanded.as_ref().unwrap_or(&self.tree);
         let mut hasher = Sha256::default();
-        hasher.update(&serde_cbor::to_vec(&(&self.tree, &self.config)).unwrap());
+        if self.generators.is_empty() {
+            hasher.update(&serde_cbor::to_vec(&(tree, &self.config)).unwrap());
+        } else {
+            hasher.update(&serde_cbor::to_vec(&(tree, &self.config, &self.generators)).unwrap());
+        }
         hex::encode(hasher.finalize())
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::server::ROOT_DIR;
+
+    fn template(name: &str, content: &str) -> String {
+        let root = ROOT_DIR
+            .get_or_init(|| std::env::temp_dir().join(format!("cog_block_{}", std::process::id())));
+        std::fs::create_dir_all(root).unwrap();
+        std::fs::write(root.join(name), content).unwrap();
+        format!("template((src: \"{name}\"))")
+    }
+
+    fn block(tree: &str, params: &str) -> Result<Block> {
+        let mut block: Block = ron::from_str(&format!(
+            "(name: \"Block\", tree: {tree}, params: [{params}])"
+        ))
+        .unwrap();
+        block.init().map(|_| block)
+    }
+
+    fn text(tree: &dyn Action) -> String {
+        format!("{tree:?}")
+    }
+
+    #[test]
+    fn params_fill_template_placeholders() {
+        let tree = template("level.ron", "instruction((text: \"Level ${level}\"))");
+        let block = block(
+            &tree,
+            "(name: \"level\", kind: int(min: 1, max: 3, default: 1))",
+        )
+        .unwrap();
+        assert!(text(block.action_tree()).contains("Level 1"));
+
+        let chosen = [(&block.params()[0], Value::Integer(3))];
+        let tree = block.expand(&chosen).unwrap();
+        assert!(text(&*tree).contains("Level 3"));
+        assert!(text(block.action_tree()).contains("Level 1"));
+    }
+
+    #[test]
+    fn template_params_come_first() {
+        let tree = template("fixed.ron", "instruction((text: \"Level ${level}\"))")
+            .replace("))", ", params: {\"level\": \"2\"}))");
+        let block = block(
+            &tree,
+            "(name: \"level\", kind: int(min: 1, max: 3, default: 1))",
+        )
+        .unwrap();
+        let chosen = [(&block.params()[0], Value::Integer(3))];
+        assert!(text(&*block.expand(&chosen).unwrap()).contains("Level 2"));
+    }
+
+    #[test]
+    fn other_placeholders_are_kept() {
+        // Left for actions that fill them from the state (e.g., through `in_mapping`)
+        let tree = template(
+            "state.ron",
+            "instruction((text: \"Score ${score}\", in_mapping: { 10: \"score\" }))",
+        );
+        let block = block(
+            &tree,
+            "(name: \"level\", signal: 10, kind: int(min: 1, max: 3, default: 1))",
+        );
+        assert!(text(block.unwrap().action_tree()).contains("Score ${score}"));
+    }
+
+    #[test]
+    fn placeholders_need_a_value() {
+        let tree = template("duration.ron", "wait(${duration})");
+        assert!(block(&tree, "").is_err());
+        let block = block(
+            &tree,
+            "(name: \"duration\", kind: float(min: 0.0, max: 2.0, default: 0.5))",
+        )
+        .unwrap();
+        assert!(text(block.action_tree()).contains("0.5"));
+    }
+
+    #[test]
+    fn param_names_are_unique() {
+        let kind = "kind: bool(false)";
+        assert!(block(
+            "nil(())",
+            &format!("(name: \"level\", {kind}), (name: \"level\", {kind})")
+        )
+        .is_err());
+    }
+
+    #[test]
+    fn legacy_hash_is_stable() {
+        // Hash of this block before any optional config keys were added; checksums on file
+        // depend on unset keys not being serialized.
+        let block: Block = ron::from_str("(name: \"Block\", tree: nil(()))").unwrap();
+        assert_eq!(
+            block.hash(),
+            "6712fea129b3e134a0175353ce2914cec373ff72fe410a670faf6bf4617a8b4c"
+        );
+
+        let block: Block =
+            ron::from_str("(name: \"Block\", config: (trace: Some(true)), tree: nil(()))").unwrap();
+        assert_ne!(
+            block.hash(),
+            "6712fea129b3e134a0175353ce2914cec373ff72fe410a670faf6bf4617a8b4c"
+        );
+    }
+}
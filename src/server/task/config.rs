@@ -1,8 +1,13 @@
 use crate::resource::{
-    AudioBackend, Color, Interpreter, LogFormat, StreamBackend, TimePrecision, UseTrigger, Volume,
+    AudioBackend, Color, Interpreter, KeyboardLayout, LogFormat, OutputDevice, StreamBackend,
+    TimePrecision, UseTrigger, Volume,
 };
-use eyre::{eyre, Result};
+use crate::server::{MonitorConfig, UploadTarget};
+use crate::util::Hash;
+use eyre::{eyre, Context, Result};
 use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::path::PathBuf;
 
 #[derive(Debug, Default, Clone, Deserialize, Serialize)]
 #[serde(deny_unknown_fields)]
@@ -28,8 +33,35 @@ pub struct Config {
     stream_backend: StreamBackend,
     #[serde(default = "defaults::background")]
     background: Color,
+    #[serde(default)]
+    columnar: Vec<String>,
+    #[serde(default)]
+    resolution: Option<(u32, u32)>,
+    #[serde(default)]
+    refresh_rate: Option<f64>,
+    #[serde(default)]
+    vsync: bool,
+    #[serde(default)]
+    audio_devices: BTreeMap<String, OutputDevice>,
+    #[serde(default)]
+    audio_fallback: bool,
+    #[serde(default)]
+    #[serde(skip_serializing)]
+    upload: Option<UploadTarget>,
+    #[serde(default)]
+    keyboard_layout: Option<KeyboardLayout>,
+    #[serde(default)]
+    monitor: Option<MonitorConfig>,
+    #[serde(default)]
+    mirror_output: Option<PathBuf>,
+    #[serde(default)]
+    trace: bool,
 }
 
+/// Environment variable that overrides the `keyboard_layout` of the task on a given machine, so
+/// the same task can be run on sites with different keyboards without modifying it.
+pub const KEYBOARD_LAYOUT_ENV: &str = "COG_KEYBOARD_LAYOUT";
+
 mod defaults {
     use crate::resource::{
         AudioBackend, Color, Interpreter, LogFormat, StreamBackend, TimePrecision, UseTrigger,
@@ -112,6 +144,23 @@ impl Config {
         self.audio_backend = self.audio_backend.or(&defaults::audio_backend());
         self.stream_backend = self.stream_backend.or(&defaults::stream_backend());
         self.background = self.background.or(&defaults::background());
+
+        #[cfg(not(feature = "arrow"))]
+        if !self.columnar.is_empty() {
+            return Err(eyre!("Columnar log groups require the `arrow` feature."));
+        }
+
+        if let Ok(layout) = std::env::var(KEYBOARD_LAYOUT_ENV) {
+            self.keyboard_layout = Some(ron::from_str(&layout).wrap_err_with(|| {
+                format!("Invalid keyboard layout in `{KEYBOARD_LAYOUT_ENV}`: {layout:?}")
+            })?);
+        }
+
+        #[cfg(not(feature = "upload"))]
+        if self.upload.is_some() {
+            return Err(eyre!("Uploading runs requires the `upload` feature."));
+        }
+
         Ok(())
     }
 
@@ -125,15 +174,33 @@ impl Config {
         self.use_trigger
     }
 
-    pub fn verify_checksum(&self, task: String) -> Result<()> {
-        if let Some(checksum) = self.verify_sha2.as_ref() {
-            if checksum != &task {
-                return Err(eyre!(
-                    "Checksum of this task does not match the one on file.\n\
-                    Current: {task}\n\
-                    On file: {checksum}"
-                ));
-            }
+    /// Accepts the checksum on file if it matches the task hash under any of the supported schemes
+    /// (the legacy hash, or the versioned canonical hash). The canonical hash is only computed if
+    /// a checksum is on file and the legacy hash does not match it.
+    pub fn verify_checksum(
+        &self,
+        legacy: String,
+        canonical: impl FnOnce() -> Result<String>,
+    ) -> Result<()> {
+        let checksum = match self.verify_sha2.as_ref() {
+            Some(checksum) if checksum != &legacy => checksum,
+            _ => return Ok(()),
+        };
+
+        let canonical = canonical().wrap_err_with(|| {
+            format!(
+                "Checksum of this task does not match the one on file, and its canonical hash \
+                could not be computed.\n\
+                Current: {legacy}\n\
+                On file: {checksum}"
+            )
+        })?;
+        if &canonical != checksum {
+            return Err(eyre!(
+                "Checksum of this task does not match the one on file.\n\
+                Current: {legacy} / {canonical}\n\
+                On file: {checksum}"
+            ));
         }
         Ok(())
     }
@@ -172,8 +239,67 @@ impl Config {
     pub fn background(&self) -> Color {
         self.background
     }
+
+    #[inline(always)]
+    pub fn columnar(&self) -> &Vec<String> {
+        &self.columnar
+    }
+
+    #[inline(always)]
+    pub fn resolution(&self) -> Option<(u32, u32)> {
+        self.resolution
+    }
+
+    #[inline(always)]
+    pub fn refresh_rate(&self) -> Option<f64> {
+        self.refresh_rate
+    }
+
+    #[inline(always)]
+    pub fn vsync(&self) -> bool {
+        self.vsync
+    }
+
+    #[inline(always)]
+    pub fn audio_devices(&self) -> &BTreeMap<String, OutputDevice> {
+        &self.audio_devices
+    }
+
+    #[inline(always)]
+    pub fn audio_fallback(&self) -> bool {
+        self.audio_fallback
+    }
+
+    #[inline(always)]
+    pub fn upload(&self) -> Option<&UploadTarget> {
+        self.upload.as_ref()
+    }
+
+    /// Keyboard layout of the machine, if set in the task config or with `COG_KEYBOARD_LAYOUT`.
+    /// Physical key positions are derived from it, so they are only available if it is set.
+    #[inline(always)]
+    pub fn keyboard_layout(&self) -> Option<KeyboardLayout> {
+        self.keyboard_layout
+    }
+
+    #[inline(always)]
+    pub fn monitor(&self) -> Option<&MonitorConfig> {
+        self.monitor.as_ref()
+    }
+
+    #[inline(always)]
+    pub fn mirror_output(&self) -> Option<&PathBuf> {
+        self.mirror_output.as_ref()
+    }
+
+    #[inline(always)]
+    pub fn trace(&self) -> bool {
+        self.trace
+    }
 }
 
+impl Hash for Config {}
+
 #[derive(Debug, Default, Clone, Copy, Deserialize, Serialize)]
 #[serde(deny_unknown_fields)]
 pub struct OptionalConfig {
@@ -193,6 +319,9 @@ pub struct OptionalConfig {
     stream_backend: StreamBackend,
     #[serde(default)]
     background: Color,
+    #[serde(default)]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    trace: Option<bool>,
 }
 
 impl OptionalConfig {
@@ -206,6 +335,53 @@ impl OptionalConfig {
         config.audio_backend = self.audio_backend.or(&config.audio_backend);
         config.stream_backend = self.stream_backend.or(&config.stream_backend);
         config.background = self.background.or(&config.background);
+        config.trace = self.trace.unwrap_or(base_config.trace);
         config
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn config(verify_sha2: Option<&str>) -> Config {
+        Config {
+            verify_sha2: verify_sha2.map(|s| s.to_owned()),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn canonical_hash_is_not_computed_without_checksum() {
+        let canonical = || -> Result<String> { panic!("canonical hash was computed") };
+        assert!(config(None)
+            .verify_checksum("legacy".to_owned(), canonical)
+            .is_ok());
+        assert!(config(Some("legacy"))
+            .verify_checksum("legacy".to_owned(), canonical)
+            .is_ok());
+    }
+
+    #[test]
+    fn checksum_matches_either_hash() {
+        let config = config(Some("v2:abc"));
+        assert!(config
+            .verify_checksum("legacy".to_owned(), || Ok("v2:abc".to_owned()))
+            .is_ok());
+        assert!(config
+            .verify_checksum("legacy".to_owned(), || Ok("v2:def".to_owned()))
+            .is_err());
+        assert!(config
+            .verify_checksum("legacy".to_owned(), || Err(eyre!("unsupported")))
+            .is_err());
+    }
+
+    #[test]
+    fn block_config_overrides_trace() {
+        let base = Config::default();
+        let block: OptionalConfig = ron::from_str("(trace: Some(true))").unwrap();
+        assert!(!base.trace());
+        assert!(block.fill_blanks(&base).trace());
+        assert!(!OptionalConfig::default().fill_blanks(&base).trace());
+    }
+}
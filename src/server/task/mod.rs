@@ -1,10 +1,14 @@
 pub mod block;
 pub mod config;
+pub mod param;
+pub mod requirement;
 
 pub use block::Block;
-pub use config::Config;
+pub use config::{Config, KEYBOARD_LAYOUT_ENV};
+pub use param::*;
+pub use requirement::Requirements;
 
-use crate::util::Hash;
+use crate::util::{Hash, CANONICAL_VERSION};
 use crate::verify_features;
 use eyre::{eyre, Context, Result};
 use itertools::Itertools;
@@ -26,6 +30,10 @@ pub struct Task {
     config: Config,
     #[serde(default)]
     description: String,
+    #[serde(default)]
+    requires: Requirements,
+    #[serde(skip)]
+    canonical_hash: OnceCell<String>,
 }
 
 impl Task {
@@ -66,7 +74,8 @@ impl Task {
         }
 
         self.config.init()?;
-        self.config.verify_checksum(self.hash())?;
+        self.config
+            .verify_checksum(self.hash(), || self.canonical_hash())?;
         BASE_CFG.set(self.config.clone()).unwrap();
 
         Ok(self)
@@ -97,6 +106,11 @@ impl Task {
         &self.blocks[i]
     }
 
+    #[inline(always)]
+    pub fn blocks(&self) -> &[Block] {
+        &self.blocks
+    }
+
     pub fn block_labels(&self) -> Vec<String> {
         self.blocks.iter().map(|b| b.label().to_string()).collect()
     }
@@ -105,6 +119,38 @@ impl Task {
     pub fn description(&self) -> &str {
         &self.description
     }
+
+    #[inline(always)]
+    pub fn requires(&self) -> &Requirements {
+        &self.requires
+    }
+
+    /// Hash of the canonical block hashes, prefixed with the version of the hashing scheme. It is
+    /// computed once, when it is first needed.
+    pub fn canonical_hash(&self) -> Result<String> {
+        self.canonical_hash
+            .get_or_try_init(|| self.compute_canonical_hash())
+            .cloned()
+    }
+
+    fn compute_canonical_hash(&self) -> Result<String> {
+        use sha2::{Digest, Sha256};
+        let mut blocks = vec![];
+        for block in self.blocks.iter() {
+            blocks.push(
+                block
+                    .canonical_hash()
+                    .wrap_err_with(|| eyre!("Failed to hash block ({}).", block.label()))?,
+            );
+        }
+
+        let mut hasher = Sha256::default();
+        hasher.update(&serde_cbor::to_vec(&blocks).unwrap());
+        Ok(format!(
+            "{CANONICAL_VERSION}:{}",
+            hex::encode(hasher.finalize())
+        ))
+    }
 }
 
 impl Hash for Task {
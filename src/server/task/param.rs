@@ -0,0 +1,154 @@
+use crate::comm::SignalId;
+use eyre::{eyre, Result};
+use serde::{Deserialize, Serialize};
+use serde_cbor::Value;
+
+/// Parameter of a block that the experimenter chooses on the selection page before starting it,
+/// e.g., `(name: "difficulty", signal: 10, kind: int(min: 1, max: 5, default: 3))`. The chosen
+/// value seeds `signal` in the initial state of the block (unless it is 0), and all values are
+/// logged as `params` in the main log. Templates are expanded with the chosen values when the
+/// block starts, so params also fill the `${name}` placeholders that template `params` leave open.
+#[derive(Debug, Clone, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct BlockParam {
+    name: String,
+    #[serde(default)]
+    signal: SignalId,
+    #[serde(default)]
+    label: Option<String>,
+    kind: ParamKind,
+}
+
+/// Type, range, and default value of a block parameter.
+#[derive(Debug, Clone, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum ParamKind {
+    Int {
+        min: i64,
+        max: i64,
+        default: i64,
+    },
+    Float {
+        min: f64,
+        max: f64,
+        default: f64,
+    },
+    Choice {
+        options: Vec<String>,
+        default: String,
+    },
+    Bool(bool),
+}
+
+impl BlockParam {
+    pub fn verify(&self) -> Result<()> {
+        if self.name.is_empty() {
+            return Err(eyre!("Block parameter `name` cannot be the empty string."));
+        }
+
+        let valid = match &self.kind {
+            ParamKind::Int { min, max, default } => min <= max && (min..=max).contains(&default),
+            ParamKind::Float { min, max, default } => min <= max && (min..=max).contains(&default),
+            ParamKind::Choice { options, default } => options.contains(default),
+            ParamKind::Bool(_) => true,
+        };
+
+        if valid {
+            Ok(())
+        } else {
+            Err(eyre!(
+                "Default value of block parameter `{}` is out of its range: {:?}",
+                self.name,
+                self.kind
+            ))
+        }
+    }
+
+    #[inline(always)]
+    pub fn name(&self) -> &str {
+        &self.name
+    }
+
+    #[inline(always)]
+    pub fn signal(&self) -> SignalId {
+        self.signal
+    }
+
+    #[inline(always)]
+    pub fn label(&self) -> &str {
+        self.label.as_deref().unwrap_or(&self.name)
+    }
+
+    #[inline(always)]
+    pub fn kind(&self) -> &ParamKind {
+        &self.kind
+    }
+
+    pub fn default_value(&self) -> Value {
+        match &self.kind {
+            ParamKind::Int { default, .. } => Value::Integer(*default as i128),
+            ParamKind::Float { default, .. } => Value::Float(*default),
+            ParamKind::Choice { default, .. } => Value::Text(default.clone()),
+            ParamKind::Bool(default) => Value::Bool(*default),
+        }
+    }
+}
+
+/// Short text form of a parameter value, as shown to the experimenter.
+pub fn param_text(value: &Value) -> String {
+    match value {
+        Value::Integer(v) => v.to_string(),
+        Value::Float(v) => v.to_string(),
+        Value::Text(v) => v.clone(),
+        Value::Bool(v) => v.to_string(),
+        v => format!("{v:?}"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn param(kind: &str) -> BlockParam {
+        ron::from_str(&format!("(name: \"level\", kind: {kind})")).unwrap()
+    }
+
+    #[test]
+    fn defaults_must_be_in_range() {
+        assert!(param("int(min: 1, max: 5, default: 3)").verify().is_ok());
+        assert!(param("int(min: 1, max: 5, default: 6)").verify().is_err());
+        assert!(param("int(min: 5, max: 1, default: 3)").verify().is_err());
+        assert!(param("float(min: 0.0, max: 1.0, default: 1.0)")
+            .verify()
+            .is_ok());
+        assert!(param("choice(options: [\"a\", \"b\"], default: \"c\")")
+            .verify()
+            .is_err());
+        assert!(param("bool(true)").verify().is_ok());
+    }
+
+    #[test]
+    fn name_cannot_be_empty() {
+        let param: BlockParam = ron::from_str("(name: \"\", kind: bool(false))").unwrap();
+        assert!(param.verify().is_err());
+    }
+
+    #[test]
+    fn label_defaults_to_name() {
+        assert_eq!(param("bool(false)").label(), "level");
+        let param: BlockParam =
+            ron::from_str("(name: \"level\", label: Some(\"Level\"), kind: bool(false))").unwrap();
+        assert_eq!(param.label(), "Level");
+        assert_eq!(param.signal(), 0);
+    }
+
+    #[test]
+    fn default_values_and_text() {
+        let value = param("int(min: 1, max: 5, default: 3)").default_value();
+        assert_eq!(value, Value::Integer(3));
+        assert_eq!(param_text(&value), "3");
+        let value = param("choice(options: [\"a\", \"b\"], default: \"b\")").default_value();
+        assert_eq!(param_text(&value), "b");
+        assert_eq!(param_text(&param("bool(true)").default_value()), "true");
+    }
+}
@@ -0,0 +1,217 @@
+use crate::resource::{verify_python_module, AudioDevice, OutputDevice};
+use crate::server::Config;
+use serde::{Deserialize, Serialize};
+use std::path::PathBuf;
+
+/// Runtime requirements of a task or block. Unlike the `//@ feature` header, which only checks the
+/// features the binaries were compiled with, these are checked against the machine the task is
+/// running on before each block is started:
+/// - `resolution`: minimum screen resolution (width, height) in physical pixels.
+/// - `refresh_rate`: minimum refresh rate (Hz), measured over the last frames with vsync enabled.
+/// - `audio_channels`: minimum number of channels of the default audio output device.
+/// - `audio_devices`: output devices that need to be available, either by their name in the
+///   `audio_devices` config or by (part of) their system name.
+/// - `devices`: paths of devices that need to be present (e.g., `/dev/ttyUSB0` for a serial port).
+/// - `python_modules`: modules that need to be importable by the python interpreter.
+#[derive(Debug, Default, Clone, Deserialize, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Requirements {
+    #[serde(default)]
+    resolution: Option<(u32, u32)>,
+    #[serde(default)]
+    refresh_rate: Option<f64>,
+    #[serde(default)]
+    audio_channels: Option<u16>,
+    #[serde(default)]
+    audio_devices: Vec<String>,
+    #[serde(default)]
+    devices: Vec<PathBuf>,
+    #[serde(default)]
+    python_modules: Vec<String>,
+}
+
+/// Refresh rates within this distance (Hz) of the required rate are accepted.
+const REFRESH_TOLERANCE: f64 = 1.0;
+
+impl Requirements {
+    /// Requirements of both `self` and `other`, taking the stricter value when both set one.
+    pub fn and(&self, other: &Self) -> Self {
+        Self {
+            resolution: match (self.resolution, other.resolution) {
+                (Some(a), Some(b)) => Some((a.0.max(b.0), a.1.max(b.1))),
+                (a, b) => a.or(b),
+            },
+            refresh_rate: match (self.refresh_rate, other.refresh_rate) {
+                (Some(a), Some(b)) => Some(a.max(b)),
+                (a, b) => a.or(b),
+            },
+            audio_channels: match (self.audio_channels, other.audio_channels) {
+                (Some(a), Some(b)) => Some(a.max(b)),
+                (a, b) => a.or(b),
+            },
+            audio_devices: union(&self.audio_devices, &other.audio_devices),
+            devices: union(&self.devices, &other.devices),
+            python_modules: union(&self.python_modules, &other.python_modules),
+        }
+    }
+
+    #[inline(always)]
+    pub fn refresh_rate(&self) -> Option<f64> {
+        self.refresh_rate
+    }
+
+    /// Checks the requirements that do not depend on the display, and returns a message for each
+    /// one that is not met. These are relatively slow (e.g., opening audio devices), so the result
+    /// should be cached when shown repeatedly.
+    pub fn check_system(&self, config: &Config) -> Vec<String> {
+        let mut unmet = vec![];
+
+        if let Some(channels) = self.audio_channels {
+            match AudioDevice::new(config) {
+                Ok(device) if device.channels() >= channels => {}
+                Ok(device) => unmet.push(format!(
+                    "Requires an audio output with at least {channels} channels \
+                    (default device has {}).",
+                    device.channels()
+                )),
+                Err(e) => unmet.push(format!(
+                    "Requires an audio output with at least {channels} channels \
+                    (failed to open default device: {e:#})."
+                )),
+            }
+        }
+
+        for name in self.audio_devices.iter() {
+            let output = match config.audio_devices().get(name) {
+                Some(output) => output.clone(),
+                None => OutputDevice::Named(name.clone()),
+            };
+            if let Err(e) = AudioDevice::open(&output, config) {
+                unmet.push(format!("Requires audio device `{name}` ({e:#})."));
+            }
+        }
+
+        for path in self.devices.iter() {
+            if !path.exists() {
+                unmet.push(format!("Requires device {path:?}, which is not present."));
+            }
+        }
+
+        for module in self.python_modules.iter() {
+            if let Err(e) = verify_python_module(module) {
+                unmet.push(format!("Requires python module `{module}` ({e:#})."));
+            }
+        }
+
+        unmet
+    }
+
+    /// Checks the display requirements against the current resolution and the refresh rate measured
+    /// over the last frames (`None` if there are not enough frames yet).
+    pub fn check_display(
+        &self,
+        config: &Config,
+        resolution: (u32, u32),
+        rate: Option<f64>,
+    ) -> Vec<String> {
+        let mut unmet = vec![];
+
+        if let Some((w, h)) = self.resolution {
+            if resolution.0 < w || resolution.1 < h {
+                unmet.push(format!(
+                    "Requires a resolution of at least {w}x{h} px (current: {}x{} px).",
+                    resolution.0, resolution.1
+                ));
+            }
+        }
+
+        if let Some(expected) = self.refresh_rate {
+            match rate {
+                _ if !config.vsync() => unmet.push(format!(
+                    "Requires a refresh rate of at least {expected:.1} Hz, \
+                    which can only be verified with `vsync` enabled."
+                )),
+                None => unmet.push(format!(
+                    "Requires a refresh rate of at least {expected:.1} Hz (still measuring)."
+                )),
+                Some(rate) if rate + REFRESH_TOLERANCE < expected => unmet.push(format!(
+                    "Requires a refresh rate of at least {expected:.1} Hz \
+                    (measured: {rate:.1} Hz)."
+                )),
+                Some(_) => {}
+            }
+        }
+
+        unmet
+    }
+}
+
+fn union<T: Clone + PartialEq>(a: &[T], b: &[T]) -> Vec<T> {
+    let mut items = a.to_vec();
+    for item in b {
+        if !items.contains(item) {
+            items.push(item.clone());
+        }
+    }
+    items
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn requirements(s: &str) -> Requirements {
+        ron::from_str(s).unwrap()
+    }
+
+    #[test]
+    fn combined_requirements_are_stricter() {
+        let task = requirements("(resolution: Some((1920, 1000)), devices: [\"/dev/a\"])");
+        let block = requirements(
+            "(resolution: Some((1280, 1080)), refresh_rate: Some(60.0), \
+            devices: [\"/dev/a\", \"/dev/b\"])",
+        );
+        let both = task.and(&block);
+        assert_eq!(both.resolution, Some((1920, 1080)));
+        assert_eq!(both.refresh_rate(), Some(60.0));
+        assert_eq!(both.audio_channels, None);
+        assert_eq!(
+            both.devices,
+            vec![PathBuf::from("/dev/a"), PathBuf::from("/dev/b")]
+        );
+    }
+
+    #[test]
+    fn display_requirements() {
+        let req = requirements("(resolution: Some((1920, 1080)), refresh_rate: Some(120.0))");
+        let vsync: Config = ron::from_str("(vsync: true)").unwrap();
+
+        assert!(req
+            .check_display(&vsync, (1920, 1080), Some(119.5))
+            .is_empty());
+        assert_eq!(
+            req.check_display(&vsync, (1280, 1080), Some(120.0)).len(),
+            1
+        );
+        assert_eq!(req.check_display(&vsync, (1920, 1080), Some(60.0)).len(), 1);
+        assert_eq!(req.check_display(&vsync, (1920, 1080), None).len(), 1);
+        // Without vsync, the measured rate is not that of the display
+        assert_eq!(
+            req.check_display(&Config::default(), (1920, 1080), Some(120.0))
+                .len(),
+            1
+        );
+    }
+
+    #[test]
+    fn missing_devices_are_unmet() {
+        let dir = std::env::temp_dir();
+        let req = requirements(&format!(
+            "(devices: [{:?}, \"/dev/cog-task-missing-device\"])",
+            dir.to_str().unwrap()
+        ));
+        let unmet = req.check_system(&Config::default());
+        assert_eq!(unmet.len(), 1);
+        assert!(unmet[0].contains("cog-task-missing-device"));
+    }
+}
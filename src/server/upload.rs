@@ -0,0 +1,597 @@
+use crate::server::{record, relative_path};
+use chrono::Local;
+use eyre::{eyre, Context, Result};
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::Duration;
+
+/// Directory (inside the output directory of the task) that holds the upload queue and archives.
+pub const QUEUE_DIR: &str = ".upload";
+
+/// Header carrying the SHA-256 of the uploaded archive. Receivers have to echo back the checksum
+/// of the body they stored in the response, and an upload only counts as synced if it matches.
+pub const CHECKSUM_HEADER: &str = "X-Checksum-Sha256";
+
+const QUEUE_FILE: &str = "queue.json";
+const POLL_INTERVAL: Duration = Duration::from_secs(2);
+const MAX_BACKOFF: i64 = 600;
+const HTTP_TIMEOUT: Duration = Duration::from_secs(300);
+
+/// Destination of completed runs:
+/// - `http(url: ..., token_env: ...)`: each run is sent as `PUT <url>/<subject>/<date>/<block>/<time>.zip`.
+///   The bearer token, if any, is read from the named environment variable when uploading, so it
+///   never needs to be part of the task.
+/// - `path(...)`: each run is copied to `<path>/<subject>/<date>/<block>/<time>.zip` (e.g., on a
+///   mounted network drive), next to a `.sha256` file with its checksum.
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum UploadTarget {
+    Http {
+        url: String,
+        #[serde(default)]
+        token_env: Option<String>,
+    },
+    Path(PathBuf),
+}
+
+/// Sync status of a run, as shown in the run history.
+#[derive(Debug, Clone)]
+pub enum SyncStatus {
+    Pending {
+        attempts: u32,
+        error: Option<String>,
+    },
+    Synced(String),
+}
+
+#[derive(Debug, Clone, Deserialize, Serialize)]
+struct Entry {
+    run: PathBuf,
+    #[serde(default)]
+    archive: Option<String>,
+    #[serde(default)]
+    sha256: Option<String>,
+    #[serde(default)]
+    attempts: u32,
+    #[serde(default)]
+    retry_at: i64,
+    #[serde(default)]
+    error: Option<String>,
+    #[serde(default)]
+    synced: Option<String>,
+}
+
+impl Entry {
+    fn new(run: PathBuf) -> Self {
+        Self {
+            run,
+            archive: None,
+            sha256: None,
+            attempts: 0,
+            retry_at: 0,
+            error: None,
+            synced: None,
+        }
+    }
+
+    /// Records a failed attempt, which is retried after a backoff that doubles with every attempt.
+    fn failed(&mut self, error: &eyre::Error, now: i64) {
+        self.attempts += 1;
+        self.error = Some(format!("{error:#}"));
+        let backoff = 2_i64.saturating_pow(self.attempts.min(16)).min(MAX_BACKOFF);
+        self.retry_at = now + backoff;
+    }
+}
+
+/// Persistent queue of completed runs that are packaged and pushed to an [`UploadTarget`] by a
+/// background thread. Failed attempts are retried with exponential backoff, and the queue is
+/// kept on disk, so runs that could not be synced before the server was closed are picked up on
+/// the next launch.
+pub struct Uploader {
+    root: PathBuf,
+    queue: Arc<Mutex<Vec<Entry>>>,
+}
+
+impl Uploader {
+    /// Starts the uploader of the task output directory `output`. Uploads are recorded in the audit
+    /// trail of each subject, which is copied to `mirror`, the mirror of `output`, if any.
+    pub fn new(output: &Path, mirror: Option<PathBuf>, target: UploadTarget) -> Result<Self> {
+        let dir = output.join(QUEUE_DIR);
+        fs::create_dir_all(&dir)
+            .wrap_err_with(|| format!("Unable to create upload queue directory: {dir:?}"))?;
+
+        let path = dir.join(QUEUE_FILE);
+        let queue: Vec<Entry> = if path.exists() {
+            let content = fs::read_to_string(&path)
+                .wrap_err_with(|| format!("Failed to read upload queue ({path:?})."))?;
+            serde_json::from_str(&content)
+                .wrap_err_with(|| format!("Failed to parse upload queue ({path:?})."))?
+        } else {
+            vec![]
+        };
+
+        let uploader = Self {
+            root: output.to_owned(),
+            queue: Arc::new(Mutex::new(queue)),
+        };
+
+        let root = uploader.root.clone();
+        let queue = uploader.queue.clone();
+        thread::spawn(move || work(root, mirror, dir, target, queue));
+
+        Ok(uploader)
+    }
+
+    /// Adds a run directory to the queue, unless it is already waiting to be synced.
+    pub fn enqueue(&self, run: &Path) -> Result<()> {
+        self.push(run, false)
+    }
+
+    /// Adds a run directory whose content changed (e.g., it was marked invalid) to the queue
+    /// again, so that the target receives the updated run even if it was already synced. A
+    /// pending entry may already have packaged the previous content, so a new one is always added.
+    pub fn requeue(&self, run: &Path) -> Result<()> {
+        self.push(run, true)
+    }
+
+    fn push(&self, run: &Path, force: bool) -> Result<()> {
+        let run = run
+            .strip_prefix(&self.root)
+            .wrap_err_with(|| format!("Run directory is not inside the output directory: {run:?}"))?
+            .to_owned();
+
+        let mut queue = self.queue.lock().unwrap();
+        if force || !queue.iter().any(|e| e.run == run && e.synced.is_none()) {
+            queue.push(Entry::new(run));
+        }
+        save(&self.root.join(QUEUE_DIR), &queue)
+    }
+
+    pub fn status(&self, run: &Path) -> Option<SyncStatus> {
+        let run = run.strip_prefix(&self.root).ok()?;
+        let queue = self.queue.lock().unwrap();
+        queue
+            .iter()
+            .rev()
+            .find(|e| e.run == run)
+            .map(|e| match &e.synced {
+                Some(time) => SyncStatus::Synced(time.clone()),
+                None => SyncStatus::Pending {
+                    attempts: e.attempts,
+                    error: e.error.clone(),
+                },
+            })
+    }
+}
+
+fn work(
+    root: PathBuf,
+    mirror: Option<PathBuf>,
+    dir: PathBuf,
+    target: UploadTarget,
+    queue: Arc<Mutex<Vec<Entry>>>,
+) {
+    loop {
+        let now = Local::now().timestamp();
+        let job = {
+            let queue = queue.lock().unwrap();
+            queue
+                .iter()
+                .position(|e| e.synced.is_none() && e.retry_at <= now)
+                .map(|i| (i, queue[i].clone()))
+        };
+
+        let (i, mut entry) = match job {
+            Some(job) => job,
+            None => {
+                thread::sleep(POLL_INTERVAL);
+                continue;
+            }
+        };
+
+        match sync(&root, &dir, &target, &mut entry) {
+            Ok(()) => {
+                if let Some(archive) = entry.archive.take() {
+                    let _ = fs::remove_file(dir.join(archive));
+                }
+                entry.synced = Some(Local::now().format("%Y-%m-%d %H:%M:%S").to_string());
+                entry.error = None;
+                audit_upload(&root, mirror.as_deref(), &target, &entry);
+            }
+            Err(e) => entry.failed(&e, Local::now().timestamp()),
+        }
+
+        let mut queue = queue.lock().unwrap();
+        queue[i] = entry;
+        if let Err(e) = save(&dir, &queue) {
+            eprintln!("Failed to save upload queue: {e:#}");
+        }
+    }
+}
+
+/// Records a successful upload in the audit trail of the subject of the run.
+fn audit_upload(root: &Path, mirror: Option<&Path>, target: &UploadTarget, entry: &Entry) {
+    if let Some(subject) = entry.run.components().next() {
+        let dir = root.join(subject);
+        let mirror = mirror.map(|m| m.join(subject));
+        let details = vec![
+            ("run", relative_path(&dir, &root.join(&entry.run))),
+            ("sha256", entry.sha256.clone().unwrap_or_default()),
+            ("target", format!("{target:?}")),
+        ];
+        if let Err(e) = record(&dir, mirror.as_deref(), "upload", details, &[]) {
+            eprintln!("Failed to write to audit log: {e:#}");
+        }
+    }
+}
+
+/// Packages the run (if there is no intact archive from a previous attempt yet) and pushes it to
+/// the target. The archive is checked against its recorded checksum before every attempt.
+fn sync(root: &Path, dir: &Path, target: &UploadTarget, entry: &mut Entry) -> Result<()> {
+    let intact = match (&entry.archive, &entry.sha256) {
+        (Some(archive), Some(checksum)) => {
+            matches!(sha256_file(&dir.join(archive)), Ok(c) if &c == checksum)
+        }
+        _ => false,
+    };
+
+    if !intact {
+        let archive = format!("{}.zip", join_components(&entry.run, "_"));
+        package(&root.join(&entry.run), &dir.join(&archive))?;
+        entry.sha256 = Some(sha256_file(&dir.join(&archive))?);
+        entry.archive = Some(archive);
+    }
+
+    let archive = dir.join(entry.archive.as_ref().unwrap());
+    let checksum = entry.sha256.as_ref().unwrap();
+    let name = format!("{}.zip", join_components(&entry.run, "/"));
+
+    match target {
+        UploadTarget::Http { url, token_env } => {
+            let token = match token_env {
+                Some(var) => Some(
+                    std::env::var(var)
+                        .wrap_err_with(|| format!("Upload token variable `{var}` is not set."))?,
+                ),
+                None => None,
+            };
+            let data = fs::read(&archive)
+                .wrap_err_with(|| format!("Failed to read archive ({archive:?})."))?;
+            let url = format!("{}/{name}", url.trim_end_matches('/'));
+            put_http(&url, token.as_deref(), &data, checksum)
+        }
+        UploadTarget::Path(path) => copy_verified(&archive, &path.join(&name), checksum),
+    }
+}
+
+/// Copies the archive to its destination through a temporary file, which is only renamed into
+/// place after its checksum has been verified.
+fn copy_verified(archive: &Path, dest: &Path, checksum: &str) -> Result<()> {
+    if let Some(parent) = dest.parent() {
+        fs::create_dir_all(parent)
+            .wrap_err_with(|| format!("Unable to create upload directory: {parent:?}"))?;
+    }
+
+    let part = dest.with_extension("zip.part");
+    fs::copy(archive, &part).wrap_err_with(|| format!("Failed to copy archive to {part:?}."))?;
+    fs::OpenOptions::new()
+        .write(true)
+        .open(&part)
+        .and_then(|f| f.sync_all())
+        .wrap_err_with(|| format!("Failed to flush archive to {part:?}."))?;
+
+    let copied = sha256_file(&part)?;
+    if copied != checksum {
+        let _ = fs::remove_file(&part);
+        return Err(eyre!(
+            "Checksum of copied archive does not match the original ({copied} != {checksum})."
+        ));
+    }
+
+    fs::rename(&part, dest).wrap_err_with(|| format!("Failed to move archive to {dest:?}."))?;
+    let file_name = dest.file_name().unwrap().to_string_lossy();
+    fs::write(
+        dest.with_extension("zip.sha256"),
+        format!("{checksum}  {file_name}\n"),
+    )
+    .wrap_err_with(|| format!("Failed to write checksum file next to {dest:?}."))
+}
+
+#[cfg(feature = "upload")]
+fn package(run: &Path, archive: &Path) -> Result<()> {
+    use std::io::Write;
+    use zip::write::FileOptions;
+    use zip::{CompressionMethod, ZipWriter};
+
+    let part = archive.with_extension("part");
+    let file = fs::File::create(&part)
+        .wrap_err_with(|| format!("Failed to create archive ({part:?})."))?;
+    let mut zip = ZipWriter::new(file);
+    let options = FileOptions::default().compression_method(CompressionMethod::Deflated);
+
+    let mut dirs = vec![run.to_owned()];
+    while let Some(dir) = dirs.pop() {
+        let items = fs::read_dir(&dir)
+            .wrap_err_with(|| format!("Failed to read run directory ({dir:?})."))?;
+        for item in items {
+            let path = item.wrap_err("Failed to read run directory.")?.path();
+            if path.is_dir() {
+                dirs.push(path);
+                continue;
+            }
+
+            let name = join_components(path.strip_prefix(run).unwrap(), "/");
+            let data = fs::read(&path).wrap_err_with(|| format!("Failed to read {path:?}."))?;
+            zip.start_file(name, options)
+                .wrap_err_with(|| format!("Failed to add {path:?} to archive."))?;
+            zip.write_all(&data)
+                .wrap_err_with(|| format!("Failed to add {path:?} to archive."))?;
+        }
+    }
+
+    zip.finish()
+        .wrap_err_with(|| format!("Failed to finalize archive ({part:?})."))?;
+    fs::rename(&part, archive).wrap_err_with(|| format!("Failed to move archive to {archive:?}."))
+}
+
+#[cfg(not(feature = "upload"))]
+fn package(_run: &Path, _archive: &Path) -> Result<()> {
+    Err(eyre!("Uploading runs requires the `upload` feature."))
+}
+
+#[cfg(feature = "upload")]
+fn put_http(url: &str, token: Option<&str>, data: &[u8], checksum: &str) -> Result<()> {
+    let mut request = ureq::put(url)
+        .timeout(HTTP_TIMEOUT)
+        .set("Content-Type", "application/zip")
+        .set(CHECKSUM_HEADER, checksum);
+    if let Some(token) = token {
+        request = request.set("Authorization", &format!("Bearer {token}"));
+    }
+
+    let response = request
+        .send_bytes(data)
+        .map_err(|e| eyre!("Upload to {url} failed ({e})."))?;
+
+    match response.header(CHECKSUM_HEADER) {
+        Some(echo) if echo.trim().eq_ignore_ascii_case(checksum) => Ok(()),
+        Some(echo) => Err(eyre!(
+            "Checksum reported by the receiver does not match the archive ({echo} != {checksum})."
+        )),
+        None => Err(eyre!(
+            "Receiver of {url} did not confirm the checksum of the archive ({CHECKSUM_HEADER})."
+        )),
+    }
+}
+
+#[cfg(not(feature = "upload"))]
+fn put_http(_url: &str, _token: Option<&str>, _data: &[u8], _checksum: &str) -> Result<()> {
+    Err(eyre!("Uploading runs requires the `upload` feature."))
+}
+
+fn join_components(path: &Path, sep: &str) -> String {
+    path.components()
+        .map(|c| c.as_os_str().to_string_lossy().into_owned())
+        .collect::<Vec<_>>()
+        .join(sep)
+}
+
+pub fn sha256_file(path: &Path) -> Result<String> {
+    use sha2::{Digest, Sha256};
+    let data = fs::read(path).wrap_err_with(|| format!("Failed to read {path:?}."))?;
+    let mut hasher = Sha256::default();
+    hasher.update(&data);
+    Ok(hex::encode(hasher.finalize()))
+}
+
+fn save(dir: &Path, queue: &[Entry]) -> Result<()> {
+    let path = dir.join(QUEUE_FILE);
+    let part = path.with_extension("part");
+    let content = serde_json::to_string_pretty(queue).wrap_err("Failed to serialize queue.")?;
+    fs::write(&part, content).wrap_err_with(|| format!("Failed to write {part:?}."))?;
+    fs::rename(&part, &path).wrap_err_with(|| format!("Failed to move queue to {path:?}."))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn archives_are_only_copied_if_intact() {
+        let dir = std::env::temp_dir().join(format!("cog_upload_{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        let archive = dir.join("run.zip");
+        fs::write(&archive, "archive").unwrap();
+        let checksum = sha256_file(&archive).unwrap();
+
+        let dest = dir.join("target").join("subject").join("run.zip");
+        copy_verified(&archive, &dest, &checksum).unwrap();
+        assert_eq!(fs::read_to_string(&dest).unwrap(), "archive");
+        assert!(fs::read_to_string(dest.with_extension("zip.sha256"))
+            .unwrap()
+            .starts_with(&checksum));
+
+        let dest = dir.join("target").join("subject").join("other.zip");
+        assert!(copy_verified(&archive, &dest, "0000").is_err());
+        assert!(!dest.exists());
+        assert!(!dest.with_extension("zip.part").exists());
+        fs::remove_dir_all(&dir).unwrap();
+    }
+
+    #[test]
+    fn archive_names_follow_the_run_path() {
+        let run = Path::new("subject")
+            .join("2026-10-17")
+            .join("block")
+            .join("12-00-00");
+        assert_eq!(
+            join_components(&run, "/"),
+            "subject/2026-10-17/block/12-00-00"
+        );
+        assert_eq!(
+            join_components(&run, "_"),
+            "subject_2026-10-17_block_12-00-00"
+        );
+    }
+
+    #[test]
+    fn changed_runs_are_queued_again() {
+        let root = std::env::temp_dir().join(format!("cog_upload_queue_{}", std::process::id()));
+        fs::create_dir_all(root.join(QUEUE_DIR)).unwrap();
+        let uploader = Uploader {
+            root: root.clone(),
+            queue: Arc::new(Mutex::new(vec![])),
+        };
+        let run = root.join("subject").join("run");
+
+        uploader.enqueue(&run).unwrap();
+        uploader.enqueue(&run).unwrap();
+        assert_eq!(uploader.queue.lock().unwrap().len(), 1);
+
+        // A pending entry may have packaged the run before it changed
+        uploader.queue.lock().unwrap()[0].archive = Some("run.zip".to_owned());
+        uploader.requeue(&run).unwrap();
+        assert_eq!(uploader.queue.lock().unwrap().len(), 2);
+
+        uploader.queue.lock().unwrap()[1].synced = Some("now".to_owned());
+        assert!(matches!(uploader.status(&run), Some(SyncStatus::Synced(_))));
+        uploader.requeue(&run).unwrap();
+        assert!(matches!(
+            uploader.status(&run),
+            Some(SyncStatus::Pending { attempts: 0, .. })
+        ));
+        fs::remove_dir_all(&root).unwrap();
+    }
+
+    #[test]
+    fn failed_attempts_back_off() {
+        let mut entry = Entry::new(PathBuf::from("run"));
+        let error = eyre!("unreachable");
+        entry.failed(&error, 100);
+        assert_eq!((entry.attempts, entry.retry_at), (1, 102));
+        entry.failed(&error, 100);
+        assert_eq!((entry.attempts, entry.retry_at), (2, 104));
+        for _ in 0..20 {
+            entry.failed(&error, 100);
+        }
+        assert_eq!(entry.retry_at, 100 + MAX_BACKOFF);
+        assert_eq!(entry.error.as_deref(), Some("unreachable"));
+    }
+
+    /// Stand-in for an HTTP receiver, which answers one request per response with the given
+    /// status and checksum echo (`Some(true)` for the checksum of the body it received, `Some(false)`
+    /// for a wrong one), and sends back the request line and headers of each request.
+    #[cfg(feature = "upload")]
+    fn receiver(
+        responses: Vec<(&'static str, Option<bool>)>,
+    ) -> (String, std::sync::mpsc::Receiver<Vec<String>>) {
+        use sha2::{Digest, Sha256};
+        use std::io::{BufRead, BufReader, Read, Write};
+
+        let listener = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let url = format!("http://{}/runs", listener.local_addr().unwrap());
+        let (tx, rx) = std::sync::mpsc::channel();
+        thread::spawn(move || {
+            for (status, echo) in responses {
+                let (stream, _) = listener.accept().unwrap();
+                let mut reader = BufReader::new(stream);
+                let mut lines = vec![];
+                let mut length = 0;
+                loop {
+                    let mut line = String::new();
+                    reader.read_line(&mut line).unwrap();
+                    let line = line.trim_end().to_owned();
+                    if line.is_empty() {
+                        break;
+                    }
+                    if let Some(value) = line.to_lowercase().strip_prefix("content-length:") {
+                        length = value.trim().parse().unwrap();
+                    }
+                    lines.push(line);
+                }
+                let mut body = vec![0; length];
+                reader.read_exact(&mut body).unwrap();
+
+                let mut response =
+                    format!("HTTP/1.1 {status}\r\nContent-Length: 0\r\nConnection: close\r\n");
+                let checksum = match echo {
+                    Some(true) => Some(hex::encode(Sha256::digest(&body))),
+                    Some(false) => Some("0000".to_owned()),
+                    None => None,
+                };
+                if let Some(checksum) = checksum {
+                    response.push_str(&format!("{CHECKSUM_HEADER}: {checksum}\r\n"));
+                }
+                response.push_str("\r\n");
+                reader.get_mut().write_all(response.as_bytes()).unwrap();
+                tx.send(lines).unwrap();
+            }
+        });
+        (url, rx)
+    }
+
+    #[cfg(feature = "upload")]
+    #[test]
+    fn http_uploads_require_a_confirmed_checksum() {
+        let root = std::env::temp_dir().join(format!("cog_upload_http_{}", std::process::id()));
+        let run = Path::new("subject")
+            .join("2026-10-17")
+            .join("block")
+            .join("12-00-00");
+        let dir = root.join(QUEUE_DIR);
+        fs::create_dir_all(root.join(&run)).unwrap();
+        fs::create_dir_all(&dir).unwrap();
+        fs::write(root.join(&run).join("main.log"), "[]").unwrap();
+
+        let (url, requests) = receiver(vec![
+            ("503 Service Unavailable", None),
+            ("201 Created", None),
+            ("201 Created", Some(false)),
+            ("201 Created", Some(true)),
+        ]);
+        let var = format!("COG_UPLOAD_TEST_TOKEN_{}", std::process::id());
+        let mut entry = Entry::new(run.clone());
+
+        // Without the token, nothing is sent
+        let target = UploadTarget::Http {
+            url: url.clone(),
+            token_env: Some(var.clone()),
+        };
+        assert!(sync(&root, &dir, &target, &mut entry).is_err());
+
+        std::env::set_var(&var, "secret");
+        let mut archive = None;
+        for attempt in 1..=4 {
+            let result = sync(&root, &dir, &target, &mut entry);
+            let lines = requests.recv().unwrap();
+            assert_eq!(
+                lines[0],
+                "PUT /runs/subject/2026-10-17/block/12-00-00.zip HTTP/1.1"
+            );
+            assert!(lines
+                .iter()
+                .any(|l| l.eq_ignore_ascii_case("authorization: bearer secret")));
+            let checksum = entry.sha256.clone().unwrap();
+            assert!(lines
+                .iter()
+                .any(|l| l.eq_ignore_ascii_case(&format!("{CHECKSUM_HEADER}: {checksum}"))));
+
+            // Retries send the archive that was packaged for the first attempt
+            assert_eq!(archive.get_or_insert(checksum.clone()), &checksum);
+            match result {
+                Ok(()) => assert_eq!(attempt, 4),
+                Err(e) => {
+                    assert!(attempt < 4, "{e:#}");
+                    entry.failed(&e, 0);
+                }
+            }
+        }
+        assert_eq!(entry.attempts, 3);
+
+        std::env::remove_var(&var);
+        fs::remove_dir_all(&root).unwrap();
+    }
+}
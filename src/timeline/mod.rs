@@ -0,0 +1,396 @@
+use crate::gui::{CUSTOM_BLUE, CUSTOM_ORANGE, CUSTOM_RED, FOREST_GREEN};
+use crate::resource::read_log;
+use chrono::{DateTime, FixedOffset};
+use eframe::egui::plot::{Line, MarkerShape, Plot, PlotPoint, PlotPoints, Points};
+use eframe::egui::{self, Color32, RichText, Vec2};
+use eframe::App;
+use eyre::{eyre, Context, Result};
+use serde_cbor::Value;
+use std::collections::{BTreeMap, HashMap};
+use std::ops::RangeInclusive;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
+const MAX_DETAIL_LENGTH: usize = 200;
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum RowKind {
+    Action,
+    Signal,
+    Event,
+}
+
+/// One line of the timeline: the active intervals of an action (by tree path), the changes of a
+/// signal, or the entries of a log group with the same name.
+#[derive(Debug, Clone)]
+struct Row {
+    label: String,
+    kind: RowKind,
+    spans: Vec<(f64, f64)>,
+    events: Vec<(f64, String)>,
+}
+
+/// Gantt-style viewer of a single block run, built from the log files of its output directory
+/// (including log groups written in columnar format).
+pub struct Timeline {
+    run_dir: PathBuf,
+    start: DateTime<FixedOffset>,
+    duration: f64,
+    rows: Arc<Vec<Row>>,
+    skipped: Vec<String>,
+}
+
+impl Row {
+    fn new(label: String, kind: RowKind) -> Self {
+        Self {
+            label,
+            kind,
+            spans: vec![],
+            events: vec![],
+        }
+    }
+
+    fn color(&self) -> Color32 {
+        match self.kind {
+            RowKind::Action => CUSTOM_BLUE.into(),
+            RowKind::Signal => CUSTOM_ORANGE.into(),
+            RowKind::Event if self.label.starts_with("main/") => CUSTOM_RED.into(),
+            RowKind::Event => FOREST_GREEN.into(),
+        }
+    }
+
+    fn describe(&self, t: f64) -> String {
+        if let Some((t0, t1)) = self.spans.iter().find(|(t0, t1)| (*t0..=*t1).contains(&t)) {
+            return format!("{}\n{t0:.3} s - {t1:.3} s ({:.3} s)", self.label, t1 - t0);
+        }
+
+        let nearest = self
+            .events
+            .iter()
+            .min_by(|(a, _), (b, _)| (a - t).abs().total_cmp(&(b - t).abs()));
+        match nearest {
+            Some((t, detail)) => format!("{}\n{t:.3} s\n{detail}", self.label),
+            None => self.label.clone(),
+        }
+    }
+}
+
+impl Timeline {
+    pub fn new(run_dir: &Path) -> Result<Self> {
+        let mut groups = vec![];
+        let mut skipped = vec![];
+        let content = run_dir
+            .read_dir()
+            .wrap_err_with(|| format!("Failed to read run directory ({run_dir:?})."))?;
+        for entry in content {
+            let path = entry?.path();
+            let entries = match path.extension().and_then(|e| e.to_str()) {
+                Some("log") => read_log(&path),
+                #[cfg(feature = "arrow")]
+                Some("arrow") => crate::resource::read_columnar_log(&path),
+                #[cfg(not(feature = "arrow"))]
+                Some("arrow") => Err(eyre!("requires the `arrow` feature")),
+                _ => continue,
+            };
+
+            let group = path.file_stem().unwrap().to_string_lossy().to_string();
+            match entries {
+                Ok(entries) => groups.push((group, entries)),
+                Err(e) => skipped.push(format!("{group} ({e})")),
+            }
+        }
+        groups.sort_by(|a, b| a.0.cmp(&b.0));
+
+        let times = || {
+            groups
+                .iter()
+                .flat_map(|(_, e)| e.iter().map(|(t, _, _)| *t))
+        };
+        let start = times()
+            .min()
+            .ok_or_else(|| eyre!("No log entries found in run directory ({run_dir:?})."))?;
+        let secs = |t: DateTime<FixedOffset>| {
+            (t - start).num_microseconds().unwrap_or_default() as f64 * 1e-6
+        };
+        let duration = secs(times().max().unwrap());
+
+        let mut actions: Vec<Row> = vec![];
+        let mut action_index = HashMap::new();
+        let mut signals = BTreeMap::new();
+        let mut events: Vec<Row> = vec![];
+        let mut event_index = HashMap::new();
+
+        for (group, entries) in groups {
+            if group == "trace" {
+                let mut open: HashMap<String, Vec<f64>> = HashMap::new();
+                for (t, name, value) in entries {
+                    let t = secs(t);
+                    match (name.as_str(), value) {
+                        ("start", Value::Text(path)) => {
+                            action_index.entry(path.clone()).or_insert_with(|| {
+                                actions.push(Row::new(path.clone(), RowKind::Action));
+                                actions.len() - 1
+                            });
+                            open.entry(path).or_default().push(t);
+                        }
+                        ("stop", Value::Text(path)) => {
+                            if let Some(t0) = open.get_mut(&path).and_then(|v| v.pop()) {
+                                actions[action_index[&path]].spans.push((t0, t));
+                            }
+                        }
+                        ("signal", Value::Array(v)) if v.len() == 2 => {
+                            if let Value::Integer(id) = v[0] {
+                                signals
+                                    .entry(id)
+                                    .or_insert_with(|| {
+                                        Row::new(format!("signal {id}"), RowKind::Signal)
+                                    })
+                                    .events
+                                    .push((t, describe(&v[1])));
+                            }
+                        }
+                        _ => {}
+                    }
+                }
+
+                // Actions that never stopped (e.g., the run was interrupted or crashed)
+                for (path, starts) in open {
+                    for t0 in starts {
+                        actions[action_index[&path]].spans.push((t0, duration));
+                    }
+                }
+            } else {
+                for (t, name, value) in entries {
+                    let label = format!("{group}/{name}");
+                    let i = *event_index.entry(label.clone()).or_insert_with(|| {
+                        events.push(Row::new(label, RowKind::Event));
+                        events.len() - 1
+                    });
+                    events[i].events.push((secs(t), describe(&value)));
+                }
+            }
+        }
+
+        let mut rows = actions;
+        rows.extend(signals.into_values());
+        rows.extend(events);
+
+        Ok(Self {
+            run_dir: run_dir.to_owned(),
+            start,
+            duration,
+            rows: Arc::new(rows),
+            skipped,
+        })
+    }
+
+    pub fn run(self) {
+        let options = eframe::NativeOptions {
+            initial_window_size: Some(Vec2::new(1600.0, 900.0)),
+            default_theme: eframe::Theme::Light,
+            ..Default::default()
+        };
+
+        eframe::run_native(
+            &format!("CogTask Timeline -- {}", self.run_dir.display()),
+            options,
+            Box::new(|_cc| Box::new(self)),
+        );
+    }
+
+    fn show_plot(&self, ui: &mut egui::Ui) {
+        let rows = self.rows.clone();
+        let label_formatter = move |_name: &str, point: &PlotPoint| {
+            let i = (-point.y).round();
+            if i < 0.0 || i as usize >= rows.len() {
+                String::new()
+            } else {
+                rows[i as usize].describe(point.x)
+            }
+        };
+
+        let rows = self.rows.clone();
+        let y_axis_formatter = move |y: f64, _range: &RangeInclusive<f64>| {
+            let i = -y;
+            if i.fract() != 0.0 || i < 0.0 || i as usize >= rows.len() {
+                String::new()
+            } else {
+                rows[i as usize].label.clone()
+            }
+        };
+
+        Plot::new("timeline")
+            .label_formatter(label_formatter)
+            .y_axis_formatter(y_axis_formatter)
+            .include_x(0.0)
+            .include_x(self.duration)
+            .include_y(0.5)
+            .include_y(0.5 - self.rows.len() as f64)
+            .show(ui, |plot_ui| {
+                for (i, row) in self.rows.iter().enumerate() {
+                    let y = -(i as f64);
+                    for &(t0, t1) in row.spans.iter() {
+                        plot_ui.line(
+                            Line::new(PlotPoints::new(vec![[t0, y], [t1, y]]))
+                                .color(row.color())
+                                .width(8.0),
+                        );
+                    }
+
+                    if !row.events.is_empty() {
+                        let points = row.events.iter().map(|(t, _)| [*t, y]).collect();
+                        plot_ui.points(
+                            Points::new(PlotPoints::new(points))
+                                .shape(MarkerShape::Diamond)
+                                .color(row.color())
+                                .radius(5.0),
+                        );
+                    }
+                }
+            });
+    }
+}
+
+impl App for Timeline {
+    fn update(&mut self, ctx: &egui::Context, _frame: &mut eframe::Frame) {
+        egui::TopBottomPanel::top("timeline_header").show(ctx, |ui| {
+            ui.heading(self.run_dir.display().to_string());
+            ui.label(format!(
+                "Started at {} and lasted {:.3} s. Drag to pan, Ctrl+scroll to zoom, \
+                double-click to reset, and hover for details.",
+                self.start, self.duration
+            ));
+            if !self.skipped.is_empty() {
+                ui.label(
+                    RichText::new(format!("Skipped: {}", self.skipped.join(", ")))
+                        .color(Color32::from(CUSTOM_RED)),
+                );
+            }
+        });
+
+        egui::CentralPanel::default().show(ctx, |ui| self.show_plot(ui));
+    }
+}
+
+fn describe(value: &Value) -> String {
+    let mut detail = match value {
+        Value::Null => "null".to_owned(),
+        Value::Bool(v) => v.to_string(),
+        Value::Integer(v) => v.to_string(),
+        Value::Float(v) => v.to_string(),
+        Value::Text(v) => v.clone(),
+        v => format!("{v:?}"),
+    };
+
+    if detail.chars().count() > MAX_DETAIL_LENGTH {
+        detail = detail.chars().take(MAX_DETAIL_LENGTH).collect();
+        detail.push_str("...");
+    }
+    detail
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+
+    fn run_dir(name: &str, logs: &[(&str, &str)]) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("cog_timeline_{name}_{}", std::process::id()));
+        fs::remove_dir_all(&dir).ok();
+        fs::create_dir_all(&dir).unwrap();
+        for (file, content) in logs {
+            fs::write(dir.join(file), content).unwrap();
+        }
+        dir
+    }
+
+    fn time(secs: u32) -> String {
+        format!("2024-01-01 10:00:0{secs}.000000 +00:00")
+    }
+
+    fn row<'a>(timeline: &'a Timeline, label: &str) -> &'a Row {
+        timeline.rows.iter().find(|r| r.label == label).unwrap()
+    }
+
+    #[test]
+    fn trace_becomes_spans_and_signals() {
+        let trace = format!(
+            "[[\"{}\", \"start\", \"0\"], [\"{}\", \"signal\", [10, 5]], \\
+            [\"{}\", \"start\", \"0/1\"], [\"{}\", \"stop\", \"0\"]]",
+            time(0),
+            time(1),
+            time(1),
+            time(2),
+        );
+        let main = format!("[[\"{}\", \"finish\", \"ok\"]]", time(4));
+        let dir = run_dir("trace", &[("trace.log", &trace), ("main.log", &main)]);
+
+        let timeline = Timeline::new(&dir).unwrap();
+        assert_eq!(timeline.duration, 4.0);
+        assert!(timeline.skipped.is_empty());
+
+        let labels: Vec<_> = timeline.rows.iter().map(|r| r.label.as_str()).collect();
+        assert_eq!(labels, ["0", "0/1", "signal 10", "main/finish"]);
+        assert_eq!(row(&timeline, "0").spans, [(0.0, 2.0)]);
+        // Actions that never stopped last until the end of the run.
+        assert_eq!(row(&timeline, "0/1").spans, [(1.0, 4.0)]);
+        assert_eq!(row(&timeline, "signal 10").events, [(1.0, "5".to_owned())]);
+        assert_eq!(
+            row(&timeline, "main/finish").events,
+            [(4.0, "ok".to_owned())]
+        );
+
+        fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn unreadable_groups_are_skipped() {
+        let main = format!("[[\"{}\", \"start\", \"ok\"]]", time(0));
+        let dir = run_dir("skipped", &[("main.log", &main), ("broken.log", "[[")]);
+
+        let timeline = Timeline::new(&dir).unwrap();
+        assert_eq!(timeline.skipped.len(), 1);
+        assert!(timeline.skipped[0].starts_with("broken"));
+        assert_eq!(timeline.rows.len(), 1);
+
+        fs::remove_dir_all(dir).ok();
+    }
+
+    #[test]
+    fn empty_runs_are_rejected() {
+        let dir = run_dir("empty", &[]);
+        assert!(Timeline::new(&dir).is_err());
+        fs::remove_dir_all(dir).ok();
+    }
+
+    #[cfg(feature = "arrow")]
+    #[test]
+    fn columnar_groups_are_read() {
+        let main = format!("[[\"{}\", \"start\", \"ok\"]]", time(0));
+        let dir = run_dir("columnar", &[("main.log", &main)]);
+        let mut writer = crate::resource::ColumnarWriter::new(dir.join("reaction.arrow"));
+        let t = DateTime::parse_from_str(&time(1), "%Y-%m-%d %H:%M:%S%.f %:z")
+            .unwrap()
+            .with_timezone(&chrono::Local);
+        writer
+            .write(&[
+                (t, "key".to_owned(), Value::Text("space".to_owned())),
+                (t, "rt".to_owned(), Value::Float(0.5)),
+            ])
+            .unwrap();
+        writer.finish().unwrap();
+
+        let timeline = Timeline::new(&dir).unwrap();
+        assert!(timeline.skipped.is_empty());
+        assert_eq!(
+            row(&timeline, "reaction/key").events,
+            [(1.0, "space".to_owned())]
+        );
+        assert_eq!(
+            row(&timeline, "reaction/rt").events,
+            [(1.0, "0.5".to_owned())]
+        );
+
+        fs::remove_dir_all(dir).ok();
+    }
+}
@@ -0,0 +1,248 @@
+use crate::action::{Action, ActionEnumAsRef};
+use eyre::{Context, Result};
+use serde::de::DeserializeOwned;
+use serde::Serialize;
+use serde_cbor::value::{from_value, to_value};
+use serde_cbor::Value;
+
+/// Version tag of the canonical hashing scheme. It only needs to change if the normalization below
+/// changes, not when actions gain new (defaulted) attributes.
+pub const CANONICAL_VERSION: &str = "v2";
+
+#[derive(Debug, Clone)]
+enum Step {
+    Key(Value),
+    Index(usize),
+}
+
+/// Normalized form of a value, with every attribute that is equal to its default value removed.
+///
+/// An attribute is considered to have its default value if removing it (or, for trailing elements
+/// of a tuple, truncating it) and deserializing again as `T` reproduces the same value. Maps are
+/// sorted by key, so the result does not depend on the declaration order of fields either.
+pub fn canonical<T>(value: &T) -> Result<Value>
+where
+    T: Serialize + DeserializeOwned,
+{
+    let full = to_value(value).wrap_err("Failed to serialize value for canonical hashing.")?;
+    Ok(strip::<T>(full, &[]))
+}
+
+/// Same as [`canonical`], but each action in the tree is normalized on its own (children are
+/// replaced by their canonical form), which keeps large trees cheap to normalize.
+pub fn canonical_action(action: &dyn Action) -> Result<Value> {
+    let full = to_value(ActionEnumAsRef::from(action))
+        .wrap_err("Failed to serialize action for canonical hashing.")?;
+
+    let mut children = vec![];
+    for child in action.children() {
+        children.push((
+            to_value(ActionEnumAsRef::from(child))
+                .wrap_err("Failed to serialize action for canonical hashing.")?,
+            canonical_action(child)?,
+        ));
+    }
+
+    Ok(strip::<Box<dyn Action>>(full, &children))
+}
+
+/// SHA-256 of the CBOR encoding of a canonical value, prefixed with the scheme version.
+pub fn canonical_hash(value: &Value) -> String {
+    use sha2::{Digest, Sha256};
+    let mut hasher = Sha256::default();
+    hasher.update(&serde_cbor::to_vec(value).unwrap());
+    format!("{CANONICAL_VERSION}:{}", hex::encode(hasher.finalize()))
+}
+
+/// Removes default-valued attributes from `full`, and replaces every occurrence of an opaque
+/// value (e.g., a child action) with its precomputed replacement without looking inside it.
+fn strip<T>(full: Value, opaque: &[(Value, Value)]) -> Value
+where
+    T: Serialize + DeserializeOwned,
+{
+    let roundtrips = |reduced: Value| -> bool {
+        from_value::<T>(reduced)
+            .ok()
+            .and_then(|v| to_value(&v).ok())
+            .map_or(false, |v| v == full)
+    };
+
+    let mut candidates = vec![];
+    collect(&full, opaque, &mut vec![], &mut candidates);
+
+    let mut keys = vec![];
+    let mut tails = vec![];
+    for (path, len) in candidates {
+        match len {
+            None => {
+                if roundtrips(remove(full.clone(), &path, None)) {
+                    keys.push(path);
+                }
+            }
+            Some(len) => {
+                let mut keep = len;
+                while keep > 0 && roundtrips(remove(full.clone(), &path, Some(keep - 1))) {
+                    keep -= 1;
+                }
+                if keep < len {
+                    tails.push((path, keep));
+                }
+            }
+        }
+    }
+
+    let mut value = full.clone();
+    for path in keys {
+        value = remove(value, &path, None);
+    }
+    for (path, keep) in tails {
+        value = remove(value, &path, Some(keep));
+    }
+    replace(value, opaque)
+}
+
+/// Lists the paths of all map entries (`None`) and arrays (`Some(len)`) that could be removed or
+/// truncated, without descending into opaque values.
+fn collect(
+    value: &Value,
+    opaque: &[(Value, Value)],
+    path: &mut Vec<Step>,
+    candidates: &mut Vec<(Vec<Step>, Option<usize>)>,
+) {
+    if opaque.iter().any(|(v, _)| v == value) {
+        return;
+    }
+
+    match value {
+        Value::Map(map) => {
+            for (k, v) in map {
+                path.push(Step::Key(k.clone()));
+                candidates.push((path.clone(), None));
+                collect(v, opaque, path, candidates);
+                path.pop();
+            }
+        }
+        Value::Array(items) => {
+            candidates.push((path.clone(), Some(items.len())));
+            for (i, v) in items.iter().enumerate() {
+                path.push(Step::Index(i));
+                collect(v, opaque, path, candidates);
+                path.pop();
+            }
+        }
+        _ => {}
+    }
+}
+
+/// Removes the map entry at `path`, or truncates the array at `path` to `keep` elements. Paths
+/// that no longer exist (e.g., inside an entry that was already removed) are ignored.
+fn remove(mut value: Value, path: &[Step], keep: Option<usize>) -> Value {
+    let target = match keep {
+        Some(_) => path,
+        None => &path[..path.len() - 1],
+    };
+
+    let mut node = Some(&mut value);
+    for step in target {
+        node = match (step, node) {
+            (Step::Key(k), Some(Value::Map(map))) => map.get_mut(k),
+            (Step::Index(i), Some(Value::Array(items))) => items.get_mut(*i),
+            _ => None,
+        };
+    }
+
+    match (keep, path.last(), node) {
+        (Some(keep), _, Some(Value::Array(items))) => items.truncate(keep),
+        (None, Some(Step::Key(k)), Some(Value::Map(map))) => {
+            map.remove(k);
+        }
+        _ => {}
+    }
+    value
+}
+
+fn replace(value: Value, opaque: &[(Value, Value)]) -> Value {
+    if let Some((_, v)) = opaque.iter().find(|(v, _)| v == &value) {
+        return v.clone();
+    }
+
+    match value {
+        Value::Map(map) => Value::Map(
+            map.into_iter()
+                .map(|(k, v)| (k, replace(v, opaque)))
+                .collect(),
+        ),
+        Value::Array(items) => {
+            Value::Array(items.into_iter().map(|v| replace(v, opaque)).collect())
+        }
+        v => v,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde::Deserialize;
+
+    #[derive(Debug, Serialize, Deserialize)]
+    struct Old {
+        name: String,
+        #[serde(default)]
+        count: u32,
+        #[serde(default)]
+        tags: Vec<String>,
+    }
+
+    /// Same as `Old` in a later version, with a new defaulted attribute and reordered fields.
+    #[derive(Debug, Serialize, Deserialize)]
+    struct New {
+        #[serde(default)]
+        tags: Vec<String>,
+        #[serde(default)]
+        enabled: bool,
+        name: String,
+        #[serde(default)]
+        count: u32,
+    }
+
+    fn hash<T: Serialize + DeserializeOwned>(value: &T) -> String {
+        canonical_hash(&canonical(value).unwrap())
+    }
+
+    #[test]
+    fn default_attributes_are_removed() {
+        let value = canonical(&Old {
+            name: "a".to_owned(),
+            count: 0,
+            tags: vec![],
+        })
+        .unwrap();
+        assert_eq!(
+            value,
+            Value::Map([(Value::Text("name".to_owned()), Value::Text("a".to_owned()))].into())
+        );
+    }
+
+    #[test]
+    fn hash_survives_new_defaulted_attributes() {
+        let old = Old {
+            name: "a".to_owned(),
+            count: 3,
+            tags: vec!["x".to_owned()],
+        };
+        let new = New {
+            tags: vec!["x".to_owned()],
+            enabled: false,
+            name: "a".to_owned(),
+            count: 3,
+        };
+        assert_eq!(hash(&old), hash(&new));
+        assert!(hash(&old).starts_with(&format!("{CANONICAL_VERSION}:")));
+
+        let changed = New {
+            enabled: true,
+            ..new
+        };
+        assert_ne!(hash(&old), hash(&changed));
+    }
+}
@@ -1,6 +1,8 @@
+use chrono::{DateTime, Local};
 use eyre::{eyre, Result};
 use serde::Serialize;
 use spin_sleep::{SpinSleeper, SpinStrategy};
+use std::time::Instant;
 
 const APPROX_EQ_EPS: f64 = 1e-6;
 const SPIN_DURATION: u32 = 100_000_000; // equivalent to 100ms
@@ -34,6 +36,17 @@ pub fn spin_sleeper() -> SpinSleeper {
     SpinSleeper::new(SPIN_DURATION).with_spin_strategy(SPIN_STRATEGY)
 }
 
+/// Converts a monotonic instant into wall-clock time, using the current time as reference.
+pub fn instant_to_local(time: Instant) -> DateTime<Local> {
+    let (now, wall) = (Instant::now(), Local::now());
+    let shift = |d| chrono::Duration::from_std(d).unwrap_or_else(|_| chrono::Duration::zero());
+    if time <= now {
+        wall - shift(now - time)
+    } else {
+        wall + shift(time - now)
+    }
+}
+
 #[inline(always)]
 pub fn f32_with_precision(x: f32, precision: u8) -> f32 {
     let precision = 10_f32.powi(precision as i32);
@@ -59,6 +72,13 @@ pub fn str_with_precision(x: f32, precision: u8) -> String {
     }
 }
 
+/// Whether `value` is the default of its type. Used to skip serializing attributes that were added
+/// after tasks were first hashed, so that the legacy hash of tasks that do not set them is kept.
+#[inline(always)]
+pub fn is_default<T: Default + PartialEq>(value: &T) -> bool {
+    value == &T::default()
+}
+
 pub trait Hash: Serialize {
     fn hash(&self) -> String {
         use sha2::{Digest, Sha256};
@@ -1,5 +1,7 @@
+pub mod canonical;
 pub mod helper;
 pub mod system;
 
+pub use canonical::*;
 pub use helper::*;
 pub use system::*;